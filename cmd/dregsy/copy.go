@@ -0,0 +1,108 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/xelalexv/dregsy/internal/pkg/sync"
+)
+
+// copyImage implements the 'copy' command, which syncs a single image without
+// a config file
+func copyImage(args []string) {
+
+	fs := flag.NewFlagSet("dregsy copy", flag.ContinueOnError)
+	relay := fs.String("relay", "",
+		"relay to use, 'docker', 'podman', 'containerd', 'skopeo', or "+
+			"'direct'; defaults to 'docker'")
+	tags := fs.String("tags", "", "comma-separated list of tags to sync, "+
+		"in the same format as 'tags' of a mapping; defaults to all tags")
+	srcAuth := fs.String("src-auth", "", "auth for the source registry, as "+
+		"for 'auth' in config; defaults to 'docker-config'")
+	dstAuth := fs.String("dst-auth", "", "auth for the target registry, as "+
+		"for 'auth' in config; defaults to 'docker-config'")
+	srcSkipTLSVerify := fs.Bool("src-skip-tls-verify", false,
+		"do not verify TLS certificate of source registry")
+	dstSkipTLSVerify := fs.Bool("dst-skip-tls-verify", false,
+		"do not verify TLS certificate of target registry")
+	platforms := fs.String("platforms", "",
+		"comma-separated list of platforms to sync, 'direct' relay only")
+	skipPing := fs.Bool("skip-ping", false,
+		"do not check whether relay is ready")
+	dryRun := fs.Bool("dry-run", false, "only show what would be synced")
+	verbose := fs.Bool("verbose", false, "show output of relay")
+	logLevel := fs.String("log-level", "",
+		"log level, overrides LOG_LEVEL environment variable")
+	logFormat := fs.String("log-format", "",
+		"log format, 'json' or 'text', overrides LOG_FORMAT environment variable")
+
+	refs, err := parseArgs(fs, args)
+	if err != nil {
+		failOnError(err)
+		return
+	}
+
+	failOnError(setLogFormat(*logFormat))
+	failOnError(setLogLevel(*logLevel))
+
+	if len(refs) != 2 {
+		version()
+		fmt.Println("synopsis: dregsy copy {source ref} {target ref} " +
+			"[-tags={tag,...}] [-relay={relay}] [-src-auth={auth}] " +
+			"[-dst-auth={auth}] [-src-skip-tls-verify] " +
+			"[-dst-skip-tls-verify] [-platforms={platform,...}] " +
+			"[-skip-ping] [-dry-run] [-verbose] [-log-level={level}] " +
+			"[-log-format={json|text}]")
+		exit(1)
+		return
+	}
+
+	version()
+
+	conf, err := sync.NewCopyConfig(&sync.CopyOptions{
+		Relay:               *relay,
+		Source:              refs[0],
+		Target:              refs[1],
+		Tags:                splitList(*tags),
+		SourceAuth:          *srcAuth,
+		TargetAuth:          *dstAuth,
+		SourceSkipTLSVerify: *srcSkipTLSVerify,
+		TargetSkipTLSVerify: *dstSkipTLSVerify,
+		Platforms:           splitList(*platforms),
+		DryRun:              *dryRun,
+		Verbose:             *verbose,
+	})
+	failOnError(err)
+	if *skipPing {
+		conf.Ping = sync.PingOff
+	}
+
+	s, err := sync.New(conf)
+	failOnError(err)
+
+	if testRound {
+		testSync <- s
+	}
+
+	err = s.SyncFromConfig(conf)
+	s.Dispose()
+
+	failOnError(err)
+	exit(0)
+}
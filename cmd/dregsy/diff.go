@@ -0,0 +1,87 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/sync"
+)
+
+// exit code of the 'diff' command when differences were found
+const exitCodeDiffs = 2
+
+// diffTargets implements the 'diff' command, which compares source and target
+// of each mapping in a config file
+func diffTargets(args []string) {
+
+	fs := flag.NewFlagSet("dregsy diff", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file or directory, "+
+		"or comma-separated list of them")
+	only := fs.String("only", "",
+		"comma-separated list of tasks to compare, all other tasks are skipped")
+	skip := fs.String("skip", "", "comma-separated list of tasks to skip")
+	logLevel := fs.String("log-level", "",
+		"log level, overrides LOG_LEVEL environment variable")
+	logFormat := fs.String("log-format", "",
+		"log format, 'json' or 'text', overrides LOG_FORMAT environment variable")
+
+	if err := fs.Parse(args); err != nil {
+		failOnError(err)
+		return
+	}
+
+	failOnError(setLogFormat(*logFormat))
+	failOnError(setLogLevel(*logLevel))
+
+	if *configFile == "" || fs.NArg() > 0 {
+		version()
+		fmt.Println("synopsis: dregsy diff -config={config file} " +
+			"[-only={task,...}] [-skip={task,...}] [-log-level={level}] " +
+			"[-log-format={json|text}]")
+		exit(1)
+		return
+	}
+
+	version()
+
+	conf, err := sync.LoadConfig(*configFile)
+	if err == nil {
+		err = conf.SelectTasks(splitList(*only), splitList(*skip))
+	}
+	if err != nil {
+		failOnError(err)
+		return
+	}
+
+	diffs, err := sync.Diff(conf, os.Stdout)
+	failOnError(err)
+
+	if diffs > 0 {
+		log.WithField("differences", diffs).Warn(
+			"source and target differ")
+		exit(exitCodeDiffs)
+		return
+	}
+
+	log.Info("source and target are in sync")
+	exit(0)
+}
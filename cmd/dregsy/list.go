@@ -0,0 +1,97 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/xelalexv/dregsy/internal/pkg/sync"
+)
+
+// listTags implements the 'list' command, which shows the tags selected by
+// the tag filters of either the tasks in a config file, or a single mapping
+// given via source and target ref
+func listTags(args []string) {
+
+	fs := flag.NewFlagSet("dregsy list", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file or directory, "+
+		"or comma-separated list of them")
+	only := fs.String("only", "",
+		"comma-separated list of tasks to list, all other tasks are skipped")
+	skip := fs.String("skip", "", "comma-separated list of tasks to skip")
+	tags := fs.String("tags", "", "comma-separated list of tags to select, "+
+		"in the same format as 'tags' of a mapping; defaults to all tags")
+	srcAuth := fs.String("src-auth", "", "auth for the source registry, as "+
+		"for 'auth' in config; defaults to 'docker-config'")
+	srcSkipTLSVerify := fs.Bool("src-skip-tls-verify", false,
+		"do not verify TLS certificate of source registry")
+	logLevel := fs.String("log-level", "",
+		"log level, overrides LOG_LEVEL environment variable")
+	logFormat := fs.String("log-format", "",
+		"log format, 'json' or 'text', overrides LOG_FORMAT environment variable")
+
+	refs, err := parseArgs(fs, args)
+	if err != nil {
+		failOnError(err)
+		return
+	}
+
+	failOnError(setLogFormat(*logFormat))
+	failOnError(setLogLevel(*logLevel))
+
+	withConfig := *configFile != "" && len(refs) == 0
+	withRefs := *configFile == "" && len(refs) == 2
+
+	if !withConfig && !withRefs {
+		version()
+		fmt.Println("synopsis: dregsy list -config={config file} " +
+			"[-only={task,...}] [-skip={task,...}] [-log-level={level}] " +
+			"[-log-format={json|text}]\n" +
+			"          dregsy list {source ref} {target ref} " +
+			"[-tags={tag,...}] [-src-auth={auth}] [-src-skip-tls-verify] " +
+			"[-log-level={level}] [-log-format={json|text}]")
+		exit(1)
+		return
+	}
+
+	version()
+
+	var conf *sync.SyncConfig
+
+	if withConfig {
+		if conf, err = sync.LoadConfig(*configFile); err == nil {
+			err = conf.SelectTasks(splitList(*only), splitList(*skip))
+		}
+	} else {
+		conf, err = sync.NewCopyConfig(&sync.CopyOptions{
+			Source:              refs[0],
+			Target:              refs[1],
+			Tags:                splitList(*tags),
+			SourceAuth:          *srcAuth,
+			SourceSkipTLSVerify: *srcSkipTLSVerify,
+		})
+	}
+	if err != nil {
+		failOnError(err)
+		return
+	}
+
+	failOnError(sync.List(conf, os.Stdout))
+	exit(0)
+}
@@ -0,0 +1,88 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/xelalexv/dregsy/internal/pkg/sync"
+)
+
+// lockTags implements the 'lock' command, which writes a lockfile pinning the
+// tags selected by the tasks in a config file to their current digests
+func lockTags(args []string) {
+
+	fs := flag.NewFlagSet("dregsy lock", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file or directory, "+
+		"or comma-separated list of them")
+	out := fs.String("out", "", "path of the lockfile to write; defaults to "+
+		"stdout")
+	only := fs.String("only", "",
+		"comma-separated list of tasks to lock, all other tasks are skipped")
+	skip := fs.String("skip", "", "comma-separated list of tasks to skip")
+	logLevel := fs.String("log-level", "",
+		"log level, overrides LOG_LEVEL environment variable")
+	logFormat := fs.String("log-format", "",
+		"log format, 'json' or 'text', overrides LOG_FORMAT environment variable")
+
+	if err := fs.Parse(args); err != nil {
+		failOnError(err)
+		return
+	}
+
+	failOnError(setLogFormat(*logFormat))
+	failOnError(setLogLevel(*logLevel))
+
+	if *configFile == "" || fs.NArg() > 0 {
+		version()
+		fmt.Println("synopsis: dregsy lock -config={config file} " +
+			"[-out={lockfile}] [-only={task,...}] [-skip={task,...}] " +
+			"[-log-level={level}] [-log-format={json|text}]")
+		exit(1)
+		return
+	}
+
+	version()
+
+	conf, err := sync.LoadConfig(*configFile)
+	if err == nil {
+		err = conf.SelectTasks(splitList(*only), splitList(*skip))
+	}
+	if err != nil {
+		failOnError(err)
+		return
+	}
+
+	// the lockfile is only written when all tags could be locked
+	var buf bytes.Buffer
+	if err := sync.Lock(conf, &buf); err != nil {
+		failOnError(err)
+		return
+	}
+
+	if *out == "" {
+		fmt.Print(buf.String())
+	} else if err := ioutil.WriteFile(*out, buf.Bytes(), 0644); err != nil {
+		failOnError(fmt.Errorf("cannot write lockfile: %v", err))
+		return
+	}
+
+	exit(0)
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
@@ -32,8 +33,22 @@ func init() {
 
 	log.SetOutput(os.Stdout)
 
-	format := strings.ToLower(os.Getenv("LOG_FORMAT"))
-	switch format {
+	if err := setLogFormat(os.Getenv("LOG_FORMAT")); err != nil {
+		log.Error(err)
+	}
+
+	if strings.ToLower(os.Getenv("LOG_METHODS")) == "true" {
+		log.SetReportCaller(true)
+	}
+
+	if err := setLogLevel(os.Getenv("LOG_LEVEL")); err != nil {
+		log.Error(err)
+	}
+}
+
+//
+func setLogFormat(format string) error {
+	switch strings.ToLower(format) {
 	case "json":
 		log.SetFormatter(&log.JSONFormatter{})
 	case "text":
@@ -41,23 +56,22 @@ func init() {
 			ForceColors: strings.ToLower(os.Getenv("LOG_FORCE_COLORS")) == "true"})
 	case "":
 	default:
-		log.Errorf("invalid log format: '%s'", format)
-	}
-
-	if strings.ToLower(os.Getenv("LOG_METHODS")) == "true" {
-		log.SetReportCaller(true)
+		return fmt.Errorf("invalid log format: '%s'", format)
 	}
+	return nil
+}
 
-	level := os.Getenv("LOG_LEVEL")
+//
+func setLogLevel(level string) error {
 	if level != "" {
 		l, err := log.ParseLevel(level)
 		if err != nil {
-			log.Errorf("invalid log level: '%s'; valid levels are: panic, "+
-				"fatal, error, warn, info, debug, trace", level)
-		} else {
-			log.SetLevel(l)
+			return fmt.Errorf("invalid log level: '%s'; valid levels are: "+
+				"panic, fatal, error, warn, info, debug, trace", level)
 		}
+		log.SetLevel(l)
 	}
+	return nil
 }
 
 //
@@ -79,32 +93,163 @@ func main() {
 
 	dregsyExitCode = 0
 
-	fs := flag.NewFlagSet("dregsy", flag.ContinueOnError)
-	configFile := fs.String("config", "", "path to config file")
-
+	args := os.Args[1:]
 	if testRound {
-		if len(testArgs) > 0 {
-			failOnError(fs.Parse(testArgs))
-		} else {
+		if len(testArgs) == 0 {
 			panic("no test arguments")
 		}
-	} else {
-		failOnError(fs.Parse(os.Args[1:]))
+		args = testArgs
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "copy":
+			copyImage(args[1:])
+			return
+		case "list":
+			listTags(args[1:])
+			return
+		case "diff":
+			diffTargets(args[1:])
+			return
+		case "lock":
+			lockTags(args[1:])
+			return
+		case "operator":
+			runOperator(args[1:])
+			return
+		}
+	}
+
+	fs := flag.NewFlagSet("dregsy", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file or directory, "+
+		"or comma-separated list of them")
+	skipPing := fs.Bool("skip-ping", false,
+		"do not check whether relay is ready, overrides 'ping' setting in config")
+	requireDaemon := fs.Bool("require-daemon", false, "fail when the relay's "+
+		"daemon is not reachable, instead of using the 'fallback-relay'")
+	only := fs.String("only", "",
+		"comma-separated list of tasks to run, all other tasks are skipped")
+	skip := fs.String("skip", "", "comma-separated list of tasks to skip")
+	dryRun := fs.Bool("dry-run", false,
+		"only show what would be synced, overrides 'dry-run' setting in config")
+	quiet := fs.Bool("quiet", false, "only log task run summaries, warnings, "+
+		"and errors, overrides 'quiet' setting in config")
+	logLevel := fs.String("log-level", "",
+		"log level, overrides LOG_LEVEL environment variable")
+	logFormat := fs.String("log-format", "",
+		"log format, 'json' or 'text', overrides LOG_FORMAT environment variable")
+	check := fs.Bool("check", false,
+		"only check the config file for errors, without contacting any registry")
+	schema := fs.Bool("schema", false,
+		"print the JSON schema of the config file and exit")
+	once := fs.Bool("once", false, "run each task once regardless of its "+
+		"interval or schedule, then print a JSON summary and exit")
+	lockfile := fs.String("lockfile", "", "sync only the tags pinned in "+
+		"this lockfile, as written by 'dregsy lock'")
+	events := fs.String("events", "", "emit an event for each step of task "+
+		"runs in the given format, currently only 'jsonl'")
+	eventsOut := fs.String("events-out", "stdout",
+		"where to write events, 'stdout', 'stderr', or a file path")
+
+	failOnError(fs.Parse(args))
+
+	failOnError(setLogFormat(*logFormat))
+	failOnError(setLogLevel(*logLevel))
+
+	if *schema {
+		out, err := sync.ConfigSchema()
+		failOnError(err)
+		fmt.Println(string(out))
+		exit(0)
+		return
 	}
 
 	if len(*configFile) == 0 {
 		version()
-		fmt.Println("synopsis: dregsy -config={config file}")
+		fmt.Println("synopsis: dregsy -config={config file} [-check] " +
+			"[-once] [-skip-ping] [-require-daemon] [-dry-run] [-quiet] " +
+			"[-only={task,...}] " +
+			"[-skip={task,...}] [-lockfile={lockfile}] " +
+			"[-events=jsonl [-events-out={stdout|stderr|file}]] " +
+			"[-log-level={level}] " +
+			"[-log-format={json|text}]\n" +
+			"          dregsy copy {source ref} {target ref} " +
+			"[-tags={tag,...}] ...\n" +
+			"          dregsy list -config={config file} ...\n" +
+			"          dregsy diff -config={config file} ...\n" +
+			"          dregsy lock -config={config file} ...\n" +
+			"          dregsy operator -config={config file} ...\n" +
+			"          dregsy -schema")
 		exit(1)
 	}
 
 	version()
 
-	conf, err := sync.LoadConfig(*configFile)
+	if *check {
+		if err := sync.CheckConfig(*configFile); err != nil {
+			failOnError(err)
+		} else {
+			log.Info("config file is valid")
+			exit(0)
+		}
+		return
+	}
+
+	load := func() (*sync.SyncConfig, error) {
+		conf, err := sync.LoadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if *skipPing {
+			conf.Ping = sync.PingOff
+		}
+		if *requireDaemon {
+			conf.RequireDaemon = true
+		}
+		if *dryRun {
+			conf.DryRun = true
+		}
+		if *quiet {
+			conf.Quiet = true
+		}
+		if *once {
+			conf.RunOnce()
+		}
+		if err := conf.SelectTasks(
+			splitList(*only), splitList(*skip)); err != nil {
+			return nil, err
+		}
+		if *lockfile != "" {
+			lock, err := sync.LoadLockfile(*lockfile)
+			if err != nil {
+				return nil, err
+			}
+			if err := conf.ApplyLockfile(lock); err != nil {
+				return nil, err
+			}
+		}
+		return conf, nil
+	}
+
+	conf, err := load()
 	failOnError(err)
+	if conf.Quiet {
+		sync.SetQuietLogging()
+	}
 
 	s, err := sync.New(conf)
 	failOnError(err)
+	s.EnableReload(load)
+	if *once {
+		s.EnableSummary()
+	}
+	if *events != "" {
+		w, err := openEvents(*events, *eventsOut)
+		failOnError(err)
+		defer w.Close()
+		s.EnableEvents(w)
+	}
 
 	if testRound {
 		testSync <- s
@@ -113,11 +258,76 @@ func main() {
 	err = s.SyncFromConfig(conf)
 	s.Dispose()
 
+	if wErr := s.WriteSummary(os.Stdout); wErr != nil {
+		log.Errorf("cannot write summary: %v", wErr)
+	}
+
 	log.Debug("exit main")
 	failOnError(err)
 	exit(0)
 }
 
+// openEvents opens the destination for events in the given format, either
+// stdout, stderr, or a file, to which events are appended
+func openEvents(format, out string) (io.WriteCloser, error) {
+
+	if format != "jsonl" {
+		return nil, fmt.Errorf(
+			"invalid event format: '%s', only 'jsonl' is supported", format)
+	}
+
+	switch out {
+	case "", "stdout":
+		return nopCloser{os.Stdout}, nil
+	case "stderr":
+		return nopCloser{os.Stderr}, nil
+	}
+
+	f, err := os.OpenFile(out, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open events file: %v", err)
+	}
+	return f, nil
+}
+
+// nopCloser keeps stdout and stderr from being closed
+type nopCloser struct {
+	io.Writer
+}
+
+//
+func (nopCloser) Close() error {
+	return nil
+}
+
+//
+func splitList(l string) []string {
+	var ret []string
+	for _, i := range strings.Split(l, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// parseArgs parses the given command line arguments with fs, and returns the
+// non-flag arguments; other than with fs.Parse, flags may also be given after
+// non-flag arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var ret []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return ret, nil
+		}
+		ret = append(ret, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
 //
 func failOnError(err error) {
 	if err != nil {
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -262,6 +263,12 @@ func TestE2ESkopeoTagSetsRegex(t *testing.T) {
 		test.GetParams())
 }
 
+//
+func TestE2EDirect(t *testing.T) {
+	tryConfig(test.NewTestHelper(t), "e2e/base/direct.yaml",
+		1, 0, true, nil, test.GetParams())
+}
+
 //
 func tryConfig(th *test.TestHelper, file string, ticks int, wait time.Duration,
 	verify bool, expectations map[string][]string, data interface{}) {
@@ -308,7 +315,7 @@ func validateAgainstExpectations(th *test.TestHelper, c *sync.SyncConfig,
 
 	for eRef, eTags := range expectations {
 		ref := fmt.Sprintf("%s/%s", t.Target.Registry, eRef)
-		tags, err := skopeo.ListAllTags(ref,
+		tags, err := skopeo.ListAllTags(context.Background(), ref,
 			util.DecodeJSONAuth(t.Target.GetAuth()),
 			"", t.Target.SkipTLSVerify)
 		th.AssertNoError(err)
@@ -323,7 +330,7 @@ func validateAgainstTaskMapping(th *test.TestHelper, c *sync.SyncConfig) {
 		th.AssertNoError(t.Target.RefreshAuth())
 		for _, m := range t.Mappings {
 			ref := fmt.Sprintf("%s%s", t.Target.Registry, m.To)
-			tags, err := skopeo.ListAllTags(ref,
+			tags, err := skopeo.ListAllTags(context.Background(), ref,
 				util.DecodeJSONAuth(t.Target.GetAuth()),
 				"", t.Target.SkipTLSVerify)
 			th.AssertNoError(err)
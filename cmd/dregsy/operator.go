@@ -0,0 +1,109 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/kube"
+	"github.com/xelalexv/dregsy/internal/pkg/operator"
+	"github.com/xelalexv/dregsy/internal/pkg/sync"
+)
+
+// runOperator implements the 'operator' command, which runs the tasks defined
+// by DregsyTask resources in a Kubernetes cluster
+func runOperator(args []string) {
+
+	fs := flag.NewFlagSet("dregsy operator", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to config file or directory, "+
+		"or comma-separated list of them, for settings other than tasks")
+	namespace := fs.String("namespace", "", "namespace to watch for "+
+		"DregsyTask resources, defaults to the namespace of the pod")
+	skipPing := fs.Bool("skip-ping", false,
+		"do not check whether relay is ready, overrides 'ping' setting in config")
+	dryRun := fs.Bool("dry-run", false,
+		"only show what would be synced, overrides 'dry-run' setting in config")
+	logLevel := fs.String("log-level", "",
+		"log level, overrides LOG_LEVEL environment variable")
+	logFormat := fs.String("log-format", "",
+		"log format, 'json' or 'text', overrides LOG_FORMAT environment variable")
+
+	if err := fs.Parse(args); err != nil {
+		failOnError(err)
+		return
+	}
+
+	failOnError(setLogFormat(*logFormat))
+	failOnError(setLogLevel(*logLevel))
+
+	if *configFile == "" || fs.NArg() > 0 {
+		version()
+		fmt.Println("synopsis: dregsy operator -config={config file} " +
+			"[-namespace={namespace}] [-skip-ping] [-dry-run] " +
+			"[-log-level={level}] [-log-format={json|text}]")
+		exit(1)
+		return
+	}
+
+	version()
+
+	client, err := kube.NewInClusterClient(*namespace)
+	if err != nil {
+		failOnError(err)
+		return
+	}
+
+	op := operator.New(client, func() (*sync.SyncConfig, error) {
+		conf, err := sync.LoadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if *skipPing {
+			conf.Ping = sync.PingOff
+		}
+		if *dryRun {
+			conf.DryRun = true
+		}
+		return conf, nil
+	})
+
+	conf, err := op.Init()
+	if err != nil {
+		failOnError(err)
+		return
+	}
+
+	s, err := sync.New(conf)
+	if err != nil {
+		failOnError(err)
+		return
+	}
+
+	if testRound {
+		testSync <- s
+	}
+
+	err = op.Run(s, conf)
+	s.Dispose()
+
+	log.Debug("exit operator")
+	failOnError(err)
+	exit(0)
+}
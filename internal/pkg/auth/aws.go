@@ -0,0 +1,51 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// NewAWSSession creates an AWS session for creds. If creds carry AWS keys,
+// e.g. obtained from Vault, these are used. Otherwise, the session uses the
+// full default credential chain, i.e. environment variables, shared config and
+// credentials files, web identity token (as used for IRSA on EKS), and EC2
+// instance profile. If creds name a role, that role is assumed on top.
+func NewAWSSession(creds *Credentials) (*session.Session, error) {
+
+	opts := session.Options{SharedConfigState: session.SharedConfigEnable}
+	if id, secret, token := creds.AWSKeys(); id != "" {
+		opts.Config.Credentials = credentials.NewStaticCredentials(
+			id, secret, token)
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if roleARN := creds.AWSRoleARN(); roleARN != "" {
+		return sess.Copy(&aws.Config{
+			Credentials: stscreds.NewCredentials(sess, roleARN),
+		}), nil
+	}
+
+	return sess, nil
+}
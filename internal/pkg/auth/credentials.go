@@ -16,6 +16,10 @@
 
 package auth
 
+import (
+	"time"
+)
+
 //
 type Refresher interface {
 	Refresh(creds *Credentials) error
@@ -45,6 +49,12 @@ type Credentials struct {
 	token     *Token
 	refresher Refresher
 	auther    Auther
+	expiry    time.Time
+	//
+	awsRoleARN   string
+	awsKeyID     string
+	awsSecretKey string
+	awsToken     string
 }
 
 //
@@ -70,6 +80,15 @@ func (c *Credentials) SetAuther(a Auther) {
 	c.auther = a
 }
 
+// Expiry returns when the credentials obtained by the refresher expire, or the
+// zero time if that's not known, or if c is nil
+func (c *Credentials) Expiry() time.Time {
+	if c == nil {
+		return time.Time{}
+	}
+	return c.expiry
+}
+
 //
 func (c *Credentials) Token() *Token {
 	return c.token
@@ -80,6 +99,37 @@ func (c *Credentials) SetToken(t *Token) {
 	c.token = t
 }
 
+// AWSRoleARN returns the AWS role to assume when talking to AWS APIs, or an
+// empty string if none is set, or if c is nil
+func (c *Credentials) AWSRoleARN() string {
+	if c == nil {
+		return ""
+	}
+	return c.awsRoleARN
+}
+
+//
+func (c *Credentials) SetAWSRoleARN(arn string) {
+	c.awsRoleARN = arn
+}
+
+// AWSKeys returns the AWS access key ID, secret access key, and session token
+// to use when talking to AWS APIs; all are empty if none were set, in which
+// case the default AWS credential chain applies
+func (c *Credentials) AWSKeys() (id, secret, token string) {
+	if c == nil {
+		return "", "", ""
+	}
+	return c.awsKeyID, c.awsSecretKey, c.awsToken
+}
+
+//
+func (c *Credentials) SetAWSKeys(id, secret, token string) {
+	c.awsKeyID = id
+	c.awsSecretKey = secret
+	c.awsToken = token
+}
+
 //
 func (c *Credentials) SetRefresher(r Refresher) {
 	c.refresher = r
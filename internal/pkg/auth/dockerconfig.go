@@ -0,0 +1,73 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// user name Docker uses for credentials consisting of an identity token only
+const identityTokenUser = "<token>"
+
+// NewDockerConfigRefresher creates a refresher that resolves credentials for
+// registry from the Docker config file, i.e. $DOCKER_CONFIG/config.json or
+// ~/.docker/config.json, including any configured credential helpers
+func NewDockerConfigRefresher(registry string) Refresher {
+	return &dockerConfigRefresher{registry: registry}
+}
+
+//
+type dockerConfigRefresher struct {
+	registry string
+}
+
+// Refresh resolves the credentials on each call, since credential helpers
+// may hand out short-lived credentials
+func (rf *dockerConfigRefresher) Refresh(creds *Credentials) error {
+
+	reg, err := gocrname.NewRegistry(rf.registry, gocrname.WeakValidation)
+	if err != nil {
+		return fmt.Errorf("invalid registry '%s': %v", rf.registry, err)
+	}
+
+	a, err := authn.DefaultKeychain.Resolve(reg)
+	if err != nil {
+		return fmt.Errorf(
+			"cannot resolve credentials for '%s' from Docker config: %v",
+			rf.registry, err)
+	}
+
+	conf, err := a.Authorization()
+	if err != nil {
+		return fmt.Errorf(
+			"cannot get credentials for '%s' from Docker config: %v",
+			rf.registry, err)
+	}
+
+	creds.username = conf.Username
+	creds.password = conf.Password
+	if creds.username == "" && conf.IdentityToken != "" {
+		creds.username = identityTokenUser
+		creds.password = conf.IdentityToken
+	}
+	creds.auther = BasicAuthJSON
+
+	return nil
+}
@@ -20,19 +20,25 @@ import (
 	"encoding/base64"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	log "github.com/sirupsen/logrus"
 )
 
+// lifetime of ECR authorization tokens, assumed when ECR doesn't report it
+const ECRTokenLifetime = 12 * time.Hour
+
 //
-func NewECRAuthRefresher(account, region string, interval time.Duration) Refresher {
+func NewECRAuthRefresher(account, region string,
+	interval, margin time.Duration) Refresher {
 	return &ecrAuthRefresher{
 		account:  account,
 		region:   region,
 		interval: interval,
+		margin:   margin,
 	}
 }
 
@@ -41,9 +47,35 @@ type ecrAuthRefresher struct {
 	account  string
 	region   string
 	interval time.Duration
+	margin   time.Duration
 	expiry   time.Time
 }
 
+// ECR authorization tokens fetched so far, shared by all refreshers for the
+// same registry and AWS identity, so that tasks syncing from or to the same
+// registry don't each fetch their own
+var ecrTokens = make(map[string]*ecrToken)
+var ecrTokensMutex sync.Mutex
+
+//
+type ecrToken struct {
+	token   string
+	fetched time.Time
+	expires time.Time
+}
+
+// renewal returns when a token fetched at the given time and expiring at the
+// given time is due for renewal, which is after interval has passed, or when
+// expiry is within margin, whichever comes first
+func renewal(fetched, expires time.Time,
+	interval, margin time.Duration) time.Time {
+	due := fetched.Add(interval)
+	if early := expires.Add(-margin); early.Before(due) {
+		return early
+	}
+	return due
+}
+
 //
 func (rf *ecrAuthRefresher) Refresh(creds *Credentials) error {
 
@@ -52,10 +84,47 @@ func (rf *ecrAuthRefresher) Refresh(creds *Credentials) error {
 		return nil
 	}
 
-	sess, err := session.NewSession()
+	keyID, _, _ := creds.AWSKeys()
+	key := strings.Join(
+		[]string{rf.account, rf.region, creds.AWSRoleARN(), keyID}, "|")
+
+	ecrTokensMutex.Lock()
+	defer ecrTokensMutex.Unlock()
+
+	if t, ok := ecrTokens[key]; ok {
+		due := renewal(t.fetched, t.expires, rf.interval, rf.margin)
+		if time.Now().Before(due) {
+			if err := setECRToken(creds, t.token, t.expires); err != nil {
+				return err
+			}
+			rf.expiry = due
+			return nil
+		}
+	}
+
+	now := time.Now()
+	token, expires, err := rf.fetch(creds)
 	if err != nil {
 		return err
 	}
+	if err := setECRToken(creds, token, expires); err != nil {
+		return err
+	}
+
+	ecrTokens[key] = &ecrToken{token: token, fetched: now, expires: expires}
+	rf.expiry = renewal(now, expires, rf.interval, rf.margin)
+	logExpiry(rf.account, expires, rf.expiry)
+	return nil
+}
+
+// fetch gets a new authorization token from ECR, together with its expiry
+func (rf *ecrAuthRefresher) fetch(creds *Credentials) (
+	string, time.Time, error) {
+
+	sess, err := NewAWSSession(creds)
+	if err != nil {
+		return "", time.Time{}, err
+	}
 
 	svc := ecr.New(sess, &aws.Config{Region: aws.String(rf.region)})
 	input := &ecr.GetAuthorizationTokenInput{
@@ -63,28 +132,52 @@ func (rf *ecrAuthRefresher) Refresh(creds *Credentials) error {
 	}
 	authToken, err := svc.GetAuthorizationToken(input)
 	if err != nil {
-		return err
+		return "", time.Time{}, err
 	}
 
 	for _, data := range authToken.AuthorizationData {
+		return *data.AuthorizationToken, tokenExpiry(data.ExpiresAt), nil
+	}
 
-		output, err := base64.StdEncoding.DecodeString(*data.AuthorizationToken)
-		if err != nil {
-			return err
-		}
+	return "", time.Time{}, fmt.Errorf("no authorization data")
+}
 
-		split := strings.Split(string(output), ":")
-		if len(split) != 2 {
-			return fmt.Errorf("failed to parse credentials")
-		}
+// tokenExpiry returns the expiry reported by ECR, or the standard token
+// lifetime from now if none was reported
+func tokenExpiry(expiresAt *time.Time) time.Time {
+	if expiresAt == nil || expiresAt.IsZero() {
+		return time.Now().Add(ECRTokenLifetime)
+	}
+	return *expiresAt
+}
 
-		creds.username = strings.TrimSpace(split[0])
-		creds.password = strings.TrimSpace(split[1])
-		creds.auther = BasicAuthJSON
-		rf.expiry = time.Now().Add(rf.interval)
+//
+func logExpiry(registry string, expires, renewal time.Time) {
+	log.WithFields(log.Fields{
+		"registry": registry,
+		"expires":  expires.Format(time.RFC3339),
+		"renewal":  renewal.Format(time.RFC3339)}).Info(
+		"fetched ECR authorization token")
+}
 
-		return nil
+// setECRToken sets creds from an ECR authorization token, which is the base64
+// encoded form of {user}:{password}
+func setECRToken(creds *Credentials, token string, expires time.Time) error {
+
+	output, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return err
+	}
+
+	split := strings.Split(string(output), ":")
+	if len(split) != 2 {
+		return fmt.Errorf("failed to parse credentials")
 	}
 
-	return fmt.Errorf("no authorization data")
+	creds.username = strings.TrimSpace(split[0])
+	creds.password = strings.TrimSpace(split[1])
+	creds.auther = BasicAuthJSON
+	creds.expiry = expires
+
+	return nil
 }
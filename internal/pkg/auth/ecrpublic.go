@@ -0,0 +1,76 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecrpublic"
+)
+
+// the ECR Public API is only available in this region
+const ECRPublicRegion = "us-east-1"
+
+//
+func NewECRPublicAuthRefresher(interval, margin time.Duration) Refresher {
+	return &ecrPublicAuthRefresher{interval: interval, margin: margin}
+}
+
+//
+type ecrPublicAuthRefresher struct {
+	interval time.Duration
+	margin   time.Duration
+	expiry   time.Time
+}
+
+//
+func (rf *ecrPublicAuthRefresher) Refresh(creds *Credentials) error {
+
+	if rf.interval == 0 || time.Now().Before(rf.expiry) {
+		return nil
+	}
+
+	now := time.Now()
+	sess, err := NewAWSSession(creds)
+	if err != nil {
+		return err
+	}
+
+	svc := ecrpublic.New(sess, &aws.Config{Region: aws.String(ECRPublicRegion)})
+	authToken, err := svc.GetAuthorizationToken(
+		&ecrpublic.GetAuthorizationTokenInput{})
+	if err != nil {
+		return err
+	}
+
+	data := authToken.AuthorizationData
+	if data == nil || data.AuthorizationToken == nil {
+		return fmt.Errorf("no authorization data")
+	}
+
+	expires := tokenExpiry(data.ExpiresAt)
+	if err := setECRToken(
+		creds, *data.AuthorizationToken, expires); err != nil {
+		return err
+	}
+
+	rf.expiry = renewal(now, expires, rf.interval, rf.margin)
+	logExpiry("public.ecr.aws", expires, rf.expiry)
+	return nil
+}
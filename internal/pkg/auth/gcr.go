@@ -17,134 +17,82 @@
 package auth
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io/ioutil"
-	"net/http"
-	"os"
-	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
-//
-const gcp_metadata_url = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+// scope needed for pulling from & pushing to GCR and Artifact Registry
+const gcpScope = "https://www.googleapis.com/auth/cloud-platform"
 
-//
-func NewGCRAuthRefresher() Refresher {
-	return &gcrAuthRefresher{}
+// NewGCRAuthRefresher creates a refresher for GCR and Artifact Registry. If
+// keyFile is set, it is used as the service account key file. Otherwise,
+// Application Default Credentials are used, i.e. the key file pointed to by
+// GOOGLE_APPLICATION_CREDENTIALS, the credentials set up via gcloud, or the
+// service account of the GCE instance or GKE workload.
+func NewGCRAuthRefresher(keyFile string) Refresher {
+	return &gcrAuthRefresher{keyFile: keyFile}
 }
 
 //
 type gcrAuthRefresher struct {
-	expiry time.Time
+	keyFile string
+	source  oauth2.TokenSource
 }
 
 //
 func (rf *gcrAuthRefresher) Refresh(creds *Credentials) error {
 
-	if time.Now().Before(rf.expiry) {
-		return nil
-	}
-
-	var authToken string
-	var expiry time.Time
-	var err error
-
-	if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "" {
-		authToken, expiry, err = gcpTokenFromCreds()
-
-	} else if isGCEInstance() {
-		authToken, expiry, err = gcpTokenFromMetadata()
-
-	} else {
-		return fmt.Errorf(
-			"neither GOOGLE_APPLICATION_CREDENTIALS set, nor a GCE instance")
+	if rf.source == nil {
+		src, err := rf.tokenSource()
+		if err != nil {
+			return err
+		}
+		rf.source = src
 	}
 
+	// the token source caches the token until shortly before expiry
+	token, err := rf.source.Token()
 	if err != nil {
-		return err
+		return fmt.Errorf("cannot get GCP access token: %v", err)
 	}
-	if authToken == "" {
+	if token.AccessToken == "" {
 		return fmt.Errorf("no auth token received")
 	}
 
 	creds.username = "oauth2accesstoken"
-	creds.password = authToken
+	creds.password = token.AccessToken
 	creds.auther = BasicAuthJSON
-	rf.expiry = expiry
 
 	return nil
 }
 
 //
-func isGCEInstance() bool {
-	resp, err := http.Head(gcp_metadata_url)
-	if err != nil {
-		return false
-	}
-	return resp.Header.Get("Metadata-Flavor") == "Google"
-}
-
-//
-func gcpTokenFromCreds() (string, time.Time, error) {
-
-	b, err := ioutil.ReadFile(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
-	if err != nil {
-		return "", time.Time{}, err
-	}
-
-	conf, err := google.JWTConfigFromJSON(
-		b, "https://www.googleapis.com/auth/devstorage.read_write")
-	if err != nil {
-		return "", time.Time{}, err
-	}
-
-	token, err := conf.TokenSource(oauth2.NoContext).Token()
-	if err != nil {
-		return "", time.Time{}, err
-	}
-
-	return token.AccessToken, token.Expiry, nil
-}
-
-//
-type GCPTokenResponse struct {
-	AccessToken string         `json:"access_token"`
-	ExpiresIn   *time.Duration `json:"expires_in"`
-	TokenType   string         `json:"token_type"`
-}
-
-//
-func gcpTokenFromMetadata() (string, time.Time, error) {
-
-	req, err := http.NewRequest("GET", gcp_metadata_url, nil)
-	if err != nil {
-		return "", time.Time{}, err
+func (rf *gcrAuthRefresher) tokenSource() (oauth2.TokenSource, error) {
+
+	ctx := context.Background()
+
+	if rf.keyFile != "" {
+		b, err := ioutil.ReadFile(rf.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read GCP key file: %v", err)
+		}
+		gc, err := google.CredentialsFromJSON(ctx, b, gcpScope)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GCP key file '%s': %v",
+				rf.keyFile, err)
+		}
+		return gc.TokenSource, nil
 	}
 
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Metadata-Flavor", "Google")
-
-	client := &http.Client{}
-	start := time.Now()
-
-	resp, err := client.Do(req)
+	gc, err := google.FindDefaultCredentials(ctx, gcpScope)
 	if err != nil {
-		return "", time.Time{}, err
+		return nil, fmt.Errorf(
+			"no GCP application default credentials found: %v", err)
 	}
 
-	defer resp.Body.Close()
-
-	var respToken GCPTokenResponse
-
-	err = json.NewDecoder(resp.Body).Decode(&respToken)
-	if err != nil {
-		return "", time.Time{}, err
-	}
-
-	expiry := start.Add(time.Second * *respToken.ExpiresIn)
-
-	return respToken.AccessToken, expiry, nil
+	return gc.TokenSource, nil
 }
@@ -0,0 +1,171 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const harborTimeout = 30 * time.Second
+
+// HarborRobot describes a Harbor robot account whose secret is kept in a file
+type HarborRobot struct {
+	ID         int64
+	Name       string
+	SecretFile string
+	Renew      time.Duration
+}
+
+// NewHarborRobotRefresher creates a refresher that takes the credentials of a
+// Harbor robot account from its secret file. If a renewal interval is set, the
+// secret is renewed via Harbor's API once the secret file is older than that,
+// and the new secret written back to the file, so that it survives restarts.
+func NewHarborRobotRefresher(host string, robot *HarborRobot,
+	insecure bool) Refresher {
+
+	client := &http.Client{Timeout: harborTimeout}
+	if insecure {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		client.Transport = t
+	}
+
+	return &harborRobotRefresher{
+		api:    fmt.Sprintf("https://%s/api/v2.0", host),
+		robot:  robot,
+		client: client,
+	}
+}
+
+//
+type harborRobotRefresher struct {
+	api    string
+	robot  *HarborRobot
+	client *http.Client
+}
+
+//
+func (rf *harborRobotRefresher) Refresh(creds *Credentials) error {
+
+	info, err := os.Stat(rf.robot.SecretFile)
+	if err != nil {
+		return fmt.Errorf("cannot access robot secret file: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(rf.robot.SecretFile)
+	if err != nil {
+		return fmt.Errorf("cannot read robot secret file: %v", err)
+	}
+
+	creds.username = rf.robot.Name
+	creds.password = strings.TrimSpace(string(b))
+	creds.auther = BasicAuthJSON
+
+	if rf.robot.Renew == 0 ||
+		time.Since(info.ModTime()) < rf.robot.Renew {
+		return nil
+	}
+
+	log.WithField("robot", rf.robot.Name).Info("renewing robot secret")
+
+	secret, err := rf.renew(creds)
+	if err != nil {
+		return fmt.Errorf("cannot renew secret of robot '%s': %v",
+			rf.robot.Name, err)
+	}
+
+	if err := writeFileAtomic(rf.robot.SecretFile, []byte(secret)); err != nil {
+		return fmt.Errorf("cannot write renewed robot secret: %v", err)
+	}
+
+	creds.password = secret
+	return nil
+}
+
+// renew has Harbor generate a new secret for the robot account, using the
+// current credentials
+func (rf *harborRobotRefresher) renew(creds *Credentials) (string, error) {
+
+	req, err := http.NewRequest(http.MethodPatch,
+		fmt.Sprintf("%s/robots/%d", rf.api, rf.robot.ID),
+		bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(creds.username, creds.password)
+
+	res, err := rf.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return "", fmt.Errorf("request failed with %d: %s", res.StatusCode,
+			bytes.TrimSpace(msg))
+	}
+
+	var sec struct {
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&sec); err != nil {
+		return "", fmt.Errorf("invalid response: %v", err)
+	}
+	if sec.Secret == "" {
+		return "", fmt.Errorf("no secret in response")
+	}
+
+	return sec.Secret, nil
+}
+
+//
+func writeFileAtomic(file string, data []byte) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".dregsy-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,243 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const (
+	defaultVaultAuthPath = "kubernetes"
+	serviceAccountToken  = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	vaultTimeout         = 30 * time.Second
+)
+
+// VaultConfig describes where to fetch the credentials of a location from in
+// HashiCorp Vault
+type VaultConfig struct {
+	Address  string `yaml:"address"`
+	Path     string `yaml:"path"`
+	Role     string `yaml:"role"`
+	AuthPath string `yaml:"auth-path"`
+}
+
+//
+func (c *VaultConfig) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Address == "" {
+		c.Address = os.Getenv("VAULT_ADDR")
+	}
+	if c.Address == "" {
+		return errors.New("no Vault address set, and VAULT_ADDR is empty")
+	}
+	c.Address = strings.TrimSuffix(c.Address, "/")
+
+	c.Path = strings.Trim(c.Path, "/")
+	if c.Path == "" {
+		return errors.New("no Vault 'path' set")
+	}
+
+	if c.Role == "" && os.Getenv("VAULT_TOKEN") == "" {
+		return errors.New("neither Vault 'role' nor VAULT_TOKEN set")
+	}
+
+	if c.AuthPath == "" {
+		c.AuthPath = defaultVaultAuthPath
+	}
+	c.AuthPath = strings.Trim(c.AuthPath, "/")
+
+	return nil
+}
+
+// NewVaultRefresher creates a refresher that reads the credentials from
+// Vault. The secret at the configured path is expected to either hold
+// 'username' & 'password' (as with the KV engine, versions 1 and 2), or
+// 'access_key', 'secret_key', and optionally 'security_token' (as with the
+// AWS secrets engine). In the latter case, the AWS keys are handed on to next,
+// which would typically be an ECR refresher.
+func NewVaultRefresher(conf *VaultConfig, next Refresher) Refresher {
+	return &vaultRefresher{
+		conf:   conf,
+		next:   next,
+		client: &http.Client{Timeout: vaultTimeout},
+	}
+}
+
+//
+type vaultRefresher struct {
+	conf   *VaultConfig
+	next   Refresher
+	client *http.Client
+	expiry time.Time
+}
+
+// vaultResponse is the part of a Vault response we're interested in
+type vaultResponse struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+//
+func (rf *vaultRefresher) Refresh(creds *Credentials) error {
+
+	if time.Now().Before(rf.expiry) {
+		return rf.refreshNext(creds)
+	}
+
+	token, err := rf.token()
+	if err != nil {
+		return err
+	}
+
+	log.WithField("path", rf.conf.Path).Debug("reading credentials from Vault")
+
+	resp, err := rf.call(http.MethodGet, rf.conf.Path, token, nil)
+	if err != nil {
+		return err
+	}
+
+	data := resp.Data
+	// KV version 2 nests the secret in another data field
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	if key := stringField(data, "access_key"); key != "" {
+		creds.SetAWSKeys(key, stringField(data, "secret_key"),
+			stringField(data, "security_token"))
+	} else {
+		user := stringField(data, "username")
+		pass := stringField(data, "password")
+		if user == "" && pass == "" {
+			return fmt.Errorf(
+				"Vault secret at '%s' holds neither username & password, "+
+					"nor AWS keys", rf.conf.Path)
+		}
+		creds.username = user
+		creds.password = pass
+		creds.auther = BasicAuthJSON
+	}
+
+	if resp.LeaseDuration > 0 {
+		// renew a bit ahead of lease expiry
+		rf.expiry = time.Now().Add(
+			time.Duration(resp.LeaseDuration) * time.Second * 4 / 5)
+	}
+
+	return rf.refreshNext(creds)
+}
+
+//
+func (rf *vaultRefresher) refreshNext(creds *Credentials) error {
+	if rf.next == nil {
+		return nil
+	}
+	return rf.next.Refresh(creds)
+}
+
+// token returns VAULT_TOKEN if no role is configured, otherwise it logs into
+// Vault with the Kubernetes service account token of the pod
+func (rf *vaultRefresher) token() (string, error) {
+
+	if rf.conf.Role == "" {
+		return os.Getenv("VAULT_TOKEN"), nil
+	}
+
+	jwt, err := ioutil.ReadFile(serviceAccountToken)
+	if err != nil {
+		return "", fmt.Errorf("cannot read service account token: %v", err)
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"role": rf.conf.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := rf.call(http.MethodPost,
+		fmt.Sprintf("auth/%s/login", rf.conf.AuthPath), "", body)
+	if err != nil {
+		return "", err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", errors.New("Vault login did not return a token")
+	}
+
+	return resp.Auth.ClientToken, nil
+}
+
+//
+func (rf *vaultRefresher) call(method, path, token string, body []byte) (
+	*vaultResponse, error) {
+
+	req, err := http.NewRequest(method,
+		fmt.Sprintf("%s/v1/%s", rf.conf.Address, path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	res, err := rf.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling Vault: %v", err)
+	}
+	defer res.Body.Close()
+
+	var resp vaultResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("invalid response from Vault for '%s': %v",
+			path, err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vault request for '%s' failed with %d: %s",
+			path, res.StatusCode, strings.Join(resp.Errors, ", "))
+	}
+
+	return &resp, nil
+}
+
+//
+func stringField(data map[string]interface{}, key string) string {
+	if v, ok := data[key].(string); ok {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package cosign
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+//
+const defaultBinary = "cosign"
+
+// run invokes cosign with given args for the image with given ref; creds are
+// expected in the form {user}:{password}
+func run(binary, ref, creds string, skipTLSVerify bool, args ...string) error {
+
+	if binary == "" {
+		binary = defaultBinary
+	}
+
+	if creds != "" {
+		parts := strings.SplitN(creds, ":", 2)
+		args = append(args, "--registry-username", parts[0])
+		if len(parts) > 1 {
+			args = append(args, "--registry-password", parts[1])
+		}
+	}
+	if skipTLSVerify {
+		args = append(args, "--allow-insecure-registry")
+	}
+
+	cmd := exec.Command(binary, append(args, ref)...)
+	cmd.Env = os.Environ()
+
+	bufErr := new(bytes.Buffer)
+	cmd.Stderr = bufErr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s, %v", strings.TrimSpace(bufErr.String()), err)
+	}
+
+	return nil
+}
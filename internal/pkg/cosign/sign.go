@@ -0,0 +1,94 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package cosign
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+type Signer interface {
+	Sign(ref, creds string, skipTLSVerify bool) error
+}
+
+// SignConfig describes how to sign images with cosign; either 'key' needs to
+// be set to a private key file or KMS URI, or 'keyless' to true, in which case
+// an OIDC identity token is used, either the one given in 'identity-token', or
+// one cosign detects in the environment
+type SignConfig struct {
+	Binary        string `yaml:"binary"`
+	Key           string `yaml:"key"`
+	Keyless       bool   `yaml:"keyless"`
+	IdentityToken string `yaml:"identity-token"`
+}
+
+//
+func (c *SignConfig) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Key != "" && c.Keyless {
+		return errors.New("'key' and 'keyless' are mutually exclusive")
+	}
+	if c.Key == "" && !c.Keyless {
+		return errors.New("either 'key' or 'keyless' needs to be set")
+	}
+	if c.IdentityToken != "" && !c.Keyless {
+		return errors.New("'identity-token' requires 'keyless'")
+	}
+
+	return nil
+}
+
+//
+func NewSigner(c *SignConfig) Signer {
+	return &signer{conf: c}
+}
+
+//
+type signer struct {
+	conf *SignConfig
+}
+
+// Sign signs the remote image with given ref and pushes the signature to the
+// image's repo; ref should point to a digest rather than a tag, so that the
+// signature is guaranteed to be for the image that was pushed; creds are
+// expected in the form {user}:{password}
+func (s *signer) Sign(ref, creds string, skipTLSVerify bool) error {
+
+	log.WithField("ref", ref).Info("signing image with cosign")
+
+	c := s.conf
+	args := []string{"sign", "--yes"}
+	if c.Key != "" {
+		args = append(args, "--key", c.Key)
+	}
+	if c.IdentityToken != "" {
+		args = append(args, "--identity-token", c.IdentityToken)
+	}
+
+	if err := run(c.Binary, ref, creds, skipTLSVerify, args...); err != nil {
+		return fmt.Errorf("error signing '%s': %v", ref, err)
+	}
+
+	return nil
+}
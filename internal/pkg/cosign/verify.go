@@ -0,0 +1,95 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package cosign
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+type Verifier interface {
+	Verify(ref, creds string, skipTLSVerify bool) error
+}
+
+// VerifyConfig describes how to verify cosign signatures of images; either a
+// public key, or for keyless signatures, the identity of the signer and the
+// OIDC issuer of that identity need to be set
+type VerifyConfig struct {
+	Binary   string `yaml:"binary"`
+	Key      string `yaml:"key"`
+	Identity string `yaml:"identity"`
+	Issuer   string `yaml:"issuer"`
+}
+
+//
+func (c *VerifyConfig) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Key != "" {
+		if c.Identity != "" || c.Issuer != "" {
+			return errors.New(
+				"'key' is mutually exclusive with 'identity' and 'issuer'")
+		}
+		return nil
+	}
+
+	if c.Identity == "" || c.Issuer == "" {
+		return errors.New(
+			"either 'key', or 'identity' and 'issuer' need to be set")
+	}
+
+	return nil
+}
+
+//
+func NewVerifier(c *VerifyConfig) Verifier {
+	return &verifier{conf: c}
+}
+
+//
+type verifier struct {
+	conf *VerifyConfig
+}
+
+// Verify verifies the signature of the remote image with given ref; creds are
+// expected in the form {user}:{password}
+func (v *verifier) Verify(ref, creds string, skipTLSVerify bool) error {
+
+	c := v.conf
+
+	log.WithField("ref", ref).Info("verifying image signature with cosign")
+
+	args := []string{"verify"}
+	if c.Key != "" {
+		args = append(args, "--key", c.Key)
+	} else {
+		args = append(args, "--certificate-identity", c.Identity,
+			"--certificate-oidc-issuer", c.Issuer)
+	}
+
+	if err := run(c.Binary, ref, creds, skipTLSVerify, args...); err != nil {
+		return fmt.Errorf("signature of '%s' did not verify: %v", ref, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,290 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// when hooks are run
+const (
+	PreSync  = "pre-sync"
+	PostSync = "post-sync"
+)
+
+// outcomes of a task run, for selecting post-sync hooks via 'on'
+const (
+	OnSuccess = "success"
+	OnFailure = "failure"
+	OnAlways  = "always"
+)
+
+//
+const defaultTimeout = time.Minute
+
+// Config holds the hooks of a task; pre-sync hooks are run before the task
+// syncs, and the task run fails if any of them fails, post-sync hooks are run
+// after the task synced
+type Config struct {
+	PreSync  []*Hook       `yaml:"pre-sync"`
+	PostSync []*Hook       `yaml:"post-sync"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// Hook is either a local command, or a webhook to which the result is posted
+// as JSON; the URL and header values may reference environment variables
+type Hook struct {
+	Command []string          `yaml:"command"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	On      string            `yaml:"on"`
+}
+
+//
+func (c *Config) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Timeout < 0 {
+		return errors.New("'timeout' must not be negative")
+	}
+
+	for ix, h := range c.PreSync {
+		if err := h.validate(false); err != nil {
+			return fmt.Errorf("'%s' hook %d invalid: %v", PreSync, ix+1, err)
+		}
+	}
+	for ix, h := range c.PostSync {
+		if err := h.validate(true); err != nil {
+			return fmt.Errorf("'%s' hook %d invalid: %v", PostSync, ix+1, err)
+		}
+	}
+
+	return nil
+}
+
+//
+func (h *Hook) validate(post bool) error {
+
+	if h == nil {
+		return errors.New("no settings")
+	}
+
+	if len(h.Command) == 0 && h.URL == "" {
+		return errors.New("either 'command' or 'url' is required")
+	}
+	if len(h.Command) > 0 && h.URL != "" {
+		return errors.New("'command' and 'url' are mutually exclusive")
+	}
+	if len(h.Headers) > 0 && h.URL == "" {
+		return errors.New("'headers' require 'url'")
+	}
+
+	switch h.On {
+	case "":
+		if post {
+			h.On = OnSuccess
+		}
+	case OnSuccess, OnFailure, OnAlways:
+		if !post {
+			return fmt.Errorf("'on' is only supported for '%s' hooks", PostSync)
+		}
+	default:
+		return fmt.Errorf("invalid value for 'on': '%s', must be one of "+
+			"'%s', '%s', or '%s'", h.On, OnSuccess, OnFailure, OnAlways)
+	}
+
+	return nil
+}
+
+// Result describes the task run a hook is run for; for pre-sync hooks, only
+// hook, task, and time are set
+type Result struct {
+	Hook    string    `json:"hook"`
+	Task    string    `json:"task"`
+	Time    time.Time `json:"time"`
+	Status  string    `json:"status,omitempty"`
+	Seconds float64   `json:"durationSeconds,omitempty"`
+	Images  int       `json:"images"`
+	Tags    int       `json:"tags"`
+	Errors  []string  `json:"errors,omitempty"`
+}
+
+// env returns the result as environment variables for hook commands
+func (r *Result) env() []string {
+	ret := []string{
+		"DREGSY_HOOK=" + r.Hook,
+		"DREGSY_TASK=" + r.Task,
+	}
+	if r.Hook == PostSync {
+		ret = append(ret,
+			"DREGSY_STATUS="+r.Status,
+			"DREGSY_DURATION_SECONDS="+
+				strconv.FormatFloat(r.Seconds, 'f', 3, 64),
+			"DREGSY_IMAGES="+strconv.Itoa(r.Images),
+			"DREGSY_TAGS="+strconv.Itoa(r.Tags),
+			"DREGSY_ERRORS="+strconv.Itoa(len(r.Errors)))
+	}
+	return ret
+}
+
+// Runner runs the hooks of a task; all methods are safe to call on a nil
+// *Runner, in which case they do nothing
+type Runner struct {
+	conf   *Config
+	client *http.Client
+}
+
+// New creates a runner for the given hooks; returns nil if there are none
+func New(conf *Config) *Runner {
+
+	if conf == nil || len(conf.PreSync)+len(conf.PostSync) == 0 {
+		return nil
+	}
+
+	timeout := conf.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	return &Runner{
+		conf:   conf,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// PreSync runs the pre-sync hooks for the given task in order, and stops at
+// the first hook that fails
+func (r *Runner) PreSync(ctx context.Context, task string) error {
+
+	if r == nil {
+		return nil
+	}
+
+	res := &Result{Hook: PreSync, Task: task, Time: time.Now().UTC()}
+	for ix, h := range r.conf.PreSync {
+		if err := r.run(ctx, h, res); err != nil {
+			return fmt.Errorf("'%s' hook %d failed: %v", PreSync, ix+1, err)
+		}
+	}
+	return nil
+}
+
+// PostSync runs the post-sync hooks selected by the outcome of the task run
+// described by res; all selected hooks are run, and their errors are returned
+// together
+func (r *Runner) PostSync(ctx context.Context, res *Result) error {
+
+	if r == nil {
+		return nil
+	}
+
+	res.Hook = PostSync
+	var errs []string
+
+	for ix, h := range r.conf.PostSync {
+		if h.On != OnAlways && h.On != res.Status {
+			continue
+		}
+		if err := r.run(ctx, h, res); err != nil {
+			errs = append(errs,
+				fmt.Sprintf("'%s' hook %d failed: %v", PostSync, ix+1, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+//
+func (r *Runner) run(ctx context.Context, h *Hook, res *Result) error {
+
+	ctx, cancel := context.WithTimeout(ctx, r.client.Timeout)
+	defer cancel()
+
+	logger := log.WithFields(log.Fields{"task": res.Task, "hook": res.Hook})
+
+	if h.URL != "" {
+		logger.WithField("url", h.URL).Debug("calling webhook")
+		return r.post(ctx, h, res)
+	}
+
+	logger.WithField("command", h.Command[0]).Debug("running command")
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), res.env()...)
+
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		logger.Debug(strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("command '%s': %v", h.Command[0], err)
+	}
+	return nil
+}
+
+//
+func (r *Runner) post(ctx context.Context, h *Hook, res *Result) error {
+
+	body, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.URL,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestValidate(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var c *Config
+	th.AssertNoError(c.Validate())
+
+	c = &Config{PostSync: []*Hook{{URL: "http://example.com"}}}
+	th.AssertNoError(c.Validate())
+	th.AssertEqual(OnSuccess, c.PostSync[0].On)
+
+	tryConfig := func(c *Config, expected string) {
+		th.AssertError(c.Validate(), expected)
+	}
+
+	tryConfig(&Config{PreSync: []*Hook{{}}},
+		"'pre-sync' hook 1 invalid: either 'command' or 'url' is required")
+	tryConfig(&Config{PostSync: []*Hook{
+		{URL: "http://example.com"},
+		{Command: []string{"true"}, URL: "http://example.com"}}},
+		"'post-sync' hook 2 invalid: 'command' and 'url' are mutually "+
+			"exclusive")
+	tryConfig(&Config{PreSync: []*Hook{{Command: []string{"true"},
+		Headers: map[string]string{"X-Token": "secret"}}}},
+		"'headers' require 'url'")
+	tryConfig(&Config{PreSync: []*Hook{{Command: []string{"true"},
+		On: OnFailure}}},
+		"'on' is only supported for 'post-sync' hooks")
+	tryConfig(&Config{PostSync: []*Hook{{Command: []string{"true"},
+		On: "never"}}},
+		"invalid value for 'on': 'never'")
+	tryConfig(&Config{Timeout: -time.Second}, "'timeout' must not be negative")
+}
+
+//
+func TestCommand(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNil(New(nil))
+	th.AssertNil(New(&Config{Timeout: time.Second}))
+
+	out := filepath.Join(t.TempDir(), "env")
+	conf := &Config{
+		PreSync: []*Hook{{Command: []string{
+			"sh", "-c", "echo $DREGSY_HOOK $DREGSY_TASK > " + out}}},
+		PostSync: []*Hook{
+			{Command: []string{"sh", "-c", "echo $DREGSY_HOOK $DREGSY_TASK " +
+				"$DREGSY_STATUS $DREGSY_IMAGES $DREGSY_TAGS $DREGSY_ERRORS " +
+				">> " + out}},
+			{Command: []string{"sh", "-c", "echo failed >> " + out},
+				On: OnFailure},
+		},
+	}
+	th.AssertNoError(conf.Validate())
+	r := New(conf)
+
+	th.AssertNoError(r.PreSync(context.Background(), "mirror"))
+	th.AssertNoError(r.PostSync(context.Background(), &Result{
+		Task: "mirror", Status: OnSuccess, Images: 2, Tags: 5}))
+
+	data, err := ioutil.ReadFile(out)
+	th.AssertNoError(err)
+	th.AssertEqual("pre-sync mirror\npost-sync mirror success 2 5 0\n",
+		string(data))
+
+	// pre-sync stops at first failing hook
+	conf.PreSync = []*Hook{
+		{Command: []string{"sh", "-c", "echo purge failed; exit 3"}},
+		{Command: []string{"sh", "-c", "echo second >> " + out}},
+	}
+	th.AssertError(r.PreSync(context.Background(), "mirror"),
+		"'pre-sync' hook 1 failed: command 'sh': exit status 3")
+	data, err = ioutil.ReadFile(out)
+	th.AssertNoError(err)
+	th.AssertFalse(strings.Contains(string(data), "second"))
+
+	// timeout
+	conf.PreSync = []*Hook{{Command: []string{"sleep", "5"}}}
+	r = New(&Config{PreSync: conf.PreSync, Timeout: 100 * time.Millisecond})
+	th.AssertError(r.PreSync(context.Background(), "mirror"),
+		"context deadline exceeded")
+}
+
+//
+func TestWebhook(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var bodies []*Result
+	var tokens []string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			res := &Result{}
+			json.NewDecoder(req.Body).Decode(res)
+			bodies = append(bodies, res)
+			tokens = append(tokens, req.Header.Get("X-Token"))
+			w.WriteHeader(status)
+		}))
+	defer server.Close()
+
+	conf := &Config{PostSync: []*Hook{
+		{URL: server.URL, Headers: map[string]string{
+			"X-Token": "secret"}},
+		{URL: server.URL + "/always", On: OnAlways},
+	}}
+	th.AssertNoError(conf.Validate())
+	r := New(conf)
+
+	th.AssertNoError(r.PostSync(context.Background(), &Result{
+		Task: "mirror", Status: OnFailure, Images: 1,
+		Errors: []string{"push failed"}}))
+	th.AssertEqual(1, len(bodies))
+	th.AssertEqual(PostSync, bodies[0].Hook)
+	th.AssertEqual("mirror", bodies[0].Task)
+	th.AssertEqualSlices([]string{"push failed"}, bodies[0].Errors)
+	th.AssertEqual("", tokens[0])
+
+	th.AssertNoError(r.PostSync(context.Background(), &Result{
+		Task: "mirror", Status: OnSuccess}))
+	th.AssertEqual(3, len(bodies))
+	th.AssertEqual("secret", tokens[1])
+
+	// all hooks are run, errors are collected
+	status = http.StatusBadGateway
+	err := r.PostSync(context.Background(), &Result{
+		Task: "mirror", Status: OnSuccess})
+	th.AssertError(err, "'post-sync' hook 1 failed: webhook responded with "+
+		"status 502 Bad Gateway; 'post-sync' hook 2 failed")
+	th.AssertEqual(5, len(bodies))
+}
@@ -0,0 +1,182 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package kube
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client is a minimal client for the Kubernetes API, scoped to a single
+// namespace, just covering what dregsy needs
+type Client struct {
+	server    string
+	namespace string
+	tokenFile string // re-read for each request, since tokens get rotated
+	client    *http.Client
+}
+
+// NewClient creates a client for the API server at given URL, using the given
+// HTTP client
+func NewClient(server, namespace string, client *http.Client) *Client {
+	return &Client{
+		server:    strings.TrimSuffix(server, "/"),
+		namespace: namespace,
+		client:    client,
+	}
+}
+
+// NewInClusterClient creates a client for the API server of the cluster in
+// which dregsy is running, authenticating with the pod's service account; if
+// namespace is empty, the namespace of the pod is used
+func NewInClusterClient(namespace string) (*Client, error) {
+
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running inside a Kubernetes cluster, " +
+			"KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT not set")
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read cluster CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no valid cluster CA certificate found")
+	}
+
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(
+			filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine namespace: %v", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	c := NewClient("https://"+net.JoinHostPort(host, port), namespace,
+		&http.Client{Transport: transport})
+	c.tokenFile = filepath.Join(serviceAccountDir, "token")
+
+	return c, nil
+}
+
+//
+func (c *Client) Namespace() string {
+	return c.namespace
+}
+
+// Path returns the API path of the namespaced resource with given group,
+// version, resource type, and name; for the core group, group is empty; when
+// name is empty, the path of the resource type is returned
+func (c *Client) Path(group, version, resource, name string) string {
+	api := "/apis/" + group
+	if group == "" {
+		api = "/api"
+	}
+	p := fmt.Sprintf("%s/%s/namespaces/%s/%s",
+		api, version, url.PathEscape(c.namespace), resource)
+	if name != "" {
+		p += "/" + url.PathEscape(name)
+	}
+	return p
+}
+
+// StatusError is returned by Do when the API server does not indicate success
+type StatusError struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+//
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API server returned %s: %s", e.Status, e.Message)
+}
+
+// IsStatus returns true if err is a StatusError with given status code
+func IsStatus(err error, code int) bool {
+	var serr *StatusError
+	return errors.As(err, &serr) && serr.Code == code
+}
+
+// Do sends a request to the API server, and returns the response if it
+// indicates success, or a StatusError otherwise; the caller needs to close
+// the response body
+func (c *Client) Do(ctx context.Context, method, path string,
+	query url.Values, body io.Reader, contentType string) (
+	*http.Response, error) {
+
+	u := c.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if c.tokenFile != "" {
+		token, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read service account token: %v", err)
+		}
+		req.Header.Set("Authorization",
+			"Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &StatusError{
+			Code:    resp.StatusCode,
+			Status:  resp.Status,
+			Message: strings.TrimSpace(string(msg)),
+		}
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,144 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package leader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//
+type leaseRecord struct {
+	Holder        string    `json:"holder"`
+	RenewTime     time.Time `json:"renewTime"`
+	LeaseDuration float64   `json:"leaseDurationSeconds"`
+}
+
+// fileLock is a lock held with a lease file on storage shared by all
+// instances; the file is replaced atomically, and read back after writing to
+// detect concurrent takeovers; this is best effort, so when running on
+// Kubernetes, prefer the Lease based lock
+type fileLock struct {
+	path     string
+	observed observation
+}
+
+//
+func newFileLock(path string) *fileLock {
+	return &fileLock{path: path}
+}
+
+//
+func (l *fileLock) String() string {
+	return "file " + l.path
+}
+
+//
+func (l *fileLock) tryAcquire(identity string, duration time.Duration) (
+	bool, error) {
+
+	current, err := l.read()
+	if err != nil {
+		return false, err
+	}
+
+	if current != nil && current.Holder != identity {
+		expired := l.observed.expired(
+			current.Holder+"@"+current.RenewTime.String(),
+			time.Duration(current.LeaseDuration*float64(time.Second)))
+		if current.Holder != "" && !expired {
+			return false, nil
+		}
+	}
+
+	if err := l.write(&leaseRecord{
+		Holder:        identity,
+		RenewTime:     time.Now().UTC(),
+		LeaseDuration: duration.Seconds(),
+	}); err != nil {
+		return false, err
+	}
+
+	if current, err = l.read(); err != nil {
+		return false, err
+	}
+	return current != nil && current.Holder == identity, nil
+}
+
+//
+func (l *fileLock) release(identity string) error {
+
+	current, err := l.read()
+	if err != nil || current == nil || current.Holder != identity {
+		return err
+	}
+
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove lease file: %v", err)
+	}
+	return nil
+}
+
+// read reads the lease file; returns nil if there is none
+func (l *fileLock) read() (*leaseRecord, error) {
+
+	data, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read lease file: %v", err)
+	}
+
+	ret := &leaseRecord{}
+	if err := json.Unmarshal(data, ret); err != nil {
+		return nil, fmt.Errorf("lease file corrupt: %v", err)
+	}
+	return ret, nil
+}
+
+// write replaces the lease file atomically, via a temporary file
+func (l *fileLock) write(r *leaseRecord) error {
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(l.path), ".dregsy-lease-")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary lease file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write lease file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot write lease file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return fmt.Errorf("cannot replace lease file '%s': %v", l.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package leader
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	gosync "sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/kube"
+)
+
+// kinds of locks for electing the leader
+const (
+	LockKubernetes = "kubernetes"
+	LockFile       = "file"
+)
+
+//
+const (
+	defaultLeaseName     = "dregsy"
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewInterval = 5 * time.Second
+)
+
+// Config sets how to elect a leader among several dregsy instances; only the
+// leader runs tasks, while the others stand by; the lease is held with either
+// a Kubernetes Lease object, or a lease file on storage shared by all instances
+type Config struct {
+	Lock          string        `yaml:"lock"`
+	Name          string        `yaml:"name"`
+	Namespace     string        `yaml:"namespace"`
+	File          string        `yaml:"file"`
+	Identity      string        `yaml:"identity"`
+	LeaseDuration time.Duration `yaml:"lease-duration"`
+	RenewInterval time.Duration `yaml:"renew-interval"`
+}
+
+//
+func (c *Config) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	switch c.Lock {
+	case LockKubernetes:
+		if c.Name == "" {
+			c.Name = defaultLeaseName
+		}
+	case LockFile:
+		if c.File == "" {
+			return fmt.Errorf("'file' is required for lock '%s'", LockFile)
+		}
+	default:
+		return fmt.Errorf("invalid lock: '%s', must be '%s' or '%s'",
+			c.Lock, LockKubernetes, LockFile)
+	}
+
+	if c.LeaseDuration < 0 || c.RenewInterval < 0 {
+		return errors.New(
+			"'lease-duration' and 'renew-interval' must not be negative")
+	}
+	if c.LeaseDuration == 0 {
+		c.LeaseDuration = defaultLeaseDuration
+	}
+	if c.RenewInterval == 0 {
+		c.RenewInterval = defaultRenewInterval
+	}
+	if c.RenewInterval >= c.LeaseDuration {
+		return errors.New("'renew-interval' must be shorter than " +
+			"'lease-duration'")
+	}
+
+	return nil
+}
+
+// lock holds a lease on behalf of one instance at a time
+type lock interface {
+	// tryAcquire acquires or renews the lease for identity, and returns true
+	// if identity holds the lease afterwards
+	tryAcquire(identity string, duration time.Duration) (bool, error)
+	// release gives up the lease if held by identity, so that another
+	// instance can take over without waiting for the lease to expire
+	release(identity string) error
+	//
+	String() string
+}
+
+// observation tracks when the record of a lease was last seen changing; a
+// lease counts as expired when its record hasn't changed for the lease
+// duration, as observed with the local clock, so that clock skew between
+// instances does not matter
+type observation struct {
+	record string
+	at     time.Time
+}
+
+// expired updates the observation with given record, and returns true if the
+// record has not changed for at least duration
+func (o *observation) expired(record string, duration time.Duration) bool {
+	if record != o.record || o.at.IsZero() {
+		o.record = record
+		o.at = time.Now()
+		return false
+	}
+	return time.Since(o.at) >= duration
+}
+
+// Elector takes part in electing the leader among several dregsy instances;
+// all methods are safe to call on a nil *Elector, in which case this instance
+// is always the leader
+type Elector struct {
+	lock          lock
+	identity      string
+	leaseDuration time.Duration
+	renewInterval time.Duration
+	//
+	elected chan bool // closed once elected
+	lost    chan bool // closed when leadership was lost
+	stop    chan bool
+	done    chan bool
+	started bool
+	once    gosync.Once
+}
+
+// New creates an elector for given config; returns nil if config is nil
+func New(conf *Config) (*Elector, error) {
+
+	if conf == nil {
+		return nil, nil
+	}
+
+	e := &Elector{
+		identity:      conf.Identity,
+		leaseDuration: conf.LeaseDuration,
+		renewInterval: conf.RenewInterval,
+		elected:       make(chan bool),
+		lost:          make(chan bool),
+		stop:          make(chan bool),
+		done:          make(chan bool),
+	}
+
+	if e.identity == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine identity: %v", err)
+		}
+		e.identity = host
+	}
+
+	switch conf.Lock {
+	case LockKubernetes:
+		client, err := kube.NewInClusterClient(conf.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		e.lock = newLeaseLock(client, conf.Name)
+	case LockFile:
+		e.lock = newFileLock(conf.File)
+	}
+
+	return e, nil
+}
+
+// Start starts trying to acquire the lease in the background; once acquired,
+// the lease is renewed periodically
+func (e *Elector) Start() {
+
+	if e == nil {
+		return
+	}
+
+	log.WithFields(log.Fields{"identity": e.identity, "lock": e.lock}).Info(
+		"starting leader election")
+
+	e.started = true
+	go e.run()
+}
+
+//
+func (e *Elector) run() {
+
+	defer close(e.done)
+
+	leading := false
+	var renewed time.Time
+	ticker := time.NewTicker(e.renewInterval)
+	defer ticker.Stop()
+
+	for {
+		held, err := e.lock.tryAcquire(e.identity, e.leaseDuration)
+		if err != nil {
+			log.WithField("lock", e.lock).Warnf(
+				"cannot acquire or renew lease: %v", err)
+		}
+
+		switch {
+		case held && !leading:
+			log.WithField("identity", e.identity).Info("elected leader")
+			leading = true
+			renewed = time.Now()
+			close(e.elected)
+		case held:
+			renewed = time.Now()
+		case leading && (err == nil ||
+			time.Since(renewed) > e.leaseDuration):
+			// either someone else took over, or we could not renew in time,
+			// so someone else may take over any moment
+			log.WithField("identity", e.identity).Error(
+				"lost leadership")
+			close(e.lost)
+			return
+		}
+
+		select {
+		case <-e.stop:
+			if leading {
+				if err := e.lock.release(e.identity); err != nil {
+					log.WithField("lock", e.lock).Warnf(
+						"cannot release lease: %v", err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Elected returns a channel that is closed once this instance has become the
+// leader
+func (e *Elector) Elected() <-chan bool {
+	if e == nil {
+		c := make(chan bool)
+		close(c)
+		return c
+	}
+	return e.elected
+}
+
+// Lost returns a channel that is closed when this instance has lost its
+// leadership, and must not run tasks anymore
+func (e *Elector) Lost() <-chan bool {
+	if e == nil {
+		return nil
+	}
+	return e.lost
+}
+
+// Stop stops taking part in leader election, and releases the lease if held
+func (e *Elector) Stop() {
+	if e == nil || !e.started {
+		return
+	}
+	e.once.Do(func() {
+		close(e.stop)
+		<-e.done
+	})
+}
@@ -0,0 +1,245 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package leader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/kube"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestValidate(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var c *Config
+	th.AssertNoError(c.Validate())
+
+	c = &Config{Lock: LockKubernetes}
+	th.AssertNoError(c.Validate())
+	th.AssertEqual(defaultLeaseName, c.Name)
+	th.AssertEqual(defaultLeaseDuration, c.LeaseDuration)
+	th.AssertEqual(defaultRenewInterval, c.RenewInterval)
+
+	th.AssertError((&Config{Lock: "etcd"}).Validate(), "invalid lock: 'etcd'")
+	th.AssertError((&Config{Lock: LockFile}).Validate(),
+		"'file' is required for lock 'file'")
+	th.AssertError((&Config{Lock: LockKubernetes,
+		LeaseDuration: time.Second, RenewInterval: time.Second}).Validate(),
+		"'renew-interval' must be shorter than 'lease-duration'")
+	th.AssertError((&Config{Lock: LockKubernetes,
+		LeaseDuration: -time.Second}).Validate(), "must not be negative")
+}
+
+//
+func TestNilElector(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	e, err := New(nil)
+	th.AssertNoError(err)
+	th.AssertNil(e)
+
+	e.Start()
+	select {
+	case <-e.Elected():
+	default:
+		t.Fatal("nil elector not elected")
+	}
+	th.AssertTrue(e.Lost() == nil)
+	e.Stop()
+}
+
+// awaitClosed returns true if c gets closed within given timeout
+func awaitClosed(c <-chan bool, timeout time.Duration) bool {
+	select {
+	case <-c:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+//
+func TestFileElection(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-leader")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "lease")
+
+	newElector := func(id string) *Elector {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		conf := &Config{Lock: LockFile, File: file, Identity: id,
+			LeaseDuration: time.Second, RenewInterval: 50 * time.Millisecond}
+		th.AssertNoError(conf.Validate())
+		e, err := New(conf)
+		th.AssertNoError(err)
+		return e
+	}
+
+	one := newElector("one")
+	two := newElector("two")
+
+	one.Start()
+	th.AssertTrue(awaitClosed(one.Elected(), 2*time.Second))
+
+	two.Start()
+	th.AssertFalse(awaitClosed(two.Elected(), 300*time.Millisecond))
+
+	// releasing the lease lets the other instance take over right away
+	one.Stop()
+	th.AssertTrue(awaitClosed(two.Elected(), 2*time.Second))
+	th.AssertFalse(awaitClosed(two.Lost(), 200*time.Millisecond))
+
+	// someone else took over
+	data, err := json.Marshal(&leaseRecord{
+		Holder: "three", RenewTime: time.Now(), LeaseDuration: 10})
+	th.AssertNoError(err)
+	th.AssertNoError(ioutil.WriteFile(file, data, 0644))
+	th.AssertTrue(awaitClosed(two.Lost(), 2*time.Second))
+	two.Stop()
+}
+
+// newLeaseServer returns a fake API server holding a single Lease object,
+// rejecting updates with an outdated resource version
+func newLeaseServer() *httptest.Server {
+
+	var mutex gosync.Mutex
+	var current map[string]interface{}
+	version := 0
+
+	path := fmt.Sprintf("/apis/%s/%s/namespaces/default/%s",
+		leaseGroup, leaseVersion, leaseResource)
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			var obj map[string]interface{}
+			if req.Body != nil {
+				json.NewDecoder(req.Body).Decode(&obj)
+			}
+
+			switch {
+			case req.Method == http.MethodGet && req.URL.Path == path+"/dregsy":
+				if current == nil {
+					http.NotFound(w, req)
+					return
+				}
+			case req.Method == http.MethodPost && req.URL.Path == path:
+				if current != nil {
+					http.Error(w, "exists", http.StatusConflict)
+					return
+				}
+				current = obj
+			case req.Method == http.MethodPut && req.URL.Path == path+"/dregsy":
+				meta := obj["metadata"].(map[string]interface{})
+				if current == nil || meta["resourceVersion"] !=
+					fmt.Sprint(version) {
+					http.Error(w, "conflict", http.StatusConflict)
+					return
+				}
+				current = obj
+			default:
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+
+			if req.Method != http.MethodGet {
+				version++
+				meta := current["metadata"].(map[string]interface{})
+				meta["resourceVersion"] = fmt.Sprint(version)
+			}
+			json.NewEncoder(w).Encode(current)
+		}))
+}
+
+//
+func TestLeaseLock(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := newLeaseServer()
+	defer srv.Close()
+
+	one := newLeaseLock(kube.NewClient(srv.URL, "default", srv.Client()),
+		"dregsy")
+	two := newLeaseLock(kube.NewClient(srv.URL, "default", srv.Client()),
+		"dregsy")
+
+	held, err := one.tryAcquire("one", time.Second)
+	th.AssertNoError(err)
+	th.AssertTrue(held)
+
+	held, err = two.tryAcquire("two", time.Second)
+	th.AssertNoError(err)
+	th.AssertFalse(held)
+
+	held, err = one.tryAcquire("one", time.Second)
+	th.AssertNoError(err)
+	th.AssertTrue(held)
+
+	// a lease not renewed for its duration can be taken over
+	held, err = two.tryAcquire("two", time.Second)
+	th.AssertNoError(err)
+	th.AssertFalse(held)
+	time.Sleep(1100 * time.Millisecond)
+	held, err = two.tryAcquire("two", time.Second)
+	th.AssertNoError(err)
+	th.AssertTrue(held)
+
+	held, err = one.tryAcquire("one", time.Second)
+	th.AssertNoError(err)
+	th.AssertFalse(held)
+
+	// an update based on an outdated version is rejected
+	stale, err := one.get()
+	th.AssertNoError(err)
+	held, err = two.tryAcquire("two", time.Second)
+	th.AssertNoError(err)
+	th.AssertTrue(held)
+	th.AssertTrue(kube.IsStatus(
+		one.send(http.MethodPut, "dregsy", stale), http.StatusConflict))
+
+	// releasing lets the other instance take over right away
+	th.AssertNoError(two.release("two"))
+	held, err = one.tryAcquire("one", time.Second)
+	th.AssertNoError(err)
+	th.AssertTrue(held)
+
+	l, err := one.get()
+	th.AssertNoError(err)
+	th.AssertEqual("one", l.Spec.HolderIdentity)
+	th.AssertEqual(2, l.Spec.LeaseTransitions)
+}
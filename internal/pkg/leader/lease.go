@@ -0,0 +1,185 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package leader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/kube"
+)
+
+//
+const (
+	leaseGroup      = "coordination.k8s.io"
+	leaseVersion    = "v1"
+	leaseResource   = "leases"
+	microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+	requestTimeout  = 10 * time.Second
+)
+
+//
+type lease struct {
+	APIVersion string                 `json:"apiVersion"`
+	Kind       string                 `json:"kind"`
+	Metadata   map[string]interface{} `json:"metadata"`
+	Spec       leaseSpec              `json:"spec"`
+}
+
+//
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// leaseLock is a lock held with a Kubernetes Lease object; concurrent updates
+// are detected via the object's resource version
+type leaseLock struct {
+	client   *kube.Client
+	name     string
+	observed observation
+}
+
+//
+func newLeaseLock(client *kube.Client, name string) *leaseLock {
+	return &leaseLock{client: client, name: name}
+}
+
+//
+func (l *leaseLock) String() string {
+	return fmt.Sprintf("lease %s/%s", l.client.Namespace(), l.name)
+}
+
+//
+func (l *leaseLock) tryAcquire(identity string, duration time.Duration) (
+	bool, error) {
+
+	now := time.Now().UTC().Format(microTimeFormat)
+	seconds := int((duration + time.Second - 1) / time.Second)
+
+	current, err := l.get()
+	if kube.IsStatus(err, http.StatusNotFound) {
+		created := &lease{
+			APIVersion: leaseGroup + "/" + leaseVersion,
+			Kind:       "Lease",
+			Metadata:   map[string]interface{}{"name": l.name},
+			Spec: leaseSpec{
+				HolderIdentity:       identity,
+				LeaseDurationSeconds: seconds,
+				AcquireTime:          now,
+				RenewTime:            now,
+			},
+		}
+		err = l.send(http.MethodPost, "", created)
+		if kube.IsStatus(err, http.StatusConflict) {
+			return false, nil // someone else was faster
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	spec := &current.Spec
+	expired := l.observed.expired(spec.HolderIdentity+"@"+spec.RenewTime,
+		time.Duration(spec.LeaseDurationSeconds)*time.Second)
+
+	if spec.HolderIdentity != identity {
+		if spec.HolderIdentity != "" && !expired {
+			return false, nil
+		}
+		spec.AcquireTime = now
+		spec.LeaseTransitions++
+	}
+	spec.HolderIdentity = identity
+	spec.LeaseDurationSeconds = seconds
+	spec.RenewTime = now
+
+	err = l.send(http.MethodPut, l.name, current)
+	if kube.IsStatus(err, http.StatusConflict) {
+		return false, nil // updated concurrently
+	}
+	return err == nil, err
+}
+
+//
+func (l *leaseLock) release(identity string) error {
+
+	current, err := l.get()
+	if err != nil {
+		return err
+	}
+	if current.Spec.HolderIdentity != identity {
+		return nil
+	}
+
+	current.Spec.HolderIdentity = ""
+	current.Spec.LeaseDurationSeconds = 1
+	current.Spec.RenewTime = time.Now().UTC().Format(microTimeFormat)
+
+	return l.send(http.MethodPut, l.name, current)
+}
+
+//
+func (l *leaseLock) get() (*lease, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := l.client.Do(ctx, http.MethodGet, l.client.Path(
+		leaseGroup, leaseVersion, leaseResource, l.name), nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	ret := &lease{}
+	if err := json.NewDecoder(resp.Body).Decode(ret); err != nil {
+		return nil, fmt.Errorf("error decoding lease: %v", err)
+	}
+	return ret, nil
+}
+
+// send creates the lease via POST, or updates it via PUT; the resource version
+// contained in the lease's metadata makes the update fail with a conflict
+// when the lease was changed in the meantime
+func (l *leaseLock) send(method, name string, obj *lease) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	resp, err := l.client.Do(ctx, method, l.client.Path(
+		leaseGroup, leaseVersion, leaseResource, name), nil,
+		bytes.NewReader(body), "application/json")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
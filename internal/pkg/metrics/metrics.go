@@ -0,0 +1,241 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const namespace = "dregsy"
+const defaultPath = "/metrics"
+
+//
+type Config struct {
+	Listen string `yaml:"listen"`
+	Path   string `yaml:"path"`
+}
+
+//
+func (c *Config) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Listen == "" {
+		return errors.New("'listen' address is required")
+	}
+
+	if c.Path == "" {
+		c.Path = defaultPath
+	} else if !strings.HasPrefix(c.Path, "/") {
+		c.Path = "/" + c.Path
+	}
+
+	return nil
+}
+
+// Metrics holds the Prometheus metrics for a sync run; all methods are safe to
+// call on a nil *Metrics, in which case they do nothing
+type Metrics struct {
+	conf     *Config
+	registry *prometheus.Registry
+	mux      *http.ServeMux
+	server   *http.Server
+	//
+	duration    *prometheus.HistogramVec
+	images      *prometheus.CounterVec
+	tags        *prometheus.CounterVec
+	bytes       *prometheus.CounterVec
+	errors      *prometheus.CounterVec
+	lastSuccess *prometheus.GaugeVec
+	credsExpiry *prometheus.GaugeVec
+}
+
+// New creates the metrics for given config; returns nil if config is nil
+func New(conf *Config) *Metrics {
+
+	if conf == nil {
+		return nil
+	}
+
+	m := &Metrics{
+		conf:     conf,
+		registry: prometheus.NewRegistry(),
+		mux:      http.NewServeMux(),
+
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "task_sync_duration_seconds",
+			Help:      "Duration of task sync runs in seconds.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+		}, []string{"task"}),
+
+		images: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "images_synced_total",
+			Help:      "Number of images synced.",
+		}, []string{"task"}),
+
+		tags: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tags_synced_total",
+			Help:      "Number of image tags synced.",
+		}, []string{"task"}),
+
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_synced_total",
+			Help:      "Compressed size of images synced in bytes.",
+		}, []string{"task"}),
+
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sync_errors_total",
+			Help:      "Number of errors during task sync runs.",
+		}, []string{"task"}),
+
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "task_last_success_timestamp_seconds",
+			Help:      "Unix time of the last task sync run without errors.",
+		}, []string{"task"}),
+
+		credsExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "credentials_expiry_timestamp_seconds",
+			Help:      "Unix time when current registry credentials expire.",
+		}, []string{"registry"}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.duration, m.images, m.tags, m.bytes, m.errors, m.lastSuccess,
+		m.credsExpiry)
+
+	return m
+}
+
+// Start starts the HTTP listener serving the metrics
+func (m *Metrics) Start() error {
+
+	if m == nil {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", m.conf.Listen)
+	if err != nil {
+		return fmt.Errorf(
+			"cannot listen for metrics on '%s': %v", m.conf.Listen, err)
+	}
+
+	m.mux.Handle(m.conf.Path,
+		promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	m.server = &http.Server{Handler: m.mux}
+
+	log.WithFields(log.Fields{
+		"listen": l.Addr().String(), "path": m.conf.Path}).Info(
+		"serving metrics")
+
+	go func() {
+		if err := m.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("metrics listener failed: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Handle serves the given handler for path alongside the metrics; needs to be
+// called before Start
+func (m *Metrics) Handle(path string, h http.Handler) {
+	if m == nil {
+		return
+	}
+	m.mux.Handle(path, h)
+}
+
+//
+func (m *Metrics) Stop() {
+	if m == nil || m.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.server.Shutdown(ctx); err != nil {
+		log.Warnf("error stopping metrics listener: %v", err)
+	}
+	m.server = nil
+}
+
+// TaskDone records the end of a sync run for given task
+func (m *Metrics) TaskDone(task string, d time.Duration, failed bool) {
+	if m == nil {
+		return
+	}
+	m.duration.WithLabelValues(task).Observe(d.Seconds())
+	if !failed {
+		m.lastSuccess.WithLabelValues(task).SetToCurrentTime()
+	}
+}
+
+// ImageSynced records that an image was synced for given task, with the given
+// number of tags; tags may be 0 if the number of tags is not known
+func (m *Metrics) ImageSynced(task string, tags int) {
+	if m == nil {
+		return
+	}
+	m.images.WithLabelValues(task).Inc()
+	m.tags.WithLabelValues(task).Add(float64(tags))
+}
+
+// BytesSynced records the given compressed size of images synced for given
+// task
+func (m *Metrics) BytesSynced(task string, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.bytes.WithLabelValues(task).Add(float64(bytes))
+}
+
+//
+func (m *Metrics) SyncError(task string) {
+	if m == nil {
+		return
+	}
+	m.errors.WithLabelValues(task).Inc()
+}
+
+// CredentialsExpiry records when the credentials for given registry expire
+func (m *Metrics) CredentialsExpiry(registry string, expiry time.Time) {
+	if m == nil {
+		return
+	}
+	m.credsExpiry.WithLabelValues(registry).Set(float64(expiry.Unix()))
+}
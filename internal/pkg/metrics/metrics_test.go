@@ -0,0 +1,59 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestMetrics(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var none *Metrics
+	none.ImageSynced("mirror", 1)
+	none.BytesSynced("mirror", 1024)
+	th.AssertNil(New(nil))
+
+	m := New(&Config{Listen: ":0"})
+	m.ImageSynced("mirror", 2)
+	m.BytesSynced("mirror", 1024)
+	m.BytesSynced("mirror", 512)
+	m.BytesSynced("other", 0)
+
+	families, err := m.registry.Gather()
+	th.AssertNoError(err)
+
+	counters := make(map[string]float64)
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			if c := metric.GetCounter(); c != nil &&
+				len(metric.GetLabel()) > 0 {
+				task := metric.GetLabel()[0].GetValue()
+				counters[f.GetName()+"/"+task] = c.GetValue()
+			}
+		}
+	}
+
+	th.AssertEqual(float64(1), counters["dregsy_images_synced_total/mirror"])
+	th.AssertEqual(float64(2), counters["dregsy_tags_synced_total/mirror"])
+	th.AssertEqual(float64(1536), counters["dregsy_bytes_synced_total/mirror"])
+	th.AssertEqual(float64(0), counters["dregsy_bytes_synced_total/other"])
+}
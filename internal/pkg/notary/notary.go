@@ -0,0 +1,96 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package notary
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+//
+const defaultBinary = "notary"
+
+// Server holds the settings for talking to a Notary server, common to
+// verification and signing
+type Server struct {
+	Binary   string `yaml:"binary"`
+	URL      string `yaml:"server"`
+	TrustDir string `yaml:"trust-dir"`
+}
+
+// run invokes notary with given args; creds for the Notary server are
+// expected in the form {user}:{password}; env holds additional environment
+// variables; returns what notary wrote to stdout
+func (s *Server) run(creds string, env []string, args ...string) (
+	string, error) {
+
+	binary := s.Binary
+	if binary == "" {
+		binary = defaultBinary
+	}
+
+	var global []string
+	if s.URL != "" {
+		global = append(global, "-s", s.URL)
+	}
+	if s.TrustDir != "" {
+		global = append(global, "-d", s.TrustDir)
+	}
+
+	cmd := exec.Command(binary, append(global, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	if creds != "" {
+		cmd.Env = append(cmd.Env, "NOTARY_AUTH="+
+			base64.StdEncoding.EncodeToString([]byte(creds)))
+	}
+
+	bufOut := new(bytes.Buffer)
+	bufErr := new(bytes.Buffer)
+	cmd.Stdout = bufOut
+	cmd.Stderr = bufErr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s, %v", strings.TrimSpace(bufErr.String()), err)
+	}
+
+	return bufOut.String(), nil
+}
+
+// splitRef splits the given ref into the globally unique name (GUN) under
+// which Notary keeps the trust data of the ref's repository, and its tag;
+// on Docker Hub, the GUN starts with 'docker.io', and official images are in
+// 'library'
+func splitRef(ref string) (gun, tag string) {
+
+	reg, path, tag := util.SplitRef(ref)
+
+	if registry.IsDockerHub(reg) {
+		reg = "docker.io"
+		if !strings.Contains(path, "/") {
+			path = "library/" + path
+		}
+	}
+
+	return reg + "/" + path, tag
+}
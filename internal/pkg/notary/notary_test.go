@@ -0,0 +1,121 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package notary
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestSplitRef(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, tc := range []struct{ ref, gun, tag string }{
+		{"registry.hub.docker.com/busybox:1.36", "docker.io/library/busybox",
+			"1.36"},
+		{"docker.io/acme/app:v1", "docker.io/acme/app", "v1"},
+		{"registry.acme.com:5000/team/app:v1",
+			"registry.acme.com:5000/team/app", "v1"},
+	} {
+		gun, tag := splitRef(tc.ref)
+		th.AssertEqual(tc.gun, gun)
+		th.AssertEqual(tc.tag, tag)
+	}
+}
+
+// fakeNotary creates a script standing in for the notary binary, which logs
+// its arguments and environment to a file, and prints out to stdout
+func fakeNotary(th *test.TestHelper, out string) (binary, log string) {
+
+	dir := th.TempDir()
+	binary = filepath.Join(dir, "notary")
+	log = filepath.Join(dir, "log")
+
+	script := "#!/bin/sh\necho \"$@\" >> " + log + "\n" +
+		"echo \"auth=$NOTARY_AUTH pass=$NOTARY_DELEGATION_PASSPHRASE\" >> " +
+		log + "\nprintf '" + out + "'\n"
+	th.AssertNoError(ioutil.WriteFile(binary, []byte(script), 0755))
+
+	return binary, log
+}
+
+//
+func TestVerify(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	binary, log := fakeNotary(th, "1.36 abcdef 527\\n")
+	v := NewVerifier(&VerifyConfig{Server: Server{
+		Binary: binary, URL: "https://notary.acme.com", TrustDir: "/trust"}})
+
+	th.AssertNoError(v.Verify("registry.acme.com/app:1.36", "sha256:abcdef",
+		"user:secret"))
+	th.AssertError(v.Verify("registry.acme.com/app:1.36", "sha256:fedcba", ""),
+		"signature of 'registry.acme.com/app:1.36' is for 'sha256:abcdef'")
+
+	b, err := ioutil.ReadFile(log)
+	th.AssertNoError(err)
+	lines := strings.Split(string(b), "\n")
+	th.AssertEqual("-s https://notary.acme.com -d /trust lookup "+
+		"registry.acme.com/app 1.36", lines[0])
+	th.AssertEqual("auth=dXNlcjpzZWNyZXQ= pass=", lines[1])
+}
+
+//
+func TestSign(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	binary, log := fakeNotary(th, "")
+
+	conf := &SignConfig{Server: Server{Binary: binary}, Key: "/keys/d.key",
+		Passphrase: "phrase"}
+	th.AssertNoError(conf.Validate())
+	th.AssertEqual(defaultRole, conf.Role)
+
+	s := NewSigner(conf)
+	for _, tag := range []string{"1.0", "2.0"} {
+		th.AssertNoError(s.Sign("registry.acme.com/app:"+tag,
+			"sha256:abcdef", 527, ""))
+	}
+	th.AssertError(s.Sign("registry.acme.com/app:3.0", "sha512:abcdef", 527,
+		""), "is not SHA256")
+
+	b, err := ioutil.ReadFile(log)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{
+		"key import /keys/d.key --role user",
+		"auth= pass=phrase",
+		"addhash registry.acme.com/app 1.0 527 --sha256 abcdef " +
+			"--roles targets/releases --publish",
+		"auth= pass=phrase",
+		"addhash registry.acme.com/app 2.0 527 --sha256 abcdef " +
+			"--roles targets/releases --publish",
+		"auth= pass=phrase",
+		"",
+	}, strings.Split(string(b), "\n"))
+
+	th.AssertError((&SignConfig{}).Validate(), "'key' needs to be set")
+	th.AssertError((&SignConfig{Key: "k", Role: "releases"}).Validate(),
+		"needs to be a delegation role")
+}
@@ -0,0 +1,116 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package notary
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+type Signer interface {
+	Sign(ref, digest string, size int64, creds string) error
+}
+
+// SignConfig describes how to sign images for Docker Content Trust with Notary
+// v1, using a delegation key; the delegation for 'role' with the key's public
+// key needs to have been added to the repository by its owner beforehand
+type SignConfig struct {
+	Server     `yaml:",inline"`
+	Key        string `yaml:"key"`
+	Role       string `yaml:"role"`
+	Passphrase string `yaml:"passphrase"`
+}
+
+// default delegation role, as used by 'docker trust signer add'
+const defaultRole = "targets/releases"
+
+//
+func (c *SignConfig) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Key == "" {
+		return errors.New("'key' needs to be set to a delegation key file")
+	}
+	if c.Role == "" {
+		c.Role = defaultRole
+	}
+	if !strings.HasPrefix(c.Role, "targets/") {
+		return fmt.Errorf(
+			"'role' needs to be a delegation role 'targets/...', not '%s'",
+			c.Role)
+	}
+
+	return nil
+}
+
+//
+func NewSigner(c *SignConfig) Signer {
+	return &signer{conf: c}
+}
+
+//
+type signer struct {
+	conf      *SignConfig
+	importKey sync.Once
+	importErr error
+}
+
+// Sign adds the manifest with given digest and size to the trust data of the
+// tag of given ref, and publishes it to the Notary server; creds for the
+// Notary server are expected in the form {user}:{password}
+func (s *signer) Sign(ref, digest string, size int64, creds string) error {
+
+	log.WithField("ref", ref).Info("signing image with notary")
+
+	c := s.conf
+	env := []string{"NOTARY_DELEGATION_PASSPHRASE=" + c.Passphrase}
+
+	// the delegation key needs to be in the trust dir only once
+	s.importKey.Do(func() {
+		if _, err := c.run("", env,
+			"key", "import", c.Key, "--role", "user"); err != nil {
+			s.importErr = fmt.Errorf("cannot import delegation key: %v", err)
+		}
+	})
+	if s.importErr != nil {
+		return s.importErr
+	}
+
+	if !strings.HasPrefix(digest, "sha256:") {
+		return fmt.Errorf("cannot sign '%s', digest '%s' is not SHA256",
+			ref, digest)
+	}
+
+	gun, tag := splitRef(ref)
+	if _, err := c.run(creds, env, "addhash", gun, tag,
+		strconv.FormatInt(size, 10),
+		"--sha256", strings.TrimPrefix(digest, "sha256:"),
+		"--roles", c.Role, "--publish"); err != nil {
+		return fmt.Errorf("error signing '%s': %v", ref, err)
+	}
+
+	return nil
+}
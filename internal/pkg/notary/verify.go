@@ -0,0 +1,83 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package notary
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+type Verifier interface {
+	Verify(ref, digest, creds string) error
+}
+
+// VerifyConfig describes how to verify Docker Content Trust signatures of
+// images with Notary v1; without 'server', Docker Hub's Notary server is used
+type VerifyConfig struct {
+	Server `yaml:",inline"`
+}
+
+//
+func NewVerifier(c *VerifyConfig) Verifier {
+	return &verifier{conf: c}
+}
+
+//
+type verifier struct {
+	conf *VerifyConfig
+}
+
+// Verify checks that the tag of the image with given ref is signed, and that
+// the signed target is the manifest with given digest, i.e. what is actually
+// going to be synced; creds for the Notary server are expected in the form
+// {user}:{password}
+func (v *verifier) Verify(ref, digest, creds string) error {
+
+	log.WithField("ref", ref).Info("verifying image signature with notary")
+
+	gun, tag := splitRef(ref)
+	out, err := v.conf.run(creds, nil, "lookup", gun, tag)
+	if err != nil {
+		return fmt.Errorf("signature of '%s' did not verify: %v", ref, err)
+	}
+
+	signed, err := parseLookup(out)
+	if err != nil {
+		return fmt.Errorf("signature of '%s' did not verify: %v", ref, err)
+	}
+
+	if "sha256:"+signed != digest {
+		return fmt.Errorf("signature of '%s' is for 'sha256:%s', but image "+
+			"has digest '%s'", ref, signed, digest)
+	}
+
+	return nil
+}
+
+// parseLookup returns the hex encoded SHA256 digest from the output of
+// 'notary lookup', which is of the form {tag} {digest} {size}
+func parseLookup(out string) (string, error) {
+	fields := strings.Fields(out)
+	if len(fields) != 3 {
+		return "", fmt.Errorf("unexpected output of notary lookup: '%s'",
+			strings.TrimSpace(out))
+	}
+	return fields[1], nil
+}
@@ -0,0 +1,282 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package notify
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+const emailTimeout = 10 * time.Second
+
+// how to secure the connection to the mail server
+const (
+	EmailTLSStartTLS = "starttls"
+	EmailTLSImplicit = "tls"
+	EmailTLSNone     = "none"
+)
+
+// EmailConfig sets the mail server to send notifications through, and the
+// recipients; username and password may reference environment variables
+type EmailConfig struct {
+	Host          string   `yaml:"host"`
+	Port          int      `yaml:"port"`
+	Username      string   `yaml:"username"`
+	Password      string   `yaml:"password"`
+	From          string   `yaml:"from"`
+	To            []string `yaml:"to"`
+	TLS           string   `yaml:"tls"`
+	SkipTLSVerify bool     `yaml:"skip-tls-verify"`
+}
+
+// validate checks the settings that are given; since task settings are merged
+// with the global ones, required settings are checked by complete
+func (c *EmailConfig) validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+
+	switch c.TLS {
+	case "", EmailTLSStartTLS, EmailTLSImplicit, EmailTLSNone:
+	default:
+		return fmt.Errorf(
+			"invalid value for 'tls': '%s', must be '%s', '%s', or '%s'",
+			c.TLS, EmailTLSStartTLS, EmailTLSImplicit, EmailTLSNone)
+	}
+
+	if c.From != "" {
+		if _, err := mail.ParseAddress(c.From); err != nil {
+			return fmt.Errorf("invalid 'from' address '%s': %v", c.From, err)
+		}
+	}
+
+	for _, to := range c.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid 'to' address '%s': %v", to, err)
+		}
+	}
+
+	return nil
+}
+
+//
+func (c *EmailConfig) complete() error {
+	if c == nil {
+		return nil
+	}
+	if c.Host == "" {
+		return errors.New("'host' is required")
+	}
+	if c.From == "" {
+		return errors.New("'from' is required")
+	}
+	if len(c.To) == 0 {
+		return errors.New("'to' is required")
+	}
+	return nil
+}
+
+// merge returns the settings resulting from overriding these settings with
+// the given ones; other than for the remaining channels, this is done per
+// field, so that a task can e.g. just set its own recipients
+func (c *EmailConfig) merge(override *EmailConfig) *EmailConfig {
+
+	if c == nil {
+		return override
+	}
+	if override == nil {
+		return c
+	}
+
+	ret := *c
+	if override.Host != "" {
+		ret.Host = override.Host
+	}
+	if override.Port != 0 {
+		ret.Port = override.Port
+	}
+	if override.Username != "" {
+		ret.Username = override.Username
+	}
+	if override.Password != "" {
+		ret.Password = override.Password
+	}
+	if override.From != "" {
+		ret.From = override.From
+	}
+	if override.To != nil {
+		ret.To = override.To
+	}
+	if override.TLS != "" {
+		ret.TLS = override.TLS
+	}
+	if override.SkipTLSVerify {
+		ret.SkipTLSVerify = true
+	}
+	return &ret
+}
+
+// email sends notifications as plain text mails via SMTP
+type email struct {
+	host     string
+	addr     string
+	username string
+	password string
+	from     string
+	to       []string
+	tls      string
+	tlsConf  *tls.Config
+}
+
+//
+func newEmail(conf *EmailConfig) *email {
+
+	e := &email{
+		host:     conf.Host,
+		username: conf.Username,
+		password: conf.Password,
+		from:     conf.From,
+		to:       conf.To,
+		tls:      conf.TLS,
+		tlsConf: &tls.Config{
+			ServerName:         conf.Host,
+			InsecureSkipVerify: conf.SkipTLSVerify,
+		},
+	}
+
+	if e.tls == "" {
+		e.tls = EmailTLSStartTLS
+	}
+
+	port := conf.Port
+	if port == 0 {
+		port = 25
+		if e.tls == EmailTLSImplicit {
+			port = 465
+		}
+	}
+	e.addr = net.JoinHostPort(conf.Host, strconv.Itoa(port))
+
+	return e
+}
+
+// send delivers the notification to all recipients; with 'starttls', the
+// connection is upgraded if the server supports it
+func (e *email) send(n *Notification) error {
+
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: emailTimeout}
+	if e.tls == EmailTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.addr, e.tlsConf)
+	} else {
+		conn, err = dialer.Dial("tcp", e.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot connect to mail server: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+
+	c, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("cannot connect to mail server: %v", err)
+	}
+	defer c.Close()
+
+	if e.tls == EmailTLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(e.tlsConf); err != nil {
+				return fmt.Errorf("STARTTLS failed: %v", err)
+			}
+		}
+	}
+
+	if e.username != "" {
+		auth := smtp.PlainAuth("", e.username, e.password, e.host)
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("authentication failed: %v", err)
+		}
+	}
+
+	if err := c.Mail(e.address(e.from)); err != nil {
+		return err
+	}
+	for _, to := range e.to {
+		if err := c.Rcpt(e.address(to)); err != nil {
+			return fmt.Errorf("recipient '%s' rejected: %v", to, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(e.message(n)); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// address returns the bare mail address of addr, which may include a name
+func (e *email) address(addr string) string {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		return a.Address
+	}
+	return addr
+}
+
+//
+func (e *email) message(n *Notification) []byte {
+
+	var b strings.Builder
+
+	header := func(k, v string) {
+		b.WriteString(k + ": " + v + "\r\n")
+	}
+
+	header("From", e.from)
+	header("To", strings.Join(e.to, ", "))
+	header("Subject", n.Title())
+	header("Date", n.Time.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(n.Text(), "\n", "\r\n"))
+	b.WriteString("\r\n")
+
+	return []byte(b.String())
+}
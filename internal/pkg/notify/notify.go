@@ -0,0 +1,226 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package notify
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// events to notify about
+const (
+	EventFailure  = "failure"
+	EventRecovery = "recovery"
+	EventSuccess  = "success"
+)
+
+//
+var defaultEvents = []string{EventFailure, EventRecovery}
+
+// Config sets which events to notify about, and via which channels; the
+// notify settings of a task override the global ones
+type Config struct {
+	Events  []string       `yaml:"events"`
+	Slack   *WebhookConfig `yaml:"slack"`
+	Teams   *WebhookConfig `yaml:"teams"`
+	Webhook *WebhookConfig `yaml:"webhook"`
+	Email   *EmailConfig   `yaml:"email"`
+}
+
+//
+func (c *Config) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	for _, e := range c.Events {
+		switch e {
+		case EventFailure, EventRecovery, EventSuccess:
+		default:
+			return fmt.Errorf(
+				"invalid event '%s', must be one of '%s', '%s', or '%s'",
+				e, EventFailure, EventRecovery, EventSuccess)
+		}
+	}
+
+	for name, w := range map[string]*WebhookConfig{
+		"slack": c.Slack, "teams": c.Teams, "webhook": c.Webhook} {
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("'%s' settings invalid: %v", name, err)
+		}
+	}
+
+	if err := c.Email.validate(); err != nil {
+		return fmt.Errorf("'email' settings invalid: %v", err)
+	}
+
+	return nil
+}
+
+// Complete checks whether the settings contain everything needed for sending
+// notifications; call this on the merged global and task settings
+func (c *Config) Complete() error {
+	if c == nil {
+		return nil
+	}
+	if err := c.Email.complete(); err != nil {
+		return fmt.Errorf("'email' settings incomplete: %v", err)
+	}
+	return nil
+}
+
+// Merge returns the settings resulting from overriding these settings with
+// the given ones; each setting that is set in override replaces the one here,
+// except for email, which is merged field by field
+func (c *Config) Merge(override *Config) *Config {
+
+	if c == nil {
+		return override
+	}
+	if override == nil {
+		return c
+	}
+
+	ret := *c
+	if override.Events != nil {
+		ret.Events = override.Events
+	}
+	if override.Slack != nil {
+		ret.Slack = override.Slack
+	}
+	if override.Teams != nil {
+		ret.Teams = override.Teams
+	}
+	if override.Webhook != nil {
+		ret.Webhook = override.Webhook
+	}
+	ret.Email = c.Email.merge(override.Email)
+	return &ret
+}
+
+// Notification describes the outcome of a task run
+type Notification struct {
+	Event    string        `json:"event"`
+	Task     string        `json:"task"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"-"`
+	Seconds  float64       `json:"durationSeconds"`
+	Images   int           `json:"images"`
+	Tags     int           `json:"tags"`
+	Errors   []string      `json:"errors,omitempty"`
+}
+
+// Title returns a one line description of the notification
+func (n *Notification) Title() string {
+	switch n.Event {
+	case EventFailure:
+		return fmt.Sprintf("dregsy task '%s' failed", n.Task)
+	case EventRecovery:
+		return fmt.Sprintf("dregsy task '%s' recovered", n.Task)
+	default:
+		return fmt.Sprintf("dregsy task '%s' succeeded", n.Task)
+	}
+}
+
+// Text returns the details of the notification
+func (n *Notification) Text() string {
+	ret := fmt.Sprintf("synced %d image(s) with %d tag(s) in %s",
+		n.Images, n.Tags, n.Duration.Round(time.Second))
+	if len(n.Errors) > 0 {
+		ret += fmt.Sprintf(", %d error(s):", len(n.Errors))
+		for _, e := range n.Errors {
+			ret += "\n- " + e
+		}
+	}
+	return ret
+}
+
+//
+type channel interface {
+	send(n *Notification) error
+}
+
+// Notifier sends notifications via the configured channels; all methods are
+// safe to call on a nil *Notifier, in which case they do nothing
+type Notifier struct {
+	events   map[string]bool
+	channels map[string]channel
+}
+
+// New creates a notifier for given config; returns nil if config is nil or
+// has no channels
+func New(conf *Config) *Notifier {
+
+	if conf == nil {
+		return nil
+	}
+
+	n := &Notifier{
+		events:   make(map[string]bool),
+		channels: make(map[string]channel),
+	}
+
+	events := conf.Events
+	if events == nil {
+		events = defaultEvents
+	}
+	for _, e := range events {
+		n.events[e] = true
+	}
+
+	if conf.Slack != nil {
+		n.channels["slack"] = newWebhook(conf.Slack, slackPayload)
+	}
+	if conf.Teams != nil {
+		n.channels["teams"] = newWebhook(conf.Teams, teamsPayload)
+	}
+	if conf.Webhook != nil {
+		n.channels["webhook"] = newWebhook(conf.Webhook, genericPayload)
+	}
+	if conf.Email != nil {
+		n.channels["email"] = newEmail(conf.Email)
+	}
+
+	if len(n.channels) == 0 {
+		return nil
+	}
+	return n
+}
+
+// Send sends the notification via all channels, if its event is to be
+// notified about; errors are logged
+func (n *Notifier) Send(note *Notification) {
+
+	if n == nil || !n.events[note.Event] {
+		return
+	}
+
+	note.Seconds = note.Duration.Seconds()
+
+	for name, c := range n.channels {
+		logger := log.WithFields(log.Fields{
+			"task": note.Task, "event": note.Event, "channel": name})
+		if err := c.send(note); err != nil {
+			logger.Errorf("cannot send notification: %v", err)
+		} else {
+			logger.Debug("notification sent")
+		}
+	}
+}
@@ -0,0 +1,286 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// receiver records the bodies and authorization headers of posted
+// notifications
+type receiver struct {
+	server *httptest.Server
+	bodies []map[string]interface{}
+	auth   []string
+	status int
+}
+
+//
+func newReceiver() *receiver {
+	r := &receiver{status: http.StatusOK}
+	r.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			data, _ := ioutil.ReadAll(req.Body)
+			body := make(map[string]interface{})
+			json.Unmarshal(data, &body)
+			r.bodies = append(r.bodies, body)
+			r.auth = append(r.auth, req.Header.Get("Authorization"))
+			w.WriteHeader(r.status)
+		}))
+	return r
+}
+
+// mailServer is a minimal SMTP server that records the recipients and data
+// of received mails
+type mailServer struct {
+	listener net.Listener
+	host     string
+	port     int
+	rcpts    []string
+	data     []string
+}
+
+//
+func newMailServer() (*mailServer, error) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	addr := l.Addr().(*net.TCPAddr)
+	m := &mailServer{listener: l, host: addr.IP.String(), port: addr.Port}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			m.serve(conn)
+		}
+	}()
+
+	return m, nil
+}
+
+//
+func (m *mailServer) serve(conn net.Conn) {
+
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			m.rcpts = append(m.rcpts,
+				strings.Trim(strings.TrimSpace(line)[8:], "<>"))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			m.data = append(m.data, data.String())
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+//
+func TestNotifier(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	slack := newReceiver()
+	defer slack.server.Close()
+	teams := newReceiver()
+	defer teams.server.Close()
+	generic := newReceiver()
+	defer generic.server.Close()
+
+	n := New(&Config{
+		Slack: &WebhookConfig{URL: slack.server.URL},
+		Teams: &WebhookConfig{URL: teams.server.URL},
+		Webhook: &WebhookConfig{URL: generic.server.URL,
+			Headers: map[string]string{
+				"Authorization": "Bearer s3cr3t"}},
+	})
+	th.AssertNotNil(n)
+
+	n.Send(&Notification{Event: EventFailure, Task: "mirror",
+		Duration: 90 * time.Second, Images: 1, Tags: 2,
+		Errors: []string{"pull failed"}})
+
+	th.AssertEqual(1, len(slack.bodies))
+	th.AssertEqual("*dregsy task 'mirror' failed*\n"+
+		"synced 1 image(s) with 2 tag(s) in 1m30s, 1 error(s):\n- pull failed",
+		slack.bodies[0]["text"])
+
+	th.AssertEqual(1, len(teams.bodies))
+	th.AssertEqual("MessageCard", teams.bodies[0]["@type"])
+	th.AssertEqual("dregsy task 'mirror' failed", teams.bodies[0]["title"])
+
+	th.AssertEqual(1, len(generic.bodies))
+	th.AssertEqual("failure", generic.bodies[0]["event"])
+	th.AssertEqual("mirror", generic.bodies[0]["task"])
+	th.AssertEqual(90.0, generic.bodies[0]["durationSeconds"])
+	th.AssertEqual("Bearer s3cr3t", generic.auth[0])
+
+	// success is not notified by default
+	n.Send(&Notification{Event: EventSuccess, Task: "mirror"})
+	th.AssertEqual(1, len(generic.bodies))
+	n.Send(&Notification{Event: EventRecovery, Task: "mirror"})
+	th.AssertEqual(2, len(generic.bodies))
+
+	// errors from the receiving end are only logged
+	generic.status = http.StatusInternalServerError
+	n.Send(&Notification{Event: EventFailure, Task: "mirror"})
+	th.AssertEqual(3, len(generic.bodies))
+
+	th.AssertNil(New(nil))
+	th.AssertNil(New(&Config{Events: []string{EventSuccess}}))
+	(*Notifier)(nil).Send(&Notification{Event: EventFailure})
+}
+
+//
+func TestEmail(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv, err := newMailServer()
+	th.AssertNoError(err)
+	defer srv.listener.Close()
+
+	global := &Config{Email: &EmailConfig{
+		Host: srv.host,
+		Port: srv.port,
+		From: "dregsy <dregsy@example.com>",
+		To:   []string{"ops@example.com"},
+	}}
+	task := &Config{Email: &EmailConfig{
+		To: []string{"team@example.com", "Lead <lead@example.com>"}}}
+
+	conf := global.Merge(task)
+	th.AssertNoError(conf.Validate())
+	th.AssertNoError(conf.Complete())
+	th.AssertEqual(srv.host, conf.Email.Host)
+
+	n := New(conf)
+	th.AssertNotNil(n)
+
+	n.Send(&Notification{Event: EventFailure, Task: "mirror",
+		Time: time.Now(), Duration: 5 * time.Second,
+		Errors: []string{"push failed"}})
+
+	th.AssertEqualSlices(
+		[]string{"team@example.com", "lead@example.com"}, srv.rcpts)
+	th.AssertEqual(1, len(srv.data))
+	th.AssertTrue(strings.Contains(srv.data[0],
+		"Subject: dregsy task 'mirror' failed\r\n"))
+	th.AssertTrue(strings.Contains(srv.data[0],
+		"To: team@example.com, Lead <lead@example.com>\r\n"))
+	th.AssertTrue(strings.Contains(srv.data[0], "\r\n- push failed\r\n"))
+
+	// success is not notified by default
+	n.Send(&Notification{Event: EventSuccess, Task: "mirror"})
+	th.AssertEqual(1, len(srv.data))
+
+	// errors when sending are only logged
+	New(&Config{Email: &EmailConfig{Host: srv.host, Port: closedPort(th),
+		From: "dregsy@example.com", To: []string{"ops@example.com"}}}).Send(
+		&Notification{Event: EventFailure, Task: "mirror"})
+}
+
+// closedPort returns a local port nobody is listening on
+func closedPort(th *test.TestHelper) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	th.AssertNoError(err)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	ret, _ := strconv.Atoi(port)
+	return ret
+}
+
+//
+func TestConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNoError((*Config)(nil).Validate())
+	th.AssertError((&Config{Events: []string{"done"}}).Validate(),
+		"invalid event 'done'")
+	th.AssertError((&Config{Teams: &WebhookConfig{}}).Validate(),
+		"'teams' settings invalid: 'url' is required")
+	th.AssertError((&Config{Email: &EmailConfig{TLS: "ssl"}}).Validate(),
+		"'email' settings invalid: invalid value for 'tls': 'ssl'")
+	th.AssertError((&Config{Email: &EmailConfig{To: []string{"x"}}}).Validate(),
+		"invalid 'to' address 'x'")
+	th.AssertError((&Config{Email: &EmailConfig{Host: "mail"}}).Complete(),
+		"'email' settings incomplete: 'from' is required")
+
+	global := &Config{
+		Events: []string{EventFailure},
+		Slack:  &WebhookConfig{URL: "https://slack.example.com"},
+	}
+	task := &Config{
+		Events:  []string{EventFailure, EventSuccess},
+		Webhook: &WebhookConfig{URL: "https://hooks.example.com"},
+	}
+
+	merged := global.Merge(task)
+	th.AssertEqualSlices(task.Events, merged.Events)
+	th.AssertEqual(global.Slack, merged.Slack)
+	th.AssertEqual(task.Webhook, merged.Webhook)
+	th.AssertNil(merged.Teams)
+
+	th.AssertEqual(global, global.Merge(nil))
+	th.AssertEqual(task, (*Config)(nil).Merge(task))
+}
@@ -0,0 +1,131 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+//
+const webhookTimeout = 10 * time.Second
+
+// WebhookConfig sets where to post notifications to; the URL and header
+// values may reference environment variables
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+//
+func (c *WebhookConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.URL == "" {
+		return errors.New("'url' is required")
+	}
+	return nil
+}
+
+// webhook posts notifications as JSON, in the format produced by payload
+type webhook struct {
+	url     string
+	headers map[string]string
+	payload func(n *Notification) interface{}
+	client  *http.Client
+}
+
+//
+func newWebhook(conf *WebhookConfig,
+	payload func(n *Notification) interface{}) *webhook {
+
+	w := &webhook{
+		url:     conf.URL,
+		headers: make(map[string]string),
+		payload: payload,
+		client:  &http.Client{Timeout: webhookTimeout},
+	}
+	for k, v := range conf.Headers {
+		w.headers[k] = v
+	}
+	return w
+}
+
+//
+func (w *webhook) send(n *Notification) error {
+
+	body, err := json.Marshal(w.payload(n))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
+
+// slackPayload formats the notification as a Slack message
+func slackPayload(n *Notification) interface{} {
+	return map[string]string{
+		"text": fmt.Sprintf("*%s*\n%s", n.Title(), n.Text()),
+	}
+}
+
+// teamsPayload formats the notification as a Microsoft Teams message card
+func teamsPayload(n *Notification) interface{} {
+	color := "2EB886"
+	if n.Event == EventFailure {
+		color = "D63232"
+	}
+	return map[string]string{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    n.Title(),
+		"title":      n.Title(),
+		"text":       n.Text(),
+		"themeColor": color,
+	}
+}
+
+// genericPayload posts the notification as it is
+func genericPayload(n *Notification) interface{} {
+	return n
+}
@@ -0,0 +1,143 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package operator
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/kube"
+)
+
+// API group, version, and resource of the DregsyTask custom resource
+const (
+	Group    = "dregsy.xelalexv.github.io"
+	Version  = "v1alpha1"
+	Resource = "dregsytasks"
+)
+
+//
+const requestTimeout = 30 * time.Second
+const watchTimeout = 5 * time.Minute
+
+// listTasks lists all DregsyTask resources, and returns them together with the
+// resource version of the list, for starting a watch
+func listTasks(c *kube.Client) ([]*DregsyTask, string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := c.Do(ctx, http.MethodGet,
+		c.Path(Group, Version, Resource, ""), nil, nil, "")
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing %s: %v", Resource, err)
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []*DregsyTask `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", fmt.Errorf("error decoding %s: %v", Resource, err)
+	}
+
+	return list.Items, list.Metadata.ResourceVersion, nil
+}
+
+//
+type event struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watchTasks watches DregsyTask resources starting at the given resource
+// version, and calls handle for each change; it returns when ctx is done, the
+// watch times out on the server, or an error occurs; the resource version of
+// the object passed to handle is the one up to which changes have been seen
+func watchTasks(ctx context.Context, c *kube.Client, version string,
+	handle func(typ string, t *DregsyTask) error) error {
+
+	query := url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {version},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(watchTimeout.Seconds()))},
+	}
+
+	resp, err := c.Do(ctx, http.MethodGet,
+		c.Path(Group, Version, Resource, ""), query, nil, "")
+	if err != nil {
+		return fmt.Errorf("error watching %s: %v", Resource, err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 4*1024*1024)
+
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("error decoding watch event: %v", err)
+		}
+		if e.Type == "ERROR" {
+			return fmt.Errorf("watch failed: %s", string(e.Object))
+		}
+		t := &DregsyTask{}
+		if err := json.Unmarshal(e.Object, t); err != nil {
+			return fmt.Errorf("error decoding watch event: %v", err)
+		}
+		if err := handle(e.Type, t); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
+
+// updateStatus replaces the status of the DregsyTask with given name
+func updateStatus(c *kube.Client, name string, status *TaskStatus) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(ctx, http.MethodPatch,
+		c.Path(Group, Version, Resource, name)+"/status", nil,
+		bytes.NewReader(body), "application/merge-patch+json")
+	if err != nil {
+		return fmt.Errorf("error updating status of '%s': %v", name, err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
@@ -0,0 +1,426 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	gosync "sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/xelalexv/dregsy/internal/pkg/kube"
+	"github.com/xelalexv/dregsy/internal/pkg/notify"
+	"github.com/xelalexv/dregsy/internal/pkg/sync"
+)
+
+// condition types and reasons reported in the status of a DregsyTask
+const (
+	ConditionReady  = "Ready"
+	ConditionSynced = "Synced"
+
+	ReasonAccepted      = "Accepted"
+	ReasonInvalidSpec   = "InvalidSpec"
+	ReasonSyncSucceeded = "SyncSucceeded"
+	ReasonSyncFailed    = "SyncFailed"
+)
+
+//
+const retryBackoff = 10 * time.Second
+
+// DregsyTask is a custom resource defining a sync task; its spec has the same
+// format as a task in the config file, except for the name, which is taken
+// from the resource
+type DregsyTask struct {
+	Metadata Metadata        `json:"metadata"`
+	Spec     json.RawMessage `json:"spec"`
+	Status   *TaskStatus     `json:"status,omitempty"`
+}
+
+//
+type Metadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	Generation      int64  `json:"generation,omitempty"`
+}
+
+// TaskStatus is the status of a DregsyTask, reflecting whether its spec was
+// accepted, and the outcome of its last run
+type TaskStatus struct {
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	LastRun            *time.Time  `json:"lastRun,omitempty"`
+	LastSuccess        *time.Time  `json:"lastSuccess,omitempty"`
+	Images             int         `json:"images"`
+	Tags               int         `json:"tags"`
+	Errors             []string    `json:"errors,omitempty"`
+	Conditions         []Condition `json:"conditions,omitempty"`
+}
+
+//
+type Condition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+// setCondition sets the given condition, replacing an existing condition of
+// the same type; the transition time is only updated when the condition's
+// status changes; returns true if anything changed
+func (s *TaskStatus) setCondition(c Condition) bool {
+	for ix, prev := range s.Conditions {
+		if prev.Type != c.Type {
+			continue
+		}
+		if prev.Status == c.Status && prev.Reason == c.Reason &&
+			prev.Message == c.Message {
+			return false
+		}
+		if prev.Status == c.Status {
+			c.LastTransitionTime = prev.LastTransitionTime
+		}
+		s.Conditions[ix] = c
+		return true
+	}
+	s.Conditions = append(s.Conditions, c)
+	return true
+}
+
+// Operator runs the tasks defined by DregsyTask resources, in addition to the
+// tasks contained in the config file, and reports their outcome back into the
+// resources' status
+type Operator struct {
+	client  *kube.Client
+	load    func() (*sync.SyncConfig, error) // loads the base config
+	version string                           // to resume watching from
+	tasks   map[string]*DregsyTask           // resources by name
+	status  map[string]*TaskStatus           // status by resource name
+	invalid map[string]error                 // resources with invalid spec
+	mutex   gosync.Mutex
+}
+
+// New creates an operator watching DregsyTask resources with given client;
+// load is used for loading the base config, which provides all settings
+// other than the tasks defined by resources
+func New(client *kube.Client, load func() (*sync.SyncConfig, error)) *Operator {
+	return &Operator{
+		client:  client,
+		load:    load,
+		tasks:   make(map[string]*DregsyTask),
+		status:  make(map[string]*TaskStatus),
+		invalid: make(map[string]error),
+	}
+}
+
+// Init lists the DregsyTask resources, and returns the initial config made up
+// of the base config and the tasks defined by the resources
+func (o *Operator) Init() (*sync.SyncConfig, error) {
+	if err := o.relist(); err != nil {
+		return nil, err
+	}
+	return o.config()
+}
+
+// Run runs the given sync with the given initial config, as returned by Init,
+// until the sync ends; while running, changes to DregsyTask resources are
+// applied to the sync via config reload
+func (o *Operator) Run(s *sync.Sync, conf *sync.SyncConfig) error {
+
+	s.EnableReload(o.config)
+	s.KeepRunning()
+	s.ObserveTasks(o.taskDone)
+	o.reportAccepted()
+
+	log.WithField("namespace", o.client.Namespace()).Info(
+		"watching DregsyTask resources")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		o.watch(ctx, s)
+		close(done)
+	}()
+	// stop watching as soon as the sync no longer accepts reloads
+	go func() {
+		select {
+		case <-s.Halted():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := s.SyncFromConfig(conf)
+	cancel()
+	<-done
+
+	return err
+}
+
+// relist replaces the known resources with the ones currently present
+func (o *Operator) relist() error {
+
+	items, version, err := listTasks(o.client)
+	if err != nil {
+		return err
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.tasks = make(map[string]*DregsyTask, len(items))
+	for _, t := range items {
+		o.tasks[t.Metadata.Name] = t
+	}
+	for name := range o.status {
+		if _, ok := o.tasks[name]; !ok {
+			delete(o.status, name)
+		}
+	}
+	o.version = version
+
+	return nil
+}
+
+// watch watches the DregsyTask resources until ctx is done, and reloads the
+// sync's config whenever a resource spec is added, changed, or removed
+func (o *Operator) watch(ctx context.Context, s *sync.Sync) {
+
+	for ctx.Err() == nil {
+
+		err := watchTasks(ctx, o.client, o.version,
+			func(typ string, t *DregsyTask) error {
+				if o.apply(typ, t) {
+					o.reload(ctx, s)
+				}
+				return nil
+			})
+
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+
+		log.Warnf("watching DregsyTask resources failed, relisting: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryBackoff):
+		}
+
+		if err := o.relist(); err != nil {
+			log.Errorf("cannot list DregsyTask resources: %v", err)
+			continue
+		}
+		o.reload(ctx, s)
+	}
+}
+
+// apply applies the given watch event to the known resources, and returns
+// true if a resource spec was added, changed, or removed
+func (o *Operator) apply(typ string, t *DregsyTask) bool {
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if t.Metadata.ResourceVersion != "" {
+		o.version = t.Metadata.ResourceVersion
+	}
+
+	name := t.Metadata.Name
+
+	switch typ {
+
+	case "ADDED", "MODIFIED":
+		prev, found := o.tasks[name]
+		o.tasks[name] = t
+		// status updates, including our own, don't change the generation
+		return !found || prev.Metadata.Generation != t.Metadata.Generation
+
+	case "DELETED":
+		delete(o.tasks, name)
+		delete(o.status, name)
+		delete(o.invalid, name)
+		return true
+	}
+
+	return false
+}
+
+//
+func (o *Operator) reload(ctx context.Context, s *sync.Sync) {
+	if err := s.Reload(ctx); err != nil {
+		log.Errorf("cannot apply DregsyTask changes: %v", err)
+		return
+	}
+	o.reportAccepted()
+}
+
+// config loads the base config, and adds the tasks defined by the known
+// resources; resources with an invalid spec are skipped, and reported as
+// such in their status
+func (o *Operator) config() (*sync.SyncConfig, error) {
+
+	conf, err := o.load()
+	if err != nil {
+		return nil, err
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	names := make([]string, 0, len(o.tasks))
+	for name := range o.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	o.invalid = make(map[string]error)
+
+	for _, name := range names {
+		t, err := parseTask(o.tasks[name])
+		if err == nil {
+			err = conf.AddTask(t)
+		}
+		if err != nil {
+			log.WithField("resource", name).Errorf(
+				"skipping DregsyTask with invalid spec: %v", err)
+			o.invalid[name] = err
+		}
+	}
+
+	return conf, nil
+}
+
+// parseTask creates a task from the spec of the given resource
+func parseTask(r *DregsyTask) (*sync.Task, error) {
+
+	if len(r.Spec) == 0 || string(r.Spec) == "null" {
+		return nil, errors.New("spec missing")
+	}
+
+	// JSON is valid YAML, so we can use the same decoding as for config files
+	t := &sync.Task{}
+	if err := yaml.UnmarshalStrict(r.Spec, t); err != nil {
+		return nil, fmt.Errorf("invalid spec: %v", err)
+	}
+	t.Name = r.Metadata.Name
+
+	return t, nil
+}
+
+// reportAccepted updates the status of all resources whose spec has not been
+// reported on yet, or whose validity has changed
+func (o *Operator) reportAccepted() {
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	for name, t := range o.tasks {
+
+		status := o.statusOf(t)
+		changed := status.ObservedGeneration != t.Metadata.Generation
+		status.ObservedGeneration = t.Metadata.Generation
+
+		c := Condition{
+			Type:               ConditionReady,
+			Status:             "True",
+			Reason:             ReasonAccepted,
+			Message:            "task is active",
+			LastTransitionTime: now,
+		}
+		if err := o.invalid[name]; err != nil {
+			c.Status = "False"
+			c.Reason = ReasonInvalidSpec
+			c.Message = err.Error()
+		}
+
+		if status.setCondition(c) || changed {
+			o.updateStatus(name, status)
+		}
+	}
+}
+
+// taskDone reports the outcome of a task run into the status of the resource
+// defining the task, if any
+func (o *Operator) taskDone(n *notify.Notification) {
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	t, ok := o.tasks[n.Task]
+	if !ok {
+		return // task from base config
+	}
+
+	status := o.statusOf(t)
+	now := n.Time.Truncate(time.Second)
+
+	status.LastRun = &now
+	status.Images = n.Images
+	status.Tags = n.Tags
+	status.Errors = n.Errors
+
+	c := Condition{
+		Type:               ConditionSynced,
+		Status:             "True",
+		Reason:             ReasonSyncSucceeded,
+		Message:            n.Text(),
+		LastTransitionTime: now,
+	}
+	if n.Event == notify.EventFailure {
+		c.Status = "False"
+		c.Reason = ReasonSyncFailed
+	} else {
+		status.LastSuccess = &now
+	}
+	status.setCondition(c)
+
+	o.updateStatus(n.Task, status)
+}
+
+// statusOf returns the status tracked for the given resource, starting out
+// with the status the resource already has
+func (o *Operator) statusOf(t *DregsyTask) *TaskStatus {
+	name := t.Metadata.Name
+	if status, ok := o.status[name]; ok {
+		return status
+	}
+	status := &TaskStatus{}
+	if t.Status != nil {
+		*status = *t.Status
+		status.Conditions = append([]Condition(nil), t.Status.Conditions...)
+	}
+	o.status[name] = status
+	return status
+}
+
+//
+func (o *Operator) updateStatus(name string, status *TaskStatus) {
+	if err := updateStatus(o.client, name, status); err != nil {
+		log.WithField("resource", name).Warnf(
+			"cannot update DregsyTask status: %v", err)
+	}
+}
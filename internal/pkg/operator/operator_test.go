@@ -0,0 +1,274 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/kube"
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/sync"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// statusUpdate is a status patch received by the fake API server
+type statusUpdate struct {
+	name   string
+	status *TaskStatus
+}
+
+// newAPIServer returns a fake API server that lists the given resources,
+// streams the events sent to the events channel to watchers, and hands status
+// patches over to the updates channel
+func newAPIServer(items []*DregsyTask, events chan *event,
+	updates chan *statusUpdate) *httptest.Server {
+
+	base := fmt.Sprintf("/apis/%s/%s/namespaces/default/%s",
+		Group, Version, Resource)
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+
+			switch {
+
+			case req.Method == http.MethodGet && req.URL.Path == base &&
+				req.URL.Query().Get("watch") == "true":
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				for {
+					select {
+					case e := <-events:
+						json.NewEncoder(w).Encode(e)
+						w.(http.Flusher).Flush()
+					case <-req.Context().Done():
+						return
+					}
+				}
+
+			case req.Method == http.MethodGet && req.URL.Path == base:
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"metadata": map[string]string{"resourceVersion": "1"},
+					"items":    items,
+				})
+
+			case req.Method == http.MethodPatch &&
+				strings.HasPrefix(req.URL.Path, base+"/") &&
+				strings.HasSuffix(req.URL.Path, "/status"):
+				if req.Header.Get("Content-Type") !=
+					"application/merge-patch+json" {
+					http.Error(w, "wrong content type", http.StatusBadRequest)
+					return
+				}
+				var patch struct {
+					Status *TaskStatus `json:"status"`
+				}
+				if err := json.NewDecoder(req.Body).Decode(&patch); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				name := strings.TrimSuffix(
+					strings.TrimPrefix(req.URL.Path, base+"/"), "/status")
+				updates <- &statusUpdate{name: name, status: patch.Status}
+				w.Write([]byte("{}"))
+
+			default:
+				http.NotFound(w, req)
+			}
+		}))
+}
+
+//
+func newDregsyTask(name string, generation int64, spec string) *DregsyTask {
+	return &DregsyTask{
+		Metadata: Metadata{
+			Name:            name,
+			Namespace:       "default",
+			ResourceVersion: fmt.Sprint(generation + 1),
+			Generation:      generation,
+		},
+		Spec: json.RawMessage(spec),
+	}
+}
+
+//
+func TestOperator(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	reg := httptest.NewServer(gocrregistry.New())
+	defer reg.Close()
+	host := strings.TrimPrefix(reg.URL, "http://")
+
+	img, err := gocrrandom.Image(256, 1)
+	th.AssertNoError(err)
+	ref, err := gocrname.NewTag(host + "/acme/app:1.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(ref, img))
+
+	spec := func(to string) string {
+		return fmt.Sprintf(`{"source": {"registry": "%s"},
+			"target": {"registry": "%s"},
+			"mappings": [{"from": "acme/app", "to": "%s", "tags": ["1.0"]}]}`,
+			host, host, to)
+	}
+
+	events := make(chan *event)
+	updates := make(chan *statusUpdate, 16)
+	api := newAPIServer([]*DregsyTask{
+		newDregsyTask("mirror", 1, spec("mirror/app")),
+		newDregsyTask("broken", 1, `{"nope": true}`),
+	}, events, updates)
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "dregsy-operator")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "config.yaml")
+	th.AssertNoError(ioutil.WriteFile(base, []byte("relay: direct\n"), 0644))
+
+	op := New(kube.NewClient(api.URL, "default", api.Client()),
+		func() (*sync.SyncConfig, error) { return sync.LoadConfig(base) })
+
+	conf, err := op.Init()
+	th.AssertNoError(err)
+	th.AssertEqual(1, len(conf.Tasks))
+	th.AssertEqual("mirror", conf.Tasks[0].Name)
+
+	s, err := sync.New(conf)
+	th.AssertNoError(err)
+
+	done := make(chan error)
+	go func() {
+		done <- op.Run(s, conf)
+	}()
+
+	// waitFor waits until the given condition has been reported for the
+	// resource with given name, and returns the reported status
+	waitFor := func(name, typ, status, reason string) *TaskStatus {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case u := <-updates:
+				if u.name != name {
+					continue
+				}
+				for _, c := range u.status.Conditions {
+					if c.Type == typ && c.Status == status &&
+						c.Reason == reason {
+						return u.status
+					}
+				}
+			case <-timeout:
+				t.Fatalf("no condition '%s' for '%s'", typ, name)
+				return nil
+			}
+		}
+	}
+
+	th.AssertTrue(strings.Contains(
+		waitFor("broken", ConditionReady, "False", ReasonInvalidSpec).
+			Conditions[0].Message, "field nope not found"))
+
+	status := waitFor("mirror", ConditionSynced, "True", ReasonSyncSucceeded)
+	th.AssertEqual(int64(1), status.ObservedGeneration)
+	th.AssertEqual(1, status.Images)
+	th.AssertEqual(1, status.Tags)
+	th.AssertNotNil(status.LastRun)
+	th.AssertNotNil(status.LastSuccess)
+
+	events <- &event{Type: "ADDED", Object: mustMarshal(t,
+		newDregsyTask("added", 1, spec("added/app")))}
+
+	status = waitFor("added", ConditionReady, "True", ReasonAccepted)
+	th.AssertEqual(int64(1), status.ObservedGeneration)
+	waitFor("added", ConditionSynced, "True", ReasonSyncSucceeded)
+
+	s.Shutdown()
+	th.AssertNoError(<-done)
+
+	// changes arriving after the sync has ended must not block
+	reloaded := make(chan bool)
+	go func() {
+		op.reload(context.Background(), s)
+		close(reloaded)
+	}()
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload blocked after sync has ended")
+	}
+	s.Dispose()
+
+	want, err := img.Digest()
+	th.AssertNoError(err)
+	for _, r := range []string{"/mirror/app:1.0", "/added/app:1.0"} {
+		got, err := registry.GetDigest(context.Background(), host+r, nil, false)
+		th.AssertNoError(err)
+		th.AssertEqual(want.String(), got)
+	}
+}
+
+//
+func TestSetCondition(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+
+	s := &TaskStatus{}
+	th.AssertTrue(s.setCondition(Condition{Type: ConditionSynced,
+		Status: "True", Reason: ReasonSyncSucceeded, LastTransitionTime: t0}))
+	th.AssertTrue(!s.setCondition(Condition{Type: ConditionSynced,
+		Status: "True", Reason: ReasonSyncSucceeded, LastTransitionTime: t1}))
+	th.AssertTrue(s.setCondition(Condition{Type: ConditionSynced,
+		Status: "True", Reason: ReasonSyncSucceeded, Message: "x",
+		LastTransitionTime: t1}))
+	th.AssertEqual(t0, s.Conditions[0].LastTransitionTime)
+	th.AssertTrue(s.setCondition(Condition{Type: ConditionSynced,
+		Status: "False", Reason: ReasonSyncFailed, LastTransitionTime: t1}))
+	th.AssertEqual(t1, s.Conditions[0].LastTransitionTime)
+	th.AssertTrue(s.setCondition(Condition{Type: ConditionReady,
+		Status: "True", Reason: ReasonAccepted, LastTransitionTime: t1}))
+	th.AssertEqual(2, len(s.Conditions))
+}
+
+//
+func mustMarshal(t *testing.T, v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
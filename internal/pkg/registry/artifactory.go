@@ -0,0 +1,125 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+)
+
+//
+const artifactoryTimeout = 30 * time.Second
+
+// ArtifactoryAPI holds what's needed for talking to the REST API of an
+// Artifactory instance; AccessToken takes precedence over APIKey, and if
+// neither is set, the basic credentials in Creds are used
+type ArtifactoryAPI struct {
+	URL         string
+	AccessToken string
+	APIKey      string
+	Creds       *auth.Credentials
+	Insecure    bool
+}
+
+//
+func (a *ArtifactoryAPI) do(method, path string, body []byte) (
+	*http.Response, error) {
+
+	req, err := http.NewRequest(method,
+		fmt.Sprintf("%s/api/%s", strings.TrimSuffix(a.URL, "/"), path),
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	switch {
+	case a.AccessToken != "":
+		req.Header.Set("Authorization", "Bearer "+a.AccessToken)
+	case a.APIKey != "":
+		req.Header.Set("X-JFrog-Art-Api", a.APIKey)
+	default:
+		setBasicAuth(req, a.Creds)
+	}
+
+	client := &http.Client{
+		Timeout: artifactoryTimeout, Transport: transport("", a.Insecure)}
+
+	return client.Do(req)
+}
+
+// EnsureArtifactoryRepo creates a local Docker repository with the given key,
+// if it doesn't exist yet
+func EnsureArtifactoryRepo(a *ArtifactoryAPI, key string) error {
+
+	path := "repositories/" + url.PathEscape(key)
+
+	res, err := a.do(http.MethodGet, path, nil)
+	if err != nil {
+		return fmt.Errorf("error checking for Artifactory repo '%s': %v",
+			key, err)
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusBadRequest:
+		// depending on version, Artifactory responds with 400 for missing repos
+	default:
+		return fmt.Errorf("checking for Artifactory repo '%s' failed with %d",
+			key, res.StatusCode)
+	}
+
+	b, err := json.Marshal(map[string]string{
+		"key":         key,
+		"rclass":      "local",
+		"packageType": "docker",
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"url": a.URL, "repo": key}).Info(
+		"creating Artifactory Docker repo")
+
+	res, err = a.do(http.MethodPut, path, b)
+	if err != nil {
+		return fmt.Errorf("error creating Artifactory repo '%s': %v", key, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("creating Artifactory repo '%s' failed with %d: %s",
+			key, res.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
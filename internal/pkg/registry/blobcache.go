@@ -0,0 +1,238 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gocrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// BlobCache keeps track of which repositories are known to hold which blobs,
+// so that blobs can be mounted from another repository of the target registry
+// instead of transferring them; repositories are given as {registry}/{repo}
+type BlobCache interface {
+	BlobRepos(digest string) []string
+	RecordBlobs(repo string, digests []string)
+}
+
+// memoryBlobCache is a BlobCache that's only kept in memory, for tasks that
+// have no state file
+type memoryBlobCache struct {
+	blobs map[string][]string
+	mutex sync.Mutex
+}
+
+// maximum number of repos kept per blob in a memory blob cache
+const maxBlobRepos = 8
+
+//
+func NewBlobCache() BlobCache {
+	return &memoryBlobCache{blobs: make(map[string][]string)}
+}
+
+//
+func (c *memoryBlobCache) BlobRepos(digest string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.blobs[digest]...)
+}
+
+//
+func (c *memoryBlobCache) RecordBlobs(repo string, digests []string) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, d := range digests {
+		repos := []string{repo}
+		for _, r := range c.blobs[d] {
+			if r != repo && len(repos) < maxBlobRepos {
+				repos = append(repos, r)
+			}
+		}
+		c.blobs[d] = repos
+	}
+}
+
+//
+type blobCacheKey struct{}
+
+// WithBlobCache returns a context that makes Copy use the given blob cache
+func WithBlobCache(ctx context.Context, cache BlobCache) context.Context {
+	return context.WithValue(ctx, blobCacheKey{}, cache)
+}
+
+//
+func blobCacheFrom(ctx context.Context) BlobCache {
+	if cache, ok := ctx.Value(blobCacheKey{}).(BlobCache); ok {
+		return cache
+	}
+	return nil
+}
+
+// recordBlobs records in cache that repo holds the layers of the given image
+// index or image
+func recordBlobs(cache BlobCache, repo gocrname.Repository,
+	idx gocrv1.ImageIndex, img gocrv1.Image) {
+
+	layers, err := collectLayers(idx, img)
+	if err != nil {
+		log.WithField("repo", repo.String()).Warnf(
+			"cannot record blobs: %v", err)
+		return
+	}
+
+	digests := make([]string, 0, len(layers))
+	for _, l := range layers {
+		if d, err := l.Digest(); err == nil {
+			digests = append(digests, d.String())
+		}
+	}
+
+	cache.RecordBlobs(repo.String(), digests)
+}
+
+// blobMounter turns layers into layers that can be mounted from another repo
+// of the target registry, if the cache knows of one holding them
+type blobMounter struct {
+	cache BlobCache
+	trgt  gocrname.Repository
+}
+
+//
+func (m *blobMounter) layer(l gocrv1.Layer) gocrv1.Layer {
+
+	d, err := l.Digest()
+	if err != nil {
+		return l
+	}
+
+	for _, r := range m.cache.BlobRepos(d.String()) {
+		if r == m.trgt.String() {
+			continue
+		}
+		repo, err := gocrname.NewRepository(r, nameOptions(r)...)
+		if err != nil || repo.RegistryStr() != m.trgt.RegistryStr() {
+			continue
+		}
+		if ml, ok := l.(*gocrremote.MountableLayer); ok {
+			l = ml.Layer
+		}
+		log.WithFields(log.Fields{"blob": d, "from": r}).Debug(
+			"blob may be mounted")
+		return &gocrremote.MountableLayer{
+			Layer: l, Reference: repo.Digest(d.String())}
+	}
+
+	return l
+}
+
+//
+func (m *blobMounter) image(img gocrv1.Image) gocrv1.Image {
+	return &mountingImage{Image: img, mounter: m}
+}
+
+//
+func (m *blobMounter) index(idx gocrv1.ImageIndex) gocrv1.ImageIndex {
+	return &mountingIndex{base: idx, mounter: m}
+}
+
+// mountingImage is an image whose layers are made mountable where possible
+type mountingImage struct {
+	gocrv1.Image
+	mounter *blobMounter
+}
+
+//
+func (i *mountingImage) Layers() ([]gocrv1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]gocrv1.Layer, 0, len(layers))
+	for _, l := range layers {
+		ret = append(ret, i.mounter.layer(l))
+	}
+	return ret, nil
+}
+
+//
+func (i *mountingImage) LayerByDigest(h gocrv1.Hash) (gocrv1.Layer, error) {
+	l, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.mounter.layer(l), nil
+}
+
+// mountingIndex is an image index whose images have their layers made
+// mountable where possible; since the ImageIndex method would collide with an
+// embedded ImageIndex, all methods are delegated explicitly
+type mountingIndex struct {
+	base    gocrv1.ImageIndex
+	mounter *blobMounter
+}
+
+//
+func (i *mountingIndex) MediaType() (gocrtypes.MediaType, error) {
+	return i.base.MediaType()
+}
+
+//
+func (i *mountingIndex) Digest() (gocrv1.Hash, error) {
+	return i.base.Digest()
+}
+
+//
+func (i *mountingIndex) Size() (int64, error) {
+	return i.base.Size()
+}
+
+//
+func (i *mountingIndex) IndexManifest() (*gocrv1.IndexManifest, error) {
+	return i.base.IndexManifest()
+}
+
+//
+func (i *mountingIndex) RawManifest() ([]byte, error) {
+	return i.base.RawManifest()
+}
+
+//
+func (i *mountingIndex) Image(h gocrv1.Hash) (gocrv1.Image, error) {
+	img, err := i.base.Image(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.mounter.image(img), nil
+}
+
+//
+func (i *mountingIndex) ImageIndex(h gocrv1.Hash) (gocrv1.ImageIndex, error) {
+	idx, err := i.base.ImageIndex(h)
+	if err != nil {
+		return nil, err
+	}
+	return i.mounter.index(idx), nil
+}
@@ -0,0 +1,154 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// mountingRegistry wraps the gocr in-memory registry, which keeps blobs
+// globally instead of per repo, and doesn't support mounting; it tracks which
+// repo holds which blobs, and counts mounts & uploads
+type mountingRegistry struct {
+	inner   http.Handler
+	blobs   map[string]bool // {repo}@{digest}
+	mounts  int
+	uploads int
+	mutex   sync.Mutex
+}
+
+//
+func (r *mountingRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	ix := strings.Index(req.URL.Path, "/blobs/")
+	if ix < 0 {
+		r.inner.ServeHTTP(w, req)
+		return
+	}
+	repo := strings.TrimPrefix(req.URL.Path[:ix], "/v2/")
+	q := req.URL.Query()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch req.Method {
+	case http.MethodHead:
+		digest := req.URL.Path[ix+len("/blobs/"):]
+		if !r.blobs[repo+"@"+digest] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	case http.MethodPost:
+		if d := q.Get("mount"); d != "" && r.blobs[q.Get("from")+"@"+d] {
+			r.blobs[repo+"@"+d] = true
+			r.mounts++
+			w.Header().Set("Location", "/v2/"+repo+"/blobs/"+d)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+	case http.MethodPut:
+		if d := q.Get("digest"); d != "" {
+			r.blobs[repo+"@"+d] = true
+			r.uploads++
+		}
+	}
+
+	r.inner.ServeHTTP(w, req)
+}
+
+//
+func TestBlobCacheMount(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	trgtReg := &mountingRegistry{
+		inner: gocrregistry.New(), blobs: make(map[string]bool)}
+	trgtSrv := httptest.NewServer(trgtReg)
+	defer trgtSrv.Close()
+	trgt := strings.TrimPrefix(trgtSrv.URL, "http://")
+
+	srcSrv := httptest.NewServer(gocrregistry.New())
+	defer srcSrv.Close()
+	src := strings.TrimPrefix(srcSrv.URL, "http://") + "/source/image:1.0"
+
+	img, err := gocrrandom.Image(1024, 1)
+	th.AssertNoError(err)
+	ref, err := gocrname.NewTag(src)
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(ref, img))
+
+	layers, err := img.Layers()
+	th.AssertNoError(err)
+	layer, err := layers[0].Digest()
+	th.AssertNoError(err)
+
+	cache := NewBlobCache()
+	ctx := WithBlobCache(context.Background(), cache)
+
+	// first copy uploads config & layer
+	th.AssertNoError(Copy(ctx, src, nil, false,
+		trgt+"/one/image:1.0", nil, false, nil, nil, ""))
+	th.AssertEqual(0, trgtReg.mounts)
+	th.AssertEqual(2, trgtReg.uploads)
+	th.AssertEquivalentSlices([]string{
+		strings.TrimPrefix(srcSrv.URL, "http://") + "/source/image",
+		trgt + "/one/image"}, cache.BlobRepos(layer.String()))
+
+	// second copy to another repo mounts the layer from the first
+	th.AssertNoError(Copy(ctx, src, nil, false,
+		trgt+"/two/image:1.0", nil, false, nil, nil, ""))
+	th.AssertEqual(1, trgtReg.mounts)
+	th.AssertEqual(3, trgtReg.uploads)
+	th.AssertEqual(trgt+"/two/image", cache.BlobRepos(layer.String())[0])
+
+	srcDigest, err := GetDigest(context.Background(), src, nil, false)
+	th.AssertNoError(err)
+	trgtDigest, err := GetDigest(context.Background(),
+		trgt+"/two/image:1.0", nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(srcDigest, trgtDigest)
+
+	// without cache, there is nothing to mount from
+	th.AssertNoError(Copy(context.Background(), src, nil, false,
+		trgt+"/three/image:1.0", nil, false, nil, nil, ""))
+	th.AssertEqual(1, trgtReg.mounts)
+	th.AssertEqual(5, trgtReg.uploads)
+
+	// a source in the same registry is mounted from, even without cache
+	th.AssertNoError(Copy(context.Background(), trgt+"/three/image:1.0",
+		nil, false, trgt+"/four/image:1.0", nil, false, nil, nil, ""))
+	th.AssertEqual(2, trgtReg.mounts)
+	th.AssertEqual(6, trgtReg.uploads)
+
+	// chunked uploads mount as well
+	th.AssertNoError(Copy(WithUploads(ctx, Uploads{ChunkSize: 256}), src,
+		nil, false, trgt+"/five/image:1.0", nil, false, nil, nil, ""))
+	th.AssertEqual(3, trgtReg.mounts)
+	th.AssertEqual(7, trgtReg.uploads)
+}
@@ -62,7 +62,8 @@ type catalog struct {
 //
 func (c *catalog) Retrieve(maxItems int) ([]string, error) {
 
-	reg, err := gocrname.NewRegistry(c.registry)
+	reg, err := gocrname.NewRegistry(
+		c.registry, nameOptions(c.registry)...)
 	if err != nil {
 		return nil, fmt.Errorf("invalid registry: %v", err)
 	}
@@ -0,0 +1,146 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsecr "github.com/aws/aws-sdk-go/service/ecr"
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// maximum number of image IDs per ECR BatchDeleteImage call
+const ecrBatchDeleteMax = 100
+
+// DeleteTags removes the given tags from the repo with given ref; keep are the
+// tags that remain in the repo. For ECR, this is done via BatchDeleteImage,
+// which only removes the tag as long as other tags still reference the image.
+// For other registries, deleting the tag itself is tried first. Since not all
+// registries support this, the manifest is deleted by digest as a fall back,
+// unless it's still referenced by any of the tags in keep. Requests are aborted
+// once ctx is done.
+func DeleteTags(ctx context.Context, ref string, tags, keep []string,
+	creds *auth.Credentials, insecure bool) error {
+
+	reg, path, _ := util.SplitRef(ref)
+
+	if isECR, region, account := IsECR(reg); isECR {
+		return deleteTagsECR(region, account, creds, path, tags)
+	}
+
+	opts := remoteOptions(ctx, ref, creds, insecure, nil, "")
+	var kept map[string]bool
+	errs := 0
+
+	for _, tag := range tags {
+
+		tagged := fmt.Sprintf("%s:%s", ref, tag)
+		r, err := gocrname.ParseReference(tagged, nameOptions(tagged)...)
+		if err != nil {
+			return fmt.Errorf("invalid ref '%s': %v", tagged, err)
+		}
+
+		if gocrremote.Delete(r, opts...) == nil {
+			continue
+		}
+
+		digest, err := GetDigest(ctx, tagged, creds, insecure)
+		if err != nil {
+			errs++
+			continue
+		}
+
+		if kept == nil {
+			kept = make(map[string]bool)
+			for _, k := range keep {
+				if d, err := GetDigest(ctx,
+					fmt.Sprintf("%s:%s", ref, k), creds, insecure); err == nil {
+					kept[d] = true
+				}
+			}
+		}
+
+		if kept[digest] {
+			return fmt.Errorf("cannot delete tag '%s', registry does not "+
+				"support deleting tags, and manifest '%s' is still referenced "+
+				"by other tags", tagged, digest)
+		}
+
+		r, err = gocrname.ParseReference(
+			fmt.Sprintf("%s@%s", ref, digest), nameOptions(ref)...)
+		if err != nil {
+			return err
+		}
+		if err := gocrremote.Delete(r, opts...); err != nil {
+			return fmt.Errorf("error deleting '%s': %v", tagged, err)
+		}
+	}
+
+	if errs > 0 {
+		return fmt.Errorf("could not delete %d tag(s) of '%s'", errs, ref)
+	}
+
+	return nil
+}
+
+//
+func deleteTagsECR(region, account string, creds *auth.Credentials,
+	repo string, tags []string) error {
+
+	e := &ecr{region: region, account: account, creds: creds}
+	svc, err := e.getService()
+	if err != nil {
+		return fmt.Errorf("error getting ECR service: %v", err)
+	}
+
+	for len(tags) > 0 {
+
+		n := len(tags)
+		if n > ecrBatchDeleteMax {
+			n = ecrBatchDeleteMax
+		}
+
+		var ids []*awsecr.ImageIdentifier
+		for _, t := range tags[:n] {
+			ids = append(ids, &awsecr.ImageIdentifier{ImageTag: aws.String(t)})
+		}
+		tags = tags[n:]
+
+		out, err := svc.BatchDeleteImage(&awsecr.BatchDeleteImageInput{
+			RegistryId:     aws.String(account),
+			RepositoryName: aws.String(repo),
+			ImageIds:       ids,
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting ECR images: %v", err)
+		}
+		if len(out.Failures) > 0 {
+			f := out.Failures[0]
+			return fmt.Errorf("error deleting ECR image '%s': %s",
+				aws.StringValue(f.ImageId.ImageTag),
+				aws.StringValue(f.FailureReason))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestDeleteTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// in-memory registry that, like the Docker registry, only supports
+	// deleting manifests by digest; deletions are recorded but not carried out
+	var deleted []string
+	inner := gocrregistry.New()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodDelete {
+				inner.ServeHTTP(w, r)
+				return
+			}
+			ref := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+			if !strings.HasPrefix(ref, "sha256:") {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			deleted = append(deleted, ref)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+	repo := reg + "/target/image"
+
+	digests := make(map[string]string)
+	for _, tags := range [][]string{{"old"}, {"shared", "current"}} {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		d, err := img.Digest()
+		th.AssertNoError(err)
+		for _, tag := range tags {
+			r, err := gocrname.NewTag(repo + ":" + tag)
+			th.AssertNoError(err)
+			th.AssertNoError(gocrremote.Write(r, img))
+			digests[tag] = d.String()
+		}
+	}
+
+	th.AssertNoError(DeleteTags(context.Background(),
+		repo, []string{"old"}, []string{"current"}, nil, false))
+	th.AssertEqualSlices([]string{digests["old"]}, deleted)
+
+	th.AssertError(DeleteTags(context.Background(),
+		repo, []string{"shared"}, []string{"current"}, nil, false),
+		"is still referenced by other tags")
+	th.AssertEqualSlices([]string{digests["old"]}, deleted)
+
+	th.AssertError(DeleteTags(context.Background(),
+		repo, []string{"missing"}, nil, nil, false),
+		"could not delete 1 tag(s)")
+}
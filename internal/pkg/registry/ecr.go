@@ -23,8 +23,9 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	awsecr "github.com/aws/aws-sdk-go/service/ecr"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
 )
 
 //
@@ -46,12 +47,22 @@ func IsECR(registry string) (ecr bool, region, account string) {
 	return
 }
 
+// ECRPublicRegistry is the registry host of ECR Public
+const ECRPublicRegistry = "public.ecr.aws"
+
+//
+func IsECRPublic(registry string) bool {
+	return registry == ECRPublicRegistry
+}
+
 //
-func newECR(registry, region, account string) ListSource {
+func newECR(registry, region, account string,
+	creds *auth.Credentials) ListSource {
 	return &ecr{
 		registry: registry,
 		region:   region,
 		account:  account,
+		creds:    creds,
 	}
 }
 
@@ -60,6 +71,7 @@ type ecr struct {
 	registry string
 	region   string
 	account  string
+	creds    *auth.Credentials
 }
 
 //
@@ -104,9 +116,42 @@ func (e *ecr) Ping() error {
 
 //
 func (e *ecr) getService() (*awsecr.ECR, error) {
-	sess, err := session.NewSession()
+	sess, err := auth.NewAWSSession(e.creds)
 	if err != nil {
 		return nil, err
 	}
 	return awsecr.New(sess, &aws.Config{Region: aws.String(e.region)}), nil
 }
+
+//
+func listUntaggedECR(region, account string, creds *auth.Credentials,
+	repo string) ([]string, error) {
+
+	e := &ecr{region: region, account: account, creds: creds}
+	svc, err := e.getService()
+	if err != nil {
+		return nil, fmt.Errorf("error getting ECR service: %v", err)
+	}
+
+	input := &awsecr.ListImagesInput{
+		RegistryId:     aws.String(account),
+		RepositoryName: aws.String(repo),
+		Filter: &awsecr.ListImagesFilter{
+			TagStatus: aws.String(awsecr.TagStatusUntagged),
+		},
+	}
+
+	var ret []string
+
+	if err := svc.ListImagesPages(input,
+		func(page *awsecr.ListImagesOutput, lastPage bool) bool {
+			for _, id := range page.ImageIds {
+				ret = append(ret, aws.StringValue(id.ImageDigest))
+			}
+			return true
+		}); err != nil {
+		return nil, fmt.Errorf("error listing untagged ECR images: %v", err)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,62 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"strings"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrgoogle "github.com/google/go-containerregistry/pkg/v1/google"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+)
+
+//
+func IsGCR(registry string) bool {
+	return registry == "gcr.io" || strings.HasSuffix(registry, ".gcr.io") ||
+		strings.HasSuffix(registry, "-docker.pkg.dev")
+}
+
+// GCR & GAR extend the tag list response with all manifests in the repo, and
+// the tags pointing to each of them
+func listUntaggedGCR(ref string, creds *auth.Credentials, insecure bool) (
+	[]string, error) {
+
+	repo, err := gocrname.NewRepository(ref, nameOptions(ref)...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ref '%s': %v", ref, err)
+	}
+
+	opts := []gocrgoogle.ListerOption{
+		gocrgoogle.WithAuth(remoteAuthenticator(creds)),
+		gocrgoogle.WithTransport(transport(refRegistry(ref), insecure))}
+
+	tags, err := gocrgoogle.List(repo, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing manifests for '%s': %v", ref, err)
+	}
+
+	var ret []string
+	for digest, info := range tags.Manifests {
+		if len(info.Tags) == 0 {
+			ret = append(ret, digest)
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,190 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// types of GitLab access tokens
+const (
+	GitLabPersonalToken = "personal"
+	GitLabDeployToken   = "deploy"
+	GitLabJobToken      = "job"
+)
+
+//
+const gitLabTimeout = 30 * time.Second
+
+// registry and API URL of gitlab.com
+const (
+	GitLabComRegistry = "registry.gitlab.com"
+	gitLabComURL      = "https://gitlab.com"
+)
+
+// DefaultGitLabURL returns the API URL for the given registry if it is known,
+// or an empty string otherwise; self-managed instances usually serve their
+// registry under a different host name than the API
+func DefaultGitLabURL(registry string) string {
+	if registry == GitLabComRegistry {
+		return gitLabComURL
+	}
+	return ""
+}
+
+// GitLabAPI holds what's needed for talking to the API of a GitLab instance
+type GitLabAPI struct {
+	URL       string
+	Token     string
+	TokenType string
+	Insecure  bool
+}
+
+//
+func (a *GitLabAPI) get(path string, v interface{}) (*http.Response, error) {
+
+	req, err := http.NewRequest(http.MethodGet,
+		fmt.Sprintf("%s/api/v4/%s", strings.TrimSuffix(a.URL, "/"), path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch a.TokenType {
+	case GitLabJobToken:
+		req.Header.Set("JOB-TOKEN", a.Token)
+	case GitLabDeployToken:
+		return nil, fmt.Errorf(
+			"GitLab deploy tokens cannot be used with the GitLab API")
+	default:
+		req.Header.Set("PRIVATE-TOKEN", a.Token)
+	}
+
+	client := &http.Client{
+		Timeout: gitLabTimeout, Transport: transport("", a.Insecure)}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error calling GitLab API: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			return nil, fmt.Errorf("invalid response from GitLab API: %v", err)
+		}
+	}
+
+	return res, nil
+}
+
+// CheckGitLabProject verifies that a GitLab project backing the repository
+// path exists. GitLab doesn't create projects on push, and an image path may
+// consist of the project path plus up to two additional levels, so we try
+// the path and its parents.
+func CheckGitLabProject(a *GitLabAPI, path string) error {
+
+	elements := strings.Split(strings.Trim(path, "/"), "/")
+
+	for n := len(elements); n > 1 && n >= len(elements)-2; n-- {
+		p := strings.Join(elements[:n], "/")
+		res, err := a.get("projects/"+url.PathEscape(p), nil)
+		if err != nil {
+			return err
+		}
+		switch res.StatusCode {
+		case http.StatusOK:
+			log.WithFields(log.Fields{"repo": path, "project": p}).Debug(
+				"found GitLab project")
+			return nil
+		case http.StatusNotFound:
+		default:
+			return fmt.Errorf(
+				"checking for GitLab project '%s' failed with %d", p,
+				res.StatusCode)
+		}
+	}
+
+	return fmt.Errorf("no GitLab project found for '%s', projects need to be "+
+		"created before pushing to their registry", path)
+}
+
+//
+func newGitLab(api *GitLabAPI, group string) ListSource {
+	return &gitlab{api: api, group: group}
+}
+
+//
+type gitlab struct {
+	api   *GitLabAPI
+	group string
+}
+
+//
+type gitLabRepo struct {
+	Path string `json:"path"`
+}
+
+// Retrieve lists the container repositories of the group, including those in
+// its subgroups; returned paths contain the full group hierarchy
+func (g *gitlab) Retrieve(maxItems int) ([]string, error) {
+
+	var ret []string
+
+	for page := "1"; page != ""; {
+		var repos []gitLabRepo
+		res, err := g.api.get(fmt.Sprintf(
+			"groups/%s/registry/repositories?per_page=100&page=%s",
+			url.PathEscape(g.group), page), &repos)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf(
+				"listing repositories of GitLab group '%s' failed with %d",
+				g.group, res.StatusCode)
+		}
+		for _, r := range repos {
+			ret = append(ret, r.Path)
+		}
+		if maxItems > 0 && len(ret) > maxItems {
+			break
+		}
+		page = res.Header.Get("X-Next-Page")
+	}
+
+	return ret, nil
+}
+
+//
+func (g *gitlab) Ping() error {
+	res, err := g.api.get("groups/"+url.PathEscape(g.group), nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GitLab group '%s' not accessible: %d", g.group,
+			res.StatusCode)
+	}
+	return nil
+}
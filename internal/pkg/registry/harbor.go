@@ -0,0 +1,121 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+)
+
+//
+const harborTimeout = 30 * time.Second
+
+// HarborProject describes a project to create in Harbor
+type HarborProject struct {
+	Name         string
+	Public       bool
+	StorageLimit int64 // in bytes, -1 for unlimited, 0 for Harbor's default
+}
+
+// EnsureHarborProject creates the given project in the Harbor registry at
+// host, if it doesn't exist yet
+func EnsureHarborProject(host string, p *HarborProject,
+	creds *auth.Credentials, insecure bool) error {
+
+	client := &http.Client{
+		Timeout: harborTimeout, Transport: transport(host, insecure)}
+
+	api := fmt.Sprintf("https://%s/api/v2.0/projects", host)
+
+	req, err := http.NewRequest(http.MethodHead,
+		fmt.Sprintf("%s?project_name=%s", api, url.QueryEscape(p.Name)), nil)
+	if err != nil {
+		return err
+	}
+	setBasicAuth(req, creds)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error checking for Harbor project '%s': %v",
+			p.Name, err)
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+	default:
+		return fmt.Errorf("checking for Harbor project '%s' failed with %d",
+			p.Name, res.StatusCode)
+	}
+
+	body := map[string]interface{}{
+		"project_name": p.Name,
+		"metadata":     map[string]string{"public": strconv.FormatBool(p.Public)},
+	}
+	if p.StorageLimit != 0 {
+		body["storage_limit"] = p.StorageLimit
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"registry": host, "project": p.Name}).Info(
+		"creating Harbor project")
+
+	req, err = http.NewRequest(http.MethodPost, api, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setBasicAuth(req, creds)
+
+	res, err = client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error creating Harbor project '%s': %v", p.Name, err)
+	}
+	defer res.Body.Close()
+
+	// conflict means someone else created it in the meantime
+	if res.StatusCode != http.StatusCreated &&
+		res.StatusCode != http.StatusConflict {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("creating Harbor project '%s' failed with %d: %s",
+			p.Name, res.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+//
+func setBasicAuth(req *http.Request, creds *auth.Credentials) {
+	if creds != nil && (creds.Username() != "" || creds.Password() != "") {
+		req.SetBasicAuth(creds.Username(), creds.Password())
+	}
+}
@@ -0,0 +1,93 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// registries with custom request headers, keyed by registry as given in refs
+var headers = make(map[string]http.Header)
+var headersMutex sync.Mutex
+
+// SetHeaders makes all requests on behalf of the given registry carry the given
+// headers, including requests to other hosts, such as token servers; a
+// 'User-Agent' header replaces the default one; 'Authorization' and 'Host'
+// can't be set; setting different headers for the same registry is an error
+func SetHeaders(registry string, h map[string]string) error {
+
+	if len(h) == 0 {
+		return nil
+	}
+
+	hdr := make(http.Header)
+	for name, value := range h {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name: '%s'", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value for header '%s'", name)
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Host":
+			return fmt.Errorf("header '%s' can't be set", name)
+		}
+		hdr.Set(name, value)
+	}
+
+	headersMutex.Lock()
+	defer headersMutex.Unlock()
+
+	if p, ok := headers[registry]; ok {
+		if !reflect.DeepEqual(p, hdr) {
+			return fmt.Errorf(
+				"conflicting header settings for registry '%s'", registry)
+		}
+		return nil
+	}
+
+	headers[registry] = hdr
+	return nil
+}
+
+// headersFor returns the custom headers for requests on behalf of the given
+// registry, nil if there are none
+func headersFor(registry string) http.Header {
+	headersMutex.Lock()
+	defer headersMutex.Unlock()
+	return headers[registry]
+}
+
+// characters not allowed in header names, besides controls, space, and non-ASCII
+const headerSeparators = `"(),/:;<=>?@[\]{}`
+
+// validHeaderName checks whether name is a token as per RFC 7230
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(headerSeparators, r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestHeaders(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// registry recording the headers of the last request
+	var last http.Header
+	var mutex sync.Mutex
+	handler := gocrregistry.New()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			last = r.Header.Clone()
+			mutex.Unlock()
+			handler.ServeHTTP(w, r)
+		}))
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	header := func(name string) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return last.Get(name)
+	}
+
+	ref := reg + "/test/image"
+	_, err := ListTagsIfExists(context.Background(), ref, nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual("", header("X-Gateway-Route"))
+	th.AssertTrue(strings.Contains(
+		header("User-Agent"), "go-containerregistry"))
+
+	th.AssertNoError(SetHeaders(reg, map[string]string{
+		"User-Agent":      "dregsy-mirror/1.0",
+		"x-gateway-route": "mirror",
+	}))
+	_, err = ListTagsIfExists(context.Background(), ref, nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual("dregsy-mirror/1.0", header("User-Agent"))
+	th.AssertEqual("mirror", header("X-Gateway-Route"))
+
+	th.AssertNoError(SetHeaders(reg, map[string]string{
+		"x-gateway-route": "mirror", "user-agent": "dregsy-mirror/1.0"}))
+	th.AssertError(SetHeaders(reg, map[string]string{
+		"X-Gateway-Route": "other"}), "conflicting header settings")
+
+	th.AssertError(SetHeaders("h.example.com", map[string]string{
+		"X Route": "a"}), "invalid header name: 'X Route'")
+	th.AssertError(SetHeaders("h.example.com", map[string]string{
+		"X-Route": "a\r\nb"}), "invalid value for header 'X-Route'")
+	th.AssertError(SetHeaders("h.example.com", map[string]string{
+		"authorization": "Bearer x"}), "header 'authorization' can't be set")
+	th.AssertTrue(headersFor("h.example.com") == nil)
+}
@@ -32,7 +32,7 @@ func newIndex(reg, filter string, insecure bool, creds *auth.Credentials) ListSo
 
 	ret := &index{filter: filter}
 
-	if !isDockerHub(reg) {
+	if !IsDockerHub(reg) {
 		ret.filter = fmt.Sprintf("%s/%s", reg, filter)
 	}
 
@@ -97,7 +97,7 @@ func (i *index) Ping() error {
 }
 
 //
-func isDockerHub(reg string) bool {
+func IsDockerHub(reg string) bool {
 	return reg == "" || reg == "docker.com" || reg == "docker.io" ||
 		strings.HasSuffix(reg, ".docker.com") ||
 		strings.HasSuffix(reg, ".docker.io")
@@ -0,0 +1,294 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gocrempty "github.com/google/go-containerregistry/pkg/v1/empty"
+	gocrlayout "github.com/google/go-containerregistry/pkg/v1/layout"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+)
+
+// LayoutPrefix marks a location as a local OCI image layout instead of a
+// registry, e.g. 'oci:/data/export'; each repository becomes a layout of its
+// own in the sub directory given by its path
+const LayoutPrefix = "oci:"
+
+// annotation carrying the tag of a manifest in a layout's index.json, as also
+// used by skopeo and others
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// platform picked from an image index when a single image is needed
+var defaultPlatform = gocrv1.Platform{OS: "linux", Architecture: "amd64"}
+
+// serializes writes to layouts, since updating index.json is not atomic
+var layoutMutex sync.Mutex
+
+// IsLayout checks whether ref, or registry name, denotes an OCI image layout
+func IsLayout(ref string) bool {
+	return strings.HasPrefix(ref, LayoutPrefix)
+}
+
+// splitLayoutRef splits a layout ref of the form oci:{dir}[:{tag}|@{digest}]
+// into its parts
+func splitLayoutRef(ref string) (dir, tag, digest string) {
+	return splitLayoutPath(strings.TrimPrefix(ref, LayoutPrefix))
+}
+
+// splitLayoutPath splits {dir}[:{tag}|@{digest}] into its parts
+func splitLayoutPath(p string) (dir, tag, digest string) {
+
+	if ix := strings.LastIndex(p, "@"); ix > -1 {
+		return p[:ix], "", p[ix+1:]
+	}
+
+	if ix := strings.LastIndex(p, ":"); ix > strings.LastIndex(p, "/") {
+		return p[:ix], p[ix+1:], ""
+	}
+
+	return p, "", ""
+}
+
+// layoutTags lists the tags in the layout of given ref; when the layout does
+// not exist, the returned error satisfies os.IsNotExist
+func layoutTags(ref string) ([]string, error) {
+
+	dir, _, _ := splitLayoutRef(ref)
+
+	manifest, err := layoutIndexManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	seen := make(map[string]bool)
+
+	for _, desc := range manifest.Manifests {
+		if tag := desc.Annotations[refNameAnnotation]; tag != "" && !seen[tag] {
+			seen[tag] = true
+			ret = append(ret, tag)
+		}
+	}
+
+	return ret, nil
+}
+
+// stagedLayoutTags is like layoutTags, but stages S3 layouts first
+func stagedLayoutTags(ctx context.Context, ref string,
+	creds *auth.Credentials) ([]string, error) {
+	lref, err := stageLayout(ctx, ref, creds, false)
+	if err != nil {
+		return nil, err
+	}
+	return layoutTags(lref)
+}
+
+//
+func layoutIndexManifest(dir string) (*gocrv1.IndexManifest, error) {
+
+	p, err := gocrlayout.FromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.IndexManifest()
+}
+
+// layoutDescriptor returns the descriptor in the layout's index.json that
+// matches the tag or digest of given ref
+func layoutDescriptor(ref string) (gocrlayout.Path, *gocrv1.Descriptor,
+	error) {
+
+	dir, tag, digest := splitLayoutRef(ref)
+	if tag == "" && digest == "" {
+		return "", nil, fmt.Errorf("ref '%s' has neither tag nor digest", ref)
+	}
+
+	manifest, err := layoutIndexManifest(dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, desc := range manifest.Manifests {
+		if (tag != "" && desc.Annotations[refNameAnnotation] == tag) ||
+			(digest != "" && desc.Digest.String() == digest) {
+			d := desc
+			return gocrlayout.Path(dir), &d, nil
+		}
+	}
+
+	return "", nil, notInLayoutError(ref)
+}
+
+// notInLayoutError is returned when a ref is not found in its layout
+type notInLayoutError string
+
+//
+func (e notInLayoutError) Error() string {
+	return fmt.Sprintf("'%s' not found in layout", string(e))
+}
+
+// stagedLayoutDescriptor is like layoutDescriptor, but stages S3 layouts
+// first
+func stagedLayoutDescriptor(ctx context.Context, ref string,
+	creds *auth.Credentials) (*gocrv1.Descriptor, error) {
+	lref, err := stageLayout(ctx, ref, creds, false)
+	if err != nil {
+		return nil, err
+	}
+	_, desc, err := layoutDescriptor(lref)
+	return desc, err
+}
+
+// readStagedLayout is like readLayout, but stages S3 layouts first
+func readStagedLayout(ctx context.Context, ref string,
+	creds *auth.Credentials) (gocrv1.ImageIndex, gocrv1.Image, error) {
+	lref, err := stageLayout(ctx, ref, creds, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return readLayout(lref)
+}
+
+// readLayout returns the image index or image, whichever it is, with given
+// ref from its layout
+func readLayout(ref string) (gocrv1.ImageIndex, gocrv1.Image, error) {
+
+	p, desc, err := layoutDescriptor(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if desc.MediaType.IsIndex() {
+		root, err := p.ImageIndex()
+		if err != nil {
+			return nil, nil, err
+		}
+		idx, err := root.ImageIndex(desc.Digest)
+		return idx, nil, err
+	}
+
+	img, err := p.Image(desc.Digest)
+	return nil, img, err
+}
+
+// layoutImage returns the image with given ref from its layout; for an image
+// index, the image for the default platform is returned
+func layoutImage(ref string) (gocrv1.Image, error) {
+
+	idx, img, err := readLayout(ref)
+	if err != nil || idx == nil {
+		return img, err
+	}
+
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, desc := range manifest.Manifests {
+		if desc.MediaType.IsImage() && matchesPlatform(
+			desc.Platform, []gocrv1.Platform{defaultPlatform}) {
+			return idx.Image(desc.Digest)
+		}
+	}
+
+	return nil, fmt.Errorf("index '%s' has no image for %s/%s", ref,
+		defaultPlatform.OS, defaultPlatform.Architecture)
+}
+
+// writeLayout writes the given image index or image to the layout of given
+// ref, under the ref's tag; the layout is created if it does not exist yet,
+// and any manifest previously carrying the tag is dropped from the layout's
+// index.json, its blobs however are kept
+func writeLayout(ref string, idx gocrv1.ImageIndex, img gocrv1.Image) error {
+
+	dir, tag, _ := splitLayoutRef(ref)
+	if tag == "" {
+		return fmt.Errorf("ref '%s' has no tag", ref)
+	}
+
+	layoutMutex.Lock()
+	defer layoutMutex.Unlock()
+
+	p, err := gocrlayout.FromPath(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if p, err = gocrlayout.Write(dir, gocrempty.Index); err != nil {
+			return err
+		}
+	}
+
+	if err := untagLayout(p, tag); err != nil {
+		return err
+	}
+
+	opt := gocrlayout.WithAnnotations(map[string]string{refNameAnnotation: tag})
+	if idx != nil {
+		return p.AppendIndex(idx, opt)
+	}
+	return p.AppendImage(img, opt)
+}
+
+// untagLayout removes all manifests carrying the given tag from the layout's
+// index.json
+func untagLayout(p gocrlayout.Path, tag string) error {
+
+	idx, err := p.ImageIndex()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return err
+	}
+
+	keep := []gocrv1.Descriptor{}
+	for _, desc := range manifest.Manifests {
+		if desc.Annotations[refNameAnnotation] != tag {
+			keep = append(keep, desc)
+		}
+	}
+
+	if len(keep) == len(manifest.Manifests) {
+		return nil
+	}
+
+	manifest.Manifests = keep
+	raw, err := json.MarshalIndent(manifest, "", "   ")
+	if err != nil {
+		return err
+	}
+
+	return p.WriteFile("index.json", raw, os.ModePerm)
+}
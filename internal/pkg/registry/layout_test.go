@@ -0,0 +1,139 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestSplitLayoutRef(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, tc := range []struct{ ref, dir, tag, digest string }{
+		{"oci:/data/export/busybox", "/data/export/busybox", "", ""},
+		{"oci:/data/export/busybox:1.36", "/data/export/busybox", "1.36", ""},
+		{"oci:/data/export/busybox@sha256:abc", "/data/export/busybox", "",
+			"sha256:abc"},
+		{"oci:/data/ex:port/busybox", "/data/ex:port/busybox", "", ""},
+	} {
+		dir, tag, digest := splitLayoutRef(tc.ref)
+		th.AssertEqual(tc.dir, dir)
+		th.AssertEqual(tc.tag, tag)
+		th.AssertEqual(tc.digest, digest)
+	}
+}
+
+//
+func TestLayoutExportImport(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srcSrv := httptest.NewServer(gocrregistry.New())
+	defer srcSrv.Close()
+	src := strings.TrimPrefix(srcSrv.URL, "http://") + "/source/image"
+
+	trgtSrv := httptest.NewServer(gocrregistry.New())
+	defer trgtSrv.Close()
+	trgt := strings.TrimPrefix(trgtSrv.URL, "http://") + "/target/image"
+
+	layout := LayoutPrefix + filepath.Join(t.TempDir(), "export/image")
+	ctx := context.Background()
+
+	tags, err := ListTagsIfExists(ctx, layout, nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(tags))
+	_, err = ListTags(ctx, layout, nil, false)
+	th.AssertError(err, "error listing tags")
+
+	idx, err := gocrrandom.Index(1024, 1, 2)
+	th.AssertNoError(err)
+	ref, err := gocrname.NewTag(src + ":1.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.WriteIndex(ref, idx))
+
+	img, err := gocrrandom.Image(1024, 1)
+	th.AssertNoError(err)
+	ref, err = gocrname.NewTag(src + ":2.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(ref, img))
+
+	// export
+	for _, tag := range []string{"1.0", "2.0"} {
+		th.AssertNoError(Copy(ctx, src+":"+tag, nil, false,
+			layout+":"+tag, nil, false, nil, nil, ""))
+	}
+
+	tags, err = ListTags(ctx, layout, nil, false)
+	th.AssertNoError(err)
+	th.AssertEquivalentSlices([]string{"1.0", "2.0"}, tags)
+
+	for _, tag := range []string{"1.0", "2.0"} {
+		srcDigest, err := GetDigest(context.Background(),
+			src+":"+tag, nil, false)
+		th.AssertNoError(err)
+		layoutDigest, err := GetDigest(context.Background(),
+			layout+":"+tag, nil, false)
+		th.AssertNoError(err)
+		th.AssertEqual(srcDigest, layoutDigest)
+		byDigest, err := GetDigest(context.Background(),
+			layout+"@"+layoutDigest, nil, false)
+		th.AssertNoError(err)
+		th.AssertEqual(layoutDigest, byDigest)
+	}
+
+	digest, size, err := GetDigestAndSize(layout+":2.0", nil, false)
+	th.AssertNoError(err)
+	wantDigest, err := img.Digest()
+	th.AssertNoError(err)
+	th.AssertEqual(wantDigest.String(), digest)
+	th.AssertTrue(size > 1024)
+
+	// re-exporting a tag replaces it
+	th.AssertNoError(Copy(ctx, src+":2.0", nil, false,
+		layout+":1.0", nil, false, nil, nil, ""))
+	tags, err = ListTags(ctx, layout, nil, false)
+	th.AssertNoError(err)
+	th.AssertEquivalentSlices([]string{"1.0", "2.0"}, tags)
+	digest, err = GetDigest(context.Background(), layout+":1.0", nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(wantDigest.String(), digest)
+
+	// import
+	th.AssertNoError(Copy(ctx, layout+":2.0", nil, false,
+		trgt+":2.0", nil, false, nil, nil, ""))
+	digest, err = GetDigest(context.Background(), trgt+":2.0", nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(wantDigest.String(), digest)
+
+	_, err = GetDigest(context.Background(), layout+":3.0", nil, false)
+	th.AssertError(err, "not found in layout")
+	err = Copy(ctx, src+":2.0", nil, false, layout, nil, false, nil, nil, "")
+	th.AssertError(err, "has no tag")
+}
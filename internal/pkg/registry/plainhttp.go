@@ -0,0 +1,60 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"sync"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// registries for which plain HTTP is allowed
+var plainHTTP = make(map[string]bool)
+var plainHTTPMutex sync.Mutex
+
+// AllowPlainHTTP makes requests to the given registry fall back to plain HTTP
+// when it doesn't speak HTTPS
+func AllowPlainHTTP(registry string) {
+	plainHTTPMutex.Lock()
+	defer plainHTTPMutex.Unlock()
+	plainHTTP[registry] = true
+}
+
+// nameOptions returns the options for parsing the given ref, or registry name
+func nameOptions(ref string) []gocrname.Option {
+
+	reg := refRegistry(ref)
+
+	plainHTTPMutex.Lock()
+	defer plainHTTPMutex.Unlock()
+
+	if plainHTTP[reg] {
+		return []gocrname.Option{gocrname.Insecure}
+	}
+	return nil
+}
+
+// refRegistry returns the registry part of the given ref, as given in the ref;
+// a ref without any path is taken as a registry name
+func refRegistry(ref string) string {
+	if reg, _, _ := util.SplitRef(ref); reg != "" {
+		return reg
+	}
+	return ref
+}
@@ -0,0 +1,50 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestPlainHTTP(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	scheme := func(ref string) string {
+		r, err := gocrname.ParseReference(ref, nameOptions(ref)...)
+		th.AssertNoError(err)
+		return r.Context().Registry.Scheme()
+	}
+
+	th.AssertEqual("https", scheme("lab.example.com:5000/app:1.0"))
+
+	AllowPlainHTTP("lab.example.com:5000")
+	th.AssertEqual("http", scheme("lab.example.com:5000/app:1.0"))
+	th.AssertEqual("http", scheme("lab.example.com:5000/team/app"))
+	th.AssertEqual("https", scheme("lab.example.com/app:1.0"))
+	th.AssertEqual("https", scheme("other.example.com:5000/app"))
+
+	reg, err := gocrname.NewRegistry(
+		"lab.example.com:5000", nameOptions("lab.example.com:5000")...)
+	th.AssertNoError(err)
+	th.AssertEqual("http", reg.Scheme())
+}
@@ -0,0 +1,112 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"strings"
+
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gocrempty "github.com/google/go-containerregistry/pkg/v1/empty"
+	gocrmutate "github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// ParsePlatforms parses platform specs of the form {os}/{arch}[/{variant}],
+// e.g. 'linux/arm64' or 'linux/arm/v7'
+func ParsePlatforms(specs []string) ([]gocrv1.Platform, error) {
+
+	var ret []gocrv1.Platform
+
+	for _, s := range specs {
+		parts := strings.Split(strings.TrimSpace(s), "/")
+		if len(parts) < 2 || len(parts) > 3 ||
+			parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf(
+				"invalid platform '%s', must be {os}/{arch}[/{variant}]", s)
+		}
+		p := gocrv1.Platform{OS: parts[0], Architecture: parts[1]}
+		if len(parts) == 3 {
+			p.Variant = parts[2]
+		}
+		ret = append(ret, p)
+	}
+
+	return ret, nil
+}
+
+// matchesPlatform checks whether p matches any of the given platforms; a
+// platform without variant matches all variants
+func matchesPlatform(p *gocrv1.Platform, platforms []gocrv1.Platform) bool {
+
+	if p == nil {
+		return false
+	}
+
+	for _, want := range platforms {
+		if p.OS == want.OS && p.Architecture == want.Architecture &&
+			(want.Variant == "" || p.Variant == want.Variant) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterIndex returns a new index that only contains those manifests of idx
+// which are for one of the given platforms; note that the resulting index has
+// a different digest than idx
+func filterIndex(idx gocrv1.ImageIndex, platforms []gocrv1.Platform) (
+	gocrv1.ImageIndex, error) {
+
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	mt, err := idx.MediaType()
+	if err != nil {
+		return nil, err
+	}
+
+	var adds []gocrmutate.IndexAddendum
+
+	for _, desc := range manifest.Manifests {
+
+		if !matchesPlatform(desc.Platform, platforms) {
+			continue
+		}
+
+		var add gocrmutate.Appendable
+		if desc.MediaType.IsIndex() {
+			add, err = idx.ImageIndex(desc.Digest)
+		} else {
+			add, err = idx.Image(desc.Digest)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		adds = append(adds, gocrmutate.IndexAddendum{Add: add, Descriptor: desc})
+	}
+
+	if len(adds) == 0 {
+		return nil, fmt.Errorf("index contains none of the requested platforms")
+	}
+
+	return gocrmutate.AppendManifests(
+		gocrmutate.IndexMediaType(gocrempty.Index, mt), adds...), nil
+}
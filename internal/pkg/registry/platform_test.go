@@ -0,0 +1,103 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gocrempty "github.com/google/go-containerregistry/pkg/v1/empty"
+	gocrmutate "github.com/google/go-containerregistry/pkg/v1/mutate"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestCopyPlatforms(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	var adds []gocrmutate.IndexAddendum
+	for _, p := range []gocrv1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+	} {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		mt, err := img.MediaType()
+		th.AssertNoError(err)
+		p := p
+		adds = append(adds, gocrmutate.IndexAddendum{
+			Add:        img,
+			Descriptor: gocrv1.Descriptor{MediaType: mt, Platform: &p},
+		})
+	}
+
+	src := reg + "/source/image:multi"
+	ref, err := gocrname.NewTag(src)
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.WriteIndex(
+		ref, gocrmutate.AppendManifests(gocrempty.Index, adds...)))
+
+	tryCopy := func(platforms []string, want []string, err string) {
+
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+
+		trgt := reg + "/target/image:multi"
+		e := Copy(context.Background(), src, nil, false, trgt, nil, false,
+			platforms, nil, "")
+		if err != "" {
+			th.AssertError(e, err)
+			return
+		}
+		th.AssertNoError(e)
+
+		ref, e := gocrname.NewTag(trgt)
+		th.AssertNoError(e)
+		idx, e := gocrremote.Index(ref)
+		th.AssertNoError(e)
+		manifest, e := idx.IndexManifest()
+		th.AssertNoError(e)
+
+		var got []string
+		for _, m := range manifest.Manifests {
+			got = append(got, m.Platform.OS+"/"+m.Platform.Architecture)
+		}
+		th.AssertEquivalentSlices(want, got)
+	}
+
+	tryCopy(nil, []string{"linux/amd64", "linux/arm64", "linux/arm"}, "")
+	tryCopy([]string{"linux/arm64", "linux/amd64"},
+		[]string{"linux/amd64", "linux/arm64"}, "")
+	tryCopy([]string{"linux/arm/v7"}, []string{"linux/arm"}, "")
+	tryCopy([]string{"linux/arm/v6"}, nil,
+		"index contains none of the requested platforms")
+	tryCopy([]string{"windows"}, nil, "invalid platform 'windows'")
+}
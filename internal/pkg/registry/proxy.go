@@ -0,0 +1,92 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// registries with their own proxy settings, keyed by registry as given in
+// refs; a nil URL means direct connections
+var proxies = make(map[string]*url.URL)
+var proxiesMutex sync.Mutex
+
+// ParseProxy parses the given proxy URL; supported schemes are http, https,
+// and socks5
+func ParseProxy(proxy string) (*url.URL, error) {
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf(
+			"proxy URL needs scheme 'http', 'https', or 'socks5'")
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL without host")
+	}
+
+	return u, nil
+}
+
+// SetProxy makes all requests on behalf of the given registry go through the
+// given proxy, instead of the one set in the environment, if any; this
+// includes requests to other hosts, such as token servers and storage the
+// registry redirects to; with a nil proxy, connections are made directly;
+// setting different proxies for the same registry is an error
+func SetProxy(registry string, proxy *url.URL) error {
+
+	proxiesMutex.Lock()
+	defer proxiesMutex.Unlock()
+
+	if p, ok := proxies[registry]; ok {
+		if (p == nil) != (proxy == nil) ||
+			(p != nil && p.String() != proxy.String()) {
+			return fmt.Errorf(
+				"conflicting proxy settings for registry '%s'", registry)
+		}
+		return nil
+	}
+
+	proxies[registry] = proxy
+	return nil
+}
+
+// proxyFor returns the proxy function to use for requests on behalf of the
+// given registry, and whether there are proxy settings for it
+func proxyFor(registry string) (func(*http.Request) (*url.URL, error), bool) {
+
+	proxiesMutex.Lock()
+	defer proxiesMutex.Unlock()
+
+	p, ok := proxies[registry]
+	if !ok {
+		return nil, false
+	}
+	if p == nil {
+		return nil, true
+	}
+	return http.ProxyURL(p), true
+}
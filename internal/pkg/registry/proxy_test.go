@@ -0,0 +1,95 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestProxy(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	// forward proxy for plain HTTP, counting the requests passing through
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&proxied, 1)
+			req, err := http.NewRequest(r.Method, r.URL.String(), r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			req.Header = r.Header
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			for k, v := range resp.Header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		}))
+	defer proxy.Close()
+
+	ref := reg + "/test/image"
+	_, err := ListTagsIfExists(context.Background(), ref, nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(int32(0), atomic.LoadInt32(&proxied))
+
+	u, err := ParseProxy(proxy.URL)
+	th.AssertNoError(err)
+	th.AssertNoError(SetProxy(reg, u))
+	_, err = ListTagsIfExists(context.Background(), ref, nil, false)
+	th.AssertNoError(err)
+	th.AssertTrue(atomic.LoadInt32(&proxied) > 0)
+
+	th.AssertNoError(SetProxy(reg, u))
+	th.AssertError(SetProxy(reg, nil), "conflicting proxy settings")
+
+	th.AssertNoError(SetProxy("direct.example.com", nil))
+	p, ok := proxyFor("direct.example.com")
+	th.AssertTrue(ok)
+	th.AssertTrue(p == nil)
+	_, ok = proxyFor("other.example.com")
+	th.AssertFalse(ok)
+
+	_, err = ParseProxy("ftp://proxy.example.com")
+	th.AssertError(err, "needs scheme 'http', 'https', or 'socks5'")
+	_, err = ParseProxy("http://")
+	th.AssertError(err, "proxy URL without host")
+	_, err = ParseProxy("socks5://proxy.example.com:1080")
+	th.AssertNoError(err)
+}
@@ -0,0 +1,117 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const (
+	QuayRegistry      = "quay.io"
+	QuayPublic        = "public"
+	QuayPrivate       = "private"
+	quayTimeout       = 30 * time.Second
+	quayAPIPathPrefix = "/api/v1/repository"
+)
+
+//
+func IsQuay(registry string) bool {
+	return registry == QuayRegistry
+}
+
+// EnsureQuayRepo creates repository path in the Quay registry at host with the
+// given visibility, if it doesn't exist yet; the first element of path is the
+// namespace, i.e. user or organization; token is an OAuth access token for
+// Quay's API
+func EnsureQuayRepo(host, path, visibility, token string,
+	insecure bool) error {
+
+	ix := strings.Index(path, "/")
+	if ix < 1 || ix == len(path)-1 {
+		return fmt.Errorf(
+			"Quay repo '%s' needs to consist of namespace and name", path)
+	}
+
+	client := &http.Client{
+		Timeout: quayTimeout, Transport: transport(host, insecure)}
+
+	api := fmt.Sprintf("https://%s%s", host, quayAPIPathPrefix)
+
+	req, err := http.NewRequest(http.MethodGet, api+"/"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error checking for Quay repo '%s': %v", path, err)
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+	default:
+		return fmt.Errorf("checking for Quay repo '%s' failed with %d",
+			path, res.StatusCode)
+	}
+
+	b, err := json.Marshal(map[string]string{
+		"namespace":   path[:ix],
+		"repository":  path[ix+1:],
+		"visibility":  visibility,
+		"description": "",
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"registry": host, "repo": path,
+		"visibility": visibility}).Info("creating Quay repo")
+
+	req, err = http.NewRequest(http.MethodPost, api, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err = client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error creating Quay repo '%s': %v", path, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("creating Quay repo '%s' failed with %d: %s",
+			path, res.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestEnsureQuayRepo(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	repos := map[string]string{"acme/existing": QuayPublic}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			if r.Header.Get("Authorization") != "Bearer t0ken" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			path := strings.TrimPrefix(r.URL.Path, quayAPIPathPrefix)
+			switch r.Method {
+			case http.MethodGet:
+				if _, ok := repos[strings.TrimPrefix(path, "/")]; ok {
+					w.WriteHeader(http.StatusOK)
+				} else {
+					w.WriteHeader(http.StatusNotFound)
+				}
+			case http.MethodPost:
+				var body map[string]string
+				th.AssertNoError(json.NewDecoder(r.Body).Decode(&body))
+				repos[body["namespace"]+"/"+body["repository"]] =
+					body["visibility"]
+				w.WriteHeader(http.StatusCreated)
+			}
+		}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	th.AssertNoError(
+		EnsureQuayRepo(host, "acme/existing", QuayPrivate, "t0ken", true))
+	th.AssertEqual(QuayPublic, repos["acme/existing"])
+
+	th.AssertNoError(
+		EnsureQuayRepo(host, "acme/busybox", QuayPrivate, "t0ken", true))
+	th.AssertEqual(QuayPrivate, repos["acme/busybox"])
+
+	th.AssertError(
+		EnsureQuayRepo(host, "acme/other", QuayPrivate, "wrong", true),
+		"failed with 401")
+	th.AssertError(
+		EnsureQuayRepo(host, "busybox", QuayPrivate, "t0ken", true),
+		"needs to consist of namespace and name")
+}
@@ -0,0 +1,153 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+)
+
+// RateLimit is the state of a registry's pull rate limit, as reported by
+// Docker Hub in the 'ratelimit-limit' and 'ratelimit-remaining' headers
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Window    time.Duration
+}
+
+// WaitFor estimates how long it takes until n pulls are available; the limit
+// applies to a sliding window, so pulls become available again at an average
+// pace of one per window/limit
+func (r *RateLimit) WaitFor(n int) time.Duration {
+	if r == nil || n <= r.Remaining {
+		return 0
+	}
+	if r.Limit <= 0 {
+		return r.Window
+	}
+	return time.Duration(n-r.Remaining) * r.Window / time.Duration(r.Limit)
+}
+
+// GetRateLimit retrieves the pull rate limit that applies to the image with
+// given ref; this is done with a HEAD request, which does not count against
+// the limit; returns nil if the registry does not report a limit
+func GetRateLimit(ref string, creds *auth.Credentials, insecure bool) (
+	*RateLimit, error) {
+
+	r, err := gocrname.ParseReference(ref, nameOptions(ref)...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ref '%s': %v", ref, err)
+	}
+
+	repo := r.Context()
+	rt := transport(refRegistry(ref), insecure)
+
+	tr, err := gocrtransport.New(repo.Registry, remoteAuthenticator(creds), rt,
+		[]string{repo.Scope(gocrtransport.PullScope)})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to registry: %v", err)
+	}
+
+	u := url.URL{
+		Scheme: repo.Registry.Scheme(),
+		Host:   repo.RegistryStr(),
+		Path: fmt.Sprintf(
+			"/v2/%s/manifests/%s", repo.RepositoryStr(), r.Identifier()),
+	}
+
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error getting rate limit for '%s': %v", ref, err)
+	}
+	defer resp.Body.Close()
+
+	limit := resp.Header.Get("ratelimit-limit")
+	remaining := resp.Header.Get("ratelimit-remaining")
+	if limit == "" || remaining == "" {
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return &RateLimit{}, nil
+		}
+		return nil, nil
+	}
+
+	ret := &RateLimit{}
+	if ret.Limit, ret.Window, err = parseRateLimitHeader(limit); err != nil {
+		return nil, err
+	}
+	if ret.Remaining, _, err = parseRateLimitHeader(remaining); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// parseRateLimitHeader parses a rate limit header of the form '100;w=21600',
+// where w is the window in seconds
+func parseRateLimitHeader(h string) (int, time.Duration, error) {
+
+	parts := strings.Split(h, ";")
+
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rate limit header '%s'", h)
+	}
+
+	var window time.Duration
+	for _, p := range parts[1:] {
+		if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 &&
+			kv[0] == "w" {
+			secs, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid rate limit header '%s'", h)
+			}
+			window = time.Duration(secs) * time.Second
+		}
+	}
+
+	return count, window, nil
+}
+
+// IsRateLimited checks whether err was caused by a registry rejecting a
+// request due to its rate limit
+func IsRateLimited(err error) bool {
+	if err == nil {
+		return false
+	}
+	if terr, ok := err.(*gocrtransport.Error); ok &&
+		terr.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	// errors from relays only carry the message
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "toomanyrequests") ||
+		strings.Contains(msg, "too many requests")
+}
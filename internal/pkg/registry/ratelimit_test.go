@@ -0,0 +1,85 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestRateLimit(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// in-memory registry that reports rate limit headers the way Docker Hub
+	// does, for manifest requests of the limited repo
+	inner := gocrregistry.New()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/v2/limited/") &&
+				strings.Contains(r.URL.Path, "/manifests/") {
+				w.Header().Set("ratelimit-limit", "100;w=21600")
+				w.Header().Set("ratelimit-remaining", "7;w=21600")
+			}
+			inner.ServeHTTP(w, r)
+		}))
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, repo := range []string{"limited", "unlimited"} {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		ref, err := gocrname.NewTag(reg + "/" + repo + "/image:1.0")
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(ref, img))
+	}
+
+	rl, err := GetRateLimit(reg+"/limited/image:1.0", nil, false)
+	th.AssertNoError(err)
+	th.AssertNotNil(rl)
+	th.AssertEqual(100, rl.Limit)
+	th.AssertEqual(7, rl.Remaining)
+	th.AssertEqual(6*time.Hour, rl.Window)
+
+	th.AssertEqual(time.Duration(0), rl.WaitFor(7))
+	th.AssertEqual(3*216*time.Second, rl.WaitFor(10))
+
+	rl, err = GetRateLimit(reg+"/unlimited/image:1.0", nil, false)
+	th.AssertNoError(err)
+	th.AssertTrue(rl == nil)
+	th.AssertEqual(time.Duration(0), rl.WaitFor(10))
+
+	_, _, err = parseRateLimitHeader("100;w=abc")
+	th.AssertError(err, "invalid rate limit header '100;w=abc'")
+
+	th.AssertTrue(IsRateLimited(errors.New(
+		"toomanyrequests: You have reached your pull rate limit")))
+	th.AssertTrue(!IsRateLimited(errors.New("manifest unknown")))
+	th.AssertTrue(!IsRateLimited(nil))
+}
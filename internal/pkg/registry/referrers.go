@@ -0,0 +1,228 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gocrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+//
+const ociImageIndex = "application/vnd.oci.image.index.v1+json"
+
+//
+var ErrReferrersNotSupported = errors.New(
+	"registry does not support referrers API")
+
+//
+type Referrer struct {
+	MediaType    string `json:"mediaType"`
+	ArtifactType string `json:"artifactType"`
+	Digest       string `json:"digest"`
+	Size         int64  `json:"size"`
+}
+
+//
+type referrersIndex struct {
+	Manifests []Referrer `json:"manifests"`
+}
+
+// ListReferrers retrieves the manifests referring to the manifest with given
+// ref via the OCI referrers API, optionally only those of given artifact type;
+// ref may either point to a tag or a digest; requests are aborted once ctx is
+// done
+func ListReferrers(ctx context.Context, ref string, creds *auth.Credentials,
+	insecure bool, artifactType string) ([]Referrer, error) {
+
+	r, err := gocrname.ParseReference(ref, nameOptions(ref)...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ref '%s': %v", ref, err)
+	}
+
+	digest := r.Identifier()
+	if _, ok := r.(gocrname.Digest); !ok {
+		if digest, err = GetDigest(ctx, ref, creds, insecure); err != nil {
+			return nil, err
+		}
+	}
+
+	repo := r.Context()
+	rt := transport(refRegistry(ref), insecure)
+
+	tr, err := gocrtransport.New(repo.Registry, remoteAuthenticator(creds), rt,
+		[]string{repo.Scope(gocrtransport.PullScope)})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to registry: %v", err)
+	}
+
+	u := url.URL{
+		Scheme: repo.Registry.Scheme(),
+		Host:   repo.RegistryStr(),
+		Path: fmt.Sprintf(
+			"/v2/%s/referrers/%s", repo.RepositoryStr(), digest),
+	}
+	if artifactType != "" {
+		u.RawQuery = url.Values{"artifactType": {artifactType}}.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", ociImageIndex)
+
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error listing referrers for '%s': %v", ref, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	// registries supporting the referrers API must not respond with 404 for
+	// existing manifests, so this indicates lack of support
+	case http.StatusNotFound:
+		return nil, ErrReferrersNotSupported
+	default:
+		return nil, fmt.Errorf("error listing referrers for '%s': %s",
+			ref, resp.Status)
+	}
+
+	idx := &referrersIndex{}
+	if err := json.NewDecoder(resp.Body).Decode(idx); err != nil {
+		return nil, fmt.Errorf(
+			"cannot decode referrers for '%s': %v", ref, err)
+	}
+
+	// registries may ignore the artifact type filter, so we filter again
+	var ret []Referrer
+	for _, m := range idx.Manifests {
+		if artifactType == "" || m.ArtifactType == artifactType {
+			ret = append(ret, m)
+		}
+	}
+
+	return ret, nil
+}
+
+// suffixes of the tags under which cosign stores signatures, attestations, and
+// SBOMs for a manifest
+var cosignSuffixes = []string{"sig", "att", "sbom"}
+
+// cosignTags returns the tags cosign uses for storing artifacts attached to
+// the manifest with given digest
+func cosignTags(digest string) []string {
+	var ret []string
+	for _, s := range cosignSuffixes {
+		ret = append(ret,
+			fmt.Sprintf("%s.%s", strings.Replace(digest, ":", "-", 1), s))
+	}
+	return ret
+}
+
+// CopyReferrers copies the artifacts attached to the manifest with given
+// source ref over to the target repo. These are the manifests referring to it
+// as found via the referrers API, which are copied by digest, and the cosign
+// signature, attestation, and SBOM tags. Transfers are throttled with the
+// given throttle, if any, and aborted once ctx is done. Returns the number of
+// artifacts copied.
+func CopyReferrers(ctx context.Context, srcRef string,
+	srcCreds *auth.Credentials, srcInsecure bool, trgtRepo string,
+	trgtCreds *auth.Credentials, trgtInsecure bool,
+	throttle *util.Throttle) (int, error) {
+
+	r, err := gocrname.ParseReference(srcRef, nameOptions(srcRef)...)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ref '%s': %v", srcRef, err)
+	}
+	srcRepo := r.Context().Name()
+
+	digest, err := GetDigest(ctx, srcRef, srcCreds, srcInsecure)
+	if err != nil {
+		return 0, err
+	}
+
+	copied := 0
+
+	refs, err := ListReferrers(ctx,
+		fmt.Sprintf("%s@%s", srcRepo, digest), srcCreds, srcInsecure, "")
+	if err != nil && err != ErrReferrersNotSupported {
+		return copied, err
+	}
+	for _, ref := range refs {
+		if err := Copy(ctx,
+			fmt.Sprintf("%s@%s", srcRepo, ref.Digest), srcCreds,
+			srcInsecure, fmt.Sprintf("%s@%s", trgtRepo, ref.Digest),
+			trgtCreds, trgtInsecure, nil, throttle, ""); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+
+	for _, tag := range cosignTags(digest) {
+		src := fmt.Sprintf("%s:%s", srcRepo, tag)
+		exists, err := manifestExists(ctx, src, srcCreds, srcInsecure)
+		if err != nil {
+			return copied, err
+		}
+		if !exists {
+			continue
+		}
+		if err := Copy(ctx, src, srcCreds, srcInsecure,
+			fmt.Sprintf("%s:%s", trgtRepo, tag), trgtCreds, trgtInsecure,
+			nil, throttle, ""); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+
+	return copied, nil
+}
+
+//
+func manifestExists(ctx context.Context, ref string, creds *auth.Credentials,
+	insecure bool) (bool, error) {
+
+	r, err := gocrname.ParseReference(ref, nameOptions(ref)...)
+	if err != nil {
+		return false, fmt.Errorf("invalid ref '%s': %v", ref, err)
+	}
+
+	opts := remoteOptions(ctx, ref, creds, insecure, nil, "")
+	if _, err = gocrremote.Head(r, opts...); err != nil {
+		if terr, ok := err.(*gocrtransport.Error); ok &&
+			terr.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("error checking for '%s': %v", ref, err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,221 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gocrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+const (
+	signedDigest   = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	unsignedDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	sigType        = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	sbomType       = "application/spdx+json"
+)
+
+// newFakeRegistry creates a registry serving two tags, 'signed' with a
+// signature and an SBOM attached, and 'unsigned' with only an SBOM; with
+// supported set to false, it behaves like a registry that doesn't know the
+// referrers API
+func newFakeRegistry(supported bool) *httptest.Server {
+
+	digests := map[string]string{
+		"signed":   signedDigest,
+		"unsigned": unsignedDigest,
+	}
+
+	referrers := map[string]string{
+		signedDigest: fmt.Sprintf(`{"schemaVersion": 2,
+			"mediaType": "application/vnd.oci.image.index.v1+json",
+			"manifests": [
+				{"mediaType": "application/vnd.oci.image.manifest.v1+json",
+				 "artifactType": "%s", "size": 100,
+				 "digest": "sha256:aaaa"},
+				{"mediaType": "application/vnd.oci.image.manifest.v1+json",
+				 "artifactType": "%s", "size": 100,
+				 "digest": "sha256:bbbb"}]}`, sigType, sbomType),
+		unsignedDigest: fmt.Sprintf(`{"schemaVersion": 2,
+			"mediaType": "application/vnd.oci.image.index.v1+json",
+			"manifests": [
+				{"mediaType": "application/vnd.oci.image.manifest.v1+json",
+				 "artifactType": "%s", "size": 100,
+				 "digest": "sha256:cccc"}]}`, sbomType),
+	}
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			p := r.URL.Path
+
+			switch {
+
+			case p == "/v2/":
+				w.WriteHeader(http.StatusOK)
+
+			case strings.HasPrefix(p, "/v2/test/image/manifests/"):
+				d, ok := digests[p[len("/v2/test/image/manifests/"):]]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type",
+					"application/vnd.docker.distribution.manifest.v2+json")
+				w.Header().Set("Content-Length", "100")
+				w.Header().Set("Docker-Content-Digest", d)
+				w.WriteHeader(http.StatusOK)
+
+			case supported &&
+				strings.HasPrefix(p, "/v2/test/image/referrers/"):
+				idx, ok := referrers[p[len("/v2/test/image/referrers/"):]]
+				if !ok {
+					idx = `{"schemaVersion": 2, "manifests": []}`
+				}
+				w.Header().Set("Content-Type", ociImageIndex)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(idx))
+
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+}
+
+//
+func TestListReferrers(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := newFakeRegistry(true)
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	refs, err := ListReferrers(context.Background(),
+		reg+"/test/image:signed", nil, false, "")
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(refs))
+
+	refs, err = ListReferrers(context.Background(),
+		reg+"/test/image:signed", nil, false, sigType)
+	th.AssertNoError(err)
+	th.AssertEqual(1, len(refs))
+	th.AssertEqual("sha256:aaaa", refs[0].Digest)
+
+	refs, err = ListReferrers(context.Background(),
+		reg+"/test/image:unsigned", nil, false, sigType)
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(refs))
+
+	refs, err = ListReferrers(context.Background(),
+		reg+"/test/image@"+unsignedDigest, nil, false, sbomType)
+	th.AssertNoError(err)
+	th.AssertEqual(1, len(refs))
+}
+
+//
+func TestListReferrersNotSupported(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := newFakeRegistry(false)
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	_, err := ListReferrers(context.Background(),
+		reg+"/test/image:signed", nil, false, sigType)
+	th.AssertEqual(ErrReferrersNotSupported, err)
+}
+
+//
+func TestCopyReferrers(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var sbomDigest string
+	var imageDigest string
+
+	// in-memory registry, extended by a referrers API that reports the SBOM
+	// as the only referrer of the image
+	inner := gocrregistry.New()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v2/source/image/referrers/"+imageDigest {
+				w.Header().Set("Content-Type", ociImageIndex)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(fmt.Sprintf(`{"schemaVersion": 2,
+					"manifests": [{"mediaType": "%s", "artifactType": "%s",
+					"digest": "%s", "size": 100}]}`,
+					gocrtypes.OCIManifestSchema1, sbomType, sbomDigest)))
+				return
+			}
+			inner.ServeHTTP(w, r)
+		}))
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	push := func(ref string) string {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		r, err := gocrname.ParseReference(ref)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(r, img))
+		d, err := img.Digest()
+		th.AssertNoError(err)
+		return d.String()
+	}
+
+	imageDigest = push(reg + "/source/image:1.0")
+	push(reg + "/source/image:2.0")
+	sig := strings.Replace(imageDigest, ":", "-", 1) + ".sig"
+	push(reg + "/source/image:" + sig)
+	sbomDigest = push(reg + "/source/image:sbom-tmp")
+
+	n, err := CopyReferrers(context.Background(),
+		reg+"/source/image:1.0", nil, false, reg+"/target/image", nil, false,
+		nil)
+	th.AssertNoError(err)
+	th.AssertEqual(2, n)
+
+	d, err := GetDigest(context.Background(),
+		reg+"/target/image:"+sig, nil, false)
+	th.AssertNoError(err)
+	th.AssertNotEqual("", d)
+	_, err = GetDigest(context.Background(),
+		reg+"/target/image@"+sbomDigest, nil, false)
+	th.AssertNoError(err)
+
+	n, err = CopyReferrers(context.Background(),
+		reg+"/source/image:2.0", nil, false, reg+"/target/image", nil, false,
+		nil)
+	th.AssertNoError(err)
+	th.AssertEqual(0, n)
+}
@@ -0,0 +1,521 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	gocrauthn "github.com/google/go-containerregistry/pkg/authn"
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gocrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// RemoteOptions returns the options for remote operations on the given ref
+func RemoteOptions(ref string, creds *auth.Credentials,
+	insecure bool) []gocrremote.Option {
+	return remoteOptions(context.Background(), ref, creds, insecure, nil, "")
+}
+
+// remoteOptions is like RemoteOptions, but requests are aborted once ctx is
+// done, and all transfers, in both directions, are throttled with the given
+// throttle; when traceParent is set, it is sent as W3C trace context header
+// with every request
+func remoteOptions(ctx context.Context, ref string, creds *auth.Credentials,
+	insecure bool, throttle *util.Throttle,
+	traceParent string) []gocrremote.Option {
+
+	opts := []gocrremote.Option{
+		gocrremote.WithAuth(remoteAuthenticator(creds)),
+		gocrremote.WithContext(ctx),
+		gocrremote.WithTransport(
+			remoteTransport(ref, insecure, throttle, traceParent)),
+	}
+
+	if jobs := uploadsFrom(ctx).Jobs; jobs > 0 {
+		opts = append(opts, gocrremote.WithJobs(jobs))
+	}
+
+	return opts
+}
+
+// remoteTransport returns the transport for requests on behalf of the given
+// ref, throttled and traced as described for remoteOptions
+func remoteTransport(ref string, insecure bool, throttle *util.Throttle,
+	traceParent string) http.RoundTripper {
+
+	rt := transport(refRegistry(ref), insecure)
+	if throttle != nil {
+		rt = &throttledTransport{base: rt, throttle: throttle}
+	}
+	if traceParent != "" {
+		rt = &tracedTransport{base: rt, traceParent: traceParent}
+	}
+
+	return rt
+}
+
+//
+func remoteAuthenticator(creds *auth.Credentials) gocrauthn.Authenticator {
+	if creds != nil && (creds.Username() != "" || creds.Password() != "") {
+		return &gocrauthn.Basic{
+			Username: creds.Username(),
+			Password: creds.Password(),
+		}
+	}
+	return gocrauthn.Anonymous
+}
+
+// throttledTransport throttles request and response bodies
+type throttledTransport struct {
+	base     http.RoundTripper
+	throttle *util.Throttle
+}
+
+//
+func (t *throttledTransport) RoundTrip(req *http.Request) (
+	*http.Response, error) {
+
+	if req.Body != nil {
+		req = req.Clone(req.Context())
+		req.Body = t.throttle.ReadCloser(req.Body)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		resp.Body = t.throttle.ReadCloser(resp.Body)
+	}
+
+	return resp, err
+}
+
+// tracedTransport adds a W3C trace context header to requests
+type tracedTransport struct {
+	base        http.RoundTripper
+	traceParent string
+}
+
+//
+func (t *tracedTransport) RoundTrip(req *http.Request) (
+	*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("traceparent", t.traceParent)
+	return t.base.RoundTrip(req)
+}
+
+// ListTags lists the tags of the repository of given ref; listing is aborted
+// once ctx is done
+func ListTags(ctx context.Context, ref string, creds *auth.Credentials,
+	insecure bool) ([]string, error) {
+
+	if isLayoutRef(ref) {
+		tags, err := stagedLayoutTags(ctx, ref, creds)
+		if err != nil {
+			return nil, fmt.Errorf("error listing tags for '%s': %v", ref, err)
+		}
+		return tags, nil
+	}
+
+	repo, err := gocrname.NewRepository(ref, nameOptions(ref)...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ref '%s': %v", ref, err)
+	}
+
+	tags, err := gocrremote.List(
+		repo, remoteOptions(ctx, ref, creds, insecure, nil, "")...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tags for '%s': %v", ref, err)
+	}
+
+	return tags, nil
+}
+
+// ListTagsIfExists is like ListTags, but returns no tags instead of an error
+// when the repository does not exist
+func ListTagsIfExists(ctx context.Context, ref string,
+	creds *auth.Credentials, insecure bool) ([]string, error) {
+
+	if isLayoutRef(ref) {
+		tags, err := stagedLayoutTags(ctx, ref, creds)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("error listing tags for '%s': %v", ref, err)
+		}
+		return tags, nil
+	}
+
+	repo, err := gocrname.NewRepository(ref, nameOptions(ref)...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ref '%s': %v", ref, err)
+	}
+
+	tags, err := gocrremote.List(
+		repo, remoteOptions(ctx, ref, creds, insecure, nil, "")...)
+	if err != nil {
+		if terr, ok := err.(*gocrtransport.Error); ok &&
+			terr.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error listing tags for '%s': %v", ref, err)
+	}
+
+	return tags, nil
+}
+
+// GetDigest returns the digest of the manifest with given ref; requests are
+// aborted once ctx is done
+func GetDigest(ctx context.Context, ref string, creds *auth.Credentials,
+	insecure bool) (string, error) {
+
+	if isLayoutRef(ref) {
+		desc, err := stagedLayoutDescriptor(ctx, ref, creds)
+		if err != nil {
+			return "", fmt.Errorf(
+				"error getting digest for '%s': %v", ref, err)
+		}
+		return desc.Digest.String(), nil
+	}
+
+	r, err := gocrname.ParseReference(ref, nameOptions(ref)...)
+	if err != nil {
+		return "", fmt.Errorf("invalid ref '%s': %v", ref, err)
+	}
+
+	desc, err := gocrremote.Head(
+		r, remoteOptions(ctx, ref, creds, insecure, nil, "")...)
+	if err != nil {
+		return "", fmt.Errorf("error getting digest for '%s': %v", ref, err)
+	}
+
+	return desc.Digest.String(), nil
+}
+
+// GetDigestIfExists is like GetDigest, but returns an empty digest if ref does
+// not exist
+func GetDigestIfExists(ctx context.Context, ref string,
+	creds *auth.Credentials, insecure bool) (string, error) {
+
+	if isLayoutRef(ref) {
+		desc, err := stagedLayoutDescriptor(ctx, ref, creds)
+		if err != nil {
+			if _, ok := err.(notInLayoutError); ok || os.IsNotExist(err) {
+				return "", nil
+			}
+			return "", fmt.Errorf(
+				"error getting digest for '%s': %v", ref, err)
+		}
+		return desc.Digest.String(), nil
+	}
+
+	r, err := gocrname.ParseReference(ref, nameOptions(ref)...)
+	if err != nil {
+		return "", fmt.Errorf("invalid ref '%s': %v", ref, err)
+	}
+
+	desc, err := gocrremote.Head(
+		r, remoteOptions(ctx, ref, creds, insecure, nil, "")...)
+	if err != nil {
+		if terr, ok := err.(*gocrtransport.Error); ok &&
+			terr.StatusCode == http.StatusNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("error getting digest for '%s': %v", ref, err)
+	}
+
+	return desc.Digest.String(), nil
+}
+
+// GetManifestDigestAndSize returns digest and size of the manifest with given
+// ref, as given in its descriptor
+func GetManifestDigestAndSize(ref string, creds *auth.Credentials,
+	insecure bool) (string, int64, error) {
+
+	r, err := gocrname.ParseReference(ref, nameOptions(ref)...)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid ref '%s': %v", ref, err)
+	}
+
+	desc, err := gocrremote.Head(r, RemoteOptions(ref, creds, insecure)...)
+	if err != nil {
+		return "", 0, fmt.Errorf("error getting '%s': %v", ref, err)
+	}
+
+	return desc.Digest.String(), desc.Size, nil
+}
+
+// GetDigestAndSize returns digest and size of the image or image index with
+// given ref; the size is the compressed size of config and layers, for an
+// index summed up across all of its images
+func GetDigestAndSize(ref string, creds *auth.Credentials, insecure bool) (
+	string, int64, error) {
+
+	idx, img, err := readSource(
+		context.Background(), ref, creds, insecure, nil, "")
+	if err != nil {
+		return "", 0, err
+	}
+
+	var digest gocrv1.Hash
+	var size int64
+
+	if idx != nil {
+		if digest, err = idx.Digest(); err != nil {
+			return "", 0, fmt.Errorf("error getting index '%s': %v", ref, err)
+		}
+		im, err := idx.IndexManifest()
+		if err != nil {
+			return "", 0, fmt.Errorf("error getting index '%s': %v", ref, err)
+		}
+		for _, m := range im.Manifests {
+			if !m.MediaType.IsImage() {
+				continue
+			}
+			img, err := idx.Image(m.Digest)
+			if err != nil {
+				return "", 0, fmt.Errorf(
+					"error getting image '%s' of '%s': %v", m.Digest, ref, err)
+			}
+			s, err := imageSize(img)
+			if err != nil {
+				return "", 0, fmt.Errorf(
+					"error getting size of '%s': %v", ref, err)
+			}
+			size += s
+		}
+
+	} else {
+		if digest, err = img.Digest(); err != nil {
+			return "", 0, fmt.Errorf("error getting image '%s': %v", ref, err)
+		}
+		if size, err = imageSize(img); err != nil {
+			return "", 0, fmt.Errorf("error getting size of '%s': %v", ref, err)
+		}
+	}
+
+	return digest.String(), size, nil
+}
+
+// readSource returns the image index or image, whichever it is, with given
+// ref from a registry or layout; parameters are as for remoteOptions
+func readSource(ctx context.Context, ref string, creds *auth.Credentials,
+	insecure bool, throttle *util.Throttle, traceParent string) (
+	gocrv1.ImageIndex, gocrv1.Image, error) {
+
+	if isLayoutRef(ref) {
+		idx, img, err := readStagedLayout(ctx, ref, creds)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting '%s': %v", ref, err)
+		}
+		return idx, img, nil
+	}
+
+	r, err := gocrname.ParseReference(ref, nameOptions(ref)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid ref '%s': %v", ref, err)
+	}
+
+	desc, err := gocrremote.Get(r, remoteOptions(
+		ctx, ref, creds, insecure, throttle, traceParent)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting '%s': %v", ref, err)
+	}
+
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, nil, fmt.Errorf(
+				"error getting index '%s': %v", ref, err)
+		}
+		return idx, nil, nil
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting image '%s': %v", ref, err)
+	}
+	return nil, img, nil
+}
+
+// imageSize returns the compressed size of config and layers of img
+func imageSize(img gocrv1.Image) (int64, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return 0, err
+	}
+	size := m.Config.Size
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+	return size, nil
+}
+
+// GetCreated returns the creation time recorded in the config of the image
+// with given ref; for an image index, the image for the default platform is
+// used; requests are aborted once ctx is done
+func GetCreated(ctx context.Context, ref string, creds *auth.Credentials,
+	insecure bool) (time.Time, error) {
+
+	var img gocrv1.Image
+
+	if isLayoutRef(ref) {
+		lref, err := stageLayout(ctx, ref, creds, true)
+		if err == nil {
+			img, err = layoutImage(lref)
+		}
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error getting '%s': %v", ref, err)
+		}
+
+	} else {
+		r, err := gocrname.ParseReference(ref, nameOptions(ref)...)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid ref '%s': %v", ref, err)
+		}
+		img, err = gocrremote.Image(
+			r, remoteOptions(ctx, ref, creds, insecure, nil, "")...)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error getting '%s': %v", ref, err)
+		}
+	}
+
+	conf, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, fmt.Errorf(
+			"error getting config for '%s': %v", ref, err)
+	}
+
+	return conf.Created.Time, nil
+}
+
+// ListUntagged lists the digests of all manifests in the repo of given ref
+// that are not referenced by any tag; the standard registry API does not
+// support this, so we can only do this for registries that have extensions
+// for this
+func ListUntagged(ref string, creds *auth.Credentials, insecure bool) (
+	[]string, error) {
+
+	reg, path, _ := util.SplitRef(ref)
+
+	if isECR, region, account := IsECR(reg); isECR {
+		return listUntaggedECR(region, account, creds, path)
+	}
+
+	if IsGCR(reg) {
+		return listUntaggedGCR(ref, creds, insecure)
+	}
+
+	return nil, fmt.Errorf(
+		"registry '%s' does not support listing untagged manifests", reg)
+}
+
+// Copy transfers the image or image index with given source ref directly to
+// the target ref; refs may either point to a tag or a digest; when platforms
+// are given, an image index is reduced to the manifests for those platforms
+// before copying, while single images are copied as they are; with a throttle,
+// transfers from source and to target are throttled; traceParent, if set, is
+// propagated to both registries; the copy is aborted once ctx is done; either
+// ref may also point into an OCI image layout, see LayoutPrefix and S3Prefix
+func Copy(ctx context.Context,
+	srcRef string, srcCreds *auth.Credentials, srcInsecure bool,
+	trgtRef string, trgtCreds *auth.Credentials, trgtInsecure bool,
+	platforms []string, throttle *util.Throttle, traceParent string) error {
+
+	filter, err := ParsePlatforms(platforms)
+	if err != nil {
+		return err
+	}
+
+	idx, img, err := readSource(
+		ctx, srcRef, srcCreds, srcInsecure, throttle, traceParent)
+	if err != nil {
+		return err
+	}
+
+	if idx != nil && len(filter) > 0 {
+		if idx, err = filterIndex(idx, filter); err != nil {
+			return fmt.Errorf("error filtering index '%s': %v", srcRef, err)
+		}
+	}
+
+	if isLayoutRef(trgtRef) {
+		if IsS3(trgtRef) {
+			err = writeS3(ctx, trgtRef, trgtCreds, idx, img)
+		} else {
+			err = writeLayout(trgtRef, idx, img)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing '%s': %v", trgtRef, err)
+		}
+		return nil
+	}
+
+	trgt, err := gocrname.ParseReference(trgtRef, nameOptions(trgtRef)...)
+	if err != nil {
+		return fmt.Errorf("invalid target ref '%s': %v", trgtRef, err)
+	}
+
+	cache := blobCacheFrom(ctx)
+	if cache != nil {
+		m := &blobMounter{cache: cache, trgt: trgt.Context()}
+		if idx != nil {
+			idx = m.index(idx)
+		} else {
+			img = m.image(img)
+		}
+	}
+
+	if uploadsFrom(ctx).ChunkSize > 0 {
+		// blobs uploaded here are found to exist when writing below
+		if err := uploadChunked(ctx, trgt.Context(), trgtRef, trgtCreds,
+			trgtInsecure, throttle, traceParent, idx, img); err != nil {
+			return fmt.Errorf("error uploading blobs to '%s': %v", trgtRef, err)
+		}
+	}
+
+	trgtOpts := remoteOptions(
+		ctx, trgtRef, trgtCreds, trgtInsecure, throttle, traceParent)
+
+	if idx != nil {
+		if err := gocrremote.WriteIndex(trgt, idx, trgtOpts...); err != nil {
+			return fmt.Errorf("error writing index '%s': %v", trgtRef, err)
+		}
+	} else if err := gocrremote.Write(trgt, img, trgtOpts...); err != nil {
+		return fmt.Errorf("error writing image '%s': %v", trgtRef, err)
+	}
+
+	if cache != nil {
+		if !isLayoutRef(srcRef) {
+			if src, err := gocrname.ParseReference(
+				srcRef, nameOptions(srcRef)...); err == nil {
+				recordBlobs(cache, src.Context(), idx, img)
+			}
+		}
+		recordBlobs(cache, trgt.Context(), idx, img)
+	}
+
+	return nil
+}
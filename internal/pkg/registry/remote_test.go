@@ -0,0 +1,156 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+//
+func TestCopyThrottled(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// separate registries for source and target, since the in-memory registry
+	// shares blobs across repos
+	srcSrv := httptest.NewServer(gocrregistry.New())
+	defer srcSrv.Close()
+	src := strings.TrimPrefix(srcSrv.URL, "http://") + "/source/image:1.0"
+
+	trgtSrv := httptest.NewServer(gocrregistry.New())
+	defer trgtSrv.Close()
+	trgt := strings.TrimPrefix(trgtSrv.URL, "http://") + "/target/image:1.0"
+
+	img, err := gocrrandom.Image(100*1024, 2)
+	th.AssertNoError(err)
+	ref, err := gocrname.NewTag(src)
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(ref, img))
+
+	// layers are pulled from source and pushed to target, i.e. about 400KB
+	// need to be transferred in total
+	start := time.Now()
+	th.AssertNoError(Copy(context.Background(), src, nil, false, trgt, nil,
+		false, nil, util.NewThrottle(400*1024), ""))
+	th.AssertTrue(time.Since(start) > 800*time.Millisecond)
+
+	srcDigest, err := GetDigest(context.Background(), src, nil, false)
+	th.AssertNoError(err)
+	trgtDigest, err := GetDigest(context.Background(), trgt, nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(srcDigest, trgtDigest)
+
+	th.AssertTrue(util.NewThrottle(0) == nil)
+}
+
+//
+func TestGetDigestAndSize(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	img, err := gocrrandom.Image(1024, 2)
+	th.AssertNoError(err)
+	ref, err := gocrname.NewTag(reg + "/image:1.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(ref, img))
+
+	m, err := img.Manifest()
+	th.AssertNoError(err)
+	wantSize := m.Config.Size + m.Layers[0].Size + m.Layers[1].Size
+	wantDigest, err := img.Digest()
+	th.AssertNoError(err)
+
+	digest, size, err := GetDigestAndSize(reg+"/image:1.0", nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(wantDigest.String(), digest)
+	th.AssertEqual(wantSize, size)
+
+	idx, err := gocrrandom.Index(1024, 1, 3)
+	th.AssertNoError(err)
+	ref, err = gocrname.NewTag(reg + "/index:1.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.WriteIndex(ref, idx))
+
+	_, size, err = GetDigestAndSize(reg+"/index:1.0", nil, false)
+	th.AssertNoError(err)
+	th.AssertTrue(size > 3*1024)
+
+	_, _, err = GetDigestAndSize(reg+"/nope:1.0", nil, false)
+	th.AssertError(err, "error getting")
+}
+
+//
+func TestHungRegistry(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// registry that never responds
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			<-req.Context().Done()
+		}))
+	defer srv.Close()
+	ref := strings.TrimPrefix(srv.URL, "http://") + "/hung/image:1.0"
+
+	calls := map[string]func(ctx context.Context) error{
+		"GetDigest": func(ctx context.Context) error {
+			_, err := GetDigest(ctx, ref, nil, false)
+			return err
+		},
+		"GetDigestIfExists": func(ctx context.Context) error {
+			_, err := GetDigestIfExists(ctx, ref, nil, false)
+			return err
+		},
+		"GetCreated": func(ctx context.Context) error {
+			_, err := GetCreated(ctx, ref, nil, false)
+			return err
+		},
+		"ListReferrers": func(ctx context.Context) error {
+			_, err := ListReferrers(ctx, ref, nil, false, "")
+			return err
+		},
+	}
+
+	for name, call := range calls {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), 200*time.Millisecond)
+		start := time.Now()
+		err := call(ctx)
+		cancel()
+		th.AssertError(err, "context deadline exceeded")
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("%s not aborted when context was done", name)
+		}
+	}
+}
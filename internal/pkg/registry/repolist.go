@@ -37,12 +37,13 @@ const (
 	Catalog   ListSourceType = "catalog"
 	DockerHub                = "dockerhub"
 	Index                    = "index"
+	GitLab                   = "gitlab"
 )
 
 //
 func (t ListSourceType) IsValid() bool {
 	switch t {
-	case Catalog, DockerHub, Index:
+	case Catalog, DockerHub, Index, GitLab:
 		return true
 	}
 	return false
@@ -93,6 +94,26 @@ func NewRepoList(registry string, insecure bool, typ ListSourceType,
 			return nil, fmt.Errorf("index lister requires a search expression")
 		}
 
+	case GitLab:
+		group := config["group"]
+		if group == "" {
+			return nil, fmt.Errorf("gitlab lister requires a group")
+		}
+		api := config["url"]
+		if api == "" {
+			api = DefaultGitLabURL(registry)
+		}
+		if api == "" {
+			return nil, fmt.Errorf(
+				"gitlab lister requires the URL of the GitLab instance")
+		}
+		list.source = newGitLab(&GitLabAPI{
+			URL:       api,
+			Token:     creds.Password(),
+			TokenType: config["token-type"],
+			Insecure:  insecure,
+		}, group)
+
 	case Catalog, "":
 		isECR, region, account := IsECR(registry)
 		if isECR {
@@ -102,7 +123,7 @@ func NewRepoList(registry string, insecure bool, typ ListSourceType,
 			// lib; if the registry is ECR we therefore use a dedicated ECR
 			// lister based on the AWS Go SDK
 			log.Info("using dedicated ECR lister instead of standard catalog")
-			list.source = newECR(registry, region, account)
+			list.source = newECR(registry, region, account, creds)
 		} else {
 			list.source = newCatalog(registry, insecure,
 				strings.HasSuffix(server, ".gcr.io"), listCreds)
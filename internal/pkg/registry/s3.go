@@ -0,0 +1,449 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+)
+
+// S3Prefix marks a location as an S3 bucket, optionally with a key prefix,
+// e.g. 's3://mirror/export'; each repository becomes an OCI image layout
+// under the key given by its path; layouts are staged in a local directory,
+// to which they are downloaded before reading, and from which they are
+// uploaded after writing
+const S3Prefix = "s3://"
+
+// S3Config holds the settings for an S3 location
+type S3Config struct {
+	Endpoint   string `yaml:"endpoint"`
+	Region     string `yaml:"region"`
+	PathStyle  bool   `yaml:"path-style"`
+	StagingDir string `yaml:"staging-dir"`
+}
+
+// Validate checks the settings, and sets the default staging directory when
+// none is set
+func (c *S3Config) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.StagingDir == "" {
+		c.StagingDir = filepath.Join(os.TempDir(), "dregsy-s3")
+	}
+
+	return nil
+}
+
+// S3 locations, keyed by their registry name, i.e. s3://{bucket}[/{prefix}]
+var s3Locations = make(map[string]S3Config)
+var s3LocationsMutex sync.Mutex
+
+// serializes staging, so that concurrent syncs don't interleave updates of a
+// layout's index.json
+var s3StagingMutex sync.Mutex
+
+// newS3Client is replaced in tests
+var newS3Client = func(conf S3Config, creds *auth.Credentials) (
+	s3iface.S3API, error) {
+
+	sess, err := auth.NewAWSSession(creds)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &aws.Config{}
+	if conf.Region != "" {
+		c.Region = aws.String(conf.Region)
+	}
+	if conf.Endpoint != "" {
+		c.Endpoint = aws.String(conf.Endpoint)
+	}
+	if conf.PathStyle {
+		c.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	return s3.New(sess, c), nil
+}
+
+// IsS3 checks whether ref, or registry name, denotes an S3 location
+func IsS3(ref string) bool {
+	return strings.HasPrefix(ref, S3Prefix)
+}
+
+// isLayoutRef checks whether ref points into an OCI image layout, either
+// local or in S3
+func isLayoutRef(ref string) bool {
+	return IsLayout(ref) || IsS3(ref)
+}
+
+// SetS3 registers the settings for the given S3 location; setting different
+// settings for the same location is an error
+func SetS3(registry string, conf *S3Config) error {
+
+	if conf == nil {
+		conf = &S3Config{}
+	}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	registry = strings.TrimSuffix(registry, "/")
+	if b, _, _ := splitS3Ref(registry); b == "" {
+		return fmt.Errorf("'%s' has no bucket", registry)
+	}
+
+	s3LocationsMutex.Lock()
+	defer s3LocationsMutex.Unlock()
+
+	if c, ok := s3Locations[registry]; ok && c != *conf {
+		return fmt.Errorf("conflicting 's3' settings for '%s'", registry)
+	}
+
+	s3Locations[registry] = *conf
+	return nil
+}
+
+// s3ConfigFor returns the settings of the S3 location that contains ref; if
+// several do, the one with the longest prefix is used
+func s3ConfigFor(ref string) S3Config {
+
+	s3LocationsMutex.Lock()
+	defer s3LocationsMutex.Unlock()
+
+	var regs []string
+	for r := range s3Locations {
+		if ref == r || strings.HasPrefix(ref, r+"/") {
+			regs = append(regs, r)
+		}
+	}
+
+	if len(regs) == 0 {
+		c := S3Config{}
+		c.Validate()
+		return c
+	}
+
+	sort.Slice(regs, func(i, j int) bool { return len(regs[i]) > len(regs[j]) })
+	return s3Locations[regs[0]]
+}
+
+// splitS3Ref splits a ref of the form s3://{bucket}/{key}[:{tag}|@{digest}]
+// into bucket, and the key with tag or digest
+func splitS3Ref(ref string) (bucket, key, rest string) {
+	p := strings.TrimPrefix(ref, S3Prefix)
+	bucket = p
+	if ix := strings.Index(p, "/"); ix > -1 {
+		bucket, p = p[:ix], p[ix+1:]
+	} else {
+		p = ""
+	}
+	key, tag, digest := splitLayoutPath(p)
+	switch {
+	case tag != "":
+		rest = ":" + tag
+	case digest != "":
+		rest = "@" + digest
+	}
+	return bucket, key, rest
+}
+
+// s3Layout is the layout of a repository in S3, together with its staging
+// directory
+type s3Layout struct {
+	bucket string
+	key    string
+	rest   string
+	local  string
+	client s3iface.S3API
+}
+
+//
+func newS3Layout(ref string, creds *auth.Credentials) (*s3Layout, error) {
+
+	bucket, key, rest := splitS3Ref(ref)
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("'%s' has no bucket or repository", ref)
+	}
+
+	conf := s3ConfigFor(ref)
+	client, err := newS3Client(conf, creds)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create S3 client: %v", err)
+	}
+
+	return &s3Layout{
+		bucket: bucket,
+		key:    key,
+		rest:   rest,
+		local:  filepath.Join(conf.StagingDir, bucket, filepath.FromSlash(key)),
+		client: client,
+	}, nil
+}
+
+// ref returns the ref for the staged layout, including tag or digest
+func (l *s3Layout) ref() string {
+	return LayoutPrefix + l.local + l.rest
+}
+
+// stageLayout returns the ref of the local layout for the given layout ref;
+// for an S3 ref, the layout is downloaded into its staging directory first,
+// with all blobs if blobs is true, otherwise only its index.json; when there
+// is no such layout, the returned error satisfies os.IsNotExist
+func stageLayout(ctx context.Context, ref string, creds *auth.Credentials,
+	blobs bool) (string, error) {
+
+	if !IsS3(ref) {
+		return ref, nil
+	}
+
+	l, err := newS3Layout(ref, creds)
+	if err != nil {
+		return "", err
+	}
+
+	s3StagingMutex.Lock()
+	defer s3StagingMutex.Unlock()
+
+	if err := l.download(ctx, blobs); err != nil {
+		return "", err
+	}
+	return l.ref(), nil
+}
+
+// download downloads the layout into its staging directory; blobs that are
+// already staged are skipped
+func (l *s3Layout) download(ctx context.Context, blobs bool) error {
+
+	if !blobs {
+		for _, f := range []string{"oci-layout", "index.json"} {
+			err := l.get(ctx, f)
+			if isNoSuchKey(err) {
+				// drop a stale index from an earlier staging
+				os.Remove(filepath.Join(l.local, "index.json"))
+				return &os.PathError{
+					Op: "stage", Path: l.key, Err: os.ErrNotExist}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	files, err := l.list(ctx)
+	if err != nil {
+		return err
+	}
+	if !files["index.json"] {
+		os.Remove(filepath.Join(l.local, "index.json"))
+		return &os.PathError{Op: "stage", Path: l.key, Err: os.ErrNotExist}
+	}
+
+	for f := range files {
+		if strings.HasPrefix(f, "blobs/") {
+			if _, err := os.Stat(l.localFile(f)); err == nil {
+				continue
+			}
+		}
+		if err := l.get(ctx, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upload uploads the staged layout; blobs already in the bucket are skipped,
+// and index.json is uploaded last, so that it never references missing blobs
+func (l *s3Layout) upload(ctx context.Context) error {
+
+	existing, err := l.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	var files []string
+	walk := func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			return err
+		}
+		rel, err := filepath.Rel(l.local, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(rel, "blobs/") && existing[rel] {
+			return nil
+		}
+		if strings.HasPrefix(rel, "blobs/") || rel == "oci-layout" {
+			files = append(files, rel)
+		}
+		return nil
+	}
+	if err := filepath.Walk(l.local, walk); err != nil {
+		return err
+	}
+
+	for _, f := range append(files, "index.json") {
+		if err := l.put(ctx, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// list returns the files of the layout in the bucket, relative to the layout
+func (l *s3Layout) list(ctx context.Context) (map[string]bool, error) {
+
+	prefix := l.key + "/"
+	ret := make(map[string]bool)
+
+	err := l.client.ListObjectsV2PagesWithContext(ctx,
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(l.bucket),
+			Prefix: aws.String(prefix),
+		},
+		func(out *s3.ListObjectsV2Output, last bool) bool {
+			for _, o := range out.Contents {
+				ret[strings.TrimPrefix(aws.StringValue(o.Key), prefix)] = true
+			}
+			return true
+		})
+	if err != nil {
+		return nil, fmt.Errorf("error listing 's3://%s/%s': %v",
+			l.bucket, prefix, err)
+	}
+
+	return ret, nil
+}
+
+// get downloads file f of the layout into the staging directory
+func (l *s3Layout) get(ctx context.Context, f string) error {
+
+	out, err := l.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(l.key + "/" + f),
+	})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return err
+		}
+		return fmt.Errorf("error downloading 's3://%s/%s/%s': %v",
+			l.bucket, l.key, f, err)
+	}
+	defer out.Body.Close()
+
+	dst := l.localFile(f)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that readers never see a partial
+	// download
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, out.Body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error downloading 's3://%s/%s/%s': %v",
+			l.bucket, l.key, f, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+// put uploads file f of the staged layout
+func (l *s3Layout) put(ctx context.Context, f string) error {
+
+	in, err := os.Open(l.localFile(f))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, err := l.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(l.bucket),
+		Key:    aws.String(l.key + "/" + f),
+		Body:   in,
+	}); err != nil {
+		return fmt.Errorf("error uploading 's3://%s/%s/%s': %v",
+			l.bucket, l.key, f, err)
+	}
+
+	return nil
+}
+
+//
+func (l *s3Layout) localFile(f string) string {
+	return filepath.Join(l.local, filepath.FromSlash(f))
+}
+
+// writeS3 writes the given image index or image to the S3 layout of given
+// ref, under the ref's tag; the layout's index.json is staged and updated
+// locally, and the new blobs are then uploaded together with it
+func writeS3(ctx context.Context, ref string, creds *auth.Credentials,
+	idx gocrv1.ImageIndex, img gocrv1.Image) error {
+
+	l, err := newS3Layout(ref, creds)
+	if err != nil {
+		return err
+	}
+
+	s3StagingMutex.Lock()
+	defer s3StagingMutex.Unlock()
+
+	if err := l.download(ctx, false); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := writeLayout(l.ref(), idx, img); err != nil {
+		return err
+	}
+
+	return l.upload(ctx)
+}
+
+//
+func isNoSuchKey(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == s3.ErrCodeNoSuchKey
+}
@@ -0,0 +1,197 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// fakeS3 is an in-memory bucket store implementing the S3 calls we use
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+	puts    []string
+	mutex   sync.Mutex
+}
+
+//
+func (f *fakeS3) ListObjectsV2PagesWithContext(_ aws.Context,
+	in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool,
+	_ ...request.Option) error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	out := &s3.ListObjectsV2Output{}
+	prefix := aws.StringValue(in.Bucket) + "/" + aws.StringValue(in.Prefix)
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			key := strings.TrimPrefix(k, aws.StringValue(in.Bucket)+"/")
+			out.Contents = append(out.Contents,
+				&s3.Object{Key: aws.String(key)})
+		}
+	}
+	fn(out, true)
+	return nil
+}
+
+//
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, in *s3.GetObjectInput,
+	_ ...request.Option) (*s3.GetObjectOutput, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := aws.StringValue(in.Bucket) + "/" + aws.StringValue(in.Key)
+	data, ok := f.objects[key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)
+	}
+	return &s3.GetObjectOutput{
+		Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+//
+func (f *fakeS3) PutObjectWithContext(_ aws.Context, in *s3.PutObjectInput,
+	_ ...request.Option) (*s3.PutObjectOutput, error) {
+
+	data, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)] = data
+	f.puts = append(f.puts, aws.StringValue(in.Key))
+	return &s3.PutObjectOutput{}, nil
+}
+
+//
+func TestSplitS3Ref(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, tc := range []struct{ ref, bucket, key, rest string }{
+		{"s3://mirror", "mirror", "", ""},
+		{"s3://mirror/export/busybox", "mirror", "export/busybox", ""},
+		{"s3://mirror/export/busybox:1.36", "mirror", "export/busybox",
+			":1.36"},
+		{"s3://mirror/busybox@sha256:abc", "mirror", "busybox", "@sha256:abc"},
+	} {
+		bucket, key, rest := splitS3Ref(tc.ref)
+		th.AssertEqual(tc.bucket, bucket)
+		th.AssertEqual(tc.key, key)
+		th.AssertEqual(tc.rest, rest)
+	}
+}
+
+//
+func TestS3ExportImport(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	bucket := &fakeS3{objects: make(map[string][]byte)}
+	orig := newS3Client
+	newS3Client = func(S3Config, *auth.Credentials) (s3iface.S3API, error) {
+		return bucket, nil
+	}
+	defer func() { newS3Client = orig }()
+
+	reg := "s3://mirror/export"
+	defer delete(s3Locations, reg)
+	th.AssertNoError(SetS3(reg, &S3Config{StagingDir: t.TempDir()}))
+	th.AssertError(SetS3(reg, &S3Config{StagingDir: t.TempDir()}),
+		"conflicting 's3' settings")
+
+	srcSrv := httptest.NewServer(gocrregistry.New())
+	defer srcSrv.Close()
+	src := strings.TrimPrefix(srcSrv.URL, "http://") + "/source/image"
+
+	trgtSrv := httptest.NewServer(gocrregistry.New())
+	defer trgtSrv.Close()
+	trgt := strings.TrimPrefix(trgtSrv.URL, "http://") + "/target/image"
+
+	ctx := context.Background()
+	layout := reg + "/image"
+
+	tags, err := ListTagsIfExists(ctx, layout, nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(tags))
+
+	img, err := gocrrandom.Image(1024, 2)
+	th.AssertNoError(err)
+	ref, err := gocrname.NewTag(src + ":1.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(ref, img))
+	idx, err := gocrrandom.Index(1024, 1, 2)
+	th.AssertNoError(err)
+	ref, err = gocrname.NewTag(src + ":2.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.WriteIndex(ref, idx))
+
+	// export, index.json is uploaded last
+	th.AssertNoError(Copy(ctx, src+":1.0", nil, false, layout+":1.0", nil,
+		false, nil, nil, ""))
+	th.AssertEqual("export/image/index.json", bucket.puts[len(bucket.puts)-1])
+	th.AssertNoError(Copy(ctx, src+":2.0", nil, false, layout+":2.0", nil,
+		false, nil, nil, ""))
+
+	tags, err = ListTags(ctx, layout, nil, false)
+	th.AssertNoError(err)
+	th.AssertEquivalentSlices([]string{"1.0", "2.0"}, tags)
+
+	// import on the other side, with an empty staging directory
+	delete(s3Locations, reg)
+	th.AssertNoError(SetS3(reg, &S3Config{StagingDir: t.TempDir()}))
+
+	for _, tag := range []string{"1.0", "2.0"} {
+		th.AssertNoError(Copy(ctx, layout+":"+tag, nil, false,
+			trgt+":"+tag, nil, false, nil, nil, ""))
+		srcDigest, err := GetDigest(context.Background(),
+			src+":"+tag, nil, false)
+		th.AssertNoError(err)
+		layoutDigest, err := GetDigest(context.Background(),
+			layout+":"+tag, nil, false)
+		th.AssertNoError(err)
+		trgtDigest, err := GetDigest(context.Background(),
+			trgt+":"+tag, nil, false)
+		th.AssertNoError(err)
+		th.AssertEqual(srcDigest, layoutDigest)
+		th.AssertEqual(srcDigest, trgtDigest)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// TLSConfig holds a custom CA bundle, and a client certificate for mutual TLS,
+// to use when talking to a registry
+type TLSConfig struct {
+	CAFile   string `yaml:"ca-file"`
+	CertFile string `yaml:"cert-file"`
+	KeyFile  string `yaml:"key-file"`
+}
+
+//
+func (c *TLSConfig) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" {
+		return errors.New(
+			"needs at least one of 'ca-file', or 'cert-file' & 'key-file'")
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("'cert-file' and 'key-file' need to be set together")
+	}
+
+	_, err := c.load()
+	return err
+}
+
+// load creates the TLS client config for these settings
+func (c *TLSConfig) load() (*tls.Config, error) {
+
+	ret := &tls.Config{}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read 'ca-file': %v", err)
+		}
+		// the CA bundle is added to the system's CAs, so that registries
+		// redirecting to public storage keep working
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf(
+				"'ca-file' '%s' contains no PEM encoded certificates", c.CAFile)
+		}
+		ret.RootCAs = pool
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %v", err)
+		}
+		ret.Certificates = []tls.Certificate{cert}
+	}
+
+	return ret, nil
+}
+
+// registries with custom TLS settings, keyed by host name and port as they
+// appear in request URLs
+var tlsHosts = make(map[string]*tlsHost)
+var tlsHostsMutex sync.Mutex
+
+//
+type tlsHost struct {
+	conf TLSConfig
+	tls  *tls.Config
+}
+
+// SetTLS makes all requests to the given registry use the given TLS settings;
+// setting different TLS settings for the same registry is an error
+func SetTLS(registry string, conf *TLSConfig) error {
+
+	if conf == nil {
+		return nil
+	}
+
+	tlsHostsMutex.Lock()
+	defer tlsHostsMutex.Unlock()
+
+	if h, ok := tlsHosts[registry]; ok {
+		if h.conf != *conf {
+			return fmt.Errorf(
+				"conflicting 'tls' settings for registry '%s'", registry)
+		}
+		return nil
+	}
+
+	tlsConf, err := conf.load()
+	if err != nil {
+		return err
+	}
+
+	tlsHosts[registry] = &tlsHost{conf: *conf, tls: tlsConf}
+	return nil
+}
+
+// tlsFor returns the TLS client config for the given host, or nil if there
+// are no custom TLS settings for it
+func tlsFor(host string) *tls.Config {
+	tlsHostsMutex.Lock()
+	defer tlsHostsMutex.Unlock()
+	if h, ok := tlsHosts[host]; ok {
+		return h.tls
+	}
+	return nil
+}
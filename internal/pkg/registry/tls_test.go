@@ -0,0 +1,116 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestTLS(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-tls")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	// self-signed client certificate, which the server trusts
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	th.AssertNoError(err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dregsy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey,
+		key)
+	th.AssertNoError(err)
+	clientCert, err := x509.ParseCertificate(der)
+	th.AssertNoError(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	th.AssertNoError(err)
+
+	writePEM := func(name, typ string, b []byte) string {
+		file := filepath.Join(dir, name)
+		th.AssertNoError(ioutil.WriteFile(
+			file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600))
+		return file
+	}
+
+	srv := httptest.NewUnstartedServer(gocrregistry.New())
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "https://")
+
+	conf := &TLSConfig{
+		CAFile:   writePEM("ca.crt", "CERTIFICATE", srv.Certificate().Raw),
+		CertFile: writePEM("client.crt", "CERTIFICATE", der),
+		KeyFile:  writePEM("client.key", "EC PRIVATE KEY", keyDer),
+	}
+	th.AssertNoError(conf.Validate())
+
+	ref := reg + "/test/image"
+	_, err = ListTagsIfExists(context.Background(), ref, nil, false)
+	th.AssertNotNil(err)
+
+	th.AssertNoError(SetTLS(reg, conf))
+	tags, err := ListTagsIfExists(context.Background(), ref, nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(0, len(tags))
+
+	th.AssertNoError(SetTLS(reg, &TLSConfig{
+		CAFile: conf.CAFile, CertFile: conf.CertFile, KeyFile: conf.KeyFile}))
+	th.AssertError(SetTLS(reg, &TLSConfig{CAFile: conf.CAFile}),
+		"conflicting 'tls' settings")
+
+	th.AssertError((&TLSConfig{}).Validate(), "needs at least one of")
+	th.AssertError((&TLSConfig{CertFile: conf.CertFile}).Validate(),
+		"'cert-file' and 'key-file' need to be set together")
+	th.AssertError((&TLSConfig{CAFile: conf.KeyFile}).Validate(),
+		"contains no PEM encoded certificates")
+	th.AssertError((&TLSConfig{CAFile: filepath.Join(dir, "none")}).Validate(),
+		"cannot read 'ca-file'")
+	th.AssertNil((*TLSConfig)(nil).Validate())
+}
@@ -0,0 +1,256 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tokens obtained from token services, shared by all requests
+var tokens = newTokenCache()
+
+// tokens are dropped from the cache this long before they expire, so that
+// they don't run out while in use
+const tokenMargin = 10 * time.Second
+
+// lifetime of tokens for which the token service gives no 'expires_in', as
+// per the distribution spec
+const defaultTokenLifetime = 60 * time.Second
+
+//
+var realmFormat = regexp.MustCompile(`(?i)^bearer\s.*realm="([^"]+)"`)
+
+// tokenCache caches the responses of token services, keyed by request, i.e.
+// URL including scopes, credentials, and for OAuth2 the form sent; token
+// services are recognized by the realms in the auth challenges of registries
+type tokenCache struct {
+	realms  map[string]bool
+	entries map[string]*cachedToken
+	mutex   sync.Mutex
+}
+
+//
+type cachedToken struct {
+	token   string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+//
+func newTokenCache() *tokenCache {
+	return &tokenCache{
+		realms:  make(map[string]bool),
+		entries: make(map[string]*cachedToken),
+	}
+}
+
+// roundTrip sends req via send, unless it's a token request for which there
+// is a cached response; token responses are cached, and realms of challenges
+// recorded; a token that a registry refuses is dropped from the cache
+func (c *tokenCache) roundTrip(req *http.Request,
+	send func(*http.Request) (*http.Response, error)) (
+	*http.Response, error) {
+
+	key := ""
+	if c.isRealm(req.URL) {
+		var err error
+		if key, req, err = tokenKey(req); err != nil {
+			return nil, err
+		}
+		if resp := c.get(key, req); resp != nil {
+			return resp, nil
+		}
+	}
+
+	resp, err := send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case key != "" && resp.StatusCode == http.StatusOK:
+		return c.put(key, resp)
+	case resp.StatusCode == http.StatusUnauthorized:
+		c.drop(req.Header.Get("Authorization"))
+		if m := realmFormat.FindStringSubmatch(
+			resp.Header.Get("WWW-Authenticate")); m != nil {
+			c.addRealm(m[1])
+		}
+	}
+
+	return resp, nil
+}
+
+//
+func (c *tokenCache) addRealm(realm string) {
+	u, err := url.Parse(realm)
+	if err != nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.realms[realmID(u)] = true
+}
+
+//
+func (c *tokenCache) isRealm(u *url.URL) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.realms[realmID(u)]
+}
+
+// get returns a response for req from the cached token with the given key,
+// nil if there is none, or it is about to expire
+func (c *tokenCache) get(key string, req *http.Request) *http.Response {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+
+	log.WithField("realm", realmID(req.URL)).Debug("using cached token")
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// put caches the token in resp under key, if it has one that lasts long
+// enough; since the body is consumed, an equivalent response is returned
+func (c *tokenCache) put(key string, resp *http.Response) (
+	*http.Response, error) {
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var content struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if json.Unmarshal(body, &content) != nil {
+		return resp, nil
+	}
+
+	token := content.Token
+	if token == "" {
+		token = content.AccessToken
+	}
+	lifetime := defaultTokenLifetime
+	if content.ExpiresIn > 0 {
+		lifetime = time.Duration(content.ExpiresIn) * time.Second
+	}
+	if token == "" || lifetime <= 2*tokenMargin {
+		return resp, nil
+	}
+
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &cachedToken{
+		token:   token,
+		header:  resp.Header.Clone(),
+		body:    body,
+		expires: now.Add(lifetime - tokenMargin),
+	}
+
+	return resp, nil
+}
+
+// drop removes the token sent with the given Authorization header from the
+// cache, if any
+func (c *tokenCache) drop(authorization string) {
+
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for k, e := range c.entries {
+		if e.token == token {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// tokenKey returns the cache key for the given token request, and the request
+// to send, since a form body needs to be read
+func tokenKey(req *http.Request) (string, *http.Request, error) {
+
+	h := sha256.New()
+	h.Write([]byte(req.Method + " " + req.URL.String() + "\n"))
+	h.Write([]byte(req.Header.Get("Authorization") + "\n"))
+
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return "", nil, err
+		}
+		h.Write(body)
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), req, nil
+}
+
+// realmID identifies a token service by scheme, host, and path
+func realmID(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.Path
+}
@@ -0,0 +1,106 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// tokenRegistry is a registry requiring bearer tokens, with its own token
+// service, which hands out tokens with the given lifetime in seconds
+type tokenRegistry struct {
+	srv      *httptest.Server
+	issued   int32 // number of tokens issued
+	lifetime int
+	revoked  int32 // when set, the first token is refused
+}
+
+//
+func newTokenRegistry(lifetime int) *tokenRegistry {
+
+	r := &tokenRegistry{lifetime: lifetime}
+	reg := gocrregistry.New()
+
+	r.srv = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+
+			if req.URL.Path == "/token" {
+				n := atomic.AddInt32(&r.issued, 1)
+				fmt.Fprintf(w, `{"token":"token-%d","expires_in":%d}`,
+					n, r.lifetime)
+				return
+			}
+
+			auth := req.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer token-") ||
+				(auth == "Bearer token-1" &&
+					atomic.LoadInt32(&r.revoked) == 1) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+					`Bearer realm="%s/token",service="test"`, r.srv.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			reg.ServeHTTP(w, req)
+		}))
+
+	return r
+}
+
+//
+func TestTokenCache(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	list := func(r *tokenRegistry) {
+		ref := strings.TrimPrefix(r.srv.URL, "http://") + "/test/image"
+		_, err := ListTagsIfExists(context.Background(), ref, nil, false)
+		th.AssertNoError(err)
+	}
+
+	// tokens are reused across operations
+	r := newTokenRegistry(300)
+	defer r.srv.Close()
+	list(r)
+	list(r)
+	list(r)
+	th.AssertEqual(int32(1), atomic.LoadInt32(&r.issued))
+
+	// a refused token is dropped, and a new one fetched
+	atomic.StoreInt32(&r.revoked, 1)
+	list(r)
+	th.AssertEqual(int32(2), atomic.LoadInt32(&r.issued))
+	list(r)
+	th.AssertEqual(int32(2), atomic.LoadInt32(&r.issued))
+
+	// tokens too short-lived are not cached
+	short := newTokenRegistry(15)
+	defer short.srv.Close()
+	list(short)
+	list(short)
+	th.AssertEqual(int32(2), atomic.LoadInt32(&short.issued))
+}
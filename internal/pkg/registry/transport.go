@@ -0,0 +1,116 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+)
+
+// transports created so far; they're shared, so that connections get reused
+var transports = make(map[transportKey]*http.Transport)
+var transportsMutex sync.Mutex
+
+//
+type transportKey struct {
+	proxyFor string // registry whose proxy settings apply, if any
+	tlsFor   string // host whose TLS settings apply, if any
+	insecure bool
+}
+
+// transport returns the round tripper to use for requests on behalf of the
+// given registry; origin may be empty when not known, in which case proxy
+// settings are looked up by the host of each request; TLS settings are always
+// looked up by request host; with insecure set, server certs are not verified
+func transport(origin string, insecure bool) http.RoundTripper {
+	return &hostTransport{origin: origin, insecure: insecure}
+}
+
+// hostTransport picks the transport for each request, as per the TLS and
+// proxy settings of registries, and adds their custom headers; token requests
+// are answered from the token cache where possible
+type hostTransport struct {
+	origin   string
+	insecure bool
+}
+
+//
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	h := headersFor(t.origin)
+	if h == nil {
+		h = headersFor(req.URL.Host)
+	}
+	if len(h) > 0 {
+		req = req.Clone(req.Context())
+		for name, values := range h {
+			req.Header[name] = values
+		}
+	}
+
+	return tokens.roundTrip(req, t.send)
+}
+
+// send sends req via the transport matching its TLS and proxy settings
+func (t *hostTransport) send(req *http.Request) (*http.Response, error) {
+
+	key := transportKey{insecure: t.insecure}
+
+	if _, ok := proxyFor(t.origin); ok && t.origin != "" {
+		key.proxyFor = t.origin
+	} else if _, ok := proxyFor(req.URL.Host); ok {
+		key.proxyFor = req.URL.Host
+	}
+	if tlsFor(req.URL.Host) != nil {
+		key.tlsFor = req.URL.Host
+	}
+
+	if key == (transportKey{}) {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	return getTransport(key).RoundTrip(req)
+}
+
+// getTransport returns the transport for the given key, creating it if needed
+func getTransport(key transportKey) *http.Transport {
+
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+
+	if t, ok := transports[key]; ok {
+		return t
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if key.proxyFor != "" {
+		t.Proxy, _ = proxyFor(key.proxyFor)
+	}
+	if conf := tlsFor(key.tlsFor); conf != nil {
+		t.TLSClientConfig = conf.Clone()
+	}
+	if key.insecure {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.InsecureSkipVerify = true
+	}
+
+	transports[key] = t
+	return t
+}
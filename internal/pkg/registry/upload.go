@@ -0,0 +1,498 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+	gocrtransport "github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// locations of chunked uploads that were interrupted, keyed by target repo
+// and blob digest, for resuming them on the next attempt
+var pendingUploads = make(map[string]string)
+var pendingUploadsMutex sync.Mutex
+
+// Uploads are the settings for uploading blobs; Jobs is the number of blobs
+// uploaded concurrently for each image, with 0 the default of the
+// go-containerregistry lib applies; with a ChunkSize of 0, each blob is
+// uploaded in one request, otherwise in chunks of at most that many bytes, and
+// uploads interrupted by an error are resumed on the next attempt
+type Uploads struct {
+	Jobs      int
+	ChunkSize int64
+}
+
+//
+type uploadsKey struct{}
+
+// WithUploads returns a context that makes Copy use the given upload settings
+func WithUploads(ctx context.Context, u Uploads) context.Context {
+	return context.WithValue(ctx, uploadsKey{}, u)
+}
+
+//
+func uploadsFrom(ctx context.Context) Uploads {
+	if u, ok := ctx.Value(uploadsKey{}).(Uploads); ok {
+		return u
+	}
+	return Uploads{}
+}
+
+// uploadChunked uploads the layers of the given image index or image to the
+// target repo in chunks, with as many uploads running concurrently as set
+// via WithUploads; layers already in the repo are skipped
+func uploadChunked(ctx context.Context, repo gocrname.Repository, ref string,
+	creds *auth.Credentials, insecure bool, throttle *util.Throttle,
+	traceParent string, idx gocrv1.ImageIndex, img gocrv1.Image) error {
+
+	layers, err := collectLayers(idx, img)
+	if err != nil {
+		return err
+	}
+
+	// mounting needs pull access to the repos blobs are mounted from
+	scopes := []string{repo.Scope(gocrtransport.PushScope)}
+	seen := map[string]bool{repo.String(): true}
+	for _, l := range layers {
+		if from := mountFrom(l, repo); from != nil && !seen[from.String()] {
+			seen[from.String()] = true
+			scopes = append(scopes, from.Scope(gocrtransport.PullScope))
+		}
+	}
+
+	rt, err := gocrtransport.New(repo.Registry, remoteAuthenticator(creds),
+		remoteTransport(ref, insecure, throttle, traceParent), scopes)
+	if err != nil {
+		return fmt.Errorf("cannot connect to registry: %v", err)
+	}
+
+	uploads := uploadsFrom(ctx)
+	u := &uploader{
+		ctx:    ctx,
+		client: &http.Client{Transport: rt},
+		repo:   repo,
+		chunk:  uploads.ChunkSize,
+	}
+
+	parallelism := uploads.Jobs
+	if parallelism < 1 {
+		parallelism = 4
+	}
+	workers := make(chan bool, parallelism)
+
+	var running sync.WaitGroup
+	var mutex sync.Mutex
+	var errs []string
+
+	for _, l := range layers {
+		running.Add(1)
+		workers <- true
+		go func(l gocrv1.Layer) {
+			defer func() {
+				<-workers
+				running.Done()
+			}()
+			if err := u.upload(l); err != nil {
+				mutex.Lock()
+				errs = append(errs, err.Error())
+				mutex.Unlock()
+			}
+		}(l)
+	}
+
+	running.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// collectLayers returns the layers of the given image index, including those
+// of nested indexes, or of the given image, without duplicates
+func collectLayers(idx gocrv1.ImageIndex, img gocrv1.Image) (
+	[]gocrv1.Layer, error) {
+
+	if idx == nil {
+		return img.Layers()
+	}
+
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []gocrv1.Layer
+	seen := make(map[gocrv1.Hash]bool)
+
+	for _, desc := range manifest.Manifests {
+		var layers []gocrv1.Layer
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if layers, err = collectLayers(child, nil); err != nil {
+				return nil, err
+			}
+		case desc.MediaType.IsImage():
+			child, err := idx.Image(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if layers, err = child.Layers(); err != nil {
+				return nil, err
+			}
+		}
+		for _, l := range layers {
+			d, err := l.Digest()
+			if err != nil {
+				return nil, err
+			}
+			if !seen[d] {
+				seen[d] = true
+				ret = append(ret, l)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// uploader does chunked blob uploads to a repository, as per the OCI
+// distribution spec
+type uploader struct {
+	ctx    context.Context
+	client *http.Client
+	repo   gocrname.Repository
+	chunk  int64
+}
+
+// upload uploads the given layer, unless it's already in the repo; when a
+// previous upload of the layer was interrupted, it's resumed
+func (u *uploader) upload(l gocrv1.Layer) error {
+
+	// foreign layers are not pushed, same as with gocr
+	if mt, err := l.MediaType(); err != nil {
+		return err
+	} else if !mt.IsDistributable() {
+		return nil
+	}
+
+	digest, err := l.Digest()
+	if err != nil {
+		return err
+	}
+	size, err := l.Size()
+	if err != nil {
+		return err
+	}
+
+	if exists, err := u.exists(digest); err != nil || exists {
+		return err
+	}
+
+	key := u.repo.String() + "@" + digest.String()
+	logger := log.WithFields(
+		log.Fields{"repo": u.repo.String(), "blob": digest})
+
+	loc, offset := u.resume(key)
+	if loc == "" {
+		from := mountFrom(l, u.repo)
+		var mounted bool
+		if loc, mounted, err = u.initiate(digest, from); err != nil {
+			return err
+		}
+		if mounted {
+			logger.WithField("from", from.String()).Debug("blob mounted")
+			return nil
+		}
+	} else {
+		logger.Infof("resuming upload at %d of %d bytes", offset, size)
+	}
+
+	rc, err := l.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// what was already uploaded still needs to be read from the source
+	if _, err := io.CopyN(ioutil.Discard, rc, offset); err != nil {
+		return err
+	}
+
+	for offset < size {
+		n := u.chunk
+		if size-offset < n {
+			n = size - offset
+		}
+		next, err := u.patch(loc, io.LimitReader(rc, n), offset, n)
+		if err != nil {
+			// a retry resumes at the last chunk that went through
+			setPendingUpload(key, loc)
+			return fmt.Errorf("error uploading blob '%s': %v", digest, err)
+		}
+		loc = next
+		offset += n
+	}
+
+	if err := u.commit(loc, digest); err != nil {
+		setPendingUpload(key, "")
+		return fmt.Errorf("error committing blob '%s': %v", digest, err)
+	}
+
+	setPendingUpload(key, "")
+	logger.Debug("blob uploaded")
+	return nil
+}
+
+//
+func setPendingUpload(key, loc string) {
+	pendingUploadsMutex.Lock()
+	defer pendingUploadsMutex.Unlock()
+	if loc == "" {
+		delete(pendingUploads, key)
+	} else {
+		pendingUploads[key] = loc
+	}
+}
+
+// resume returns location and offset for continuing an interrupted upload of
+// the blob with given key, or an empty location if there is none, or the
+// registry does not know about it anymore
+func (u *uploader) resume(key string) (string, int64) {
+
+	pendingUploadsMutex.Lock()
+	loc, ok := pendingUploads[key]
+	pendingUploadsMutex.Unlock()
+
+	if !ok {
+		return "", 0
+	}
+
+	req, err := http.NewRequest(http.MethodGet, loc, nil)
+	if err != nil {
+		return "", 0
+	}
+
+	resp, err := u.client.Do(req.WithContext(u.ctx))
+	if err != nil {
+		return "", 0
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return "", 0
+	}
+
+	// an end of 0 can't be told apart from 'nothing uploaded yet', so we start
+	// over in that case
+	end, ok := parseRange(resp.Header.Get("Range"))
+	if !ok || end == 0 {
+		return "", 0
+	}
+
+	next, err := u.location(resp, loc)
+	if err != nil {
+		return "", 0
+	}
+
+	return next, end + 1
+}
+
+// parseRange returns the end of a range header of the form [bytes=]0-{end}
+func parseRange(r string) (int64, bool) {
+	r = strings.TrimPrefix(r, "bytes=")
+	if !strings.HasPrefix(r, "0-") {
+		return 0, false
+	}
+	end, err := strconv.ParseInt(strings.TrimPrefix(r, "0-"), 10, 64)
+	return end, err == nil
+}
+
+// exists checks whether the blob with given digest is in the repo
+func (u *uploader) exists(digest gocrv1.Hash) (bool, error) {
+
+	req, err := http.NewRequest(http.MethodHead, u.url(
+		fmt.Sprintf("/v2/%s/blobs/%s", u.repo.RepositoryStr(), digest)), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := u.client.Do(req.WithContext(u.ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if err := gocrtransport.CheckError(
+		resp, http.StatusOK, http.StatusNotFound); err != nil {
+		return false, err
+	}
+
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// initiate starts an upload, and returns its location; when from is given,
+// the registry is asked to mount the blob from that repo instead, in which case
+// mounted is true if it did, otherwise an upload was started
+func (u *uploader) initiate(digest gocrv1.Hash,
+	from *gocrname.Repository) (loc string, mounted bool, err error) {
+
+	l := &url.URL{Scheme: u.repo.Registry.Scheme(), Host: u.repo.RegistryStr(),
+		Path: fmt.Sprintf("/v2/%s/blobs/uploads/", u.repo.RepositoryStr())}
+	if from != nil {
+		l.RawQuery = url.Values{
+			"mount": {digest.String()},
+			"from":  {from.RepositoryStr()},
+		}.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, l.String(), nil)
+	if err != nil {
+		return "", false, err
+	}
+
+	resp, err := u.client.Do(req.WithContext(u.ctx))
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if err := gocrtransport.CheckError(
+		resp, http.StatusCreated, http.StatusAccepted); err != nil {
+		return "", false, err
+	}
+
+	if resp.StatusCode == http.StatusCreated {
+		return "", true, nil
+	}
+
+	loc, err = u.location(resp, "")
+	return loc, false, err
+}
+
+// mountFrom returns the repo from which the given layer can be mounted into
+// repo, or nil if there is none; layers read from a repo of the same registry,
+// or with a repo of that registry in the blob cache, are mountable
+func mountFrom(l gocrv1.Layer, repo gocrname.Repository) *gocrname.Repository {
+	if ml, ok := l.(*gocrremote.MountableLayer); ok {
+		from := ml.Reference.Context()
+		if from.RegistryStr() == repo.RegistryStr() &&
+			from.String() != repo.String() {
+			return &from
+		}
+	}
+	return nil
+}
+
+// patch uploads a chunk of size n at given offset to location loc, and returns
+// the location for the next chunk
+func (u *uploader) patch(loc string, chunk io.Reader, offset, n int64) (
+	string, error) {
+
+	req, err := http.NewRequest(http.MethodPatch, loc, chunk)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+
+	resp, err := u.client.Do(req.WithContext(u.ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := gocrtransport.CheckError(
+		resp, http.StatusAccepted, http.StatusNoContent); err != nil {
+		return "", err
+	}
+
+	return u.location(resp, loc)
+}
+
+// commit completes the upload at location loc
+func (u *uploader) commit(loc string, digest gocrv1.Hash) error {
+
+	l, err := url.Parse(loc)
+	if err != nil {
+		return err
+	}
+	q := l.Query()
+	q.Set("digest", digest.String())
+	l.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodPut, l.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := u.client.Do(req.WithContext(u.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return gocrtransport.CheckError(resp, http.StatusCreated)
+}
+
+// location returns the absolute upload location from the response, or the
+// previous location loc if the response has none
+func (u *uploader) location(resp *http.Response, loc string) (string, error) {
+
+	l := resp.Header.Get("Location")
+	if l == "" {
+		if loc == "" {
+			return "", fmt.Errorf("registry sent no upload location")
+		}
+		return loc, nil
+	}
+
+	ref, err := url.Parse(l)
+	if err != nil {
+		return "", err
+	}
+
+	return resp.Request.URL.ResolveReference(ref).String(), nil
+}
+
+//
+func (u *uploader) url(path string) string {
+	return (&url.URL{Scheme: u.repo.Registry.Scheme(),
+		Host: u.repo.RegistryStr(), Path: path}).String()
+}
@@ -0,0 +1,142 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestResumableUpload(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var mutex sync.Mutex
+	uploaded := make(map[string]int64) // upload location -> bytes so far
+	var patched int64                  // bytes accepted in chunks
+	var patches, statusChecks int
+
+	// target registry that fails the third chunk, and answers upload status
+	// requests, which the gocr registry doesn't do
+	inner := gocrregistry.New()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.URL.Path, "/blobs/uploads/") {
+				inner.ServeHTTP(w, r)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch {
+			case r.Method == http.MethodGet:
+				statusChecks++
+				w.Header().Set("Location", r.URL.Path)
+				w.Header().Set("Range",
+					fmt.Sprintf("0-%d", uploaded[r.URL.Path]-1))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			case r.Method == http.MethodPatch &&
+				r.Header.Get("Content-Range") != "":
+				patches++
+				if patches == 3 {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				var start, end int64
+				fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d",
+					&start, &end)
+				uploaded[r.URL.Path] = end + 1
+				patched += end - start + 1
+			}
+			inner.ServeHTTP(w, r)
+		}))
+	defer srv.Close()
+
+	srcSrv := httptest.NewServer(gocrregistry.New())
+	defer srcSrv.Close()
+
+	img, err := gocrrandom.Image(4096, 1)
+	th.AssertNoError(err)
+	src := strings.TrimPrefix(srcSrv.URL, "http://") + "/source/image:1.0"
+	ref, err := gocrname.NewTag(src)
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(ref, img))
+
+	layers, err := img.Layers()
+	th.AssertNoError(err)
+	size, err := layers[0].Size()
+	th.AssertNoError(err)
+	th.AssertTrue(size > 2048)
+
+	trgt := strings.TrimPrefix(srv.URL, "http://") + "/target/image:1.0"
+	ctx := WithUploads(
+		context.Background(), Uploads{Jobs: 2, ChunkSize: 1024})
+
+	err = Copy(ctx, src, nil, false, trgt, nil, false, nil, nil, "")
+	th.AssertError(err, "error uploading blobs")
+	th.AssertEqual(int64(2048), patched)
+
+	// second attempt continues after the second chunk
+	th.AssertNoError(
+		Copy(ctx, src, nil, false, trgt, nil, false, nil, nil, ""))
+	th.AssertEqual(1, statusChecks)
+	th.AssertEqual(size, patched)
+	th.AssertEqual(0, len(pendingUploads))
+
+	srcDigest, err := GetDigest(context.Background(), src, nil, false)
+	th.AssertNoError(err)
+	trgtDigest, err := GetDigest(context.Background(), trgt, nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(srcDigest, trgtDigest)
+
+	// nothing left to upload
+	th.AssertNoError(
+		Copy(ctx, src, nil, false, trgt, nil, false, nil, nil, ""))
+	th.AssertEqual(size, patched)
+}
+
+//
+func TestParseRange(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	end, ok := parseRange("0-1023")
+	th.AssertTrue(ok)
+	th.AssertEqual(int64(1023), end)
+
+	end, ok = parseRange("bytes=0-99")
+	th.AssertTrue(ok)
+	th.AssertEqual(int64(99), end)
+
+	_, ok = parseRange("5-99")
+	th.AssertTrue(!ok)
+	_, ok = parseRange("")
+	th.AssertTrue(!ok)
+}
@@ -0,0 +1,94 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package containerd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runCtr runs ctr with the given args, which is killed once ctx is done; when
+// not verbose, the output of ctr is discarded, except for errors, which are
+// included in the returned error
+func (r *ContainerdRelay) runCtr(ctx context.Context, verbose bool,
+	args ...string) error {
+
+	cmd := exec.CommandContext(ctx, r.binary, r.globalArgs(args)...)
+
+	bufErr := new(bytes.Buffer)
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = bufErr
+
+	if verbose {
+		cmd.Stdout = r.out(log.InfoLevel)
+		cmd.Stderr = io.MultiWriter(bufErr, r.out(log.ErrorLevel))
+	}
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(bufErr.String()); msg != "" {
+			return fmt.Errorf("ctr %s: %s, %v", args[0], msg, err)
+		}
+		return fmt.Errorf("ctr %s: %v", args[0], err)
+	}
+
+	return nil
+}
+
+// globalArgs prepends the address and namespace settings to args, if set;
+// otherwise ctr falls back to CONTAINERD_ADDRESS and CONTAINERD_NAMESPACE
+func (r *ContainerdRelay) globalArgs(args []string) []string {
+	var ret []string
+	if r.address != "" {
+		ret = append(ret, "--address", r.address)
+	}
+	if r.namespace != "" {
+		ret = append(ret, "--namespace", r.namespace)
+	}
+	return append(ret, args...)
+}
+
+//
+func (r *ContainerdRelay) out(level log.Level) io.Writer {
+	if r.wrOut != nil {
+		return r.wrOut
+	}
+	return log.StandardLogger().WriterLevel(level)
+}
+
+// transferArgs returns the args for a pull or push of ref
+func transferArgs(op, ref, creds string, skipTLSVerify bool) []string {
+	ret := []string{"images", op}
+	if op == "pull" {
+		// all platforms need to be present for pushing the complete image
+		// index later on
+		ret = append(ret, "--all-platforms")
+	}
+	if creds != "" {
+		ret = append(ret, "--user", creds)
+	}
+	if skipTLSVerify {
+		ret = append(ret, "--skip-verify")
+	}
+	return append(ret, ref)
+}
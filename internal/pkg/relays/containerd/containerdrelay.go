@@ -0,0 +1,213 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	gosync "sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/tracing"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+const RelayID = "containerd"
+
+const defaultCtrBinary = "ctr"
+
+// valid containerd namespace, as checked by containerd itself
+var namespaceFormat = regexp.MustCompile(
+	`^[A-Za-z0-9]+(?:[._-][A-Za-z0-9]+)*$`)
+
+//
+type RelayConfig struct {
+	Binary    string `yaml:"binary"`
+	Address   string `yaml:"address"`
+	Namespace string `yaml:"namespace"`
+}
+
+//
+func (c *RelayConfig) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Namespace != "" && !namespaceFormat.MatchString(c.Namespace) {
+		return fmt.Errorf("invalid value for 'namespace': '%s'", c.Namespace)
+	}
+
+	return nil
+}
+
+// ContainerdRelay syncs images by pulling them into containerd, tagging, and
+// pushing them via the ctr CLI, which talks to containerd's native API
+type ContainerdRelay struct {
+	binary    string
+	address   string
+	namespace string
+	wrOut     io.Writer
+	// refs pulled & tagged per source & target, for cleanup
+	synced map[[2]string][]string
+	mutex  gosync.Mutex
+}
+
+//
+func NewContainerdRelay(conf *RelayConfig, out io.Writer) *ContainerdRelay {
+
+	relay := &ContainerdRelay{
+		binary: defaultCtrBinary,
+		wrOut:  out,
+		synced: make(map[[2]string][]string),
+	}
+
+	if conf != nil {
+		if conf.Binary != "" {
+			relay.binary = conf.Binary
+		}
+		relay.address = conf.Address
+		relay.namespace = conf.Namespace
+	}
+
+	return relay
+}
+
+//
+func (r *ContainerdRelay) Prepare() error {
+	if err := r.runCtr(context.Background(), true, "version"); err != nil {
+		return fmt.Errorf("cannot reach containerd: %v", err)
+	}
+	log.WithField("relay", RelayID).Info("relay ready")
+	return nil
+}
+
+// CheckHealth returns an error if containerd is not reachable
+func (r *ContainerdRelay) CheckHealth() error {
+	return r.runCtr(context.Background(), false, "version")
+}
+
+//
+func (r *ContainerdRelay) Dispose() error {
+	return nil
+}
+
+//
+func (r *ContainerdRelay) Sync(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	trgtRef, trgtAuth string, trgtSkipTLSVerify bool, ts *tags.TagSet,
+	platforms []string, throttle *util.Throttle, span *tracing.Span,
+	verbose bool) error {
+
+	srcCreds := util.DecodeJSONAuth(srcAuth)
+	trgtCreds := util.DecodeJSONAuth(trgtAuth)
+
+	srcCertDir := ""
+	repo, _, _ := util.SplitRef(srcRef)
+	if repo != "" {
+		srcCertDir = skopeo.CertsDirForRepo(repo)
+	}
+
+	tags, err := ts.Expand(func() ([]string, error) {
+		return skopeo.ListAllTags(
+			ctx, srcRef, srcCreds, srcCertDir, srcSkipTLSVerify)
+	})
+
+	if err != nil {
+		return fmt.Errorf("error expanding tags: %v", err)
+	}
+
+	errs := false
+	for _, tag := range tags {
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("sync aborted: %v", ctx.Err())
+		}
+
+		log.WithField("tag", tag).Info("syncing tag")
+		src := fmt.Sprintf("%s:%s", srcRef, tag)
+		trgt := fmt.Sprintf("%s:%s", trgtRef, ts.TargetTag(tag))
+
+		r.mutex.Lock()
+		key := [2]string{srcRef, trgtRef}
+		r.synced[key] = append(r.synced[key], src, trgt)
+		r.mutex.Unlock()
+
+		ps := span.Child(
+			"containerd pull", tracing.Attributes{"image.source": src})
+		err := r.runCtr(ctx, verbose,
+			transferArgs("pull", src, srcCreds, srcSkipTLSVerify)...)
+		ps.Fail(err)
+		ps.End()
+
+		if err == nil {
+			err = r.runCtr(
+				ctx, verbose, "images", "tag", "--force", src, trgt)
+		}
+
+		if err == nil {
+			ps = span.Child(
+				"containerd push", tracing.Attributes{"image.target": trgt})
+			err = r.runCtr(ctx, verbose,
+				transferArgs("push", trgt, trgtCreds, trgtSkipTLSVerify)...)
+			ps.Fail(err)
+			ps.End()
+		}
+
+		if err != nil {
+			log.Error(err)
+			errs = true
+		}
+	}
+
+	if errs {
+		return fmt.Errorf("errors during sync")
+	}
+
+	return nil
+}
+
+// Cleanup removes the images pulled and tagged for the given source and target
+// refs from containerd; containerd's garbage collection then removes content
+// no longer referenced, so there's no need for removing dangling images
+func (r *ContainerdRelay) Cleanup(ctx context.Context, srcRef, trgtRef string,
+	dangling bool) error {
+
+	key := [2]string{srcRef, trgtRef}
+
+	r.mutex.Lock()
+	refs := r.synced[key]
+	delete(r.synced, key)
+	r.mutex.Unlock()
+
+	if len(refs) == 0 {
+		return nil
+	}
+
+	log.WithField("refs", refs).Debug("removing local images")
+	if err := r.runCtr(ctx, false,
+		append([]string{"images", "rm", "--sync"}, refs...)...); err != nil {
+		return fmt.Errorf("error during cleanup of local images: %v", err)
+	}
+
+	return nil
+}
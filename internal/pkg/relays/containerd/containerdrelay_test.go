@@ -0,0 +1,137 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package containerd
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// fakeCtr writes a script standing in for ctr, which records its args, one
+// call per line, and fails when asked to pull a ref containing 'broken'
+func fakeCtr(th *test.TestHelper, dir string) (binary, calls string) {
+	binary = filepath.Join(dir, "ctr")
+	calls = filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n" +
+		"case \"$*\" in *pull*broken*) echo 'not found' >&2; exit 1;; esac\n"
+	th.AssertNoError(ioutil.WriteFile(binary, []byte(script), 0755))
+	return binary, calls
+}
+
+//
+func readCalls(th *test.TestHelper, calls string) []string {
+	data, err := ioutil.ReadFile(calls)
+	th.AssertNoError(err)
+	os.Remove(calls)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+//
+func TestContainerdRelaySync(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	binary, calls := fakeCtr(th, t.TempDir())
+
+	relay := NewContainerdRelay(&RelayConfig{
+		Binary:    binary,
+		Address:   "/run/k3s/containerd/containerd.sock",
+		Namespace: "sync",
+	}, ioutil.Discard)
+
+	th.AssertNoError(relay.Prepare())
+	th.AssertNoError(relay.CheckHealth())
+	readCalls(th, calls)
+
+	ts, err := tags.NewTagSet([]string{"1.0", "2.0"})
+	th.AssertNoError(err)
+	auth := base64.StdEncoding.EncodeToString(
+		[]byte(`{"username": "user", "password": "secret"}`))
+	global := "--address /run/k3s/containerd/containerd.sock --namespace sync "
+
+	th.AssertNoError(relay.Sync(context.Background(),
+		"source.io/app", "", false, "target.io/app", auth, true, ts,
+		nil, nil, nil, false))
+	th.AssertEqualSlices([]string{
+		global + "images pull --all-platforms source.io/app:1.0",
+		global + "images tag --force source.io/app:1.0 target.io/app:1.0",
+		global + "images push --user user:secret --skip-verify " +
+			"target.io/app:1.0",
+		global + "images pull --all-platforms source.io/app:2.0",
+		global + "images tag --force source.io/app:2.0 target.io/app:2.0",
+		global + "images push --user user:secret --skip-verify " +
+			"target.io/app:2.0",
+	}, readCalls(th, calls))
+
+	th.AssertNoError(relay.Cleanup(context.Background(),
+		"source.io/app", "target.io/app", true))
+	th.AssertEqualSlices([]string{
+		global + "images rm --sync source.io/app:1.0 target.io/app:1.0 " +
+			"source.io/app:2.0 target.io/app:2.0",
+	}, readCalls(th, calls))
+
+	// nothing left to clean up
+	th.AssertNoError(relay.Cleanup(context.Background(),
+		"source.io/app", "target.io/app", false))
+	_, err = os.Stat(calls)
+	th.AssertTrue(os.IsNotExist(err))
+
+	// failing pull skips tag & push
+	ts, err = tags.NewTagSet([]string{"1.0"})
+	th.AssertNoError(err)
+	th.AssertError(relay.Sync(context.Background(),
+		"source.io/broken", "", false, "target.io/broken", "", false, ts,
+		nil, nil, nil, false), "errors during sync")
+	th.AssertEqualSlices([]string{
+		global + "images pull --all-platforms source.io/broken:1.0",
+	}, readCalls(th, calls))
+}
+
+//
+func TestContainerdRelayDefaults(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	binary, calls := fakeCtr(th, t.TempDir())
+
+	relay := NewContainerdRelay(&RelayConfig{Binary: binary}, nil)
+	th.AssertNoError(relay.CheckHealth())
+	// without address & namespace, ctr uses its defaults and environment
+	th.AssertEqualSlices([]string{"version"}, readCalls(th, calls))
+
+	th.AssertError(NewContainerdRelay(
+		&RelayConfig{Binary: filepath.Join(t.TempDir(), "nope")}, nil).
+		CheckHealth(), "ctr version")
+}
+
+//
+func TestContainerdRelayConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNoError((*RelayConfig)(nil).Validate())
+	th.AssertNoError((&RelayConfig{}).Validate())
+	th.AssertNoError((&RelayConfig{Namespace: "k8s.io"}).Validate())
+	th.AssertError((&RelayConfig{Namespace: "my namespace"}).Validate(),
+		"invalid value for 'namespace': 'my namespace'")
+}
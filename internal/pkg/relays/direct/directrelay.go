@@ -0,0 +1,162 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package direct
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	units "github.com/docker/go-units"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/tracing"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+const RelayID = "direct"
+
+//
+type RelayConfig struct {
+	Jobs      int    `yaml:"jobs"`
+	ChunkSize string `yaml:"chunk-size"`
+	//
+	chunkSize int64
+}
+
+//
+func (c *RelayConfig) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Jobs < 0 {
+		return fmt.Errorf("invalid value for 'jobs': %d", c.Jobs)
+	}
+
+	if c.ChunkSize != "" {
+		size, err := units.RAMInBytes(c.ChunkSize)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid value for 'chunk-size': '%s'",
+				c.ChunkSize)
+		}
+		c.chunkSize = size
+	}
+
+	return nil
+}
+
+// DirectRelay copies images straight from source to target registry, using
+// the go-containerregistry lib; it needs neither a Docker daemon nor Skopeo
+type DirectRelay struct {
+	wrOut   io.Writer
+	uploads registry.Uploads
+}
+
+//
+func NewDirectRelay(conf *RelayConfig, out io.Writer) *DirectRelay {
+	r := &DirectRelay{wrOut: out}
+	if conf != nil {
+		r.uploads = registry.Uploads{
+			Jobs: conf.Jobs, ChunkSize: conf.chunkSize}
+	}
+	return r
+}
+
+//
+func (r *DirectRelay) Prepare() error {
+	log.WithField("relay", RelayID).Info("relay ready")
+	return nil
+}
+
+//
+func (r *DirectRelay) Dispose() error {
+	return nil
+}
+
+//
+func (r *DirectRelay) Sync(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	trgtRef, trgtAuth string, trgtSkipTLSVerify bool, ts *tags.TagSet,
+	platforms []string, throttle *util.Throttle, span *tracing.Span,
+	verbose bool) error {
+
+	srcCreds, err := decodeAuth(srcAuth)
+	if err != nil {
+		return fmt.Errorf("invalid source auth: %v", err)
+	}
+	trgtCreds, err := decodeAuth(trgtAuth)
+	if err != nil {
+		return fmt.Errorf("invalid target auth: %v", err)
+	}
+
+	ctx = registry.WithUploads(ctx, r.uploads)
+
+	tags, err := ts.Expand(func() ([]string, error) {
+		return registry.ListTags(ctx, srcRef, srcCreds, srcSkipTLSVerify)
+	})
+
+	if err != nil {
+		return fmt.Errorf("error expanding tags: %v", err)
+	}
+
+	errs := false
+	for _, tag := range tags {
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("sync aborted: %v", ctx.Err())
+		}
+
+		src := fmt.Sprintf("%s:%s", srcRef, tag)
+		trgt := fmt.Sprintf("%s:%s", trgtRef, ts.TargetTag(tag))
+
+		log.WithField("tag", tag).Info("syncing tag")
+		if verbose {
+			log.WithFields(log.Fields{"source": src, "target": trgt}).Info(
+				"copying")
+		}
+
+		cs := span.Child("copy", tracing.Attributes{
+			"image.source": src, "image.target": trgt})
+		if err := registry.Copy(ctx, src, srcCreds, srcSkipTLSVerify,
+			trgt, trgtCreds, trgtSkipTLSVerify, platforms,
+			throttle, cs.TraceParent()); err != nil {
+			log.Error(err)
+			cs.Fail(err)
+			errs = true
+		}
+		cs.End()
+	}
+
+	if errs {
+		return fmt.Errorf("errors during sync")
+	}
+
+	return nil
+}
+
+//
+func decodeAuth(a string) (*auth.Credentials, error) {
+	if a == "" {
+		return &auth.Credentials{}, nil
+	}
+	return auth.NewCredentialsFromAuth(a)
+}
@@ -0,0 +1,163 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package direct
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	gosync "sync"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+	"github.com/xelalexv/dregsy/internal/pkg/tracing"
+)
+
+//
+func TestDirectRelaySync(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// record the trace context propagated to the registry
+	var mutex gosync.Mutex
+	traceParents := make(map[string]bool)
+	handler := gocrregistry.New()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if tp := req.Header.Get("traceparent"); tp != "" {
+				mutex.Lock()
+				traceParents[tp] = true
+				mutex.Unlock()
+			}
+			handler.ServeHTTP(w, req)
+		}))
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	src := reg + "/source/image"
+	trgt := reg + "/target/image"
+
+	for _, tag := range []string{"1.0.0", "1.1.0", "2.0.0"} {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		ref, err := gocrname.NewTag(fmt.Sprintf("%s:%s", src, tag))
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(ref, img))
+	}
+
+	idx, err := gocrrandom.Index(256, 1, 2)
+	th.AssertNoError(err)
+	ref, err := gocrname.NewTag(src + ":multi")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.WriteIndex(ref, idx))
+
+	// the in-memory registry does not support listing tags, so stick to
+	// verbatim tags here
+	ts, err := tags.NewTagSet([]string{"1.0.0", "1.1.0", "multi"})
+	th.AssertNoError(err)
+
+	relay := NewDirectRelay(nil, nil)
+	th.AssertNoError(relay.Prepare())
+	span := tracing.New(&tracing.Config{Endpoint: "http://localhost"}).NewSpan(
+		"test", nil)
+	th.AssertNoError(relay.Sync(context.Background(), src, "", false, trgt,
+		"", false, ts, nil, nil, span, false))
+
+	// each tag is copied in its own span of the same trace
+	th.AssertEqual(3, len(traceParents))
+	traceID := strings.Split(span.TraceParent(), "-")[1]
+	for tp := range traceParents {
+		th.AssertEqual(traceID, strings.Split(tp, "-")[1])
+	}
+
+	for _, tag := range []string{"1.0.0", "1.1.0", "multi"} {
+		srcDigest, err := registry.GetDigest(context.Background(),
+			src+":"+tag, nil, false)
+		th.AssertNoError(err)
+		trgtDigest, err := registry.GetDigest(context.Background(),
+			trgt+":"+tag, nil, false)
+		th.AssertNoError(err)
+		th.AssertEqual(srcDigest, trgtDigest)
+	}
+
+	_, err = registry.GetDigest(context.Background(), trgt+":2.0.0", nil, false)
+	th.AssertError(err, "")
+}
+
+//
+func TestDirectRelayUploads(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srcSrv := httptest.NewServer(gocrregistry.New())
+	defer srcSrv.Close()
+	src := strings.TrimPrefix(srcSrv.URL, "http://") + "/source/image"
+
+	img, err := gocrrandom.Image(4096, 1)
+	th.AssertNoError(err)
+	ref, err := gocrname.NewTag(src + ":1.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(ref, img))
+
+	// target registry that counts chunk uploads; separate registries are
+	// needed, since the in-memory registry shares blobs across repos
+	target := func(chunks *int) *httptest.Server {
+		handler := gocrregistry.New()
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, req *http.Request) {
+				if req.Method == http.MethodPatch &&
+					req.Header.Get("Content-Range") != "" {
+					*chunks++
+				}
+				handler.ServeHTTP(w, req)
+			}))
+	}
+
+	var chunked, whole int
+	chunkedSrv := target(&chunked)
+	defer chunkedSrv.Close()
+	wholeSrv := target(&whole)
+	defer wholeSrv.Close()
+
+	ts, err := tags.NewTagSet([]string{"1.0"})
+	th.AssertNoError(err)
+
+	// settings of one relay must not affect another one created later
+	conf := &RelayConfig{ChunkSize: "1024", Jobs: 1}
+	th.AssertNoError(conf.Validate())
+	chunkedRelay := NewDirectRelay(conf, nil)
+	wholeRelay := NewDirectRelay(&RelayConfig{}, nil)
+
+	th.AssertNoError(chunkedRelay.Sync(context.Background(), src, "", false,
+		strings.TrimPrefix(chunkedSrv.URL, "http://")+"/target/image", "",
+		false, ts, nil, nil, nil, false))
+	th.AssertNoError(wholeRelay.Sync(context.Background(), src, "", false,
+		strings.TrimPrefix(wholeSrv.URL, "http://")+"/target/image", "",
+		false, ts, nil, nil, nil, false))
+
+	th.AssertTrue(chunked >= 4)
+	th.AssertEqual(0, whole)
+}
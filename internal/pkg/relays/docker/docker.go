@@ -21,15 +21,20 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/docker/cli/cli/connhelper"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"golang.org/x/crypto/ssh/terminal"
 
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
 	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
@@ -54,17 +59,22 @@ func (s *image) refWithTags() string {
 //
 type dockerClient struct {
 	host    string
-	version string
+	version string // negotiated with the daemon when empty
+	tls     *registry.TLSConfig
+	timeout time.Duration // max duration of each call to the daemon
 	env     bool
 	client  *client.Client
 	wrOut   io.Writer
 }
 
 //
-func newClient(host, version string, out io.Writer) (*dockerClient, error) {
+func newClient(host, version string, tls *registry.TLSConfig,
+	timeout time.Duration, out io.Writer) (*dockerClient, error) {
 	dc := &dockerClient{
 		host:    host,
 		version: version,
+		tls:     tls,
+		timeout: timeout,
 		wrOut:   os.Stdout,
 	}
 	if out != nil {
@@ -91,24 +101,76 @@ func (dc *dockerClient) open() error {
 		if dc.env {
 			dc.client, err = client.NewEnvClient()
 		} else {
-			dc.client, err = client.NewClient(dc.host, dc.version, nil, nil)
+			var opts []client.Opt
+			if opts, err = dc.options(); err == nil {
+				dc.client, err = client.NewClientWithOpts(opts...)
+			}
 		}
 	}
 	return err
 }
 
-//
-func (dc *dockerClient) ping(attempts int, sleep time.Duration) (
-	types.Ping, error) {
+// options returns the options for a client connecting to the host, which may
+// be an SSH connection string, in which case the docker CLI needs to be
+// installed on the remote host
+func (dc *dockerClient) options() ([]client.Opt, error) {
+
+	opts := []client.Opt{
+		client.WithVersion(dc.version),
+		client.WithAPIVersionNegotiation(),
+	}
+
+	if strings.HasPrefix(dc.host, "ssh://") {
+		helper, err := connhelper.GetConnectionHelper(dc.host)
+		if err != nil {
+			return nil, err
+		}
+		return append(opts,
+			client.WithHTTPClient(&http.Client{
+				Transport: &http.Transport{DialContext: helper.Dialer}}),
+			client.WithHost(helper.Host),
+			client.WithDialContext(helper.Dialer)), nil
+	}
+
+	opts = append(opts, client.WithHost(dc.host))
+	if dc.tls != nil {
+		opts = append(opts, client.WithTLSClientConfig(
+			dc.tls.CAFile, dc.tls.CertFile, dc.tls.KeyFile))
+	}
+
+	return opts, nil
+}
+
+// withTimeout returns a context for a call to the daemon, which is cancelled
+// after the configured timeout, if any
+func (dc *dockerClient) withTimeout(ctx context.Context) (
+	context.Context, context.CancelFunc) {
+	if dc.timeout > 0 {
+		return context.WithTimeout(ctx, dc.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// ping pings the Docker daemon up to the given number of attempts, sleeping
+// in between; gives up early once ctx is done
+func (dc *dockerClient) ping(ctx context.Context, attempts int,
+	sleep time.Duration) (types.Ping, error) {
 	var err error
 	for i := 1; ; i++ {
-		if res, err := dc.client.Ping(context.Background()); err == nil {
-			return res, err
+		pctx, cancel := dc.withTimeout(ctx)
+		res, e := dc.client.Ping(pctx)
+		cancel()
+		if e == nil {
+			return res, nil
 		}
-		if i >= attempts {
+		err = e
+		if i >= attempts || ctx.Err() != nil {
 			break
 		}
-		time.Sleep(sleep)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+		}
 	}
 	return types.Ping{},
 		fmt.Errorf(
@@ -126,10 +188,13 @@ func (dc *dockerClient) close() error {
 }
 
 //
-func (dc *dockerClient) listImages(ref string) ([]*image, error) {
+func (dc *dockerClient) listImages(ctx context.Context, ref string) (
+	[]*image, error) {
 
-	imgs, err := dc.client.ImageList(
-		context.Background(), types.ImageListOptions{})
+	ctx, cancel := dc.withTimeout(ctx)
+	defer cancel()
+
+	imgs, err := dc.client.ImageList(ctx, types.ImageListOptions{})
 	ret := []*image{}
 
 	if err == nil {
@@ -184,31 +249,69 @@ func match(filterRepo, filterPath, filterTag, ref string) (bool, error) {
 }
 
 //
-func (dc *dockerClient) pullImage(ref string, allTags bool, auth string,
-	verbose bool) error {
+func (dc *dockerClient) pullImage(ctx context.Context, ref string,
+	allTags bool, auth string, verbose bool) error {
+	ctx, cancel := dc.withTimeout(ctx)
+	defer cancel()
 	opts := &types.ImagePullOptions{
 		All:          allTags,
 		RegistryAuth: auth,
 	}
-	rc, err := dc.client.ImagePull(context.Background(), ref, *opts)
+	rc, err := dc.client.ImagePull(ctx, ref, *opts)
 	return dc.handleLog(rc, err, verbose)
 }
 
 //
-func (dc *dockerClient) pushImage(image string, allTags bool, auth string,
-	verbose bool) error {
+func (dc *dockerClient) pushImage(ctx context.Context, image string,
+	allTags bool, auth string, verbose bool) error {
 
+	ctx, cancel := dc.withTimeout(ctx)
+	defer cancel()
 	opts := &types.ImagePushOptions{
 		All:          allTags,
 		RegistryAuth: auth,
 	}
-	rc, err := dc.client.ImagePush(context.Background(), image, *opts)
+	rc, err := dc.client.ImagePush(ctx, image, *opts)
 	return dc.handleLog(rc, err, verbose)
 }
 
 //
-func (dc *dockerClient) tagImage(source, target string) error {
-	return dc.client.ImageTag(context.Background(), source, target)
+func (dc *dockerClient) tagImage(ctx context.Context,
+	source, target string) error {
+	ctx, cancel := dc.withTimeout(ctx)
+	defer cancel()
+	return dc.client.ImageTag(ctx, source, target)
+}
+
+//
+func (dc *dockerClient) removeImage(ctx context.Context, ref string) error {
+	ctx, cancel := dc.withTimeout(ctx)
+	defer cancel()
+	_, err := dc.client.ImageRemove(ctx, ref,
+		types.ImageRemoveOptions{PruneChildren: true})
+	return err
+}
+
+// pruneDanglingImages removes all dangling images, and returns the number of
+// bytes reclaimed
+func (dc *dockerClient) pruneDanglingImages(ctx context.Context) (
+	uint64, error) {
+	ctx, cancel := dc.withTimeout(ctx)
+	defer cancel()
+	report, err := dc.client.ImagesPrune(ctx,
+		filters.NewArgs(filters.Arg("dangling", "true")))
+	return report.SpaceReclaimed, err
+}
+
+// dataRoot returns the root directory of the Docker daemon's persistent data
+func (dc *dockerClient) dataRoot(ctx context.Context) (string, error) {
+	ctx, cancel := dc.withTimeout(ctx)
+	defer cancel()
+	info, err := dc.client.Info(ctx)
+	if err != nil {
+		return "", err
+	}
+	return info.DockerRootDir, nil
 }
 
 //
@@ -225,6 +328,16 @@ func (dc *dockerClient) handleLog(rc io.ReadCloser, err error,
 	}
 	terminalFd := os.Stdout.Fd()
 	isTerminal := dc.wrOut == os.Stdout && terminal.IsTerminal(int(terminalFd))
+	if verbose && isTerminal {
+		return displayProgress(rc, out)
+	}
+	var in io.Reader = rc
+	if verbose {
+		// progress lines would flood the logs otherwise
+		tr := throttleProgress(rc)
+		defer tr.Close()
+		in = tr
+	}
 	return jsonmessage.DisplayJSONMessagesStream(
-		rc, out, terminalFd, isTerminal, nil)
+		in, out, terminalFd, isTerminal, nil)
 }
@@ -0,0 +1,161 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package docker
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// daemonHandler stands in for the Docker daemon; it reports API version 1.40,
+// and hangs on requests for tagging until they are cancelled
+func daemonHandler(paths chan<- string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if paths != nil {
+			paths <- req.URL.Path
+		}
+		if strings.HasSuffix(req.URL.Path, "/tag") {
+			<-req.Context().Done()
+			return
+		}
+		w.Header().Set("API-Version", "1.40")
+		w.Write([]byte("{}"))
+	}
+}
+
+//
+func TestClientVersion(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	paths := make(chan string, 10)
+	srv := httptest.NewServer(daemonHandler(paths))
+	defer srv.Close()
+	host := "tcp://" + strings.TrimPrefix(srv.URL, "http://")
+
+	// version is negotiated with the daemon when not set
+	dc, err := newClient(host, "", nil, 0, nil)
+	th.AssertNoError(err)
+	_, err = dc.dataRoot(context.Background())
+	th.AssertNoError(err)
+	th.AssertEqual("/_ping", <-paths)
+	th.AssertEqual("/v1.40/info", <-paths)
+
+	// pinned version is used as is
+	dc, err = newClient(host, "1.24", nil, 0, nil)
+	th.AssertNoError(err)
+	_, err = dc.dataRoot(context.Background())
+	th.AssertNoError(err)
+	th.AssertEqual("/v1.24/info", <-paths)
+}
+
+//
+func TestClientTimeout(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(daemonHandler(nil))
+	defer srv.Close()
+	host := "tcp://" + strings.TrimPrefix(srv.URL, "http://")
+
+	dc, err := newClient(host, "1.40", nil, 100*time.Millisecond, nil)
+	th.AssertNoError(err)
+
+	start := time.Now()
+	th.AssertError(dc.tagImage(context.Background(), "a", "b:c"),
+		"context deadline exceeded")
+	th.AssertTrue(time.Since(start) < 5*time.Second)
+
+	// timeout applies to each call, not to the client as a whole
+	_, err = dc.ping(context.Background(), 1, 0)
+	th.AssertNoError(err)
+}
+
+//
+func TestClientTLS(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewTLSServer(daemonHandler(nil))
+	defer srv.Close()
+	host := "tcp://" + strings.TrimPrefix(srv.URL, "https://")
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	th.AssertNoError(ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644))
+
+	conf := &RelayConfig{
+		DockerHost: host,
+		TLS:        &registry.TLSConfig{CAFile: ca},
+	}
+	th.AssertNoError(conf.Validate())
+
+	relay, err := NewDockerRelay(conf, nil)
+	th.AssertNoError(err)
+	th.AssertNoError(relay.CheckHealth())
+
+	// without TLS settings, the daemon cannot be reached
+	dc, err := newClient(host, "", nil, 0, nil)
+	th.AssertNoError(err)
+	_, err = dc.ping(context.Background(), 1, 0)
+	th.AssertNotNil(err)
+}
+
+//
+func TestClientSSH(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dc, err := newClient("ssh://builder@build.example.com", "", nil, 0, nil)
+	th.AssertNoError(err)
+	th.AssertEqual("http://docker", dc.client.DaemonHost())
+
+	_, err = newClient("ssh://", "", nil, 0, nil)
+	th.AssertNotNil(err)
+}
+
+//
+func TestRelayConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertError((&RelayConfig{
+		DockerHost: "unix:///var/run/docker.sock",
+		TLS:        &registry.TLSConfig{CAFile: "ca.pem"},
+	}).Validate(), "'tls' is only supported with a 'tcp://' Docker host")
+	th.AssertError((&RelayConfig{
+		DockerHost: "tcp://build.example.com:2376",
+		TLS:        &registry.TLSConfig{CertFile: "cert.pem"},
+	}).Validate(), "invalid 'tls' settings: 'cert-file' and 'key-file' "+
+		"need to be set together")
+	th.AssertError((&RelayConfig{Timeout: -time.Second}).Validate(),
+		"'timeout' must not be negative")
+
+	_, err := NewPodmanRelay(
+		&PodmanRelayConfig{Socket: "ssh://core@podman.example.com"}, nil)
+	th.AssertError(err, "SSH connections are not supported by the Podman relay")
+}
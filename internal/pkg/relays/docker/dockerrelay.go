@@ -17,51 +17,138 @@
 package docker
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"strings"
+	gosync "sync"
 	"time"
 
 	"github.com/docker/docker/client"
+	units "github.com/docker/go-units"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
 	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/tracing"
 	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
 const RelayID = "docker"
 
+// what to do when the Docker host is low on disk space
+const (
+	OnLowSpaceCleanup = "cleanup"
+	OnLowSpacePause   = "pause"
+)
+
 //
 type RelayConfig struct {
-	DockerHost string `yaml:"dockerhost"`
-	APIVersion string `yaml:"api-version"`
+	DockerHost   string              `yaml:"dockerhost"`
+	APIVersion   string              `yaml:"api-version"`
+	TLS          *registry.TLSConfig `yaml:"tls"`
+	Timeout      time.Duration       `yaml:"timeout"`
+	MinFreeSpace string              `yaml:"min-free-space"`
+	DataRoot     string              `yaml:"data-root"`
+	OnLowSpace   string              `yaml:"on-low-space"`
+	//
+	minFreeSpace uint64
+}
+
+//
+func (c *RelayConfig) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.TLS != nil {
+		if !strings.HasPrefix(c.DockerHost, "tcp://") {
+			return fmt.Errorf(
+				"'tls' is only supported with a 'tcp://' Docker host")
+		}
+		if err := c.TLS.Validate(); err != nil {
+			return fmt.Errorf("invalid 'tls' settings: %v", err)
+		}
+	}
+
+	if c.Timeout < 0 {
+		return fmt.Errorf("'timeout' must not be negative")
+	}
+
+	if c.MinFreeSpace != "" {
+		size, err := units.RAMInBytes(c.MinFreeSpace)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid value for 'min-free-space': '%s'",
+				c.MinFreeSpace)
+		}
+		c.minFreeSpace = uint64(size)
+	}
+
+	switch c.OnLowSpace {
+	case "":
+		c.OnLowSpace = OnLowSpaceCleanup
+	case OnLowSpaceCleanup, OnLowSpacePause:
+	default:
+		return fmt.Errorf(
+			"invalid value for 'on-low-space': '%s', must be '%s' or '%s'",
+			c.OnLowSpace, OnLowSpaceCleanup, OnLowSpacePause)
+	}
+
+	return nil
 }
 
 //
 type DockerRelay struct {
-	client *dockerClient
+	id           string // relay ID, also used for the Podman relay
+	daemon       string // name of the daemon for log messages
+	client       *dockerClient
+	minFreeSpace uint64
+	dataRoot     string
+	onLowSpace   string
+	// source & target refs synced so far, for cleanup when low on disk space
+	synced map[[2]string]bool
+	mutex  gosync.Mutex
 }
 
 //
 func NewDockerRelay(conf *RelayConfig, out io.Writer) (*DockerRelay, error) {
+	return newRelay(RelayID, "Docker daemon", client.DefaultDockerHost,
+		conf, out)
+}
 
-	relay := &DockerRelay{}
+// newRelay creates a relay talking to the Docker API at the configured host,
+// or at defaultHost if none is configured
+func newRelay(id, daemon, defaultHost string, conf *RelayConfig,
+	out io.Writer) (*DockerRelay, error) {
+
+	relay := &DockerRelay{
+		id:     id,
+		daemon: daemon,
+		synced: make(map[[2]string]bool),
+	}
 
-	dockerHost := client.DefaultDockerHost
-	apiVersion := "1.24"
+	dockerHost := defaultHost
+	var apiVersion string // negotiated with the daemon unless set
+	var tls *registry.TLSConfig
+	var timeout time.Duration
 
 	if conf != nil {
 		if conf.DockerHost != "" {
 			dockerHost = conf.DockerHost
 		}
-		if conf.APIVersion != "" {
-			apiVersion = conf.APIVersion
-		}
+		apiVersion = conf.APIVersion
+		tls = conf.TLS
+		timeout = conf.Timeout
+		relay.minFreeSpace = conf.minFreeSpace
+		relay.dataRoot = conf.DataRoot
+		relay.onLowSpace = conf.OnLowSpace
 	}
 
-	cli, err := newClient(dockerHost, apiVersion, out)
+	cli, err := newClient(dockerHost, apiVersion, tls, timeout, out)
 	if err != nil {
-		return nil, fmt.Errorf("cannot create Docker client: %v", err)
+		return nil, fmt.Errorf("cannot create client for %s: %v", daemon, err)
 	}
 
 	relay.client = cli
@@ -73,25 +160,35 @@ func (r *DockerRelay) Prepare() error {
 
 	// when we begin, Docker daemon may not be ready yet, e.g. when dregsy runs
 	// side by side with a Docker-in-Docker container inside a pod on k8s
-	log.Info("pinging Docker daemon...")
+	log.Infof("pinging %s...", r.daemon)
 
-	if _, err := r.client.ping(30, 10*time.Second); err != nil {
+	_, err := r.client.ping(context.Background(), 30, 10*time.Second)
+	if err != nil {
 		return err
 	}
 
-	log.WithField("relay", RelayID).Info("ok, relay ready")
+	log.WithField("relay", r.id).Info("ok, relay ready")
 	return nil
 }
 
+// CheckHealth pings the Docker daemon once, and returns an error if it is not
+// reachable
+func (r *DockerRelay) CheckHealth() error {
+	_, err := r.client.ping(context.Background(), 1, 0)
+	return err
+}
+
 //
 func (r *DockerRelay) Dispose() error {
-	log.WithField("relay", RelayID).Info("disposing relay")
+	log.WithField("relay", r.id).Info("disposing relay")
 	return r.client.close()
 }
 
 //
-func (r *DockerRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
+func (r *DockerRelay) Sync(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
 	trgtRef, trgtAuth string, trgtSkipTLSVerify bool, ts *tags.TagSet,
+	platforms []string, throttle *util.Throttle, span *tracing.Span,
 	verbose bool) error {
 
 	log.WithField("ref", srcRef).Info("pulling source image")
@@ -108,7 +205,7 @@ func (r *DockerRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
 			srcCertDir = skopeo.CertsDirForRepo(repo)
 		}
 		tags, err = ts.Expand(func() ([]string, error) {
-			return skopeo.ListAllTags(
+			return skopeo.ListAllTags(ctx,
 				srcRef, util.DecodeJSONAuth(srcAuth), srcCertDir, srcSkipTLSVerify)
 		})
 
@@ -118,7 +215,7 @@ func (r *DockerRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
 	}
 
 	if len(tags) == 0 {
-		if err = r.pull(srcRef, srcAuth, true, verbose); err != nil {
+		if err = r.pull(ctx, srcRef, srcAuth, true, verbose, span); err != nil {
 			return fmt.Errorf(
 				"error pulling source image '%s': %v", srcRef, err)
 		}
@@ -126,7 +223,8 @@ func (r *DockerRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
 	} else {
 		for _, tag := range tags {
 			srcRefTagged := fmt.Sprintf("%s:%s", srcRef, tag)
-			if err = r.pull(srcRefTagged, srcAuth, false, verbose); err != nil {
+			err = r.pull(ctx, srcRefTagged, srcAuth, false, verbose, span)
+			if err != nil {
 				return fmt.Errorf(
 					"error pulling source image '%s': %v", srcRefTagged, err)
 			}
@@ -137,7 +235,7 @@ func (r *DockerRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
 	var srcImages []*image
 
 	if len(tags) == 0 {
-		srcImages, err = r.list(srcRef)
+		srcImages, err = r.list(ctx, srcRef)
 		if err != nil {
 			log.Error(
 				fmt.Errorf("error listing all tags of source image '%s': %v",
@@ -147,7 +245,7 @@ func (r *DockerRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
 	} else {
 		for _, tag := range tags {
 			srcRefTagged := fmt.Sprintf("%s:%s", srcRef, tag)
-			srcImageTagged, err := r.list(srcRefTagged)
+			srcImageTagged, err := r.list(ctx, srcRefTagged)
 			if err != nil {
 				log.Error(
 					fmt.Errorf("error listing source image '%s': %v",
@@ -163,33 +261,158 @@ func (r *DockerRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
 
 	log.WithField("ref", trgtRef).Info("setting tags for target image")
 
-	_, err = r.tag(srcImages, trgtRef)
+	tagSpan := span.Child(
+		"docker tag", tracing.Attributes{"image.target": trgtRef})
+	_, err = r.tag(ctx, srcImages, trgtRef, ts)
+	tagSpan.Fail(err)
+	tagSpan.End()
 	if err != nil {
 		return fmt.Errorf("error setting tags: %v", err)
 	}
 
 	log.WithField("ref", trgtRef).Info("pushing target image")
 
-	if err := r.push(trgtRef, trgtAuth, verbose); err != nil {
+	if err := r.push(ctx, trgtRef, trgtAuth, verbose, span); err != nil {
 		return fmt.Errorf("error pushing target image: %v", err)
 	}
 
+	r.mutex.Lock()
+	r.synced[[2]string{srcRef, trgtRef}] = true
+	r.mutex.Unlock()
+
+	return nil
+}
+
+// EnsureSpace checks whether the file system holding the Docker data root has
+// at least the configured minimum of free space left; if not, and the relay
+// is set to clean up, the images of earlier syncs are removed from the Docker
+// host before checking again
+func (r *DockerRelay) EnsureSpace() error {
+
+	if r.minFreeSpace == 0 {
+		return nil
+	}
+
+	free, err := r.freeSpace()
+	if err != nil {
+		log.Warnf("cannot determine free disk space, skipping check: %v", err)
+		return nil
+	}
+
+	if free < r.minFreeSpace && r.onLowSpace == OnLowSpaceCleanup {
+		log.WithField("free", units.BytesSize(float64(free))).Warn(
+			"Docker host is low on disk space, removing images of earlier syncs")
+		r.cleanupSynced()
+		if free, err = r.freeSpace(); err != nil {
+			return fmt.Errorf("cannot determine free disk space: %v", err)
+		}
+	}
+
+	if free < r.minFreeSpace {
+		return fmt.Errorf(
+			"only %s of disk space left on Docker host, need at least %s",
+			units.BytesSize(float64(free)),
+			units.BytesSize(float64(r.minFreeSpace)))
+	}
+
 	return nil
 }
 
 //
-func (r *DockerRelay) pull(ref, auth string, allTags, verbose bool) error {
-	return r.client.pullImage(ref, allTags, auth, verbose)
+func (r *DockerRelay) freeSpace() (uint64, error) {
+	if r.dataRoot == "" {
+		root, err := r.client.dataRoot(context.Background())
+		if err != nil {
+			return 0, err
+		}
+		r.dataRoot = root
+	}
+	return freeSpace(r.dataRoot)
+}
+
+// cleanupSynced removes the images of all syncs done so far from the Docker
+// host, as well as dangling images
+func (r *DockerRelay) cleanupSynced() {
+
+	ctx := context.Background()
+
+	r.mutex.Lock()
+	synced := r.synced
+	r.synced = make(map[[2]string]bool)
+	r.mutex.Unlock()
+
+	for refs := range synced {
+		if err := r.Cleanup(ctx, refs[0], refs[1], false); err != nil {
+			log.Warn(err)
+		}
+	}
+
+	if _, err := r.client.pruneDanglingImages(ctx); err != nil {
+		log.Warnf("cannot prune dangling images: %v", err)
+	}
+}
+
+// Cleanup removes all local images of the given source and target refs from
+// the Docker daemon; with dangling set, all dangling images are removed as well
+func (r *DockerRelay) Cleanup(ctx context.Context, srcRef, trgtRef string,
+	dangling bool) error {
+
+	errs := false
+
+	for _, ref := range []string{srcRef, trgtRef} {
+		imgs, err := r.list(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("error listing images of '%s': %v", ref, err)
+		}
+		for _, img := range imgs {
+			for _, tag := range img.Tags {
+				tagged := fmt.Sprintf("%s:%s", img.ref(), tag)
+				log.WithField("ref", tagged).Debug("removing local image")
+				if err := r.client.removeImage(ctx, tagged); err != nil {
+					log.WithField("ref", tagged).Warnf(
+						"cannot remove local image: %v", err)
+					errs = true
+				}
+			}
+		}
+	}
+
+	if dangling {
+		reclaimed, err := r.client.pruneDanglingImages(ctx)
+		if err != nil {
+			log.Warnf("cannot prune dangling images: %v", err)
+			errs = true
+		} else {
+			log.WithField("bytes", reclaimed).Info("pruned dangling images")
+		}
+	}
+
+	if errs {
+		return fmt.Errorf("errors during cleanup of local images")
+	}
+
+	return nil
 }
 
 //
-func (r *DockerRelay) list(ref string) ([]*image, error) {
-	return r.client.listImages(ref)
+func (r *DockerRelay) pull(ctx context.Context, ref, auth string, allTags,
+	verbose bool, span *tracing.Span) error {
+	ps := span.Child("docker pull", tracing.Attributes{"image.source": ref})
+	defer ps.End()
+	err := r.client.pullImage(ctx, ref, allTags, auth, verbose)
+	ps.Fail(err)
+	return err
 }
 
 //
-func (r *DockerRelay) tag(images []*image, targetRef string) (
+func (r *DockerRelay) list(ctx context.Context, ref string) (
 	[]*image, error) {
+	return r.client.listImages(ctx, ref)
+}
+
+//
+func (r *DockerRelay) tag(ctx context.Context, images []*image,
+	targetRef string, ts *tags.TagSet) ([]*image, error) {
 
 	taggedImages := []*image{}
 	targetRepo, targetPath, _ := util.SplitRef(targetRef)
@@ -199,13 +422,14 @@ func (r *DockerRelay) tag(images []*image, targetRef string) (
 			ID:   img.ID,
 			Repo: targetRepo,
 			Path: targetPath,
-			Tags: img.Tags,
 		}
 		for _, tag := range img.Tags {
-			if err := r.client.tagImage(img.ID, fmt.Sprintf("%s:%s",
+			tag = ts.TargetTag(tag)
+			if err := r.client.tagImage(ctx, img.ID, fmt.Sprintf("%s:%s",
 				tagged.ref(), tag)); err != nil {
 				return nil, err
 			}
+			tagged.Tags = append(tagged.Tags, tag)
 		}
 		taggedImages = append(taggedImages, tagged)
 	}
@@ -214,6 +438,11 @@ func (r *DockerRelay) tag(images []*image, targetRef string) (
 }
 
 //
-func (r *DockerRelay) push(ref, auth string, verbose bool) error {
-	return r.client.pushImage(ref, true, auth, verbose)
+func (r *DockerRelay) push(ctx context.Context, ref, auth string,
+	verbose bool, span *tracing.Span) error {
+	ps := span.Child("docker push", tracing.Attributes{"image.target": ref})
+	defer ps.End()
+	err := r.client.pushImage(ctx, ref, true, auth, verbose)
+	ps.Fail(err)
+	return err
 }
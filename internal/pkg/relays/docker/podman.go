@@ -0,0 +1,118 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// PodmanRelayID is the ID of the relay that uses the Docker compatible API of
+// the Podman service instead of a Docker daemon
+const PodmanRelayID = "podman"
+
+// PodmanRelayConfig holds the settings for the Podman relay; 'socket' is the
+// path or URL of the Podman API socket, the other settings are as for the
+// Docker relay
+type PodmanRelayConfig struct {
+	Socket       string        `yaml:"socket"`
+	APIVersion   string        `yaml:"api-version"`
+	Timeout      time.Duration `yaml:"timeout"`
+	MinFreeSpace string        `yaml:"min-free-space"`
+	DataRoot     string        `yaml:"data-root"`
+	OnLowSpace   string        `yaml:"on-low-space"`
+	//
+	docker *RelayConfig
+}
+
+//
+func (c *PodmanRelayConfig) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	host := c.Socket
+	if strings.HasPrefix(host, "/") {
+		host = "unix://" + host
+	}
+
+	c.docker = &RelayConfig{
+		DockerHost:   host,
+		APIVersion:   c.APIVersion,
+		Timeout:      c.Timeout,
+		MinFreeSpace: c.MinFreeSpace,
+		DataRoot:     c.DataRoot,
+		OnLowSpace:   c.OnLowSpace,
+	}
+
+	if err := c.docker.Validate(); err != nil {
+		return err
+	}
+	c.OnLowSpace = c.docker.OnLowSpace
+
+	return nil
+}
+
+// NewPodmanRelay creates a relay that talks to the Podman service; without a
+// socket configured, the socket is taken from CONTAINER_HOST, or else the
+// default socket for rootless or rootful Podman is used
+func NewPodmanRelay(conf *PodmanRelayConfig, out io.Writer) (
+	*DockerRelay, error) {
+
+	var dc *RelayConfig
+	if conf != nil {
+		if conf.docker == nil {
+			if err := conf.Validate(); err != nil {
+				return nil, err
+			}
+		}
+		dc = conf.docker
+	}
+
+	host := defaultPodmanSocket()
+	if dc != nil && dc.DockerHost != "" {
+		host = dc.DockerHost
+	}
+
+	// Podman's SSH connections differ from Docker's
+	if strings.HasPrefix(host, "ssh://") {
+		return nil, fmt.Errorf("SSH connections are not supported by the "+
+			"Podman relay, forward the Podman socket instead: '%s'", host)
+	}
+
+	return newRelay(PodmanRelayID, "Podman service", host, dc, out)
+}
+
+//
+func defaultPodmanSocket() string {
+
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+
+	if os.Geteuid() > 0 {
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+			return fmt.Sprintf("unix://%s/podman/podman.sock", dir)
+		}
+	}
+
+	return "unix:///run/podman/podman.sock"
+}
@@ -0,0 +1,87 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package docker
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestPodmanRelay(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// stands in for the Podman service, answering pings on a Unix socket
+	socket := filepath.Join(t.TempDir(), "podman.sock")
+	l, err := net.Listen("unix", socket)
+	th.AssertNoError(err)
+	pings := 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if filepath.Base(req.URL.Path) == "_ping" {
+				pings++
+			}
+			w.Header().Set("API-Version", "1.40")
+			w.Write([]byte("OK"))
+		}))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	conf := &PodmanRelayConfig{Socket: socket}
+	th.AssertNoError(conf.Validate())
+	th.AssertEqual("unix://"+socket, conf.docker.DockerHost)
+	th.AssertEqual(OnLowSpaceCleanup, conf.OnLowSpace)
+
+	relay, err := NewPodmanRelay(conf, nil)
+	th.AssertNoError(err)
+	th.AssertEqual(PodmanRelayID, relay.id)
+	th.AssertNoError(relay.Prepare())
+	th.AssertNoError(relay.CheckHealth())
+	th.AssertEqual(2, pings)
+	th.AssertNoError(relay.Dispose())
+
+	th.AssertError((&PodmanRelayConfig{OnLowSpace: "wait"}).Validate(),
+		"invalid value for 'on-low-space': 'wait'")
+}
+
+//
+func TestDefaultPodmanSocket(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	t.Setenv("CONTAINER_HOST", "ssh://core@podman.example.com/run/podman.sock")
+	th.AssertEqual("ssh://core@podman.example.com/run/podman.sock",
+		defaultPodmanSocket())
+
+	t.Setenv("CONTAINER_HOST", "")
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if os.Geteuid() > 0 {
+		th.AssertEqual("unix:///run/user/1000/podman/podman.sock",
+			defaultPodmanSocket())
+	} else {
+		th.AssertEqual("unix:///run/podman/podman.sock",
+			defaultPodmanSocket())
+	}
+}
@@ -0,0 +1,250 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	units "github.com/docker/go-units"
+)
+
+// minimum time between two progress messages for the same layer, when output
+// does not go to a terminal
+const progressInterval = 10 * time.Second
+
+// throttleProgress passes on the JSON messages read from r, dropping progress
+// messages for a layer that follow the previous one for that layer within
+// progressInterval; the returned reader needs to be closed when done
+func throttleProgress(r io.Reader) *io.PipeReader {
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		dec := json.NewDecoder(r)
+		enc := json.NewEncoder(pw)
+		last := make(map[string]time.Time)
+		for {
+			var msg jsonmessage.JSONMessage
+			if err := dec.Decode(&msg); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+			if msg.Progress != nil && msg.ID != "" {
+				now := time.Now()
+				if now.Sub(last[msg.ID]) < progressInterval {
+					continue
+				}
+				last[msg.ID] = now
+			}
+			if err := enc.Encode(&msg); err != nil {
+				return // reader was closed
+			}
+		}
+	}()
+
+	return pr
+}
+
+// layer statuses reported by the daemon, after which a layer is complete
+var layerDone = []string{
+	"Pull complete", "Already exists", "Pushed", "Layer already exists",
+	"Mounted from",
+}
+
+// layer statuses reported by the daemon while a layer is in progress
+var layerBusy = []string{
+	"Pulling fs layer", "Waiting", "Downloading", "Verifying Checksum",
+	"Download complete", "Extracting", "Preparing", "Pushing",
+}
+
+// minimum time between two updates of the progress line
+const progressRedraw = 100 * time.Millisecond
+
+//
+type layerProgress struct {
+	current int64
+	total   int64
+	done    bool
+}
+
+// imageProgress aggregates the progress of all layers of an image
+type imageProgress struct {
+	layers map[string]*layerProgress
+	start  time.Time
+	drawn  time.Time
+}
+
+//
+func newImageProgress() *imageProgress {
+	return &imageProgress{
+		layers: make(map[string]*layerProgress),
+		start:  time.Now(),
+	}
+}
+
+// update records msg if it's about a layer, and returns whether it was
+func (p *imageProgress) update(msg *jsonmessage.JSONMessage) bool {
+
+	if msg.ID == "" {
+		return false
+	}
+
+	done := hasStatus(msg.Status, layerDone)
+	if !done && !hasStatus(msg.Status, layerBusy) {
+		return false
+	}
+
+	l, ok := p.layers[msg.ID]
+	if !ok {
+		l = &layerProgress{}
+		p.layers[msg.ID] = l
+	}
+
+	switch {
+	case done:
+		l.done = true
+		if l.total > 0 {
+			l.current = l.total
+		}
+	case msg.Status == "Download complete":
+		l.current = l.total
+	case msg.Progress != nil && msg.Progress.Total > 0 &&
+		(msg.Status == "Downloading" || msg.Status == "Pushing"):
+		l.current, l.total = msg.Progress.Current, msg.Progress.Total
+	}
+
+	return true
+}
+
+// line renders the progress line: a bar across the bytes of all layers with
+// known size, layers completed, bytes transferred, and estimated time left
+func (p *imageProgress) line() string {
+
+	var current, total int64
+	done := 0
+	for _, l := range p.layers {
+		current += l.current
+		total += l.total
+		if l.done {
+			done++
+		}
+	}
+
+	const width = 30
+	filled := 0
+	if total > 0 {
+		filled = int(current * width / total)
+	}
+	if done == len(p.layers) {
+		filled = width
+	}
+
+	eta := "--"
+	if elapsed := time.Since(p.start); current > 0 && total > current {
+		left := time.Duration(float64(elapsed) *
+			float64(total-current) / float64(current))
+		eta = left.Round(time.Second).String()
+	} else if total > 0 && current >= total {
+		eta = "0s"
+	}
+
+	return fmt.Sprintf("[%s%s] %d/%d layers  %s/%s  ETA %s",
+		strings.Repeat("=", filled), strings.Repeat(" ", width-filled),
+		done, len(p.layers), units.HumanSize(float64(current)),
+		units.HumanSize(float64(total)), eta)
+}
+
+// draw shows the progress line on out, replacing the previous one; unless
+// forced, this is skipped if the line was drawn within progressRedraw
+func (p *imageProgress) draw(out io.Writer, force bool) {
+	if !force && time.Since(p.drawn) < progressRedraw {
+		return
+	}
+	fmt.Fprintf(out, "\r%s\x1b[K", p.line())
+	p.drawn = time.Now()
+}
+
+// finish shows the final progress line, if there were any layers
+func (p *imageProgress) finish(out io.Writer) {
+	if len(p.layers) > 0 {
+		p.draw(out, true)
+		fmt.Fprintln(out)
+	}
+}
+
+//
+func hasStatus(status string, list []string) bool {
+	for _, s := range list {
+		if strings.HasPrefix(status, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// displayProgress shows the JSON messages of pulls and pushes read from r on
+// the terminal out, rendering a single progress line per image instead of a
+// line per layer; all other messages are shown as they are
+func displayProgress(r io.Reader, out io.Writer) error {
+
+	dec := json.NewDecoder(r)
+	p := newImageProgress()
+	defer func() { p.finish(out) }()
+
+	for {
+
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if msg.Error != nil {
+			return msg.Error
+		}
+
+		if p.update(&msg) {
+			p.draw(out, p.layers[msg.ID].done)
+			continue
+		}
+
+		// any other message starts a new image, e.g. with all tags pulled
+		p.finish(out)
+		p = newImageProgress()
+
+		text := msg.Status
+		if msg.Stream != "" {
+			text = strings.TrimSuffix(msg.Stream, "\n")
+		}
+		if msg.ID != "" {
+			text = fmt.Sprintf("%s: %s", msg.ID, text)
+		}
+		if text != "" {
+			fmt.Fprintln(out, text)
+		}
+	}
+}
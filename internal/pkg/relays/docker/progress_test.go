@@ -0,0 +1,94 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestThrottleProgress(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	progress := func(id string, current int) string {
+		return fmt.Sprintf(`{"status":"Downloading","progressDetail":`+
+			`{"current":%d,"total":9},"id":"%s"}`, current, id)
+	}
+
+	in := strings.Join([]string{
+		`{"status":"Pulling fs layer","id":"a"}`,
+		progress("a", 1),
+		progress("a", 2),
+		progress("b", 1),
+		`{"status":"Download complete","id":"a"}`,
+	}, "\n")
+
+	r := throttleProgress(strings.NewReader(in))
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	th.AssertNoError(err)
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	th.AssertEqual(4, len(lines))
+	th.AssertTrue(strings.Contains(lines[1], `"current":1`))
+	th.AssertTrue(strings.Contains(lines[2], `"id":"b"`))
+	th.AssertTrue(strings.Contains(lines[3], "Download complete"))
+}
+
+//
+func TestDisplayProgress(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	progress := func(id, status string, current int) string {
+		return fmt.Sprintf(`{"status":"%s","progressDetail":`+
+			`{"current":%d,"total":2048},"id":"%s"}`, status, current, id)
+	}
+
+	in := strings.Join([]string{
+		`{"status":"Pulling from library/test","id":"1.0"}`,
+		`{"status":"Pulling fs layer","id":"a"}`,
+		`{"status":"Pulling fs layer","id":"b"}`,
+		progress("a", "Downloading", 1024),
+		progress("b", "Downloading", 1024),
+		`{"status":"Download complete","id":"a"}`,
+		progress("a", "Extracting", 2048),
+		`{"status":"Pull complete","id":"a"}`,
+		`{"status":"Pull complete","id":"b"}`,
+		`{"status":"Digest: sha256:0123"}`,
+	}, "\n")
+
+	var out strings.Builder
+	th.AssertNoError(displayProgress(strings.NewReader(in), &out))
+
+	lines := strings.Split(out.String(), "\n")
+	th.AssertEqual(4, len(lines))
+	th.AssertEqual("1.0: Pulling from library/test", lines[0])
+	last := lines[1][strings.LastIndex(lines[1], "\r")+1:]
+	th.AssertEqual("["+strings.Repeat("=", 30)+"] 2/2 layers  "+
+		"4.096kB/4.096kB  ETA 0s\x1b[K", last)
+	th.AssertEqual("Digest: sha256:0123", lines[2])
+
+	in = `{"errorDetail":{"message":"denied"},"error":"denied"}`
+	th.AssertError(displayProgress(strings.NewReader(in), &out), "denied")
+}
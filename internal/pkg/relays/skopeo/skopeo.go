@@ -18,6 +18,7 @@ package skopeo
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -51,9 +52,10 @@ func CertsDirForRepo(r string) string {
 	return fmt.Sprintf("%s/%s", certsBaseDir, withoutPort(r))
 }
 
-//
-func ListAllTags(ref, creds, certDir string, skipTLSVerify bool) (
-	[]string, error) {
+// ListAllTags lists the tags of ref via skopeo, which is killed once ctx is
+// done
+func ListAllTags(ctx context.Context, ref, creds, certDir string,
+	skipTLSVerify bool) ([]string, error) {
 
 	cmd := []string{
 		"list-tags",
@@ -76,7 +78,7 @@ func ListAllTags(ref, creds, certDir string, skipTLSVerify bool) (
 	bufOut := new(bytes.Buffer)
 	bufErr := new(bytes.Buffer)
 
-	if err := runSkopeo(bufOut, bufErr, true, cmd...); err != nil {
+	if err := runSkopeo(ctx, bufOut, bufErr, true, cmd...); err != nil {
 		return nil,
 			fmt.Errorf("error listing image tags for ref '%s': %s, %v",
 				ref, bufErr.String(), err)
@@ -103,10 +105,12 @@ func chooseOutStream(out io.Writer, verbose, isErrorStream bool) io.Writer {
 	return ioutil.Discard
 }
 
-//
-func runSkopeo(outWr, errWr io.Writer, verbose bool, args ...string) error {
+// runSkopeo runs skopeo with the given args; the skopeo process is killed
+// once ctx is done
+func runSkopeo(ctx context.Context, outWr, errWr io.Writer, verbose bool,
+	args ...string) error {
 
-	cmd := exec.Command(skopeoBinary, args...)
+	cmd := exec.CommandContext(ctx, skopeoBinary, args...)
 
 	cmd.Stdout = chooseOutStream(outWr, verbose, false)
 	cmd.Stderr = chooseOutStream(errWr, verbose, true)
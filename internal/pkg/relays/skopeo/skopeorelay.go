@@ -18,12 +18,14 @@ package skopeo
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/tracing"
 	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
@@ -31,13 +33,15 @@ const RelayID = "skopeo"
 
 //
 type RelayConfig struct {
-	Binary   string `yaml:"binary"`
-	CertsDir string `yaml:"certs-dir"`
+	Binary       string `yaml:"binary"`
+	CertsDir     string `yaml:"certs-dir"`
+	AllPlatforms bool   `yaml:"all-platforms"`
 }
 
 //
 type SkopeoRelay struct {
-	wrOut io.Writer
+	wrOut        io.Writer
+	allPlatforms bool
 }
 
 //
@@ -55,6 +59,7 @@ func NewSkopeoRelay(conf *RelayConfig, out io.Writer) *SkopeoRelay {
 		if conf.CertsDir != "" {
 			certsBaseDir = conf.CertsDir
 		}
+		relay.allPlatforms = conf.AllPlatforms
 	}
 
 	return relay
@@ -63,7 +68,8 @@ func NewSkopeoRelay(conf *RelayConfig, out io.Writer) *SkopeoRelay {
 //
 func (r *SkopeoRelay) Prepare() error {
 	bufOut := new(bytes.Buffer)
-	if err := runSkopeo(bufOut, nil, true, "--version"); err != nil {
+	if err := runSkopeo(
+		context.Background(), bufOut, nil, true, "--version"); err != nil {
 		return fmt.Errorf("cannot execute skopeo: %v", err)
 	}
 	log.Info(bufOut.String())
@@ -77,8 +83,10 @@ func (r *SkopeoRelay) Dispose() error {
 }
 
 //
-func (r *SkopeoRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
+func (r *SkopeoRelay) Sync(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
 	destRef, destAuth string, destSkipTLSVerify bool, ts *tags.TagSet,
+	platforms []string, throttle *util.Throttle, span *tracing.Span,
 	verbose bool) error {
 
 	srcCreds := util.DecodeJSONAuth(srcAuth)
@@ -89,6 +97,12 @@ func (r *SkopeoRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
 		"copy",
 	}
 
+	if r.allPlatforms {
+		// copy the complete manifest list/image index instead of just the
+		// image matching the platform skopeo runs on
+		cmd = append(cmd, "--all")
+	}
+
 	if srcSkipTLSVerify {
 		cmd = append(cmd, "--src-tls-verify=false")
 	}
@@ -116,7 +130,8 @@ func (r *SkopeoRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
 	}
 
 	tags, err := ts.Expand(func() ([]string, error) {
-		return ListAllTags(srcRef, srcCreds, srcCertDir, srcSkipTLSVerify)
+		return ListAllTags(
+			ctx, srcRef, srcCreds, srcCertDir, srcSkipTLSVerify)
 	})
 
 	if err != nil {
@@ -125,13 +140,21 @@ func (r *SkopeoRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
 
 	errs := false
 	for _, tag := range tags {
+		if ctx.Err() != nil {
+			return fmt.Errorf("sync aborted: %v", ctx.Err())
+		}
 		log.WithField("tag", tag).Info("syncing tag")
-		if err := runSkopeo(r.wrOut, r.wrOut, verbose, append(cmd,
-			fmt.Sprintf("docker://%s:%s", srcRef, tag),
-			fmt.Sprintf("docker://%s:%s", destRef, tag))...); err != nil {
+		src := fmt.Sprintf("docker://%s:%s", srcRef, tag)
+		dest := fmt.Sprintf("docker://%s:%s", destRef, ts.TargetTag(tag))
+		cs := span.Child("skopeo copy", tracing.Attributes{
+			"image.source": src, "image.target": dest})
+		if err := runSkopeo(ctx, r.wrOut, r.wrOut, verbose,
+			append(cmd, src, dest)...); err != nil {
 			log.Error(err)
+			cs.Fail(err)
 			errs = true
 		}
+		cs.End()
 	}
 
 	if errs {
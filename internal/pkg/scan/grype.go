@@ -0,0 +1,117 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package scan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const GrypeID = "grype"
+const defaultGrypeBinary = "grype"
+
+//
+type grypeMatch struct {
+	Vulnerability struct {
+		ID       string `json:"id"`
+		Severity string `json:"severity"`
+	} `json:"vulnerability"`
+}
+
+//
+type grypeReport struct {
+	Matches []grypeMatch `json:"matches"`
+}
+
+//
+type grype struct {
+	binary string
+}
+
+//
+func newGrype(binary string) *grype {
+	if binary == "" {
+		binary = defaultGrypeBinary
+	}
+	return &grype{binary: binary}
+}
+
+// Scan scans the remote image with given ref; creds are expected in the form
+// {user}:{password}
+func (g *grype) Scan(ref, creds string, skipTLSVerify bool) (*Result, error) {
+
+	log.WithField("ref", ref).Info("scanning image with grype")
+
+	// the 'registry:' scheme makes grype pull straight from the registry,
+	// rather than looking for the image in a local Docker daemon first
+	cmd := exec.Command(g.binary, "--quiet", "--output", "json",
+		"registry:"+ref)
+	cmd.Env = os.Environ()
+
+	if creds != "" {
+		parts := strings.SplitN(creds, ":", 2)
+		cmd.Env = append(cmd.Env, "GRYPE_REGISTRY_AUTH_USERNAME="+parts[0])
+		if len(parts) > 1 {
+			cmd.Env = append(cmd.Env, "GRYPE_REGISTRY_AUTH_PASSWORD="+parts[1])
+		}
+	}
+	if skipTLSVerify {
+		cmd.Env = append(cmd.Env, "GRYPE_REGISTRY_INSECURE_SKIP_TLS_VERIFY=true")
+	}
+
+	bufOut := new(bytes.Buffer)
+	bufErr := new(bytes.Buffer)
+	cmd.Stdout = bufOut
+	cmd.Stderr = bufErr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error scanning image '%s': %s, %v",
+			ref, bufErr.String(), err)
+	}
+
+	return parseGrypeOutput(ref, bufOut.Bytes())
+}
+
+//
+func parseGrypeOutput(ref string, out []byte) (*Result, error) {
+
+	report := &grypeReport{}
+	if err := json.Unmarshal(out, report); err != nil {
+		return nil, fmt.Errorf("cannot decode grype output for '%s': %v",
+			ref, err)
+	}
+
+	ret := &Result{Ref: ref, Findings: make(map[string]int)}
+	for _, m := range report.Matches {
+		// grype reports e.g. 'Critical' and 'Negligible', the latter of which
+		// we count as low
+		sev := strings.ToUpper(m.Vulnerability.Severity)
+		if sev == "NEGLIGIBLE" {
+			sev = SeverityLow
+		}
+		ret.Findings[sev]++
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,161 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package scan
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const (
+	ActionFail = "fail"
+	ActionSkip = "skip"
+	ActionWarn = "warn"
+)
+
+//
+const (
+	SeverityUnknown  = "UNKNOWN"
+	SeverityLow      = "LOW"
+	SeverityMedium   = "MEDIUM"
+	SeverityHigh     = "HIGH"
+	SeverityCritical = "CRITICAL"
+)
+
+// severities in ascending order
+var severities = []string{
+	SeverityUnknown, SeverityLow, SeverityMedium, SeverityHigh, SeverityCritical}
+
+//
+func severityLevel(severity string) int {
+	for ix, s := range severities {
+		if s == strings.ToUpper(severity) {
+			return ix
+		}
+	}
+	return -1
+}
+
+//
+type Scanner interface {
+	Scan(ref, creds string, skipTLSVerify bool) (*Result, error)
+}
+
+//
+type Result struct {
+	Ref string
+	// number of findings per severity, keyed by upper case severity
+	Findings map[string]int
+}
+
+//
+func (r *Result) Count(severity string) int {
+	if r == nil {
+		return 0
+	}
+	return r.Findings[strings.ToUpper(severity)]
+}
+
+// CountAtLeast returns the number of findings with given severity or higher
+func (r *Result) CountAtLeast(severity string) int {
+	if r == nil {
+		return 0
+	}
+	min := severityLevel(severity)
+	count := 0
+	for s, c := range r.Findings {
+		if severityLevel(s) >= min {
+			count += c
+		}
+	}
+	return count
+}
+
+//
+type Config struct {
+	Scanner     string `yaml:"scanner"`
+	Binary      string `yaml:"binary"`
+	BlockOn     string `yaml:"block-on"`
+	MaxFindings int    `yaml:"max-findings"`
+	MaxCritical int    `yaml:"max-critical"` // DEPRECATED
+	Action      string `yaml:"action"`
+}
+
+//
+func (c *Config) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	switch c.Scanner {
+	case "":
+		c.Scanner = TrivyID
+	case TrivyID, GrypeID:
+	default:
+		return fmt.Errorf("invalid scanner: '%s', must be '%s' or '%s'",
+			c.Scanner, TrivyID, GrypeID)
+	}
+
+	if c.BlockOn == "" {
+		c.BlockOn = SeverityCritical
+	}
+	c.BlockOn = strings.ToUpper(c.BlockOn)
+	if severityLevel(c.BlockOn) < 0 {
+		return fmt.Errorf("invalid severity for 'block-on': '%s', must be "+
+			"one of %s", c.BlockOn, strings.Join(severities, ", "))
+	}
+
+	switch c.Action {
+	case "":
+		c.Action = ActionFail
+	case ActionFail, ActionSkip, ActionWarn:
+	default:
+		return fmt.Errorf(
+			"invalid scan action: '%s', must be one of '%s', '%s', or '%s'",
+			c.Action, ActionFail, ActionSkip, ActionWarn)
+	}
+
+	if c.MaxCritical != 0 {
+		log.Warn("scan setting 'max-critical' is deprecated, " +
+			"use 'max-findings' instead")
+		if c.MaxFindings == 0 {
+			c.MaxFindings = c.MaxCritical
+		}
+		c.MaxCritical = 0
+	}
+
+	if c.MaxFindings < 0 {
+		return fmt.Errorf("'max-findings' must not be negative")
+	}
+
+	return nil
+}
+
+//
+func NewScanner(c *Config) (Scanner, error) {
+	switch c.Scanner {
+	case TrivyID:
+		return newTrivy(c.Binary), nil
+	case GrypeID:
+		return newGrype(c.Binary), nil
+	}
+	return nil, fmt.Errorf("scanner '%s' not supported", c.Scanner)
+}
@@ -0,0 +1,120 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package scan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const TrivyID = "trivy"
+const defaultTrivyBinary = "trivy"
+
+//
+type trivyVulnerability struct {
+	ID       string `json:"VulnerabilityID"`
+	Severity string `json:"Severity"`
+}
+
+//
+type trivyResult struct {
+	Target          string               `json:"Target"`
+	Vulnerabilities []trivyVulnerability `json:"Vulnerabilities"`
+}
+
+// newer Trivy versions wrap the results into a report object, older ones
+// produce only the list of results
+type trivyReport struct {
+	Results []trivyResult `json:"Results"`
+}
+
+//
+type trivy struct {
+	binary string
+}
+
+//
+func newTrivy(binary string) *trivy {
+	if binary == "" {
+		binary = defaultTrivyBinary
+	}
+	return &trivy{binary: binary}
+}
+
+// Scan scans the remote image with given ref; creds are expected in the form
+// {user}:{password}
+func (t *trivy) Scan(ref, creds string, skipTLSVerify bool) (*Result, error) {
+
+	log.WithField("ref", ref).Info("scanning image with trivy")
+
+	cmd := exec.Command(t.binary,
+		"image", "--quiet", "--no-progress", "--format", "json", ref)
+	cmd.Env = os.Environ()
+
+	if creds != "" {
+		parts := strings.SplitN(creds, ":", 2)
+		cmd.Env = append(cmd.Env, "TRIVY_USERNAME="+parts[0])
+		if len(parts) > 1 {
+			cmd.Env = append(cmd.Env, "TRIVY_PASSWORD="+parts[1])
+		}
+	}
+	if skipTLSVerify {
+		cmd.Env = append(cmd.Env, "TRIVY_INSECURE=true")
+	}
+
+	bufOut := new(bytes.Buffer)
+	bufErr := new(bytes.Buffer)
+	cmd.Stdout = bufOut
+	cmd.Stderr = bufErr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error scanning image '%s': %s, %v",
+			ref, bufErr.String(), err)
+	}
+
+	return parseTrivyOutput(ref, bufOut.Bytes())
+}
+
+//
+func parseTrivyOutput(ref string, out []byte) (*Result, error) {
+
+	var results []trivyResult
+
+	report := &trivyReport{}
+	if err := json.Unmarshal(out, report); err == nil {
+		results = report.Results
+	} else if err := json.Unmarshal(out, &results); err != nil {
+		return nil, fmt.Errorf("cannot decode trivy output for '%s': %v",
+			ref, err)
+	}
+
+	ret := &Result{Ref: ref, Findings: make(map[string]int)}
+	for _, r := range results {
+		for _, v := range r.Vulnerabilities {
+			ret.Findings[strings.ToUpper(v.Severity)]++
+		}
+	}
+
+	return ret, nil
+}
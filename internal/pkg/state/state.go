@@ -0,0 +1,230 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stores opened so far, keyed by file path; tasks that point to the same
+// state file share a store
+var stores = make(map[string]*Store)
+var storesMutex sync.Mutex
+
+// maximum number of repos recorded per blob; when exceeded, the repo recorded
+// longest ago is dropped
+const maxBlobRepos = 8
+
+//
+type content struct {
+	// synced tags per mapping, each with the digest it had when synced
+	Mappings map[string]map[string]string `json:"mappings"`
+	// start of the last completed run per task
+	Runs map[string]time.Time `json:"runs,omitempty"`
+	// repos known to hold each blob, most recently recorded first
+	Blobs map[string][]string `json:"blobs,omitempty"`
+}
+
+//
+func newContent() *content {
+	return &content{
+		Mappings: make(map[string]map[string]string),
+	}
+}
+
+//
+type Store struct {
+	path  string
+	data  *content
+	mutex sync.Mutex
+}
+
+//
+func Open(path string) *Store {
+
+	storesMutex.Lock()
+	defer storesMutex.Unlock()
+
+	if s, ok := stores[path]; ok {
+		return s
+	}
+
+	s := &Store{path: path}
+	s.load()
+	stores[path] = s
+	return s
+}
+
+//
+func (s *Store) load() {
+
+	logger := log.WithField("state", s.path)
+	s.data = newContent()
+
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Info("no state file yet, starting with empty state")
+		} else {
+			logger.Warnf("cannot read state file, starting with empty state: %v",
+				err)
+		}
+		return
+	}
+
+	c := newContent()
+	if err := json.Unmarshal(data, c); err != nil {
+		logger.Warnf("state file corrupt, starting with empty state: %v", err)
+		return
+	}
+
+	if c.Mappings == nil {
+		c.Mappings = make(map[string]map[string]string)
+	}
+	s.data = c
+	logger.Debug("state loaded")
+}
+
+//
+func (s *Store) Path() string {
+	return s.path
+}
+
+// SyncedTags returns a copy of the tag to digest pairs recorded for the
+// mapping with given key
+func (s *Store) SyncedTags(key string) map[string]string {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ret := make(map[string]string)
+	for t, d := range s.data.Mappings[key] {
+		ret[t] = d
+	}
+	return ret
+}
+
+//
+func (s *Store) RecordTag(key, tag, digest string) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m, ok := s.data.Mappings[key]
+	if !ok {
+		m = make(map[string]string)
+		s.data.Mappings[key] = m
+	}
+	m[tag] = digest
+}
+
+// LastRun returns when the last completed run of the task with given name
+// started, or zero time if there is none on record
+func (s *Store) LastRun(task string) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.data.Runs[task]
+}
+
+//
+func (s *Store) RecordRun(task string, start time.Time) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.data.Runs == nil {
+		s.data.Runs = make(map[string]time.Time)
+	}
+	s.data.Runs[task] = start.UTC()
+}
+
+// BlobRepos returns the repos known to hold the blob with given digest, most
+// recently recorded first
+func (s *Store) BlobRepos(digest string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.data.Blobs[digest]...)
+}
+
+//
+func (s *Store) RecordBlobs(repo string, digests []string) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.data.Blobs == nil {
+		s.data.Blobs = make(map[string][]string)
+	}
+
+	for _, d := range digests {
+		repos := []string{repo}
+		for _, r := range s.data.Blobs[d] {
+			if r != repo && len(repos) < maxBlobRepos {
+				repos = append(repos, r)
+			}
+		}
+		s.data.Blobs[d] = repos
+	}
+}
+
+// Save writes the state to its file; to not leave a truncated file behind
+// when interrupted, it is first written to a temporary file, which then
+// replaces the actual state file
+func (s *Store) Save() error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode state: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".dregsy-state-")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot write state: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("cannot replace state file '%s': %v", s.path, err)
+	}
+
+	log.WithField("state", s.path).Debug("state saved")
+	return nil
+}
+
+//
+func MappingKey(srcRef, trgtRef string) string {
+	return fmt.Sprintf("%s -> %s", srcRef, trgtRef)
+}
@@ -0,0 +1,134 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestStateRoundTrip(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-state")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "state.json")
+	key := MappingKey("source/busybox", "target/busybox")
+
+	s := Open(file)
+	th.AssertEqual(0, len(s.SyncedTags(key)))
+
+	s.RecordTag(key, "latest", "sha256:abc")
+	th.AssertNoError(s.Save())
+
+	delete(stores, file)
+	s = Open(file)
+	synced := s.SyncedTags(key)
+	th.AssertEqual(1, len(synced))
+	th.AssertEqual("sha256:abc", synced["latest"])
+}
+
+//
+func TestStateCorrupt(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-state")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "state.json")
+	th.AssertNoError(ioutil.WriteFile(file, []byte(`{"mappings": {`), 0644))
+
+	s := Open(file)
+	key := MappingKey("source/busybox", "target/busybox")
+	th.AssertEqual(0, len(s.SyncedTags(key)))
+
+	s.RecordTag(key, "latest", "sha256:abc")
+	th.AssertNoError(s.Save())
+}
+
+//
+func TestStateRuns(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-state")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "state.json")
+
+	s := Open(file)
+	th.AssertTrue(s.LastRun("mirror").IsZero())
+
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	s.RecordRun("mirror", start)
+	th.AssertNoError(s.Save())
+
+	delete(stores, file)
+	s = Open(file)
+	th.AssertTrue(start.Equal(s.LastRun("mirror")))
+	th.AssertTrue(s.LastRun("other").IsZero())
+}
+
+//
+func TestStateBlobs(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-state")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "state.json")
+
+	s := Open(file)
+	th.AssertEqual(0, len(s.BlobRepos("sha256:abc")))
+
+	s.RecordBlobs("registry.example.com/one", []string{"sha256:abc"})
+	s.RecordBlobs("registry.example.com/two",
+		[]string{"sha256:abc", "sha256:def"})
+	s.RecordBlobs("registry.example.com/one", []string{"sha256:abc"})
+	th.AssertNoError(s.Save())
+
+	delete(stores, file)
+	s = Open(file)
+	th.AssertEqualSlices([]string{"registry.example.com/one",
+		"registry.example.com/two"}, s.BlobRepos("sha256:abc"))
+	th.AssertEqualSlices([]string{"registry.example.com/two"},
+		s.BlobRepos("sha256:def"))
+
+	for i := 0; i < 2*maxBlobRepos; i++ {
+		s.RecordBlobs(fmt.Sprintf("registry.example.com/r%d", i),
+			[]string{"sha256:abc"})
+	}
+	repos := s.BlobRepos("sha256:abc")
+	th.AssertEqual(maxBlobRepos, len(repos))
+	th.AssertEqual(fmt.Sprintf("registry.example.com/r%d", 2*maxBlobRepos-1),
+		repos[0])
+}
@@ -0,0 +1,210 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const apiTasksPath = "/api/v1/tasks"
+
+// runResult is the outcome of a task run; bytes copied are only known when
+// sizes of synced images are looked up, see countsBytes
+type runResult struct {
+	Start    time.Time        `json:"start"`
+	Seconds  float64          `json:"durationSeconds"`
+	Failed   bool             `json:"failed"`
+	Images   int              `json:"images"`
+	Tags     int              `json:"tags"`
+	Bytes    int64            `json:"bytes,omitempty"`
+	Errors   []string         `json:"errors,omitempty"`
+	Mappings []*mappingResult `json:"mappings,omitempty"`
+}
+
+// mappingResult is the outcome of syncing a mapping during a task run
+type mappingResult struct {
+	From   string   `json:"from"`
+	To     string   `json:"to"`
+	Failed bool     `json:"failed"`
+	Images int      `json:"images"`
+	Tags   int      `json:"tags"`
+	Bytes  int64    `json:"bytes,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+	//
+	images int       // images synced in the run before this mapping
+	tags   int       // tags synced in the run before this mapping
+	bytes  int64     // bytes synced in the run before this mapping
+	start  time.Time // when syncing of this mapping started
+}
+
+// startMapping starts recording the outcome of syncing m in the current run
+func (t *Task) startMapping(m *Mapping) {
+	t.endMapping()
+	t.runMapping = &mappingResult{From: m.From, To: m.To,
+		images: t.runImages, tags: t.runTags, bytes: t.runBytes,
+		start: time.Now()}
+}
+
+// endMapping finishes recording the outcome of the mapping currently synced,
+// if any
+func (t *Task) endMapping() {
+	if mr := t.runMapping; mr != nil {
+		mr.Images = t.runImages - mr.images
+		mr.Tags = t.runTags - mr.tags
+		mr.Bytes = t.runBytes - mr.bytes
+		t.runResults = append(t.runResults, mr)
+		t.runMapping = nil
+	}
+}
+
+// taskInfo describes a task and its state, as returned by the API
+type taskInfo struct {
+	Name     string     `json:"name"`
+	Source   string     `json:"source"`
+	Target   string     `json:"target"`
+	Interval int        `json:"interval,omitempty"`
+	Schedule string     `json:"schedule,omitempty"`
+	Running  bool       `json:"running"`
+	Paused   bool       `json:"paused"`
+	LastRun  *runResult `json:"lastRun,omitempty"`
+	NextRun  *time.Time `json:"nextRun,omitempty"`
+}
+
+//
+func newTaskInfo(t *Task) *taskInfo {
+	return &taskInfo{
+		Name:     t.Name,
+		Source:   t.Source.Registry,
+		Target:   t.Target.Registry,
+		Interval: t.Interval,
+		Schedule: t.Schedule,
+		Running:  t.isRunning(),
+		Paused:   t.isPaused(),
+		LastRun:  t.lastResult(),
+		NextRun:  t.nextRun(),
+	}
+}
+
+// handleAPI serves the task API: GET on /api/v1/tasks lists all tasks, GET on
+// /api/v1/tasks/{name} returns a single task, and POST on
+// /api/v1/tasks/{name}/{trigger|pause|resume|cancel} acts on a task
+func (ts *triggerServer) handleAPI(w http.ResponseWriter, r *http.Request) {
+
+	if !ts.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiTasksPath), "/")
+	parts := strings.Split(path, "/")
+
+	if path == "" {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		ts.mutex.RLock()
+		ret := make([]*taskInfo, 0, len(ts.tasks))
+		for _, t := range ts.tasks {
+			ret = append(ret, newTaskInfo(t))
+		}
+		ts.mutex.RUnlock()
+		sort.Slice(ret, func(i, j int) bool {
+			return ret[i].Name < ret[j].Name
+		})
+		respondJSON(w, http.StatusOK, ret)
+		return
+	}
+
+	if len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	ts.mutex.RLock()
+	t, ok := ts.tasks[parts[0]]
+	ts.mutex.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no task with name '%s'", parts[0]),
+			http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		if allowMethod(w, r, http.MethodGet) {
+			respondJSON(w, http.StatusOK, newTaskInfo(t))
+		}
+		return
+	}
+
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	logger := log.WithFields(log.Fields{"task": t.Name, "remote": r.RemoteAddr})
+
+	switch parts[1] {
+	case "trigger":
+		logger.Info("sync triggered via API")
+		ts.enqueue(w, t)
+	case "pause":
+		logger.Info("task paused via API")
+		t.pause()
+		respondJSON(w, http.StatusOK, newTaskInfo(t))
+	case "resume":
+		logger.Info("task resumed via API")
+		t.resume()
+		respondJSON(w, http.StatusOK, newTaskInfo(t))
+	case "cancel":
+		if !t.cancelRun() {
+			http.Error(w, fmt.Sprintf("task '%s' is not running", t.Name),
+				http.StatusConflict)
+			return
+		}
+		logger.Info("task run cancelled via API")
+		respondJSON(w, http.StatusAccepted, newTaskInfo(t))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// allowMethod returns true if the request uses the given method, and responds
+// with status 405 otherwise
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+//
+func respondJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("cannot write API response: %v", err)
+	}
+}
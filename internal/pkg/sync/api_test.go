@@ -0,0 +1,145 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestAPI(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	mirror := &Task{Name: "mirror", Interval: 60,
+		Source: &Location{Registry: "docker.io"},
+		Target: &Location{Registry: "registry.example.com"}}
+	other := &Task{Name: "other", Schedule: "0 * * * *",
+		Source: &Location{Registry: "quay.io"},
+		Target: &Location{Registry: "registry.example.com"}}
+	mirror.setResult(&runResult{Start: time.Now(), Images: 2, Tags: 5})
+
+	ts := newTriggerServer(&TriggerConfig{Listen: ":0", Secret: "s3cr3t",
+		API: true}, []*Task{other, mirror})
+
+	received := make(chan *Task, 1)
+	go func() {
+		received <- <-ts.queue
+	}()
+
+	tryAPI := func(method, path, secret string, want int,
+		v interface{}) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		req := httptest.NewRequest(method, path, nil)
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		rec := httptest.NewRecorder()
+		ts.handleAPI(rec, req)
+		th.AssertEqual(want, rec.Code)
+		if v != nil {
+			th.AssertNoError(json.Unmarshal(rec.Body.Bytes(), v))
+		}
+	}
+
+	tryAPI(http.MethodGet, "/api/v1/tasks", "", http.StatusUnauthorized, nil)
+	tryAPI(http.MethodGet, "/api/v1/tasks", "wrong", http.StatusUnauthorized,
+		nil)
+	tryAPI(http.MethodPost, "/api/v1/tasks", "s3cr3t",
+		http.StatusMethodNotAllowed, nil)
+
+	var list []*taskInfo
+	tryAPI(http.MethodGet, "/api/v1/tasks", "s3cr3t", http.StatusOK, &list)
+	th.AssertEqual(2, len(list))
+	th.AssertEqual("mirror", list[0].Name)
+	th.AssertEqual(60, list[0].Interval)
+	th.AssertEqual("docker.io", list[0].Source)
+	th.AssertEqual(5, list[0].LastRun.Tags)
+	th.AssertEqual("other", list[1].Name)
+	th.AssertEqual("0 * * * *", list[1].Schedule)
+	th.AssertNil(list[1].LastRun)
+
+	info := &taskInfo{}
+	tryAPI(http.MethodGet, "/api/v1/tasks/mirror", "s3cr3t", http.StatusOK,
+		info)
+	th.AssertEqual(2, info.LastRun.Images)
+	tryAPI(http.MethodGet, "/api/v1/tasks/nope", "s3cr3t",
+		http.StatusNotFound, nil)
+	tryAPI(http.MethodGet, "/api/v1/tasks/mirror/trigger", "s3cr3t",
+		http.StatusMethodNotAllowed, nil)
+	tryAPI(http.MethodPost, "/api/v1/tasks/mirror/nope", "s3cr3t",
+		http.StatusNotFound, nil)
+
+	// pause & resume
+	info = &taskInfo{}
+	tryAPI(http.MethodPost, "/api/v1/tasks/mirror/pause", "s3cr3t",
+		http.StatusOK, info)
+	th.AssertTrue(info.Paused)
+	th.AssertTrue(mirror.isPaused())
+	tryAPI(http.MethodPost, "/api/v1/tasks/mirror/trigger", "s3cr3t",
+		http.StatusConflict, nil)
+
+	info = &taskInfo{}
+	tryAPI(http.MethodPost, "/api/v1/tasks/mirror/resume", "s3cr3t",
+		http.StatusOK, info)
+	th.AssertFalse(info.Paused)
+
+	tryAPI(http.MethodPost, "/api/v1/tasks/mirror/trigger", "s3cr3t",
+		http.StatusAccepted, nil)
+	th.AssertEqual(mirror, <-received)
+
+	// cancel
+	tryAPI(http.MethodPost, "/api/v1/tasks/mirror/cancel", "s3cr3t",
+		http.StatusConflict, nil)
+	cancelled := false
+	mirror.setCancel(func() { cancelled = true })
+	tryAPI(http.MethodPost, "/api/v1/tasks/mirror/cancel", "s3cr3t",
+		http.StatusAccepted, nil)
+	th.AssertTrue(cancelled)
+
+	th.AssertError((&TriggerConfig{Listen: ":0", API: true}).validate(),
+		"'api' requires a 'secret'")
+}
+
+//
+func TestPausedTaskSkipped(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s := &Sync{workers: make(chan bool, 1), ticks: make(chan bool, 1)}
+	task := &Task{Name: "mirror"}
+	task.pause()
+
+	ran := false
+	var running gosync.WaitGroup
+	s.runExclusive(task, &running, false, func() { ran = true })
+	running.Wait()
+	th.AssertFalse(ran)
+
+	task.resume()
+	s.runExclusive(task, &running, false, func() { ran = true })
+	running.Wait()
+	th.AssertTrue(ran)
+}
@@ -0,0 +1,93 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	gosync "sync"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+)
+
+// ArtifactoryConfig holds settings for locations that are Docker registries
+// hosted in JFrog Artifactory, using the repository path access method, i.e.
+// image refs of the form {registry}/{repo key}/{image path}
+type ArtifactoryConfig struct {
+	URL         string `yaml:"url"`
+	RepoKey     string `yaml:"repo-key"`
+	CreateRepo  bool   `yaml:"create-repo"`
+	APIKey      string `yaml:"api-key"`
+	AccessToken string `yaml:"access-token"`
+	//
+	ensured gosync.Once
+	err     error
+}
+
+//
+func (c *ArtifactoryConfig) validate(l *Location) error {
+
+	if c == nil {
+		return nil
+	}
+
+	c.RepoKey = strings.Trim(c.RepoKey, "/")
+	if c.RepoKey == "" {
+		return errors.New("'repo-key' is required")
+	}
+
+	if c.URL == "" {
+		c.URL = fmt.Sprintf("https://%s/artifactory", l.Registry)
+	}
+
+	if c.APIKey != "" && c.AccessToken != "" {
+		return errors.New("'api-key' and 'access-token' are mutually exclusive")
+	}
+
+	return nil
+}
+
+// prefix returns the path prefix under which images are found in this
+// location
+func (c *ArtifactoryConfig) prefix() string {
+	if c == nil {
+		return ""
+	}
+	return "/" + c.RepoKey
+}
+
+// ensureRepo creates the Docker repository if repo creation is enabled; this
+// is done only once
+func (c *ArtifactoryConfig) ensureRepo(l *Location) error {
+
+	if c == nil || !c.CreateRepo {
+		return nil
+	}
+
+	c.ensured.Do(func() {
+		c.err = registry.EnsureArtifactoryRepo(&registry.ArtifactoryAPI{
+			URL:         c.URL,
+			AccessToken: c.AccessToken,
+			APIKey:      c.APIKey,
+			Creds:       l.creds,
+			Insecure:    l.SkipTLSVerify,
+		}, c.RepoKey)
+	})
+
+	return c.err
+}
@@ -0,0 +1,104 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestArtifactory(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var created []map[string]string
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			if r.Header.Get("X-JFrog-Art-Api") != "k3y" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			if r.URL.Path != "/artifactory/api/repositories/docker-mirror" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			switch r.Method {
+			case http.MethodGet:
+				if len(created) > 0 {
+					w.WriteHeader(http.StatusOK)
+				} else {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			case http.MethodPut:
+				var repo map[string]string
+				th.AssertNoError(json.NewDecoder(r.Body).Decode(&repo))
+				created = append(created, repo)
+				w.WriteHeader(http.StatusOK)
+			}
+		}))
+	defer srv.Close()
+
+	reg := strings.TrimPrefix(srv.URL, "https://")
+
+	m := &Mapping{From: "library/busybox", To: "mirror/busybox"}
+	th.AssertNoError(m.validate())
+
+	task := &Task{
+		Name:   "test",
+		Source: &Location{Registry: "registry.hub.docker.com"},
+		Target: &Location{
+			Registry:      reg,
+			SkipTLSVerify: true,
+			Artifactory: &ArtifactoryConfig{
+				RepoKey:    "/docker-mirror/",
+				CreateRepo: true,
+				APIKey:     "k3y",
+			},
+		},
+		Mappings: []*Mapping{m},
+	}
+	th.AssertNoError(task.validate())
+
+	refs, err := task.mappingRefs(m)
+	th.AssertNoError(err)
+	th.AssertEqual(1, len(refs))
+	th.AssertEqual("registry.hub.docker.com/library/busybox", refs[0][0])
+	th.AssertEqual(reg+"/docker-mirror/mirror/busybox", refs[0][1])
+
+	// repo is only created once
+	th.AssertNoError(task.ensureTargetExists(refs[0][1]))
+	th.AssertNoError(task.ensureTargetExists(refs[0][1]))
+	th.AssertEqual(1, len(created))
+	th.AssertEqual("docker", created[0]["packageType"])
+	th.AssertEqual("local", created[0]["rclass"])
+
+	path, ok := task.Target.repoPath("docker-mirror/mirror/busybox")
+	th.AssertTrue(ok)
+	th.AssertEqual("/mirror/busybox", path)
+	_, ok = task.Target.repoPath("docker-other/mirror/busybox")
+	th.AssertTrue(!ok)
+}
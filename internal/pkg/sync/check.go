@@ -0,0 +1,160 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/xelalexv/dregsy/internal/pkg/relays/containerd"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/direct"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/docker"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
+)
+
+// CheckConfig loads the given config file and checks it more thoroughly than
+// LoadConfig, without contacting any registry: paths in mappings need to form
+// valid image refs, and settings that have no effect are reported; all
+// problems found are returned in one error
+func CheckConfig(file string) error {
+
+	config, err := LoadConfig(file)
+	if err != nil {
+		return err
+	}
+
+	problems := append(config.checkRefs(), config.checkUnused()...)
+	if len(problems) > 0 {
+		return fmt.Errorf("config file '%s' has %d problem(s):\n  %s",
+			file, len(problems), strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// checkRefs checks whether the paths of all mappings form valid image refs
+// together with the registries of their task
+func (c *SyncConfig) checkRefs() []string {
+
+	var ret []string
+
+	for _, t := range c.Tasks {
+		for ix, m := range t.Mappings {
+
+			where := fmt.Sprintf("task '%s', mapping %d", t.Name, ix+1)
+
+			if !m.isRegexpFrom() {
+				if err := checkRepo(t.Source.Registry, m.From); err != nil {
+					ret = append(ret, fmt.Sprintf(
+						"%s: invalid 'from' path '%s': %v", where, m.From, err))
+				}
+			}
+
+			to := ""
+			switch {
+			case m.toTemplate != nil || isRegexp(m.To):
+				// only known when rendering/replacing
+			case isWildcard(m.To):
+				to = m.toReplace + "x"
+			default:
+				to = m.To
+			}
+
+			if to != "" {
+				if err := checkRepo(t.Target.Registry, to); err != nil {
+					ret = append(ret, fmt.Sprintf(
+						"%s: invalid 'to' path '%s': %v", where, m.To, err))
+				}
+			}
+		}
+	}
+
+	return ret
+}
+
+//
+func checkRepo(registry, path string) error {
+	_, err := gocrname.NewRepository(
+		fmt.Sprintf("%s/%s", registry, strings.TrimPrefix(path, "/")))
+	return err
+}
+
+// checkUnused looks for settings that have no effect due to other settings
+func (c *SyncConfig) checkUnused() []string {
+
+	var ret []string
+
+	unusedRelay := func(section, relay string) {
+		ret = append(ret, fmt.Sprintf(
+			"'%s' settings have no effect, since relay is '%s'", section, relay))
+	}
+	if c.Relay != docker.RelayID && c.Docker != nil {
+		unusedRelay(docker.RelayID, c.Relay)
+	}
+	if c.Relay != docker.PodmanRelayID && c.Podman != nil {
+		unusedRelay(docker.PodmanRelayID, c.Relay)
+	}
+	if c.Relay != containerd.RelayID && c.Containerd != nil {
+		unusedRelay(containerd.RelayID, c.Relay)
+	}
+	if c.Relay != skopeo.RelayID && c.FallbackRelay != skopeo.RelayID &&
+		c.Skopeo != nil {
+		unusedRelay(skopeo.RelayID, c.Relay)
+	}
+	if c.Relay != direct.RelayID && c.FallbackRelay != direct.RelayID &&
+		c.Direct != nil {
+		unusedRelay(direct.RelayID, c.Relay)
+	}
+
+	used := make(map[string]bool)
+	for _, t := range c.Tasks {
+		used[t.Relay] = true
+	}
+	var names []string
+	for name := range c.Relays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !used[name] {
+			ret = append(ret, fmt.Sprintf(
+				"relay '%s' is not used by any task", name))
+		}
+		r := c.Relays[name]
+		for _, section := range r.unusedSections() {
+			ret = append(ret, fmt.Sprintf("relay '%s': '%s' settings have no "+
+				"effect, since its type is '%s'", name, section, r.Type))
+		}
+	}
+
+	for _, t := range c.Tasks {
+		if t.Retries == 0 && t.RetryBackoff > 0 {
+			ret = append(ret, fmt.Sprintf(
+				"task '%s': 'retry-backoff' has no effect without 'retries'",
+				t.Name))
+		}
+		if !t.DockerHubPacing && t.DockerHubWait > 0 {
+			ret = append(ret, fmt.Sprintf("task '%s': 'dockerhub-max-wait' "+
+				"has no effect without 'dockerhub-pacing'", t.Name))
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,54 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestCheckConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNoError(CheckConfig(th.GetFixture("config/direct-valid.yaml")))
+
+	th.AssertError(CheckConfig(th.GetFixture("config/check-unknown-field.yaml")),
+		"line 10: field tag not found")
+
+	th.AssertError(CheckConfig(th.GetFixture("config/task-no-name.yaml")),
+		"a task requires a name")
+
+	err := CheckConfig(th.GetFixture("config/check-problems.yaml"))
+	th.AssertError(err, "has 4 problem(s)")
+	th.AssertError(err,
+		"task 'test', mapping 1: invalid 'from' path '/library/BusyBox'")
+	th.AssertError(err,
+		"task 'test', mapping 2: invalid 'to' path 'mirror/Library/*'")
+	th.AssertError(err, "'docker' settings have no effect, since relay is "+
+		"'skopeo'")
+	th.AssertError(err,
+		"task 'test': 'retry-backoff' has no effect without 'retries'")
+
+	err = CheckConfig(th.GetFixture("config/check-relays.yaml"))
+	th.AssertError(err, "has 2 problem(s)")
+	th.AssertError(err, "relay 'spare' is not used by any task")
+	th.AssertError(err, "relay 'spare': 'direct' settings have no effect, "+
+		"since its type is 'skopeo'")
+}
@@ -17,31 +17,70 @@
 package sync
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"strings"
 	"time"
 
-	"gopkg.in/yaml.v2"
-
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/leader"
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/notify"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/containerd"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/direct"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/docker"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
+	"github.com/xelalexv/dregsy/internal/pkg/tracing"
 )
 
 //
 const minimumTaskInterval = 30
 const minimumAuthRefreshInterval = time.Hour
+const defaultAuthRefreshMargin = 30 * time.Minute
+
+// a larger margin would renew ECR tokens more often than the minimum interval
+const maximumAuthRefreshMargin = auth.ECRTokenLifetime -
+	minimumAuthRefreshInterval
+const defaultShutdownTimeout = 5 * time.Minute
+
+// when to check whether the relay is ready
+const (
+	PingStartup = "startup"
+	PingTask    = "task"
+	PingOff     = "off"
+)
 
 //
 type SyncConfig struct {
-	Relay      string              `yaml:"relay"`
-	Docker     *docker.RelayConfig `yaml:"docker"`
-	Skopeo     *skopeo.RelayConfig `yaml:"skopeo"`
-	DockerHost string              `yaml:"dockerhost"`  // DEPRECATED
-	APIVersion string              `yaml:"api-version"` // DEPRECATED
-	Lister     *ListerConfig       `yaml:"lister"`
-	Tasks      []*Task             `yaml:"tasks"`
+	Relay           string                    `yaml:"relay"`
+	FallbackRelay   string                    `yaml:"fallback-relay"`
+	RequireDaemon   bool                      `yaml:"require-daemon"`
+	Ping            string                    `yaml:"ping"`
+	Parallelism     int                       `yaml:"parallelism"`
+	DryRun          bool                      `yaml:"dry-run"`
+	Quiet           bool                      `yaml:"quiet"`
+	ShutdownTimeout time.Duration             `yaml:"shutdown-timeout"`
+	MaxRunDuration  time.Duration             `yaml:"max-run-duration"`
+	Spread          time.Duration             `yaml:"spread"`
+	Docker          *docker.RelayConfig       `yaml:"docker"`
+	Podman          *docker.PodmanRelayConfig `yaml:"podman"`
+	Containerd      *containerd.RelayConfig   `yaml:"containerd"`
+	Skopeo          *skopeo.RelayConfig       `yaml:"skopeo"`
+	Direct          *direct.RelayConfig       `yaml:"direct"`
+	Relays          map[string]*RelayConfig   `yaml:"relays"`
+	DockerHost      string                    `yaml:"dockerhost"`  // DEPRECATED
+	APIVersion      string                    `yaml:"api-version"` // DEPRECATED
+	Lister          *ListerConfig             `yaml:"lister"`
+	Metrics         *metrics.Config           `yaml:"metrics"`
+	Dashboard       bool                      `yaml:"dashboard"`
+	Trigger         *TriggerConfig            `yaml:"trigger"`
+	Notify          *notify.Config            `yaml:"notify"`
+	Tracing         *tracing.Config           `yaml:"tracing"`
+	LeaderElection  *leader.Config            `yaml:"leader-election"`
+	Include         []string                  `yaml:"include"`
+	Tasks           []*Task                   `yaml:"tasks"`
 }
 
 //
@@ -84,53 +123,350 @@ func (c *SyncConfig) validate() error {
 			}
 		}
 
-	case skopeo.RelayID:
+		if err := c.Docker.Validate(); err != nil {
+			return err
+		}
+
+	case docker.PodmanRelayID, containerd.RelayID, skopeo.RelayID,
+		direct.RelayID:
 		if c.DockerHost != "" {
 			return fmt.Errorf(
 				"setting 'dockerhost' implies '%s' relay, but relay is set to '%s'",
 				docker.RelayID, c.Relay)
 		}
+		if err := c.Podman.Validate(); err != nil {
+			return err
+		}
+		if err := c.Containerd.Validate(); err != nil {
+			return err
+		}
+		if err := c.Direct.Validate(); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("invalid relay type: '%s', must be one of '%s', "+
+			"'%s', '%s', '%s', or '%s'", c.Relay, docker.RelayID,
+			docker.PodmanRelayID, containerd.RelayID, skopeo.RelayID,
+			direct.RelayID)
+	}
 
+	switch c.Ping {
+	case "":
+		c.Ping = PingStartup
+	case PingStartup, PingTask, PingOff:
 	default:
 		return fmt.Errorf(
-			"invalid relay type: '%s', must be either '%s' or '%s'",
-			c.Relay, docker.RelayID, skopeo.RelayID)
+			"invalid ping mode: '%s', must be one of '%s', '%s', or '%s'",
+			c.Ping, PingStartup, PingTask, PingOff)
+	}
+
+	if err := c.validateFallback(); err != nil {
+		return err
+	}
+
+	for name, r := range c.Relays {
+		if err := r.validate(name); err != nil {
+			return err
+		}
+	}
+
+	if c.Parallelism < 0 {
+		return errors.New("'parallelism' needs to be 0 or a positive integer")
+	}
+	if c.Parallelism == 0 {
+		c.Parallelism = 1
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return errors.New("'shutdown-timeout' must not be negative")
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	if c.MaxRunDuration < 0 {
+		return errors.New("'max-run-duration' must not be negative")
+	}
+
+	if c.Spread < 0 {
+		return errors.New("'spread' must not be negative")
 	}
 
 	if err := c.Lister.validate(); err != nil {
 		return err
 	}
 
+	if err := c.Metrics.Validate(); err != nil {
+		return fmt.Errorf("metrics settings invalid: %v", err)
+	}
+
+	if c.Dashboard && c.Metrics == nil {
+		return errors.New("'dashboard' requires 'metrics' to be set")
+	}
+
+	if err := c.Trigger.validate(); err != nil {
+		return fmt.Errorf("trigger settings invalid: %v", err)
+	}
+
+	if err := c.Notify.Validate(); err != nil {
+		return fmt.Errorf("notify settings invalid: %v", err)
+	}
+
+	if err := c.Tracing.Validate(); err != nil {
+		return fmt.Errorf("tracing settings invalid: %v", err)
+	}
+
+	if err := c.LeaderElection.Validate(); err != nil {
+		return fmt.Errorf("leader election settings invalid: %v", err)
+	}
+
+	names := make(map[string]bool, len(c.Tasks))
+
 	for _, t := range c.Tasks {
-		if err := t.validate(); err != nil {
+		if names[t.Name] {
+			return fmt.Errorf("duplicate task name '%s'", t.Name)
+		}
+		if err := c.validateTask(t); err != nil {
+			return err
+		}
+		names[t.Name] = true
+	}
+
+	if err := c.checkDependencies(); err != nil {
+		return err
+	}
+
+	c.spreadTasks()
+	return nil
+}
+
+// validateFallback validates the fallback relay, which needs to be daemonless,
+// and can only replace a relay that depends on a daemon, and is checked at
+// startup
+func (c *SyncConfig) validateFallback() error {
+
+	switch c.FallbackRelay {
+	case "":
+		return nil
+	case skopeo.RelayID:
+	case direct.RelayID:
+		if err := c.Direct.Validate(); err != nil {
 			return err
 		}
-		if c.Lister != nil && t.repoList != nil {
-			if c.Lister.MaxItems != 0 {
-				t.repoList.SetMaxItems(c.Lister.MaxItems)
+	default:
+		return fmt.Errorf(
+			"invalid value for 'fallback-relay': '%s', must be '%s' or '%s'",
+			c.FallbackRelay, skopeo.RelayID, direct.RelayID)
+	}
+
+	if !isLocalRelay(c.Relay) {
+		return fmt.Errorf("'fallback-relay' is set, but relay '%s' does not "+
+			"depend on a daemon", c.Relay)
+	}
+	if c.Ping != PingStartup {
+		return fmt.Errorf(
+			"'fallback-relay' requires 'ping' to be '%s'", PingStartup)
+	}
+
+	return nil
+}
+
+// checkDependencies checks that all tasks named in 'depends-on' exist, and
+// that there are no cycles
+func (c *SyncConfig) checkDependencies() error {
+
+	byName := make(map[string]*Task, len(c.Tasks))
+	for _, t := range c.Tasks {
+		byName[t.Name] = t
+	}
+
+	for _, t := range c.Tasks {
+		for _, d := range t.DependsOn {
+			if _, ok := byName[d]; !ok {
+				return fmt.Errorf(
+					"task '%s' depends on unknown task '%s'", t.Name, d)
 			}
-			if c.Lister.CacheDuration != 0 {
-				t.repoList.SetCacheDuration(c.Lister.CacheDuration)
+		}
+	}
+
+	// depth-first search, with tasks on the current path marked as visiting
+	const visiting, visited = 1, 2
+	state := make(map[string]int, len(c.Tasks))
+
+	var visit func(t *Task, path []string) error
+	visit = func(t *Task, path []string) error {
+		switch state[t.Name] {
+		case visiting:
+			return fmt.Errorf("tasks have circular dependency: %s",
+				strings.Join(append(path, t.Name), " -> "))
+		case visited:
+			return nil
+		}
+		state[t.Name] = visiting
+		for _, d := range t.DependsOn {
+			if err := visit(byName[d], append(path, t.Name)); err != nil {
+				return err
 			}
 		}
+		state[t.Name] = visited
+		return nil
+	}
+
+	for _, t := range c.Tasks {
+		if err := visit(t, nil); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-//
-func LoadConfig(file string) (*SyncConfig, error) {
+// spreadTasks spreads the first runs of interval tasks that don't set their
+// own 'offset' evenly across the 'spread' window, in the order in which they
+// are configured
+func (c *SyncConfig) spreadTasks() {
+
+	var spread []*Task
+	for _, t := range c.Tasks {
+		t.spread = 0
+		if c.Spread > 0 && t.Interval > 0 && t.Offset == 0 {
+			spread = append(spread, t)
+		}
+	}
+
+	for ix, t := range spread {
+		t.spread = c.Spread * time.Duration(ix) / time.Duration(len(spread))
+		t.spread %= time.Duration(t.Interval) * time.Second
+	}
+}
+
+// AddTask validates the given task against the settings of this config, which
+// needs to be validated already, and adds it to the tasks of this config
+func (c *SyncConfig) AddTask(t *Task) error {
+
+	for _, other := range c.Tasks {
+		if other.Name == t.Name {
+			return fmt.Errorf("duplicate task name '%s'", t.Name)
+		}
+	}
+
+	if err := c.validateTask(t); err != nil {
+		return err
+	}
+
+	c.Tasks = append(c.Tasks, t)
+	if err := c.checkDependencies(); err != nil {
+		c.Tasks = c.Tasks[:len(c.Tasks)-1]
+		return err
+	}
+	c.spreadTasks()
+	return nil
+}
+
+// validateTask validates the given task, and checks whether it is compatible
+// with the settings of this config
+func (c *SyncConfig) validateTask(t *Task) error {
+
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	notifyConf := c.Notify.Merge(t.Notify)
+	if err := notifyConf.Complete(); err != nil {
+		return fmt.Errorf(
+			"notify settings for task '%s' invalid: %v", t.Name, err)
+	}
+	t.notifier = notify.New(notifyConf)
+
+	rc := c.relayConfig(t)
+	if rc == nil {
+		return fmt.Errorf("task '%s' uses relay '%s', which is not defined "+
+			"in 'relays'", t.Name, t.Relay)
+	}
+	relay := rc.Type
+
+	// these relays copy images as they are, so digests in target have to be
+	// the same as in source
+	t.unchanged = relay == direct.RelayID ||
+		(relay == skopeo.RelayID && rc.Skopeo != nil && rc.Skopeo.AllPlatforms)
+
+	if relay != direct.RelayID && t.hasPlatforms() {
+		return fmt.Errorf("task '%s' restricts 'platforms', which is only "+
+			"supported by the '%s' relay", t.Name, direct.RelayID)
+	}
+	if relay != direct.RelayID &&
+		(t.Source.IsLayout() || t.Target.IsLayout()) {
+		return fmt.Errorf("task '%s' uses an OCI image layout, which is only "+
+			"supported by the '%s' relay", t.Name, direct.RelayID)
+	}
+	if relay != direct.RelayID && t.RateLimit > 0 {
+		return fmt.Errorf("task '%s' has 'rate-limit-mbps' set, which is "+
+			"only supported by the '%s' relay", t.Name, direct.RelayID)
+	}
+	if relay != direct.RelayID &&
+		(t.Source.TLS != nil || t.Target.TLS != nil) {
+		return fmt.Errorf("task '%s' has 'tls' set, which is only supported "+
+			"by the '%s' relay, see the notes on certificates for the other "+
+			"relays", t.Name, direct.RelayID)
+	}
+	if relay != direct.RelayID && (t.Source.hasProxySettings() ||
+		t.Target.hasProxySettings()) {
+		return fmt.Errorf("task '%s' has 'proxy' or 'no-proxy' set, which is "+
+			"only supported by the '%s' relay", t.Name, direct.RelayID)
+	}
+	if relay != direct.RelayID && (t.Source.hasHeaderSettings() ||
+		t.Target.hasHeaderSettings()) {
+		return fmt.Errorf("task '%s' has 'user-agent' or 'headers' set, which "+
+			"is only supported by the '%s' relay", t.Name, direct.RelayID)
+	}
+	if relay == docker.RelayID &&
+		(t.Source.PlainHTTP || t.Target.PlainHTTP) {
+		return fmt.Errorf("task '%s' has 'plain-http' set, which is not "+
+			"supported by the '%s' relay, configure the Docker daemon for "+
+			"insecure registries instead", t.Name, docker.RelayID)
+	}
+	if (relay == docker.PodmanRelayID || relay == containerd.RelayID) &&
+		(t.Source.PlainHTTP || t.Target.PlainHTTP) {
+		return fmt.Errorf("task '%s' has 'plain-http' set, which is not "+
+			"supported by the '%s' relay", t.Name, relay)
+	}
+	if !isLocalRelay(relay) && t.Cleanup {
+		return fmt.Errorf("task '%s' has 'cleanup' set, which is only "+
+			"supported by the '%s', '%s', and '%s' relays", t.Name,
+			docker.RelayID, docker.PodmanRelayID, containerd.RelayID)
+	}
+
+	if c.Lister != nil && t.repoList != nil {
+		if c.Lister.MaxItems != 0 {
+			t.repoList.SetMaxItems(c.Lister.MaxItems)
+		}
+		if c.Lister.CacheDuration != 0 {
+			t.repoList.SetCacheDuration(c.Lister.CacheDuration)
+		}
+	}
+
+	return nil
+}
 
-	data, err := ioutil.ReadFile(file)
+// LoadConfig loads the config from the given file; file may also be a
+// directory, in which case all YAML files in it are loaded, or a comma
+// separated list of files and directories; see loadFile for how the files are
+// merged
+func LoadConfig(file string) (*SyncConfig, error) {
 
+	files, err := configFiles(strings.Split(file, ","))
 	if err != nil {
-		return nil, fmt.Errorf("error loading config file '%s': %v", file, err)
+		return nil, err
 	}
 
 	config := &SyncConfig{}
+	l := newConfigLoader()
 
-	if err = yaml.Unmarshal(data, config); err != nil {
-		return nil, fmt.Errorf("error parsing config file '%s': %v", file, err)
+	for _, f := range files {
+		if err := l.loadFile(config, f); err != nil {
+			return nil, err
+		}
 	}
 
 	if err = config.validate(); err != nil {
@@ -168,3 +504,48 @@ func (c *ListerConfig) validate() error {
 
 	return nil
 }
+
+// RunOnce turns all tasks into one-off tasks, and turns off triggers, so that
+// each task is run exactly once
+func (c *SyncConfig) RunOnce() {
+	c.Trigger = nil
+	for _, t := range c.Tasks {
+		t.Interval = 0
+		t.Schedule = ""
+		t.schedule = nil
+	}
+}
+
+// SelectTasks disables all tasks not contained in only, when only is not
+// empty, and all tasks contained in skip
+func (c *SyncConfig) SelectTasks(only, skip []string) error {
+
+	names := make(map[string]*Task)
+	for _, t := range c.Tasks {
+		names[t.Name] = t
+	}
+
+	for _, n := range append(only, skip...) {
+		if _, ok := names[n]; !ok {
+			return fmt.Errorf("no task with name '%s'", n)
+		}
+	}
+
+	if len(only) > 0 {
+		selected := make(map[string]bool)
+		for _, n := range only {
+			selected[n] = true
+		}
+		for _, t := range c.Tasks {
+			if !selected[t.Name] {
+				t.disable("not selected via -only")
+			}
+		}
+	}
+
+	for _, n := range skip {
+		names[n].disable("skipped via -skip")
+	}
+
+	return nil
+}
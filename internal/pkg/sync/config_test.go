@@ -17,6 +17,7 @@
 package sync
 
 import (
+	"os"
 	"testing"
 
 	"github.com/xelalexv/dregsy/internal/pkg/test"
@@ -31,11 +32,39 @@ func TestValidSyncConfigs(t *testing.T) {
 	th.AssertNoError(e)
 	th.AssertNotNil(c)
 	th.AssertEqual("skopeo", c.Relay)
+	th.AssertEqual(PingStartup, c.Ping)
 
 	c, e = LoadConfig(th.GetFixture("config/docker-valid.yaml"))
 	th.AssertNoError(e)
 	th.AssertNotNil(c)
 	th.AssertEqual("docker", c.Relay)
+
+	c, e = LoadConfig(th.GetFixture("config/direct-valid.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual("direct", c.Relay)
+
+	c, e = LoadConfig(th.GetFixture("config/podman-valid.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual("podman", c.Relay)
+	th.AssertTrue(c.Tasks[0].Cleanup)
+
+	c, e = LoadConfig(th.GetFixture("config/named-relays-valid.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	th.AssertEqual(2, len(c.Relays))
+	th.AssertEqual("docker", c.relayConfig(c.Tasks[0]).Type)
+	th.AssertEqual("tcp://pull-host.example.com:2375",
+		c.relayConfig(c.Tasks[1]).Docker.DockerHost)
+	th.AssertTrue(c.Tasks[2].unchanged)
+
+	c, e = LoadConfig(th.GetFixture("config/target-normalize-repos-valid.yaml"))
+	th.AssertNoError(e)
+	th.AssertNotNil(c)
+	ref, e := c.Tasks[0].targetRef(c.Tasks[0].Mappings[0], "/tools/builder")
+	th.AssertNoError(e)
+	th.AssertEqual("registry.example.com/mirror/tools/builder", ref)
 }
 
 //
@@ -47,6 +76,55 @@ func TestInvalidSyncConfigs(t *testing.T) {
 	tryConfig(th, "config/invalid-relay.yaml", "invalid relay type")
 	tryConfig(th, "config/multiple-relays.yaml",
 		"setting 'dockerhost' implies 'docker' relay")
+	tryConfig(th, "config/invalid-ping.yaml", "invalid ping mode")
+	tryConfig(th, "config/invalid-parallelism.yaml",
+		"'parallelism' needs to be 0 or a positive integer")
+	tryConfig(th, "config/invalid-shutdown-timeout.yaml",
+		"'shutdown-timeout' must not be negative")
+	tryConfig(th, "config/invalid-task-timeout.yaml",
+		"task 'test' has negative 'timeout'")
+	tryConfig(th, "config/docker-plain-http.yaml",
+		"task 'lab' has 'plain-http' set, which is not supported by the "+
+			"'docker' relay")
+	tryConfig(th, "config/containerd-plain-http.yaml",
+		"task 'lab' has 'plain-http' set, which is not supported by the "+
+			"'containerd' relay")
+	tryConfig(th, "config/containerd-bad-namespace.yaml",
+		"invalid value for 'namespace': 'my images'")
+	tryConfig(th, "config/fallback-bad-relay.yaml",
+		"invalid value for 'fallback-relay': 'docker', must be 'skopeo' or "+
+			"'direct'")
+	tryConfig(th, "config/fallback-not-daemon.yaml",
+		"'fallback-relay' is set, but relay 'skopeo' does not depend on a "+
+			"daemon")
+	tryConfig(th, "config/fallback-ping-task.yaml",
+		"'fallback-relay' requires 'ping' to be 'startup'")
+	tryConfig(th, "config/relay-undefined.yaml",
+		"task 'heavy' uses relay 'pull-host', which is not defined in "+
+			"'relays'")
+	tryConfig(th, "config/relay-bad-type.yaml",
+		"relay 'pull-host' has invalid type 'kaniko'")
+	tryConfig(th, "config/relay-plain-http.yaml",
+		"task 'lab' has 'plain-http' set, which is not supported by the "+
+			"'docker' relay")
+	tryConfig(th, "config/skopeo-oci-layout.yaml",
+		"task 'export' uses an OCI image layout, which is only supported by "+
+			"the 'direct' relay")
+	tryConfig(th, "config/direct-oci-layout-prune.yaml",
+		"task 'export' uses an OCI image layout, which does not support "+
+			"prune-target")
+	tryConfig(th, "config/direct-docker-archive.yaml",
+		"'docker-archive:' locations are not supported, use an OCI image "+
+			"layout ('oci:') instead")
+	tryConfig(th, "config/direct-s3-auth.yaml",
+		"'s3://mirror/export' is an OCI image layout, which takes no "+
+			"registry settings")
+	tryConfig(th, "config/invalid-task-dependency.yaml",
+		"tasks have circular dependency: base -> apps -> base")
+	tryConfig(th, "config/metrics-no-listen.yaml",
+		"metrics settings invalid: 'listen' address is required")
+	tryConfig(th, "config/leader-election-no-file.yaml",
+		"leader election settings invalid: 'file' is required for lock 'file'")
 
 	// task
 	tryConfig(th, "config/task-no-name.yaml", "a task requires a name")
@@ -54,8 +132,54 @@ func TestInvalidSyncConfigs(t *testing.T) {
 		"minimum task interval is 30 seconds")
 	tryConfig(th, "config/task-bad-interval.yaml",
 		"task interval needs to be 0 or a positive integer")
+	tryConfig(th, "config/task-interval-and-schedule.yaml",
+		"task 'test' has both 'interval' and 'schedule' set")
+	tryConfig(th, "config/task-bad-schedule.yaml",
+		"task 'test' has invalid 'schedule' '0 25 * * *'")
+	tryConfig(th, "config/task-bad-on-error.yaml",
+		"task 'test' has invalid 'on-error' policy 'ignore'")
+	tryConfig(th, "config/task-bad-enabled.yaml",
+		"task 'test' has invalid value for 'enabled': 'maybe'")
+	tryConfig(th, "config/task-platforms-not-direct.yaml",
+		"task 'test' restricts 'platforms', which is only supported by the "+
+			"'direct' relay")
+	tryConfig(th, "config/task-duplicate-name.yaml",
+		"duplicate task name 'test'")
+	tryConfig(th, "config/task-pacing-not-dockerhub.yaml",
+		"task 'test' has 'dockerhub-pacing' set, but source is not Docker Hub")
+	tryConfig(th, "config/task-rate-limit-not-direct.yaml",
+		"task 'test' has 'rate-limit-mbps' set, which is only supported by "+
+			"the 'direct' relay")
+	tryConfig(th, "config/docker-bad-on-low-space.yaml",
+		"invalid value for 'on-low-space': 'wait'")
+	tryConfig(th, "config/direct-bad-chunk-size.yaml",
+		"invalid value for 'chunk-size': 'lots'")
+	tryConfig(th, "config/task-notify-email-incomplete.yaml",
+		"notify settings for task 'test' invalid: 'email' settings "+
+			"incomplete: 'to' is required")
+	tryConfig(th, "config/task-hook-no-command.yaml",
+		"hook settings in task 'test' invalid: 'post-sync' hook 2 invalid: "+
+			"either 'command' or 'url' is required")
+	tryConfig(th, "config/target-invalid-repo.yaml",
+		"task 'test': invalid target repository 'Mirror/Tools/builder' for "+
+			"'tools/builder': path component 'Mirror' contains upper case "+
+			"letters")
+	tryConfig(th, "config/source-normalize-repos.yaml",
+		"task 'test' has 'normalize-repos' set on its source, which is only "+
+			"supported for the target")
+	tryConfig(th, "config/task-cleanup-not-docker.yaml",
+		"task 'test' has 'cleanup' set, which is only supported by the "+
+			"'docker', 'podman', and 'containerd' relays")
+	tryConfig(th, "config/task-verify-no-key.yaml",
+		"verify settings in task 'test' invalid: either 'key', or 'identity' "+
+			"and 'issuer' need to be set")
+	tryConfig(th, "config/task-sign-key-and-keyless.yaml",
+		"sign settings in task 'test' invalid: 'key' and 'keyless' are "+
+			"mutually exclusive")
 	tryConfig(th, "config/task-no-source.yaml",
 		"source registry in task 'test' invalid: location is nil")
+	tryConfig(th, "config/task-pacing-no-source.yaml",
+		"source registry in task 'test' invalid: location is nil")
 	tryConfig(th, "config/task-no-target.yaml",
 		"target registry in task 'test' invalid: location is nil")
 
@@ -63,9 +187,72 @@ func TestInvalidSyncConfigs(t *testing.T) {
 	tryConfig(th, "config/source-no-registry.yaml",
 		"source registry in task 'test' invalid: registry not set")
 	tryConfig(th, "config/source-not-ecr.yaml", "is not an ECR registry")
+	tryConfig(th, "config/source-refresh-margin-not-ecr.yaml",
+		"is not an ECR registry")
+	tryConfig(th, "config/source-bad-refresh-margin.yaml",
+		"has an invalid 'auth-refresh-margin', must be between 0 and 11h0m0s")
+	tryConfig(th, "config/target-role-not-ecr.yaml",
+		"has a 'role-arn' set, but is not an ECR registry")
+	tryConfig(th, "config/target-key-file-not-gcr.yaml",
+		"has a 'key-file' set, but is not a GCR or Artifact Registry")
+	tryConfig(th, "config/quay-bad-visibility.yaml",
+		"invalid value for 'repo-visibility': 'internal'")
+	tryConfig(th, "config/headers-not-direct.yaml",
+		"has 'user-agent' or 'headers' set, which is only supported by the "+
+			"'direct' relay")
+	tryConfig(th, "config/direct-user-agent-conflict.yaml",
+		"'user-agent' and a 'User-Agent' header are mutually exclusive")
+	tryConfig(th, "config/immutable-tags-source.yaml",
+		"has 'immutable-tags' set on its source")
+	tryConfig(th, "config/target-bad-on-tag-conflict.yaml",
+		"invalid value for 'on-tag-conflict': 'overwrite'")
+	tryConfig(th, "config/target-on-tag-conflict-not-immutable.yaml",
+		"'on-tag-conflict' requires 'immutable-tags'")
+
+	// ECR repository settings
+	tryConfig(th, "config/ecr-repo-not-ecr.yaml",
+		"task 'test' has 'ecr-repository' settings, but target is not an ECR")
+	tryConfig(th, "config/ecr-repo-bad-encryption.yaml",
+		"invalid value for 'encryption': 'DES'")
 
 	// mappings
 	tryConfig(th, "config/mapping-no-from.yaml", "mapping without 'From' path")
+	tryConfig(th, "config/mapping-untagged-both.yaml",
+		"'include-untagged' and 'exclude-untagged' are mutually exclusive")
+	tryConfig(th, "config/mapping-bad-limit-by.yaml",
+		"invalid value for 'limit-by': 'size'")
+	tryConfig(th, "config/mapping-bad-platform.yaml",
+		"invalid platform 'arm64', must be {os}/{arch}[/{variant}]")
+}
+
+//
+func TestTaskSelection(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	c, e := tryConfig(th, "config/task-enabled-env.yaml", "")
+	th.AssertNoError(e)
+	th.AssertTrue(c.Tasks[0].isEnabled())
+	th.AssertFalse(c.Tasks[1].isEnabled())
+
+	os.Setenv("DREGSY_TEST_TASK_ENABLED", "true")
+	defer os.Unsetenv("DREGSY_TEST_TASK_ENABLED")
+
+	c, e = tryConfig(th, "config/task-enabled-env.yaml", "")
+	th.AssertNoError(e)
+	th.AssertTrue(c.Tasks[1].isEnabled())
+
+	th.AssertNoError(c.SelectTasks(nil, []string{"enabled"}))
+	th.AssertFalse(c.Tasks[0].isEnabled())
+	th.AssertTrue(c.Tasks[1].isEnabled())
+
+	c, _ = tryConfig(th, "config/task-enabled-env.yaml", "")
+	th.AssertNoError(c.SelectTasks([]string{"enabled"}, nil))
+	th.AssertTrue(c.Tasks[0].isEnabled())
+	th.AssertFalse(c.Tasks[1].isEnabled())
+
+	th.AssertError(c.SelectTasks([]string{"unknown"}, nil),
+		"no task with name 'unknown'")
 }
 
 //
@@ -85,3 +272,59 @@ func tryConfig(th *test.TestHelper, file, err string) (*SyncConfig, error) {
 
 	return c, e
 }
+
+//
+func TestEnvExpansion(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	os.Setenv("DREGSY_TEST_ENV", "staging")
+	defer os.Unsetenv("DREGSY_TEST_ENV")
+	// values are expanded only once, so a $ in them needs to survive
+	os.Setenv("DREGSY_TEST_SECRET", "ab$cd${x}")
+	defer os.Unsetenv("DREGSY_TEST_SECRET")
+
+	c, _ := tryConfig(th, "config/env-expansion.yaml", "")
+	th.AssertEqual("skopeo", c.Relay)
+	th.AssertEqual("ab$cd${x}", c.Trigger.Secret)
+	th.AssertEqual("staging-mirror", c.Tasks[0].Name)
+	th.AssertEqual(60, c.Tasks[0].Interval)
+	th.AssertEqual("registry.staging.example.com", c.Tasks[0].Target.Registry)
+	th.AssertEqual("/staging/busybox", c.Tasks[0].Mappings[0].To)
+	th.AssertEqualSlices([]string{"regex:^v[0-9]+$", "${NOT_EXPANDED}"},
+		c.Tasks[0].Mappings[0].Tags)
+}
+
+//
+func TestMultipleConfigFiles(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryFiles := func(file string, relay string, tasks ...string) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		c, err := LoadConfig(file)
+		th.AssertNoError(err)
+		th.AssertEqual(relay, c.Relay)
+		var names []string
+		for _, t := range c.Tasks {
+			names = append(names, t.Name)
+		}
+		th.AssertEqualSlices(tasks, names)
+	}
+
+	main := th.GetFixture("config/multi/main.yaml")
+	teams := th.GetFixture("config/multi/teams")
+	one := th.GetFixture("config/multi/teams/one.yaml")
+
+	tryFiles(main, "skopeo", "base", "team-one", "team-two")
+	tryFiles(teams, "docker", "team-one", "team-two")
+	tryFiles(one+", "+main, "skopeo", "team-one", "base", "team-two")
+
+	_, err := LoadConfig(th.GetFixture("config/multi-conflict"))
+	th.AssertError(err, "setting 'relay' in config file")
+	th.AssertError(err, "is already set in")
+
+	_, err = LoadConfig(th.GetFixture("config/multi/missing.yaml"))
+	th.AssertError(err, "error loading config file")
+}
@@ -0,0 +1,153 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/xelalexv/dregsy/internal/pkg/relays/docker"
+)
+
+// name of the task created for the 'copy' command
+const CopyTaskName = "copy"
+
+// CopyOptions are the settings for copying a single image with the 'copy'
+// command
+type CopyOptions struct {
+	Relay               string
+	Source              string
+	Target              string
+	Tags                []string
+	SourceAuth          string
+	TargetAuth          string
+	SourceSkipTLSVerify bool
+	TargetSkipTLSVerify bool
+	Platforms           []string
+	DryRun              bool
+	Verbose             bool
+}
+
+// NewCopyConfig creates the config for a one-off sync of the source to the
+// target ref; a tag in the source ref selects just that tag, and can then be
+// renamed via a tag in the target ref; without any tags, all tags are synced;
+// the auth settings default to the Docker config, except for ECR and GCR
+// registries, where dregsy's built-in handling applies
+func NewCopyConfig(opts *CopyOptions) (*SyncConfig, error) {
+
+	srcReg, srcPath, srcTag, err := parseCopyRef(opts.Source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source ref: %v", err)
+	}
+
+	trgtReg, trgtPath, trgtTag, err := parseCopyRef(opts.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target ref: %v", err)
+	}
+
+	m := &Mapping{
+		From:      srcPath,
+		To:        trgtPath,
+		Tags:      opts.Tags,
+		Platforms: opts.Platforms,
+	}
+
+	if srcTag != "" {
+		if len(opts.Tags) > 0 {
+			return nil, errors.New(
+				"source ref has a tag, so no further tags can be selected")
+		}
+		m.Tags = []string{srcTag}
+		if trgtTag != "" && trgtTag != srcTag {
+			m.TagRewrite = &TagRewrite{
+				Match:   "^" + regexp.QuoteMeta(srcTag) + "$",
+				Replace: trgtTag,
+			}
+		}
+	} else if trgtTag != "" {
+		return nil, errors.New(
+			"target ref may only have a tag when source ref has one")
+	}
+
+	src := &Location{
+		Registry:      srcReg,
+		Auth:          opts.SourceAuth,
+		SkipTLSVerify: opts.SourceSkipTLSVerify,
+	}
+	trgt := &Location{
+		Registry:      trgtReg,
+		Auth:          opts.TargetAuth,
+		SkipTLSVerify: opts.TargetSkipTLSVerify,
+	}
+	for _, l := range []*Location{src, trgt} {
+		if l.Auth == "" && !l.IsECR() && !l.IsECRPublic() && !l.IsGCR() {
+			l.Auth = "docker-config"
+		}
+	}
+
+	conf := &SyncConfig{
+		Relay:  opts.Relay,
+		DryRun: opts.DryRun,
+		Docker: &docker.RelayConfig{},
+		Tasks: []*Task{{
+			Name:     CopyTaskName,
+			Source:   src,
+			Target:   trgt,
+			Mappings: []*Mapping{m},
+			Verbose:  opts.Verbose,
+		}},
+	}
+
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// parseCopyRef splits ref into registry, path, and tag; as with the Docker
+// CLI, refs without a registry refer to Docker Hub
+func parseCopyRef(ref string) (reg, path, tag string, err error) {
+
+	r, err := gocrname.ParseReference(ref, gocrname.WeakValidation)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if _, ok := r.(gocrname.Digest); ok {
+		return "", "", "", fmt.Errorf(
+			"'%s' is a digest ref, only tags are supported", ref)
+	}
+
+	// a missing tag defaults to latest, but should select all tags here
+	if t, ok := r.(gocrname.Tag); ok && hasTag(ref) {
+		tag = t.TagStr()
+	}
+
+	repo := r.Context()
+	return repo.RegistryStr(), "/" + repo.RepositoryStr(), tag, nil
+}
+
+// hasTag returns true if ref explicitly includes a tag, i.e. there's a ':' in
+// its last path element
+func hasTag(ref string) bool {
+	return strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":")
+}
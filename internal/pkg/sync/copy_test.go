@@ -0,0 +1,127 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/direct"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestNewCopyConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryCopy := func(opts *CopyOptions, reg, from, to string, tags []string,
+		err string) *Mapping {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		conf, e := NewCopyConfig(opts)
+		if err != "" {
+			th.AssertError(e, err)
+			return nil
+		}
+		th.AssertNoError(e)
+		task := conf.Tasks[0]
+		th.AssertEqual(CopyTaskName, task.Name)
+		th.AssertEqual(reg, task.Source.Registry)
+		m := task.Mappings[0]
+		th.AssertEqual(from, m.From)
+		th.AssertEqual(to, m.To)
+		th.AssertEqualSlices(tags, m.Tags)
+		return m
+	}
+
+	tryCopy(&CopyOptions{Source: "busybox", Target: "reg.example.com/busybox"},
+		"index.docker.io", "/library/busybox", "/busybox", nil, "")
+
+	tryCopy(&CopyOptions{Source: "localhost:5000/acme/app",
+		Target: "reg.example.com/mirror/app",
+		Tags:   []string{"semver:>=1.0.0", "keep:latest"}},
+		"localhost:5000", "/acme/app", "/mirror/app",
+		[]string{"semver:>=1.0.0", "keep:latest"}, "")
+
+	m := tryCopy(&CopyOptions{Source: "quay.io/acme/app:1.0",
+		Target: "reg.example.com/acme/app:stable"},
+		"quay.io", "/acme/app", "/acme/app", []string{"1.0"}, "")
+	th.AssertEqual("stable", m.targetTag("1.0"))
+
+	m = tryCopy(&CopyOptions{Source: "quay.io/acme/app:1.0",
+		Target: "reg.example.com/acme/app:1.0"},
+		"quay.io", "/acme/app", "/acme/app", []string{"1.0"}, "")
+	th.AssertNil(m.TagRewrite)
+
+	tryCopy(&CopyOptions{Source: "quay.io/acme/app:1.0",
+		Target: "reg.example.com/app", Tags: []string{"2.0"}},
+		"", "", "", nil, "source ref has a tag")
+	tryCopy(&CopyOptions{Source: "quay.io/acme/app",
+		Target: "reg.example.com/app:1.0"},
+		"", "", "", nil, "target ref may only have a tag")
+	tryCopy(&CopyOptions{Source: "quay.io/acme/app@sha256:" +
+		strings.Repeat("a", 64), Target: "reg.example.com/app"},
+		"", "", "", nil, "only tags are supported")
+	tryCopy(&CopyOptions{Source: "quay.io/acme/app", Target: "Bad Ref"},
+		"", "", "", nil, "invalid target ref")
+	tryCopy(&CopyOptions{Source: "quay.io/acme/app", Target: "x.io/app",
+		Relay: "nope"}, "", "", "", nil, "invalid relay type: 'nope'")
+}
+
+//
+func TestCopy(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	img, err := gocrrandom.Image(256, 1)
+	th.AssertNoError(err)
+	ref, err := gocrname.NewTag(reg + "/acme/app:1.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(ref, img))
+
+	conf, err := NewCopyConfig(&CopyOptions{
+		Relay:  direct.RelayID,
+		Source: reg + "/acme/app:1.0",
+		Target: reg + "/mirror/app:stable",
+	})
+	th.AssertNoError(err)
+
+	s, err := New(conf)
+	th.AssertNoError(err)
+	th.AssertNoError(s.SyncFromConfig(conf))
+	s.Dispose()
+
+	want, err := img.Digest()
+	th.AssertNoError(err)
+	got, err := registry.GetDigest(context.Background(),
+		reg+"/mirror/app:stable", nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(want.String(), got)
+}
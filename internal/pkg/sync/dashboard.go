@@ -0,0 +1,251 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"net/http"
+	"sort"
+	gosync "sync"
+)
+
+//
+const (
+	dashboardPath      = "/dashboard/"
+	dashboardTasksPath = dashboardPath + "tasks"
+)
+
+// dashboard serves a read-only web UI showing the state of all tasks
+type dashboard struct {
+	tasks []*Task
+	mutex gosync.RWMutex
+}
+
+//
+func newDashboard(enabled bool) *dashboard {
+	if !enabled {
+		return nil
+	}
+	return &dashboard{}
+}
+
+// setTasks sets the tasks to show
+func (d *dashboard) setTasks(tasks []*Task) {
+
+	if d == nil {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.tasks = tasks
+}
+
+// handlePage serves the dashboard page, which fetches the task list from
+// dashboardTasksPath
+func (d *dashboard) handlePage(w http.ResponseWriter, r *http.Request) {
+
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if r.URL.Path != dashboardPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(dashboardPage))
+}
+
+//
+func (d *dashboard) handleTasks(w http.ResponseWriter, r *http.Request) {
+
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	d.mutex.RLock()
+	ret := make([]*taskInfo, 0, len(d.tasks))
+	for _, t := range d.tasks {
+		ret = append(ret, newTaskInfo(t))
+	}
+	d.mutex.RUnlock()
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	respondJSON(w, http.StatusOK, ret)
+}
+
+// dashboardPage is the single page of the dashboard; it needs to work without
+// any external resources, and only inserts data via textContent
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>dregsy</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .4em .8em; border-bottom: 1px solid #ddd;
+  vertical-align: top; }
+th { background: #f4f4f4; }
+tr.task { cursor: pointer; }
+tr.task:hover { background: #fafafa; }
+tr.details td { background: #fcfcfc; font-size: .9em; }
+.ok { color: #2a7d2a; }
+.failed { color: #b22222; }
+.muted { color: #888; }
+ul.errors { margin: .3em 0; color: #b22222; }
+#updated { font-size: .8em; color: #888; }
+</style>
+</head>
+<body>
+<h1>dregsy tasks</h1>
+<p id="updated"></p>
+<table>
+<thead><tr>
+<th>Task</th><th>Source</th><th>Target</th><th>Schedule</th><th>State</th>
+<th>Last Run</th><th>Duration</th><th>Images / Tags</th><th>Throughput</th>
+<th>Next Run</th>
+</tr></thead>
+<tbody id="tasks"></tbody>
+</table>
+<script>
+"use strict";
+var open = {};
+
+function el(tag, text, cls) {
+  var e = document.createElement(tag);
+  if (text !== undefined) { e.textContent = text; }
+  if (cls) { e.className = cls; }
+  return e;
+}
+
+function time(t) {
+  return t ? new Date(t).toLocaleString() : "-";
+}
+
+function schedule(t) {
+  if (t.schedule) { return t.schedule; }
+  if (t.interval) { return "every " + t.interval + "s"; }
+  return "one-off";
+}
+
+function state(t) {
+  if (t.running) { return el("span", "running"); }
+  if (t.paused) { return el("span", "paused", "muted"); }
+  if (!t.lastRun) { return el("span", "not run yet", "muted"); }
+  return t.lastRun.failed ? el("span", "failed", "failed") :
+    el("span", "ok", "ok");
+}
+
+function throughput(r) {
+  if (!r || !r.durationSeconds) { return "-"; }
+  if (r.bytes) {
+    return (r.bytes / r.durationSeconds / 1048576).toFixed(2) + " MB/s";
+  }
+  return (r.tags / r.durationSeconds * 60).toFixed(1) + " tags/min";
+}
+
+function errors(list) {
+  var ul = el("ul", undefined, "errors");
+  (list || []).forEach(function (e) { ul.appendChild(el("li", e)); });
+  return ul;
+}
+
+function details(t) {
+  var td = el("td");
+  td.colSpan = 10;
+  var r = t.lastRun;
+  if (!r) {
+    td.appendChild(el("span", "no results yet", "muted"));
+    return td;
+  }
+  var table = el("table");
+  var head = el("tr");
+  ["From", "To", "Result", "Images", "Tags", "Errors"].forEach(
+    function (h) { head.appendChild(el("th", h)); });
+  table.appendChild(head);
+  (r.mappings || []).forEach(function (m) {
+    var tr = el("tr");
+    tr.appendChild(el("td", m.from));
+    tr.appendChild(el("td", m.to || m.from));
+    tr.appendChild(m.failed ? el("td", "failed", "failed") :
+      el("td", "ok", "ok"));
+    tr.appendChild(el("td", m.images));
+    tr.appendChild(el("td", m.tags));
+    var e = el("td");
+    e.appendChild(errors(m.errors));
+    tr.appendChild(e);
+    table.appendChild(tr);
+  });
+  td.appendChild(table);
+  if (r.errors && r.errors.length) {
+    td.appendChild(el("p", "Errors of last run:"));
+    td.appendChild(errors(r.errors));
+  }
+  return td;
+}
+
+function render(tasks) {
+  var body = document.getElementById("tasks");
+  while (body.firstChild) { body.removeChild(body.firstChild); }
+  tasks.forEach(function (t) {
+    var r = t.lastRun;
+    var tr = el("tr", undefined, "task");
+    tr.appendChild(el("td", t.name));
+    tr.appendChild(el("td", t.source));
+    tr.appendChild(el("td", t.target));
+    tr.appendChild(el("td", schedule(t)));
+    var s = el("td");
+    s.appendChild(state(t));
+    tr.appendChild(s);
+    tr.appendChild(el("td", time(r && r.start)));
+    tr.appendChild(el("td", r ? r.durationSeconds.toFixed(1) + "s" : "-"));
+    tr.appendChild(el("td", r ? r.images + " / " + r.tags : "-"));
+    tr.appendChild(el("td", throughput(r)));
+    tr.appendChild(el("td", t.paused ? "-" : time(t.nextRun)));
+    tr.onclick = function () { open[t.name] = !open[t.name]; render(tasks); };
+    body.appendChild(tr);
+    if (open[t.name]) {
+      var d = el("tr", undefined, "details");
+      d.appendChild(details(t));
+      body.appendChild(d);
+    }
+  });
+}
+
+function refresh() {
+  fetch("tasks").then(function (resp) {
+    if (!resp.ok) { throw new Error(resp.status + " " + resp.statusText); }
+    return resp.json();
+  }).then(function (tasks) {
+    render(tasks);
+    document.getElementById("updated").textContent =
+      "updated " + new Date().toLocaleTimeString();
+  }).catch(function (e) {
+    document.getElementById("updated").textContent =
+      "update failed: " + e.message;
+  });
+}
+
+refresh();
+setInterval(refresh, 10000);
+</script>
+</body>
+</html>
+`
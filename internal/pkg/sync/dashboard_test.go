@@ -0,0 +1,135 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestDashboard(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNil(newDashboard(false))
+	newDashboard(false).setTasks(nil)
+
+	mirror := &Task{Name: "mirror", Interval: 60,
+		Source: &Location{Registry: "docker.io"},
+		Target: &Location{Registry: "registry.example.com"}}
+	mirror.setResult(&runResult{Start: time.Now(), Seconds: 2, Tags: 5,
+		Bytes: 1 << 20, Mappings: []*mappingResult{
+			{From: "/library/busybox", Images: 1, Tags: 5}}})
+
+	d := newDashboard(true)
+	d.setTasks([]*Task{mirror})
+
+	rec := httptest.NewRecorder()
+	d.handlePage(rec, httptest.NewRequest(http.MethodGet, dashboardPath, nil))
+	th.AssertEqual(http.StatusOK, rec.Code)
+	th.AssertTrue(strings.HasPrefix(
+		rec.Header().Get("Content-Type"), "text/html"))
+	th.AssertTrue(strings.Contains(rec.Body.String(), `fetch("tasks")`))
+
+	rec = httptest.NewRecorder()
+	d.handlePage(rec, httptest.NewRequest(
+		http.MethodGet, dashboardPath+"nope", nil))
+	th.AssertEqual(http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	d.handleTasks(rec, httptest.NewRequest(
+		http.MethodPost, dashboardTasksPath, nil))
+	th.AssertEqual(http.StatusMethodNotAllowed, rec.Code)
+
+	rec = httptest.NewRecorder()
+	d.handleTasks(rec, httptest.NewRequest(
+		http.MethodGet, dashboardTasksPath, nil))
+	th.AssertEqual(http.StatusOK, rec.Code)
+	var list []*taskInfo
+	th.AssertNoError(json.Unmarshal(rec.Body.Bytes(), &list))
+	th.AssertEqual(1, len(list))
+	th.AssertEqual(int64(1<<20), list[0].LastRun.Bytes)
+	th.AssertEqual(1, len(list[0].LastRun.Mappings))
+	th.AssertEqual("/library/busybox", list[0].LastRun.Mappings[0].From)
+	th.AssertNil(list[0].NextRun)
+}
+
+//
+func TestNextRun(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNil((&Task{Name: "once"}).nextRun())
+
+	ticking := &Task{Name: "ticking", Interval: 60}
+	th.AssertNil(ticking.nextRun())
+	ticking.tickStart = time.Now().Add(-90 * time.Second)
+	next := ticking.nextRun()
+	th.AssertNotNil(next)
+	th.AssertEqual(ticking.tickStart.Add(120*time.Second), *next)
+
+	scheduled := &Task{Name: "scheduled", Schedule: "0 * * * *",
+		Source:   &Location{Registry: "docker.io"},
+		Target:   &Location{Registry: "registry.example.com"},
+		Mappings: []*Mapping{{From: "library/busybox"}}}
+	th.AssertNoError(scheduled.validate())
+	next = scheduled.nextRun()
+	th.AssertNotNil(next)
+	th.AssertEqual(0, next.Minute())
+	th.AssertTrue(next.After(time.Now()))
+}
+
+//
+func TestMappingResults(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	s := &Sync{abort: make(chan bool, 1)}
+	task := &Task{Name: "mirror"}
+
+	task.startMapping(&Mapping{From: "/acme/app", To: "/mirror/app"})
+	task.runImages, task.runTags, task.runBytes = 1, 3, 1024
+	task.startMapping(&Mapping{From: "/acme/db"})
+	task.runImages, task.runTags, task.runBytes = 2, 4, 1536
+	s.taskError(task, errors.New("boom"))
+	task.endMapping()
+	task.endMapping()
+
+	th.AssertEqual(2, len(task.runResults))
+	r := task.runResults[0]
+	th.AssertEqual("/mirror/app", r.To)
+	th.AssertEqual(1, r.Images)
+	th.AssertEqual(3, r.Tags)
+	th.AssertEqual(int64(1024), r.Bytes)
+	th.AssertFalse(r.Failed)
+	r = task.runResults[1]
+	th.AssertEqual("/acme/db", r.From)
+	th.AssertEqual(1, r.Images)
+	th.AssertEqual(1, r.Tags)
+	th.AssertEqual(int64(512), r.Bytes)
+	th.AssertTrue(r.Failed)
+	th.AssertEqualSlices([]string{"boom"}, r.Errors)
+	th.AssertEqualSlices([]string{"boom"}, task.runErrors)
+}
@@ -0,0 +1,168 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+)
+
+// kinds of differences between source and target
+const (
+	DiffMissing   = "missing"
+	DiffExtra     = "extra"
+	DiffDivergent = "divergent"
+)
+
+// Diff compares source and target of each mapping of the enabled tasks in
+// conf, and writes the differences found: selected source tags missing in the
+// target, target tags without counterpart in the source, and tags whose
+// digests differ; returns the number of differences
+func Diff(conf *SyncConfig, w io.Writer) (int, error) {
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tDIFF\tSOURCE\tTARGET")
+
+	diffs := 0
+	failed := false
+
+	for _, t := range conf.Tasks {
+
+		if !t.isEnabled() {
+			continue
+		}
+
+		if err := t.Source.RefreshAuth(); err != nil {
+			log.WithField("task", t.Name).Error(err)
+			failed = true
+			continue
+		}
+		if err := t.Target.RefreshAuth(); err != nil {
+			log.WithField("task", t.Name).Error(err)
+			failed = true
+			continue
+		}
+
+		for _, m := range t.Mappings {
+
+			refs, err := t.mappingRefs(m)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"task": t.Name, "from": m.From}).Error(err)
+				failed = true
+				continue
+			}
+
+			for _, ref := range refs {
+				src, trgt := ref[0], ref[1]
+				n, err := t.diffRef(tw, m, src, trgt)
+				diffs += n
+				if err != nil {
+					log.WithFields(log.Fields{
+						"task": t.Name, "ref": src}).Error(err)
+					failed = true
+				}
+			}
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return diffs, err
+	}
+
+	if failed {
+		return diffs, errors.New("errors while comparing source and target")
+	}
+	return diffs, nil
+}
+
+// diffRef writes the differences between src and trgt, and returns their
+// number; digests are not compared for mappings restricted to platforms,
+// since the target then holds a reduced image index
+func (t *Task) diffRef(w io.Writer, m *Mapping, src, trgt string) (
+	int, error) {
+
+	srcTags, err := registry.ListTags(t.context(),
+		src, t.Source.creds, t.Source.SkipTLSVerify)
+	if err != nil {
+		return 0, err
+	}
+
+	selected, err := t.selectTags(m, src, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	trgtTags, err := registry.ListTagsIfExists(t.context(),
+		trgt, t.Target.creds, t.Target.SkipTLSVerify)
+	if err != nil {
+		return 0, err
+	}
+
+	inTarget := make(map[string]bool, len(trgtTags))
+	for _, tag := range trgtTags {
+		inTarget[tag] = true
+	}
+
+	diffs := 0
+	report := func(kind, srcRef, trgtRef string) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.Name, kind, srcRef, trgtRef)
+		diffs++
+	}
+
+	for _, tag := range selected {
+
+		srcRef := fmt.Sprintf("%s:%s", src, tag)
+		trgtRef := fmt.Sprintf("%s:%s", trgt, m.targetTag(tag))
+
+		if !inTarget[m.targetTag(tag)] {
+			report(DiffMissing, srcRef, trgtRef)
+			continue
+		}
+
+		if len(t.platforms(m)) > 0 {
+			continue
+		}
+
+		srcDigest, err := registry.GetDigest(t.context(),
+			srcRef, t.Source.creds, t.Source.SkipTLSVerify)
+		if err != nil {
+			return diffs, err
+		}
+		trgtDigest, err := registry.GetDigest(t.context(),
+			trgtRef, t.Target.creds, t.Target.SkipTLSVerify)
+		if err != nil {
+			return diffs, err
+		}
+		if srcDigest != trgtDigest {
+			report(DiffDivergent, srcRef, trgtRef)
+		}
+	}
+
+	stale, _ := m.staleTags(srcTags, trgtTags)
+	for _, tag := range stale {
+		report(DiffExtra, "-", fmt.Sprintf("%s:%s", trgt, tag))
+	}
+
+	return diffs, nil
+}
@@ -0,0 +1,102 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/relays/direct"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestDiff(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := newTagListRegistry(map[string][]string{
+		"acme/app":   {"1.0", "1.1", "1.2", "latest"},
+		"mirror/app": {"1.0", "1.1", "latest", "0.9"},
+	}, gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	push := func(ref string, size int64) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		img, err := gocrrandom.Image(size, 1)
+		th.AssertNoError(err)
+		r, err := gocrname.NewTag(reg + "/" + ref)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(r, img))
+	}
+
+	img, err := gocrrandom.Image(256, 1)
+	th.AssertNoError(err)
+	for _, ref := range []string{"acme/app:1.0", "mirror/app:1.0",
+		"acme/app:1.1", "mirror/app:1.1"} {
+		r, err := gocrname.NewTag(reg + "/" + ref)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(r, img))
+	}
+	push("acme/app:latest", 128)
+	push("mirror/app:latest", 128)
+
+	conf := &SyncConfig{
+		Relay: direct.RelayID,
+		Tasks: []*Task{{
+			Name:   "mirror",
+			Source: &Location{Registry: reg},
+			Target: &Location{Registry: reg},
+			Mappings: []*Mapping{{
+				From: "acme/app",
+				To:   "mirror/app",
+				Tags: []string{"1.0", "1.1", "1.2", "latest"},
+			}, {
+				From: "acme/app",
+				To:   "other/app",
+				Tags: []string{"1.0"},
+			}},
+		}},
+	}
+	th.AssertNoError(conf.validate())
+
+	var out bytes.Buffer
+	diffs, err := Diff(conf, &out)
+	th.AssertNoError(err)
+	th.AssertEqual(4, diffs)
+
+	var got []string
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		got = append(got, strings.Join(strings.Fields(l), " "))
+	}
+	src, trgt := reg+"/acme/app", reg+"/mirror/app"
+	th.AssertEqualSlices([]string{
+		"TASK DIFF SOURCE TARGET",
+		"mirror missing " + src + ":1.2 " + trgt + ":1.2",
+		"mirror divergent " + src + ":latest " + trgt + ":latest",
+		"mirror extra - " + trgt + ":0.9",
+		"mirror missing " + src + ":1.0 " + reg + "/other/app:1.0",
+	}, got)
+}
@@ -0,0 +1,261 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	log "github.com/sirupsen/logrus"
+)
+
+// ECRRepoConfig holds the settings applied to ECR repositories that get
+// created in the target registry of a task; the lifecycle policy is a
+// template, rendered for each repository
+type ECRRepoConfig struct {
+	Tags                   map[string]string `yaml:"tags"`
+	ImmutableTags          bool              `yaml:"immutable-tags"`
+	ScanOnPush             bool              `yaml:"scan-on-push"`
+	Encryption             string            `yaml:"encryption"`
+	KMSKey                 string            `yaml:"kms-key"`
+	LifecyclePolicy        string            `yaml:"lifecycle-policy"`
+	LifecyclePolicyFile    string            `yaml:"lifecycle-policy-file"`
+	EnforceLifecyclePolicy bool              `yaml:"enforce-lifecycle-policy"`
+	//
+	policy *template.Template
+}
+
+// LifecyclePolicyData holds the values that can be used in a lifecycle policy
+// template
+type LifecyclePolicyData struct {
+	// name of the repository, e.g. 'mirror/library/busybox'
+	Repo string
+	// last element of Repo, e.g. 'busybox'
+	Name string
+	// Repo without its last element, e.g. 'mirror/library'
+	Dir string
+	// ID of the AWS account the registry belongs to
+	Account string
+	// AWS region of the registry
+	Region string
+	// name of the task
+	Task string
+}
+
+//
+func newLifecyclePolicyData(account, region, task,
+	repo string) *LifecyclePolicyData {
+	dir := path.Dir(repo)
+	if dir == "." {
+		dir = ""
+	}
+	return &LifecyclePolicyData{
+		Repo:    repo,
+		Name:    path.Base(repo),
+		Dir:     dir,
+		Account: account,
+		Region:  region,
+		Task:    task,
+	}
+}
+
+//
+func (c *ECRRepoConfig) validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	switch c.Encryption {
+	case "", ecr.EncryptionTypeAes256, ecr.EncryptionTypeKms:
+	default:
+		return fmt.Errorf("invalid value for 'encryption': '%s', must be "+
+			"'%s' or '%s'", c.Encryption, ecr.EncryptionTypeAes256,
+			ecr.EncryptionTypeKms)
+	}
+
+	if c.KMSKey != "" && c.Encryption != ecr.EncryptionTypeKms {
+		return fmt.Errorf("'kms-key' requires 'encryption' to be '%s'",
+			ecr.EncryptionTypeKms)
+	}
+
+	if c.LifecyclePolicyFile != "" {
+		if c.LifecyclePolicy != "" {
+			return errors.New(
+				"'lifecycle-policy' and 'lifecycle-policy-file' are mutually " +
+					"exclusive")
+		}
+		b, err := ioutil.ReadFile(c.LifecyclePolicyFile)
+		if err != nil {
+			return fmt.Errorf("cannot read 'lifecycle-policy-file': %v", err)
+		}
+		c.LifecyclePolicy = string(b)
+	}
+
+	if c.EnforceLifecyclePolicy && c.LifecyclePolicy == "" {
+		return errors.New("'enforce-lifecycle-policy' requires a lifecycle " +
+			"policy")
+	}
+
+	c.policy = nil
+	if c.LifecyclePolicy == "" {
+		return nil
+	}
+
+	tmpl, err := template.New("lifecycle-policy").Funcs(toTemplateFuncs).
+		Option("missingkey=error").Parse(c.LifecyclePolicy)
+	if err != nil {
+		return fmt.Errorf("lifecycle policy is not a valid template: %v", err)
+	}
+	c.policy = tmpl
+
+	if _, err := c.renderPolicy(newLifecyclePolicyData("123456789012",
+		"us-east-1", "test", "acme/app")); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// renderPolicy renders the lifecycle policy template with given data, and
+// checks that the result is valid JSON
+func (c *ECRRepoConfig) renderPolicy(data *LifecyclePolicyData) (
+	string, error) {
+
+	var buf bytes.Buffer
+	if err := c.policy.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("cannot render lifecycle policy: %v", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return "", errors.New("lifecycle policy is not valid JSON")
+	}
+	return buf.String(), nil
+}
+
+// createInput returns the input for creating repository path with these
+// settings
+func (c *ECRRepoConfig) createInput(path string) *ecr.CreateRepositoryInput {
+
+	ret := &ecr.CreateRepositoryInput{RepositoryName: aws.String(path)}
+
+	if c == nil {
+		return ret
+	}
+
+	// sorted, for stable requests
+	keys := make([]string, 0, len(c.Tags))
+	for k := range c.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ret.Tags = append(ret.Tags,
+			&ecr.Tag{Key: aws.String(k), Value: aws.String(c.Tags[k])})
+	}
+
+	if c.ImmutableTags {
+		ret.ImageTagMutability = aws.String(ecr.ImageTagMutabilityImmutable)
+	}
+
+	if c.ScanOnPush {
+		ret.ImageScanningConfiguration = &ecr.ImageScanningConfiguration{
+			ScanOnPush: aws.Bool(true)}
+	}
+
+	if c.Encryption != "" {
+		ret.EncryptionConfiguration = &ecr.EncryptionConfiguration{
+			EncryptionType: aws.String(c.Encryption)}
+		if c.KMSKey != "" {
+			ret.EncryptionConfiguration.KmsKey = aws.String(c.KMSKey)
+		}
+	}
+
+	return ret
+}
+
+// lifecyclePolicyInput returns the input for attaching the lifecycle policy,
+// rendered with given data, to repository data.Repo, or nil if there is no
+// policy
+func (c *ECRRepoConfig) lifecyclePolicyInput(
+	data *LifecyclePolicyData) (*ecr.PutLifecyclePolicyInput, error) {
+
+	if c == nil || c.policy == nil {
+		return nil, nil
+	}
+
+	policy, err := c.renderPolicy(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecr.PutLifecyclePolicyInput{
+		RegistryId:          aws.String(data.Account),
+		RepositoryName:      aws.String(data.Repo),
+		LifecyclePolicyText: aws.String(policy),
+	}, nil
+}
+
+// enforceLifecyclePolicy puts the lifecycle policy given by inp, in case the
+// repository it is for has no policy, or a different one
+func enforceLifecyclePolicy(svc ecriface.ECRAPI,
+	inp *ecr.PutLifecyclePolicyInput) error {
+
+	current := ""
+	out, err := svc.GetLifecyclePolicy(&ecr.GetLifecyclePolicyInput{
+		RegistryId:     inp.RegistryId,
+		RepositoryName: inp.RepositoryName,
+	})
+	if err == nil {
+		current = aws.StringValue(out.LifecyclePolicyText)
+	} else if aerr, ok := err.(awserr.Error); !ok ||
+		aerr.Code() != ecr.ErrCodeLifecyclePolicyNotFoundException {
+		return fmt.Errorf("error getting lifecycle policy: %v", err)
+	}
+
+	if samePolicy(current, aws.StringValue(inp.LifecyclePolicyText)) {
+		return nil
+	}
+
+	log.WithField("repo", aws.StringValue(inp.RepositoryName)).Warn(
+		"lifecycle policy differs from configured one, re-applying")
+	if _, err := svc.PutLifecyclePolicy(inp); err != nil {
+		return fmt.Errorf("error re-applying lifecycle policy: %v", err)
+	}
+	return nil
+}
+
+// samePolicy tells whether the two lifecycle policies are the same, ignoring
+// formatting
+func samePolicy(a, b string) bool {
+	var pa, pb interface{}
+	if json.Unmarshal([]byte(a), &pa) != nil ||
+		json.Unmarshal([]byte(b), &pb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(pa, pb)
+}
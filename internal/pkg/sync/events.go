@@ -0,0 +1,154 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"io"
+	gosync "sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// event types
+const (
+	EventTaskStart    = "task-start"
+	EventTagSkipped   = "tag-skipped"
+	EventTagFailed    = "tag-failed"
+	EventPushComplete = "push-complete"
+	EventTaskEnd      = "task-end"
+)
+
+// event is a single step in the lifecycle of a task run, written as one line
+// of JSON to the event stream
+type event struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Task  string    `json:"task"`
+	*tagEvent
+	*taskEndEvent
+}
+
+//
+type tagEvent struct {
+	Source    string `json:"source"`
+	Target    string `json:"target"`
+	Tag       string `json:"tag"`
+	TargetTag string `json:"targetTag"`
+	Digest    string `json:"digest,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+//
+type taskEndEvent struct {
+	Failed  bool     `json:"failed"`
+	Images  int      `json:"images"`
+	Tags    int      `json:"tags"`
+	Bytes   int64    `json:"bytes,omitempty"`
+	Seconds float64  `json:"durationSeconds"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// eventStream writes events as JSON lines
+type eventStream struct {
+	enc   *json.Encoder
+	mutex gosync.Mutex
+}
+
+// EnableEvents makes the sync write an event to w for each step of its task
+// runs, as one line of JSON per event
+func (s *Sync) EnableEvents(w io.Writer) {
+	s.events = &eventStream{enc: json.NewEncoder(w)}
+}
+
+//
+func (e *eventStream) emit(ev *event) {
+
+	if e == nil {
+		return
+	}
+
+	ev.Time = time.Now().UTC()
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if err := e.enc.Encode(ev); err != nil {
+		log.WithField("event", ev.Event).Warnf("cannot write event: %v", err)
+	}
+}
+
+//
+func (e *eventStream) taskStart(t *Task) {
+	e.emit(&event{Event: EventTaskStart, Task: t.Name})
+}
+
+//
+func (e *eventStream) taskEnd(t *Task, d time.Duration) {
+	e.emit(&event{Event: EventTaskEnd, Task: t.Name,
+		taskEndEvent: &taskEndEvent{
+			Failed:  t.failed,
+			Images:  t.runImages,
+			Tags:    t.runTags,
+			Bytes:   t.runBytes,
+			Seconds: d.Seconds(),
+			Errors:  t.runErrors,
+		}})
+}
+
+// refDone emits an event for each considered tag of source ref src, classified
+// the same way as for reports: tags that were synced are complete, selected
+// tags that were not synced failed in case of error, all others were skipped
+func (e *eventStream) refDone(t *Task, m *Mapping, src, trgt string,
+	considered, selected, synced []string, images map[string]*imageInfo,
+	err error) {
+
+	if e == nil {
+		return
+	}
+
+	isSelected := make(map[string]bool)
+	for _, tag := range selected {
+		isSelected[tag] = true
+	}
+	isSynced := make(map[string]bool)
+	for _, tag := range synced {
+		isSynced[tag] = true
+	}
+
+	for _, tag := range considered {
+
+		te := &tagEvent{Source: src, Target: trgt, Tag: tag,
+			TargetTag: m.targetTag(tag)}
+		ev := &event{Event: EventTagSkipped, Task: t.Name, tagEvent: te}
+
+		switch {
+		case isSynced[tag]:
+			ev.Event = EventPushComplete
+			if img := images[tag]; img != nil {
+				te.Digest, te.Size = img.digest, img.size
+			}
+		case isSelected[tag] && err != nil:
+			ev.Event = EventTagFailed
+			te.Error = err.Error()
+		}
+
+		e.emit(ev)
+	}
+}
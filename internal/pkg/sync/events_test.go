@@ -0,0 +1,105 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestEvents(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	img, err := gocrrandom.Image(256, 1)
+	th.AssertNoError(err)
+	digest, err := img.Digest()
+	th.AssertNoError(err)
+	r, err := gocrname.NewTag(reg + "/good:1.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(r, img))
+
+	conf := &SyncConfig{Ping: PingOff}
+	for _, from := range []string{"good", "bad"} {
+		m := &Mapping{From: from, Tags: []string{"1.0"}}
+		th.AssertNoError(m.validate())
+		conf.Tasks = append(conf.Tasks, &Task{
+			Name:     from,
+			Source:   &Location{Registry: reg},
+			Target:   &Location{Registry: "target.example.com"},
+			Mappings: []*Mapping{m},
+		})
+	}
+
+	relay := &mockRelay{fail: map[string]bool{reg + "/bad": true}}
+	s := &Sync{
+		relay:    relay,
+		ping:     PingOff,
+		workers:  make(chan bool, 1),
+		shutdown: make(chan bool),
+		ticks:    make(chan bool, 1),
+	}
+	var buf bytes.Buffer
+	s.EnableEvents(&buf)
+
+	th.AssertError(s.SyncFromConfig(conf), "one or more tasks had errors")
+
+	events := make(map[string][]map[string]interface{})
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		ev := make(map[string]interface{})
+		th.AssertNoError(json.Unmarshal(scanner.Bytes(), &ev))
+		task := ev["task"].(string)
+		events[task] = append(events[task], ev)
+	}
+
+	good := events["good"]
+	th.AssertEqual(3, len(good))
+	th.AssertEqual(EventTaskStart, good[0]["event"])
+	th.AssertEqual(EventPushComplete, good[1]["event"])
+	th.AssertEqual(reg+"/good", good[1]["source"])
+	th.AssertEqual("target.example.com/good", good[1]["target"])
+	th.AssertEqual("1.0", good[1]["targetTag"])
+	th.AssertEqual(digest.String(), good[1]["digest"])
+	th.AssertTrue(good[1]["size"].(float64) > 0)
+	th.AssertEqual(EventTaskEnd, good[2]["event"])
+	th.AssertEqual(false, good[2]["failed"])
+	th.AssertEqual(float64(1), good[2]["tags"])
+
+	bad := events["bad"]
+	th.AssertEqual(3, len(bad))
+	th.AssertEqual(EventTagFailed, bad[1]["event"])
+	th.AssertEqual("sync failed", bad[1]["error"])
+	th.AssertEqual(EventTaskEnd, bad[2]["event"])
+	th.AssertEqual(true, bad[2]["failed"])
+}
@@ -0,0 +1,115 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// user name GitLab expects for CI job tokens
+const gitLabJobTokenUser = "gitlab-ci-token"
+
+// GitLabConfig holds settings for locations that are GitLab registries
+type GitLabConfig struct {
+	URL           string `yaml:"url"`
+	Token         string `yaml:"token"`
+	TokenType     string `yaml:"token-type"`
+	User          string `yaml:"user"`
+	CheckProjects bool   `yaml:"check-projects"`
+}
+
+//
+func (c *GitLabConfig) validate(l *Location) error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Token == "" {
+		return errors.New("'token' is required")
+	}
+
+	switch c.TokenType {
+	case "":
+		c.TokenType = registry.GitLabPersonalToken
+	case registry.GitLabPersonalToken, registry.GitLabDeployToken,
+		registry.GitLabJobToken:
+	default:
+		return fmt.Errorf("invalid value for 'token-type': '%s', must be "+
+			"'%s', '%s', or '%s'", c.TokenType, registry.GitLabPersonalToken,
+			registry.GitLabDeployToken, registry.GitLabJobToken)
+	}
+
+	if c.User == "" {
+		if c.TokenType != registry.GitLabJobToken {
+			return fmt.Errorf("'user' is required for %s tokens", c.TokenType)
+		}
+		c.User = gitLabJobTokenUser
+	}
+
+	if c.URL == "" {
+		c.URL = registry.DefaultGitLabURL(l.Registry)
+	}
+
+	needsAPI := c.CheckProjects || l.ListerType == registry.GitLab
+	if needsAPI {
+		if c.URL == "" {
+			return errors.New(
+				"'url' of the GitLab instance is required for using its API")
+		}
+		if c.TokenType == registry.GitLabDeployToken {
+			return errors.New("deploy tokens cannot be used with the GitLab " +
+				"API, which is required for 'check-projects' and the gitlab " +
+				"lister")
+		}
+	}
+
+	if l.ListerType == registry.GitLab {
+		if _, ok := l.ListerConfig["url"]; !ok {
+			l.ListerConfig["url"] = c.URL
+		}
+		if _, ok := l.ListerConfig["token-type"]; !ok {
+			l.ListerConfig["token-type"] = c.TokenType
+		}
+	}
+
+	return nil
+}
+
+//
+func (c *GitLabConfig) api(l *Location) *registry.GitLabAPI {
+	return &registry.GitLabAPI{
+		URL:       c.URL,
+		Token:     c.Token,
+		TokenType: c.TokenType,
+		Insecure:  l.SkipTLSVerify,
+	}
+}
+
+// checkProject verifies that the GitLab project for ref exists, if checking
+// is enabled
+func (c *GitLabConfig) checkProject(l *Location, ref string) error {
+	if c == nil || !c.CheckProjects {
+		return nil
+	}
+	_, path, _ := util.SplitRef(ref)
+	return registry.CheckGitLabProject(c.api(l), path)
+}
@@ -0,0 +1,103 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestGitLab(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			if r.Header.Get("PRIVATE-TOKEN") != "glpat" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			switch r.URL.EscapedPath() {
+			case "/api/v4/groups/acme%2Fplatform/registry/repositories":
+				if r.URL.Query().Get("page") == "1" {
+					w.Header().Set("X-Next-Page", "2")
+					w.Write([]byte(`[{"path": "acme/platform/app"}]`))
+				} else {
+					w.Write([]byte(`[{"path": "acme/platform/infra/db/backup"}]`))
+				}
+			case "/api/v4/projects/acme%2Fplatform%2Fapp":
+				w.Write([]byte(`{}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer srv.Close()
+
+	l := &Location{
+		Registry:      "registry.acme.com",
+		SkipTLSVerify: true,
+		ListerConfig: map[string]string{
+			"type": "gitlab", "group": "acme/platform"},
+		GitLab: &GitLabConfig{
+			URL:           srv.URL,
+			Token:         "glpat",
+			User:          "alex",
+			CheckProjects: true,
+		},
+	}
+	th.AssertNoError(l.validate())
+	th.AssertEqual("alex:glpat", l.basicCreds())
+
+	list, err := registry.NewRepoList(l.Registry, l.SkipTLSVerify,
+		l.ListerType, l.ListerConfig, l.creds)
+	th.AssertNoError(err)
+	repos, err := list.Get()
+	th.AssertNoError(err)
+	th.AssertEquivalentSlices(
+		[]string{"acme/platform/app", "acme/platform/infra/db/backup"}, repos)
+
+	// image path may extend the project path by up to two levels
+	th.AssertNoError(
+		l.GitLab.checkProject(l, "registry.acme.com/acme/platform/app"))
+	th.AssertNoError(
+		l.GitLab.checkProject(l, "registry.acme.com/acme/platform/app/a/b"))
+	th.AssertError(
+		l.GitLab.checkProject(l, "registry.acme.com/acme/platform/app/a/b/c"),
+		"no GitLab project found")
+	th.AssertError(
+		l.GitLab.checkProject(l, "registry.acme.com/acme/platform/other"),
+		"no GitLab project found")
+
+	// job tokens come with a fixed user
+	l = &Location{Registry: registry.GitLabComRegistry,
+		GitLab: &GitLabConfig{Token: "job", TokenType: "job"}}
+	th.AssertNoError(l.validate())
+	th.AssertEqual("gitlab-ci-token:job", l.basicCreds())
+	th.AssertEqual("https://gitlab.com", l.GitLab.URL)
+
+	l = &Location{Registry: "registry.acme.com",
+		GitLab: &GitLabConfig{Token: "deploy", TokenType: "deploy",
+			User: "gitlab+deploy-token-1", CheckProjects: true}}
+	th.AssertError(l.validate(), "'url' of the GitLab instance is required")
+}
@@ -0,0 +1,102 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// HarborConfig holds settings for locations that are Harbor registries
+type HarborConfig struct {
+	CreateProjects bool         `yaml:"create-projects"`
+	Public         bool         `yaml:"public"`
+	StorageLimit   int64        `yaml:"storage-limit"`
+	Robot          *HarborRobot `yaml:"robot"`
+}
+
+// HarborRobot is a Harbor robot account to use as credentials
+type HarborRobot struct {
+	ID         int64         `yaml:"id"`
+	Name       string        `yaml:"name"`
+	SecretFile string        `yaml:"secret-file"`
+	Renew      time.Duration `yaml:"renew"`
+}
+
+//
+func (c *HarborConfig) validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.StorageLimit < -1 {
+		return errors.New("'storage-limit' needs to be -1 (unlimited), " +
+			"0 (default), or positive")
+	}
+
+	if r := c.Robot; r != nil {
+		if r.Name == "" || r.SecretFile == "" {
+			return errors.New("robot requires 'name' and 'secret-file'")
+		}
+		if r.Renew < 0 {
+			return errors.New("robot 'renew' must not be negative")
+		}
+		if r.Renew > 0 && r.ID <= 0 {
+			return errors.New("robot 'id' is required for renewing its secret")
+		}
+	}
+
+	return nil
+}
+
+//
+func (c *HarborConfig) robotRefresher(l *Location) auth.Refresher {
+	return auth.NewHarborRobotRefresher(l.Registry, &auth.HarborRobot{
+		ID:         c.Robot.ID,
+		Name:       c.Robot.Name,
+		SecretFile: c.Robot.SecretFile,
+		Renew:      c.Robot.Renew,
+	}, l.SkipTLSVerify)
+}
+
+// ensureProject creates the Harbor project for ref if project creation is
+// enabled; the project is the first path element of ref
+func (c *HarborConfig) ensureProject(l *Location, ref string) error {
+
+	if c == nil || !c.CreateProjects {
+		return nil
+	}
+
+	_, path, _ := util.SplitRef(ref)
+	ix := strings.Index(path, "/")
+	if ix < 1 {
+		return fmt.Errorf("Harbor ref '%s' does not contain a project", ref)
+	}
+
+	return registry.EnsureHarborProject(l.Registry, &registry.HarborProject{
+		Name:         path[:ix],
+		Public:       c.Public,
+		StorageLimit: c.StorageLimit,
+	}, l.creds, l.SkipTLSVerify)
+}
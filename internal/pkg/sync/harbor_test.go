@@ -0,0 +1,127 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestHarbor(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	secret := "initial"
+	projects := map[string]map[string]interface{}{"existing": nil}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+
+			user, pass, _ := r.BasicAuth()
+			if user != "robot$dregsy" || pass != secret {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			switch {
+			case r.Method == http.MethodHead &&
+				r.URL.Path == "/api/v2.0/projects":
+				if _, ok := projects[r.URL.Query().Get("project_name")]; ok {
+					w.WriteHeader(http.StatusOK)
+				} else {
+					w.WriteHeader(http.StatusNotFound)
+				}
+
+			case r.Method == http.MethodPost &&
+				r.URL.Path == "/api/v2.0/projects":
+				var p map[string]interface{}
+				th.AssertNoError(json.NewDecoder(r.Body).Decode(&p))
+				projects[p["project_name"].(string)] = p
+				w.WriteHeader(http.StatusCreated)
+
+			case r.Method == http.MethodPatch &&
+				r.URL.Path == "/api/v2.0/robots/7":
+				secret = "renewed"
+				w.Write([]byte(`{"secret": "renewed"}`))
+
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "dregsy-harbor")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "secret")
+	th.AssertNoError(ioutil.WriteFile(secretFile, []byte("initial\n"), 0600))
+
+	reg := strings.TrimPrefix(srv.URL, "https://")
+	l := &Location{
+		Registry:      reg,
+		SkipTLSVerify: true,
+		Harbor: &HarborConfig{
+			CreateProjects: true,
+			StorageLimit:   1024,
+			Robot: &HarborRobot{
+				ID:         7,
+				Name:       "robot$dregsy",
+				SecretFile: secretFile,
+				Renew:      time.Hour,
+			},
+		},
+	}
+	th.AssertNoError(l.validate())
+
+	// secret file is fresh, so no renewal yet
+	th.AssertNoError(l.RefreshAuth())
+	th.AssertEqual("robot$dregsy:initial", l.basicCreds())
+
+	th.AssertNoError(l.Harbor.ensureProject(l, reg+"/existing/image"))
+	th.AssertNoError(l.Harbor.ensureProject(l, reg+"/mirror/library/busybox"))
+	th.AssertEqual(2, len(projects))
+	th.AssertEqual("false",
+		projects["mirror"]["metadata"].(map[string]interface{})["public"])
+	th.AssertEqual(float64(1024), projects["mirror"]["storage_limit"])
+	th.AssertError(l.Harbor.ensureProject(l, reg+"/image"),
+		"does not contain a project")
+
+	// age the secret file to trigger renewal
+	old := time.Now().Add(-2 * time.Hour)
+	th.AssertNoError(os.Chtimes(secretFile, old, old))
+	th.AssertNoError(l.RefreshAuth())
+	th.AssertEqual("robot$dregsy:renewed", l.basicCreds())
+
+	b, err := ioutil.ReadFile(secretFile)
+	th.AssertNoError(err)
+	th.AssertEqual("renewed", string(b))
+
+	l = &Location{Registry: reg, Auth: "x",
+		Harbor: &HarborConfig{Robot: l.Harbor.Robot}}
+	th.AssertError(l.validate(), "Harbor robot is mutually exclusive")
+}
@@ -0,0 +1,217 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	gosync "sync"
+	"time"
+)
+
+//
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+)
+
+// health tracks the outcome of task runs, and reports on it, as well as on
+// the readiness of the relay, via HTTP
+type health struct {
+	relay    Relay
+	named    map[string]Relay // named relays selected by tasks
+	stopping func() bool
+	started  time.Time
+	standby  bool // whether standing by for leadership, with tasks not run
+	tasks    map[string]*taskHealth
+	mutex    gosync.Mutex
+}
+
+//
+type taskHealth struct {
+	Name        string     `json:"name"`
+	LastRun     *time.Time `json:"lastRun,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	Failed      bool       `json:"failed"`
+	Stale       bool       `json:"stale"`
+	//
+	interval time.Duration
+}
+
+//
+type healthReport struct {
+	Status  string        `json:"status"`
+	Standby bool          `json:"standby,omitempty"`
+	Relay   string        `json:"relay,omitempty"`
+	Tasks   []*taskHealth `json:"tasks,omitempty"`
+}
+
+//
+func newHealth(relay Relay, stopping func() bool) *health {
+	return &health{
+		relay:    relay,
+		stopping: stopping,
+		started:  time.Now(),
+		tasks:    make(map[string]*taskHealth),
+	}
+}
+
+// setTasks sets the tasks to report on; records of tasks that were reported
+// on before are kept
+func (h *health) setTasks(tasks []*Task) {
+
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	current := make(map[string]*taskHealth)
+	for _, t := range tasks {
+		th, ok := h.tasks[t.Name]
+		if !ok {
+			th = &taskHealth{Name: t.Name}
+		}
+		th.interval = t.expectedInterval()
+		current[t.Name] = th
+	}
+	h.tasks = current
+}
+
+// setStandby records whether this instance is standing by for leadership;
+// tasks don't become stale while standing by, and staleness is determined
+// from the end of standing by
+func (h *health) setStandby(standby bool) {
+
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.standby && !standby {
+		h.started = time.Now()
+	}
+	h.standby = standby
+}
+
+// taskDone records the end of a run of the given task
+func (h *health) taskDone(task string, failed bool) {
+
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	th, ok := h.tasks[task]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	th.LastRun = &now
+	th.Failed = failed
+	if !failed {
+		th.LastSuccess = &now
+	}
+}
+
+// healthy reports on the tasks, and whether standing by; a periodic task is
+// stale when its last successful run, or the start of dregsy if there was none
+// yet, lies back more than twice its interval
+func (h *health) healthy() (bool, bool, []*taskHealth) {
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ok := true
+	now := time.Now()
+	var ret []*taskHealth
+
+	for _, th := range h.tasks {
+		last := h.started
+		if th.LastSuccess != nil {
+			last = *th.LastSuccess
+		}
+		th.Stale = !h.standby && th.interval > 0 &&
+			now.Sub(last) > 2*th.interval
+		ok = ok && !th.Stale
+		report := *th
+		ret = append(ret, &report)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ok, h.standby, ret
+}
+
+// ready checks whether the relays can be used, and dregsy is not shutting down
+func (h *health) ready() (bool, string) {
+	if h.stopping != nil && h.stopping() {
+		return false, "shutting down"
+	}
+	if c, ok := h.relay.(HealthChecker); ok {
+		if err := c.CheckHealth(); err != nil {
+			return false, err.Error()
+		}
+	}
+	var names []string
+	for name := range h.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if c, ok := h.named[name].(HealthChecker); ok {
+			if err := c.CheckHealth(); err != nil {
+				return false, fmt.Sprintf("relay '%s': %v", name, err)
+			}
+		}
+	}
+	return true, ""
+}
+
+//
+func (h *health) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ok, standby, tasks := h.healthy()
+	h.respond(w, ok, &healthReport{Standby: standby, Tasks: tasks})
+}
+
+//
+func (h *health) handleReady(w http.ResponseWriter, r *http.Request) {
+	ok, msg := h.ready()
+	h.respond(w, ok, &healthReport{Relay: msg})
+}
+
+//
+func (h *health) respond(w http.ResponseWriter, ok bool, report *healthReport) {
+
+	status := http.StatusOK
+	report.Status = "ok"
+	if !ok {
+		status = http.StatusServiceUnavailable
+		report.Status = "failing"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
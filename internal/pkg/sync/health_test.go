@@ -0,0 +1,114 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// unhealthyRelay is a mockRelay whose service is not reachable
+type unhealthyRelay struct {
+	mockRelay
+}
+
+//
+func (r *unhealthyRelay) CheckHealth() error {
+	return errors.New("cannot reach Docker daemon")
+}
+
+//
+func TestHealth(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryHandler := func(handler http.HandlerFunc, wantCode int,
+		wantStatus string) *healthReport {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		th.AssertEqual(wantCode, rec.Code)
+		report := &healthReport{}
+		th.AssertNoError(json.Unmarshal(rec.Body.Bytes(), report))
+		th.AssertEqual(wantStatus, report.Status)
+		return report
+	}
+
+	h := newHealth(&mockRelay{}, nil)
+	h.setTasks([]*Task{{Name: "periodic", Interval: 60}, {Name: "once"}})
+
+	report := tryHandler(h.handleHealth, http.StatusOK, "ok")
+	th.AssertEqual(2, len(report.Tasks))
+	th.AssertEqual("once", report.Tasks[0].Name)
+	th.AssertNil(report.Tasks[1].LastRun)
+
+	// periodic task without success for more than twice its interval
+	h.started = time.Now().Add(-3 * time.Minute)
+	report = tryHandler(h.handleHealth, http.StatusServiceUnavailable,
+		"failing")
+	th.AssertFalse(report.Tasks[0].Stale)
+	th.AssertTrue(report.Tasks[1].Stale)
+
+	h.taskDone("periodic", false)
+	report = tryHandler(h.handleHealth, http.StatusOK, "ok")
+	th.AssertNotNil(report.Tasks[1].LastSuccess)
+
+	// failed run keeps time of last success
+	h.taskDone("periodic", true)
+	report = tryHandler(h.handleHealth, http.StatusOK, "ok")
+	th.AssertTrue(report.Tasks[1].Failed)
+	th.AssertNotNil(report.Tasks[1].LastSuccess)
+
+	tryHandler(h.handleReady, http.StatusOK, "ok")
+
+	// tasks don't become stale while standing by for leadership, and
+	// staleness counts from when standing by ended
+	h = newHealth(&mockRelay{}, nil)
+	h.setTasks([]*Task{{Name: "periodic", Interval: 60}})
+	h.setStandby(true)
+	h.started = time.Now().Add(-3 * time.Minute)
+	report = tryHandler(h.handleHealth, http.StatusOK, "ok")
+	th.AssertTrue(report.Standby)
+	th.AssertFalse(report.Tasks[0].Stale)
+	h.setStandby(false)
+	report = tryHandler(h.handleHealth, http.StatusOK, "ok")
+	th.AssertFalse(report.Standby)
+
+	h = newHealth(&unhealthyRelay{}, nil)
+	report = tryHandler(h.handleReady, http.StatusServiceUnavailable,
+		"failing")
+	th.AssertEqual("cannot reach Docker daemon", report.Relay)
+
+	h = newHealth(&mockRelay{}, nil)
+	h.named = map[string]Relay{"pull-host": &unhealthyRelay{}}
+	report = tryHandler(h.handleReady, http.StatusServiceUnavailable,
+		"failing")
+	th.AssertEqual("relay 'pull-host': cannot reach Docker daemon",
+		report.Relay)
+
+	h = newHealth(&mockRelay{}, func() bool { return true })
+	report = tryHandler(h.handleReady, http.StatusServiceUnavailable,
+		"failing")
+	th.AssertEqual("shutting down", report.Relay)
+}
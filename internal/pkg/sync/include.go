@@ -0,0 +1,182 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// configLoader loads config files into one config, keeping track of which
+// files were already loaded, and where settings came from
+type configLoader struct {
+	loaded  map[string]bool
+	origins map[string]string
+}
+
+//
+func newConfigLoader() *configLoader {
+	return &configLoader{
+		loaded:  make(map[string]bool),
+		origins: make(map[string]string),
+	}
+}
+
+// loadFile loads the given config file, and the files it includes, and merges
+// them into config: tasks from all files are combined, while the remaining
+// settings may only be set in one of the files; a file is loaded only once,
+// no matter how often it is given or included
+func (l *configLoader) loadFile(config *SyncConfig, file string) error {
+
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return fmt.Errorf("invalid config file path '%s': %v", file, err)
+	}
+	if l.loaded[abs] {
+		return nil
+	}
+	l.loaded[abs] = true
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("error loading config file '%s': %v", file, err)
+	}
+
+	// environment variables can be used anywhere in the config
+	data = []byte(util.ExpandEnvRefs(string(data)))
+
+	part := &SyncConfig{}
+
+	// unknown settings are rejected, so that typos don't go unnoticed; errors
+	// include line numbers
+	if err = yaml.UnmarshalStrict(data, part); err != nil {
+		return fmt.Errorf("error parsing config file '%s': %v", file, err)
+	}
+
+	if err := l.merge(config, part, file); err != nil {
+		return err
+	}
+
+	// included paths are relative to the including file
+	var includes []string
+	for _, inc := range part.Include {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(file), inc)
+		}
+		matches, err := filepath.Glob(inc)
+		if err != nil {
+			return fmt.Errorf("invalid include '%s' in config file '%s': %v",
+				inc, file, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("include '%s' in config file '%s' matches no "+
+				"files", inc, file)
+		}
+		includes = append(includes, matches...)
+	}
+
+	files, err := configFiles(includes)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := l.loadFile(config, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// merge merges the settings loaded from file into config
+func (l *configLoader) merge(config, part *SyncConfig, file string) error {
+
+	config.Tasks = append(config.Tasks, part.Tasks...)
+
+	trgt := reflect.ValueOf(config).Elem()
+	src := reflect.ValueOf(part).Elem()
+
+	for ix := 0; ix < src.NumField(); ix++ {
+
+		name := strings.Split(src.Type().Field(ix).Tag.Get("yaml"), ",")[0]
+		if name == "tasks" || name == "include" || src.Field(ix).IsZero() {
+			continue
+		}
+
+		if origin, ok := l.origins[name]; ok {
+			return fmt.Errorf("setting '%s' in config file '%s' is already "+
+				"set in '%s'", name, file, origin)
+		}
+		l.origins[name] = file
+		trgt.Field(ix).Set(src.Field(ix))
+	}
+
+	return nil
+}
+
+// configFiles resolves the given paths into config files, replacing each
+// directory with the YAML files it contains
+func configFiles(paths []string) ([]string, error) {
+
+	var ret []string
+
+	for _, p := range paths {
+
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("error loading config file '%s': %v", p, err)
+		}
+		if !info.IsDir() {
+			ret = append(ret, p)
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error reading config directory '%s': %v", p, err)
+		}
+		var files []string
+		for _, e := range entries {
+			ext := strings.ToLower(filepath.Ext(e.Name()))
+			if !e.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				files = append(files, filepath.Join(p, e.Name()))
+			}
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf(
+				"no config files found in directory '%s'", p)
+		}
+		sort.Strings(files)
+		ret = append(ret, files...)
+	}
+
+	return ret, nil
+}
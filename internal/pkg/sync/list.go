@@ -0,0 +1,86 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// List writes for each enabled task of conf the source tags selected by the
+// tag filters of its mappings, together with the target refs they map to; no
+// image is synced, and only the source registries are contacted; filters that
+// depend on the target, such as 'skip-existing', are not taken into account
+func List(conf *SyncConfig, w io.Writer) error {
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TASK\tSOURCE\tTARGET")
+
+	failed := false
+
+	for _, t := range conf.Tasks {
+
+		if !t.isEnabled() {
+			continue
+		}
+
+		if err := t.Source.RefreshAuth(); err != nil {
+			log.WithField("task", t.Name).Error(err)
+			failed = true
+			continue
+		}
+
+		for _, m := range t.Mappings {
+
+			refs, err := t.mappingRefs(m)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"task": t.Name, "from": m.From}).Error(err)
+				failed = true
+				continue
+			}
+
+			for _, ref := range refs {
+				src, trgt := ref[0], ref[1]
+				selected, err := t.selectTags(m, src, nil)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"task": t.Name, "ref": src}).Error(err)
+					failed = true
+					continue
+				}
+				for _, tag := range selected {
+					fmt.Fprintf(tw, "%s\t%s:%s\t%s:%s\n",
+						t.Name, src, tag, trgt, m.targetTag(tag))
+				}
+			}
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if failed {
+		return errors.New("errors while listing tags")
+	}
+	return nil
+}
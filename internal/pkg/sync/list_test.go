@@ -0,0 +1,115 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/relays/direct"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// newTagListRegistry returns a registry that lists the tags of the given
+// repos, and hands all other requests over to next, if set; this is needed
+// since the in-memory registry does not support listing tags
+func newTagListRegistry(repos map[string][]string,
+	next http.Handler) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if !strings.HasSuffix(req.URL.Path, "/tags/list") {
+				if next != nil {
+					next.ServeHTTP(w, req)
+				}
+				return
+			}
+			repo := strings.TrimSuffix(
+				strings.TrimPrefix(req.URL.Path, "/v2/"), "/tags/list")
+			tags, ok := repos[repo]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"name": repo, "tags": tags})
+		}))
+}
+
+//
+func TestList(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := newTagListRegistry(map[string][]string{
+		"acme/app": {"0.9.0", "1.0.0", "1.1.0", "1.2.0-rc1", "latest"},
+	}, nil)
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	conf := &SyncConfig{
+		Relay: direct.RelayID,
+		Tasks: []*Task{
+			{
+				Name:   "mirror",
+				Source: &Location{Registry: reg},
+				Target: &Location{Registry: "registry.example.com"},
+				Mappings: []*Mapping{{
+					From:        "acme/app",
+					To:          "mirror/app",
+					Tags:        []string{"semver:>=1.0.0-0", "latest"},
+					ExcludeTags: []string{"regex:.*-rc[0-9]+"},
+					TagPrefix:   "m-",
+				}, {
+					From: "acme/missing",
+					Tags: []string{"semver:>=1.0.0"},
+				}},
+			},
+			{
+				Name:     "skipped",
+				Source:   &Location{Registry: reg},
+				Target:   &Location{Registry: "registry.example.com"},
+				Mappings: []*Mapping{{From: "acme/app"}},
+			},
+		},
+	}
+	th.AssertNoError(conf.validate())
+	th.AssertNoError(conf.SelectTasks(nil, []string{"skipped"}))
+
+	var out bytes.Buffer
+	th.AssertError(List(conf, &out), "errors while listing tags")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	th.AssertEqual(4, len(lines))
+	th.AssertEqualSlices([]string{"TASK", "SOURCE", "TARGET"},
+		strings.Fields(lines[0]))
+
+	var got []string
+	for _, l := range lines[1:] {
+		got = append(got, strings.Join(strings.Fields(l), " "))
+	}
+	src := reg + "/acme/app"
+	trgt := "registry.example.com/mirror/app"
+	th.AssertEquivalentSlices([]string{
+		"mirror " + src + ":1.0.0 " + trgt + ":m-1.0.0",
+		"mirror " + src + ":1.1.0 " + trgt + ":m-1.1.0",
+		"mirror " + src + ":latest " + trgt + ":m-latest",
+	}, got)
+}
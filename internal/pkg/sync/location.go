@@ -19,6 +19,8 @@ package sync
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"strings"
 	"time"
 
@@ -28,14 +30,41 @@ import (
 	"github.com/xelalexv/dregsy/internal/pkg/registry"
 )
 
+// what to do when a tag to sync already exists in an immutable target with a
+// different digest
+const (
+	OnTagConflictSkip = "skip"
+	OnTagConflictFail = "fail"
+)
+
 //
 type Location struct {
-	Registry      string            `yaml:"registry"`
-	Auth          string            `yaml:"auth"`
-	SkipTLSVerify bool              `yaml:"skip-tls-verify"`
-	AuthRefresh   *time.Duration    `yaml:"auth-refresh"`
-	ListerConfig  map[string]string `yaml:"lister"`
-	ListerType    registry.ListSourceType
+	Registry       string              `yaml:"registry"`
+	Auth           string              `yaml:"auth"`
+	AuthFile       string              `yaml:"auth-file"`
+	SkipTLSVerify  bool                `yaml:"skip-tls-verify"`
+	PlainHTTP      bool                `yaml:"plain-http"`
+	TLS            *registry.TLSConfig `yaml:"tls"`
+	Proxy          string              `yaml:"proxy"`
+	NoProxy        bool                `yaml:"no-proxy"`
+	UserAgent      string              `yaml:"user-agent"`
+	Headers        map[string]string   `yaml:"headers"`
+	S3             *registry.S3Config  `yaml:"s3"`
+	AuthRefresh    *time.Duration      `yaml:"auth-refresh"`
+	RefreshMargin  *time.Duration      `yaml:"auth-refresh-margin"`
+	RoleARN        string              `yaml:"role-arn"`
+	KeyFile        string              `yaml:"key-file"`
+	Vault          *auth.VaultConfig   `yaml:"vault"`
+	Harbor         *HarborConfig       `yaml:"harbor"`
+	GitLab         *GitLabConfig       `yaml:"gitlab"`
+	Artifactory    *ArtifactoryConfig  `yaml:"artifactory"`
+	APIToken       string              `yaml:"api-token"`
+	RepoVisibility string              `yaml:"repo-visibility"`
+	ImmutableTags  bool                `yaml:"immutable-tags"`
+	OnTagConflict  string              `yaml:"on-tag-conflict"`
+	NormalizeRepos bool                `yaml:"normalize-repos"`
+	ListerConfig   map[string]string   `yaml:"lister"`
+	ListerType     registry.ListSourceType
 	//
 	creds *auth.Credentials
 }
@@ -51,6 +80,83 @@ func (l *Location) validate() error {
 		return errors.New("registry not set")
 	}
 
+	for _, t := range [][2]string{
+		{"dir:", "an OCI image layout ('" + registry.LayoutPrefix + "')"},
+		{"docker-archive:", "an OCI image layout ('" +
+			registry.LayoutPrefix + "')"},
+		{"gs://", "'" + registry.S3Prefix + "' with the S3 compatible " +
+			"'endpoint' of Google Cloud Storage"},
+	} {
+		if strings.HasPrefix(l.Registry, t[0]) {
+			return fmt.Errorf(
+				"'%s' locations are not supported, use %s instead", t[0], t[1])
+		}
+	}
+
+	switch l.OnTagConflict {
+	case "", OnTagConflictSkip, OnTagConflictFail:
+	default:
+		return fmt.Errorf(
+			"invalid value for 'on-tag-conflict': '%s', must be '%s' or '%s'",
+			l.OnTagConflict, OnTagConflictSkip, OnTagConflictFail)
+	}
+	if l.OnTagConflict != "" && !l.ImmutableTags {
+		return errors.New("'on-tag-conflict' requires 'immutable-tags'")
+	}
+
+	if l.IsLayout() {
+		return l.validateLayout()
+	}
+
+	if l.S3 != nil {
+		return fmt.Errorf(
+			"'%s' has 's3' settings, but is not in S3", l.Registry)
+	}
+
+	if l.PlainHTTP {
+		registry.AllowPlainHTTP(l.Registry)
+	}
+
+	if err := l.TLS.Validate(); err != nil {
+		return fmt.Errorf("invalid TLS settings: %v", err)
+	}
+	if err := registry.SetTLS(l.Registry, l.TLS); err != nil {
+		return err
+	}
+
+	if l.Proxy != "" && l.NoProxy {
+		return errors.New("'proxy' and 'no-proxy' are mutually exclusive")
+	}
+	if l.Proxy != "" || l.NoProxy {
+		var proxy *url.URL
+		if l.Proxy != "" {
+			var err error
+			if proxy, err = registry.ParseProxy(l.Proxy); err != nil {
+				return err
+			}
+		}
+		if err := registry.SetProxy(l.Registry, proxy); err != nil {
+			return err
+		}
+	}
+
+	if l.hasHeaderSettings() {
+		h := make(map[string]string)
+		for name, value := range l.Headers {
+			if l.UserAgent != "" && strings.EqualFold(name, "User-Agent") {
+				return errors.New("'user-agent' and a 'User-Agent' header " +
+					"are mutually exclusive")
+			}
+			h[name] = value
+		}
+		if l.UserAgent != "" {
+			h["User-Agent"] = l.UserAgent
+		}
+		if err := registry.SetHeaders(l.Registry, h); err != nil {
+			return fmt.Errorf("invalid header settings: %v", err)
+		}
+	}
+
 	if l.ListerConfig != nil {
 		if typ, ok := l.ListerConfig["type"]; ok {
 			l.ListerType = registry.ListSourceType(typ)
@@ -62,8 +168,53 @@ func (l *Location) validate() error {
 		}
 	}
 
+	if l.Vault != nil && (l.Auth != "" || l.AuthFile != "") {
+		return errors.New(
+			"'vault' is mutually exclusive with 'auth' and 'auth-file'")
+	}
+
+	if err := l.validateQuay(); err != nil {
+		return err
+	}
+
+	if err := l.GitLab.validate(l); err != nil {
+		return fmt.Errorf("invalid GitLab settings: %v", err)
+	}
+
+	if l.GitLab != nil &&
+		(l.Auth != "" || l.AuthFile != "" || l.Vault != nil) {
+		return errors.New("'gitlab' is mutually exclusive with " +
+			"'auth', 'auth-file', and 'vault'")
+	}
+
+	if err := l.Artifactory.validate(l); err != nil {
+		return fmt.Errorf("invalid Artifactory settings: %v", err)
+	}
+
+	if err := l.Harbor.validate(); err != nil {
+		return fmt.Errorf("invalid Harbor settings: %v", err)
+	}
+
+	harborRobot := l.Harbor != nil && l.Harbor.Robot != nil
+	if harborRobot && (l.Auth != "" || l.AuthFile != "" || l.Vault != nil) {
+		return errors.New("Harbor robot is mutually exclusive with " +
+			"'auth', 'auth-file', and 'vault'")
+	}
+
+	if l.AuthFile != "" {
+		if l.Auth != "" {
+			return errors.New("'auth' and 'auth-file' are mutually exclusive")
+		}
+		b, err := ioutil.ReadFile(l.AuthFile)
+		if err != nil {
+			return fmt.Errorf("cannot read 'auth-file': %v", err)
+		}
+		l.Auth = strings.TrimSpace(string(b))
+	}
+
 	disableAuth := l.Auth == "none"
-	if disableAuth {
+	dockerConfig := l.Auth == "docker-config"
+	if disableAuth || dockerConfig {
 		l.Auth = ""
 	}
 
@@ -75,6 +226,12 @@ func (l *Location) validate() error {
 		}
 		l.creds = crd
 		l.Auth = ""
+	} else if l.GitLab != nil {
+		crd, err := auth.NewCredentialsFromBasic(l.GitLab.User, l.GitLab.Token)
+		if err != nil {
+			return fmt.Errorf("invalid GitLab token: %v", err)
+		}
+		l.creds = crd
 	} else {
 		l.creds = &auth.Credentials{}
 	}
@@ -91,22 +248,151 @@ func (l *Location) validate() error {
 		}
 	}
 
+	margin := defaultAuthRefreshMargin
+
+	if l.RefreshMargin != nil {
+		margin = *l.RefreshMargin
+		if margin < 0 || margin > maximumAuthRefreshMargin {
+			return fmt.Errorf(
+				"'%s' has an invalid 'auth-refresh-margin', must be between "+
+					"0 and %s", l.Registry, maximumAuthRefreshMargin)
+		}
+	}
+
+	var ecrRefresher auth.Refresher
+
 	if l.IsECR() {
 		_, region, account := l.GetECR()
-		l.creds.SetRefresher(auth.NewECRAuthRefresher(account, region, interval))
-	} else if interval > 0 {
+		ecrRefresher = auth.NewECRAuthRefresher(
+			account, region, interval, margin)
+		l.creds.SetAWSRoleARN(l.RoleARN)
+		l.creds.SetRefresher(ecrRefresher)
+	} else if l.IsECRPublic() {
+		ecrRefresher = auth.NewECRPublicAuthRefresher(interval, margin)
+		l.creds.SetAWSRoleARN(l.RoleARN)
+		l.creds.SetRefresher(ecrRefresher)
+	} else if interval > 0 || l.RefreshMargin != nil {
 		return fmt.Errorf(
 			"'%s' wants authentication refresh, but is not an ECR registry",
 			l.Registry)
+	} else if l.RoleARN != "" {
+		return fmt.Errorf(
+			"'%s' has a 'role-arn' set, but is not an ECR registry", l.Registry)
+	}
+
+	if !l.IsGCR() && l.KeyFile != "" {
+		return fmt.Errorf(
+			"'%s' has a 'key-file' set, but is not a GCR or Artifact Registry",
+			l.Registry)
+	}
+
+	if dockerConfig {
+		// credentials from Docker config take precedence over ECR & GCR
+		// specific handling
+		l.creds.SetRefresher(auth.NewDockerConfigRefresher(l.Registry))
+	} else if l.IsGCR() && !disableAuth {
+		l.creds.SetRefresher(auth.NewGCRAuthRefresher(l.KeyFile))
 	}
 
-	if l.IsGCR() && !disableAuth {
-		l.creds.SetRefresher(auth.NewGCRAuthRefresher())
+	if harborRobot {
+		l.creds.SetRefresher(l.Harbor.robotRefresher(l))
+	}
+
+	if l.Vault != nil {
+		if err := l.Vault.Validate(); err != nil {
+			return fmt.Errorf("invalid Vault settings: %v", err)
+		}
+		// for ECR, Vault may provide AWS keys for retrieving the ECR token
+		l.creds.SetRefresher(auth.NewVaultRefresher(l.Vault, ecrRefresher))
+	}
+
+	return nil
+}
+
+// validateLayout validates a location that is an OCI image layout, local or
+// in S3; a layout takes none of the registry related settings, except for
+// 'role-arn' with S3
+func (l *Location) validateLayout() error {
+
+	s3 := registry.IsS3(l.Registry)
+
+	if !s3 && strings.TrimPrefix(l.Registry, registry.LayoutPrefix) == "" {
+		return fmt.Errorf("'%s' has no directory", l.Registry)
+	}
+
+	if l.Auth != "" || l.AuthFile != "" || l.Vault != nil ||
+		l.SkipTLSVerify || l.PlainHTTP || l.TLS != nil ||
+		l.hasProxySettings() || l.hasHeaderSettings() || l.AuthRefresh != nil ||
+		l.RefreshMargin != nil ||
+		(l.RoleARN != "" && !s3) || l.KeyFile != "" || l.Harbor != nil ||
+		l.GitLab != nil || l.Artifactory != nil || l.APIToken != "" ||
+		l.RepoVisibility != "" || l.ListerConfig != nil {
+		return fmt.Errorf("'%s' is an OCI image layout, which takes no "+
+			"registry settings such as auth, TLS, or proxy", l.Registry)
+	}
+
+	l.creds = &auth.Credentials{}
+
+	if !s3 {
+		if l.S3 != nil {
+			return fmt.Errorf(
+				"'%s' has 's3' settings, but is not in S3", l.Registry)
+		}
+		return nil
+	}
+
+	l.creds.SetAWSRoleARN(l.RoleARN)
+	if err := registry.SetS3(l.Registry, l.S3); err != nil {
+		return fmt.Errorf("invalid S3 settings: %v", err)
 	}
 
 	return nil
 }
 
+//
+func (l *Location) validateQuay() error {
+
+	if !l.IsQuay() {
+		if l.APIToken != "" || l.RepoVisibility != "" {
+			return fmt.Errorf("'%s' has 'api-token' or 'repo-visibility' set, "+
+				"but is not a Quay registry", l.Registry)
+		}
+		return nil
+	}
+
+	switch l.RepoVisibility {
+	case "":
+		l.RepoVisibility = registry.QuayPrivate
+	case registry.QuayPublic, registry.QuayPrivate:
+	default:
+		return fmt.Errorf("invalid value for 'repo-visibility': '%s', must "+
+			"be '%s' or '%s'", l.RepoVisibility, registry.QuayPublic,
+			registry.QuayPrivate)
+	}
+
+	return nil
+}
+
+// ref returns the image ref for path in this location
+func (l *Location) ref(path string) string {
+	return l.Registry + l.Artifactory.prefix() + normalizePath(path)
+}
+
+// repoPath returns the path of repo relative to this location, i.e. with any
+// location specific prefix removed; ok is false if repo is not inside this
+// location
+func (l *Location) repoPath(repo string) (path string, ok bool) {
+	p := l.Artifactory.prefix()
+	if p == "" {
+		return repo, true
+	}
+	repo = normalizePath(repo)
+	if !strings.HasPrefix(repo, p+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(repo, p), true
+}
+
 //
 func (l *Location) GetAuth() string {
 	if l.creds != nil {
@@ -116,15 +402,54 @@ func (l *Location) GetAuth() string {
 	return ""
 }
 
+// basicCreds returns the credentials in the form {user}:{password}, or an empty
+// string if there are none
+func (l *Location) basicCreds() string {
+	if l.creds == nil ||
+		(l.creds.Username() == "" && l.creds.Password() == "") {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s", l.creds.Username(), l.creds.Password())
+}
+
+//
+func (l *Location) hasProxySettings() bool {
+	return l.Proxy != "" || l.NoProxy
+}
+
+//
+func (l *Location) hasHeaderSettings() bool {
+	return l.UserAgent != "" || len(l.Headers) > 0
+}
+
+// insecure returns true if TLS verification is skipped or plain HTTP is
+// allowed for this location; external tools such as skopeo or cosign only
+// have a single switch for both
+func (l *Location) insecure() bool {
+	return l.SkipTLSVerify || l.PlainHTTP
+}
+
 //
 func (l *Location) RefreshAuth() error {
 	if l.creds == nil {
 		return nil
 	}
-	log.WithField("registry", l.Registry).Info("refreshing credentials")
+	log.WithField("registry", l.Registry).Debug("refreshing credentials")
 	return l.creds.Refresh()
 }
 
+// CredentialsExpiry returns when the current credentials for this location
+// expire, or the zero time if that's not known
+func (l *Location) CredentialsExpiry() time.Time {
+	return l.creds.Expiry()
+}
+
+// IsLayout checks whether this location is an OCI image layout, either local
+// or in S3
+func (l *Location) IsLayout() bool {
+	return registry.IsLayout(l.Registry) || registry.IsS3(l.Registry)
+}
+
 //
 func (l *Location) IsECR() bool {
 	ecr, _, _ := l.GetECR()
@@ -136,8 +461,17 @@ func (l *Location) GetECR() (ecr bool, region, account string) {
 	return registry.IsECR(l.Registry)
 }
 
+//
+func (l *Location) IsECRPublic() bool {
+	return registry.IsECRPublic(l.Registry)
+}
+
+//
+func (l *Location) IsQuay() bool {
+	return registry.IsQuay(l.Registry)
+}
+
 //
 func (l *Location) IsGCR() bool {
-	return strings.HasSuffix(l.Registry, ".gcr.io") ||
-		strings.HasSuffix(l.Registry, "-docker.pkg.dev")
+	return registry.IsGCR(l.Registry)
 }
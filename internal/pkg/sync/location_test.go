@@ -0,0 +1,161 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestDockerConfigAuth(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-docker-config")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	// base64 of 'alex:secret'
+	th.AssertNoError(ioutil.WriteFile(filepath.Join(dir, "config.json"),
+		[]byte(`{"auths": {"registry.acme.com": {"auth": "YWxleDpzZWNyZXQ="}}}`),
+		0600))
+
+	prev, set := os.LookupEnv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+	defer func() {
+		if set {
+			os.Setenv("DOCKER_CONFIG", prev)
+		} else {
+			os.Unsetenv("DOCKER_CONFIG")
+		}
+	}()
+
+	l := &Location{Registry: "registry.acme.com", Auth: "docker-config"}
+	th.AssertNoError(l.validate())
+	th.AssertNoError(l.RefreshAuth())
+	th.AssertEqual("alex:secret", l.basicCreds())
+
+	l = &Location{Registry: "other.acme.com", Auth: "docker-config"}
+	th.AssertNoError(l.validate())
+	th.AssertNoError(l.RefreshAuth())
+	th.AssertEqual("", l.basicCreds())
+}
+
+//
+func TestAuthFromFileAndEnv(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-auth")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	// base64 of 'alex:secret'
+	file := filepath.Join(dir, "auth")
+	th.AssertNoError(ioutil.WriteFile(file, []byte("YWxleDpzZWNyZXQ=\n"), 0600))
+
+	l := &Location{Registry: "registry.acme.com", AuthFile: file}
+	th.AssertNoError(l.validate())
+	th.AssertEqual("alex:secret", l.basicCreds())
+
+	l = &Location{Registry: "registry.acme.com", Auth: "YWxleDpzZWNyZXQ="}
+	th.AssertNoError(l.validate())
+	th.AssertEqual("alex:secret", l.basicCreds())
+
+	l = &Location{Registry: "registry.acme.com", Auth: "x", AuthFile: file}
+	th.AssertError(l.validate(), "mutually exclusive")
+
+	l = &Location{Registry: "registry.acme.com",
+		AuthFile: filepath.Join(dir, "missing")}
+	th.AssertError(l.validate(), "cannot read 'auth-file'")
+}
+
+//
+func TestVaultAuth(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Vault-Token") != "t0ken" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors": ["permission denied"]}`))
+				return
+			}
+			switch r.URL.Path {
+			case "/v1/secret/data/registry":
+				w.Write([]byte(`{"data": {"data": ` +
+					`{"username": "alex", "password": "secret"}}}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors": []}`))
+			}
+		}))
+	defer srv.Close()
+
+	os.Setenv("VAULT_TOKEN", "t0ken")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	l := &Location{Registry: "registry.acme.com",
+		Vault: &auth.VaultConfig{Address: srv.URL, Path: "secret/data/registry"}}
+	th.AssertNoError(l.validate())
+	th.AssertNoError(l.RefreshAuth())
+	th.AssertEqual("alex:secret", l.basicCreds())
+
+	l = &Location{Registry: "registry.acme.com",
+		Vault: &auth.VaultConfig{Address: srv.URL, Path: "secret/data/other"}}
+	th.AssertNoError(l.validate())
+	th.AssertError(l.RefreshAuth(), "failed with 404")
+
+	l = &Location{Registry: "registry.acme.com", Auth: "x",
+		Vault: &auth.VaultConfig{Address: srv.URL, Path: "secret/data/registry"}}
+	th.AssertError(l.validate(), "mutually exclusive")
+
+	l = &Location{Registry: "registry.acme.com",
+		Vault: &auth.VaultConfig{Address: srv.URL}}
+	th.AssertError(l.validate(), "no Vault 'path' set")
+}
+
+//
+func TestECRPublicLocation(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	refresh := 10 * time.Hour
+	l := &Location{Registry: "public.ecr.aws", AuthRefresh: &refresh,
+		RoleARN: "arn:aws:iam::123456789012:role/dregsy"}
+	th.AssertNoError(l.validate())
+	th.AssertTrue(l.IsECRPublic())
+	th.AssertTrue(!l.IsECR())
+	th.AssertEqual("arn:aws:iam::123456789012:role/dregsy",
+		l.creds.AWSRoleARN())
+
+	// no refresh interval means anonymous access, so no AWS call is made
+	l = &Location{Registry: "public.ecr.aws"}
+	th.AssertNoError(l.validate())
+	th.AssertNoError(l.RefreshAuth())
+	th.AssertEqual("", l.basicCreds())
+}
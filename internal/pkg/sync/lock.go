@@ -0,0 +1,185 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+)
+
+// Lockfile pins the tags selected by the mappings of each task to the digests
+// they had in the source when the lockfile was written
+type Lockfile struct {
+	Tasks map[string]LockedRefs `json:"tasks"`
+}
+
+// LockedRefs holds the pinned tags of a task, as tag to digest pairs for each
+// source ref
+type LockedRefs map[string]map[string]string
+
+// Lock writes a lockfile for the enabled tasks of conf to w, pinning each tag
+// selected by their mappings to its current digest in the source; only the
+// source registries are contacted
+func Lock(conf *SyncConfig, w io.Writer) error {
+
+	lock := &Lockfile{Tasks: make(map[string]LockedRefs)}
+	failed := false
+
+	for _, t := range conf.Tasks {
+
+		if !t.isEnabled() {
+			continue
+		}
+
+		if err := t.Source.RefreshAuth(); err != nil {
+			log.WithField("task", t.Name).Error(err)
+			failed = true
+			continue
+		}
+
+		refs := make(LockedRefs)
+		lock.Tasks[t.Name] = refs
+
+		for _, m := range t.Mappings {
+
+			if !m.syncsTags() {
+				continue
+			}
+
+			mappingRefs, err := t.mappingRefs(m)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"task": t.Name, "from": m.From}).Error(err)
+				failed = true
+				continue
+			}
+
+			for _, ref := range mappingRefs {
+				src := ref[0]
+				if err := t.lockTags(m, src, refs); err != nil {
+					log.WithFields(log.Fields{
+						"task": t.Name, "ref": src}).Error(err)
+					failed = true
+				}
+			}
+		}
+	}
+
+	if failed {
+		return errors.New("errors while locking tags")
+	}
+
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode lockfile: %v", err)
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// lockTags adds the tags selected by mapping m for srcRef, together with their
+// digests, to refs
+func (t *Task) lockTags(m *Mapping, srcRef string, refs LockedRefs) error {
+
+	selected, err := t.selectTags(m, srcRef, nil)
+	if err != nil {
+		return err
+	}
+
+	tags, ok := refs[srcRef]
+	if !ok {
+		tags = make(map[string]string)
+		refs[srcRef] = tags
+	}
+
+	for _, tag := range selected {
+		digest, err := registry.GetDigest(t.context(),
+			fmt.Sprintf("%s:%s", srcRef, tag), t.Source.creds,
+			t.Source.SkipTLSVerify)
+		if err != nil {
+			return fmt.Errorf("cannot get digest of tag '%s': %v", tag, err)
+		}
+		tags[tag] = digest
+	}
+
+	return nil
+}
+
+//
+func LoadLockfile(path string) (*Lockfile, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read lockfile: %v", err)
+	}
+
+	lock := &Lockfile{}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("invalid lockfile '%s': %v", path, err)
+	}
+
+	return lock, nil
+}
+
+// ApplyLockfile makes the enabled tasks of the config sync strictly the tags
+// and digests pinned in lock, instead of selecting tags from the source; an
+// enabled task not in lock is an error
+func (c *SyncConfig) ApplyLockfile(lock *Lockfile) error {
+
+	for _, t := range c.Tasks {
+		if !t.isEnabled() {
+			continue
+		}
+		refs, ok := lock.Tasks[t.Name]
+		if !ok {
+			return fmt.Errorf("task '%s' is not in lockfile", t.Name)
+		}
+		t.locked = refs
+	}
+
+	return nil
+}
+
+// lockedDigests returns the digests pinned in the lockfile for srcRef, each to
+// be tagged in the target with the target tag of its source tag
+func (t *Task) lockedDigests(m *Mapping, srcRef string) ([]*Digest, error) {
+
+	tags, ok := t.locked[srcRef]
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not in lockfile", srcRef)
+	}
+
+	sorted := make([]string, 0, len(tags))
+	for tag := range tags {
+		sorted = append(sorted, tag)
+	}
+	sort.Strings(sorted)
+
+	ret := make([]*Digest, 0, len(tags))
+	for _, tag := range sorted {
+		ret = append(ret, &Digest{Digest: tags[tag], Tag: m.targetTag(tag)})
+	}
+	return ret, nil
+}
@@ -0,0 +1,109 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/direct"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestLockfile(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := newTagListRegistry(map[string][]string{
+		"acme/app": {"1.0", "latest"},
+	}, gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+	src := reg + "/acme/app"
+	trgt := reg + "/mirror/app"
+
+	push := func(tag string) string {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		r, err := gocrname.NewTag(src + ":" + tag)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(r, img))
+		d, err := img.Digest()
+		th.AssertNoError(err)
+		return d.String()
+	}
+
+	v1 := push("1.0")
+	latest := push("latest")
+
+	conf := &SyncConfig{
+		Relay: direct.RelayID,
+		Tasks: []*Task{{
+			Name:   "mirror",
+			Source: &Location{Registry: reg},
+			Target: &Location{Registry: reg},
+			Mappings: []*Mapping{{
+				From:      "acme/app",
+				To:        "mirror/app",
+				TagPrefix: "m-",
+			}},
+		}},
+	}
+	th.AssertNoError(conf.validate())
+
+	var out bytes.Buffer
+	th.AssertNoError(Lock(conf, &out))
+
+	lock := &Lockfile{}
+	th.AssertNoError(json.Unmarshal(out.Bytes(), lock))
+	th.AssertEqual(1, len(lock.Tasks))
+	th.AssertEqual(v1, lock.Tasks["mirror"][src]["1.0"])
+	th.AssertEqual(latest, lock.Tasks["mirror"][src]["latest"])
+
+	// a tag moved after locking is synced as locked
+	push("latest")
+
+	th.AssertNoError(conf.ApplyLockfile(lock))
+	task := conf.Tasks[0]
+	th.AssertNoError(
+		(&Sync{}).syncLocked(task, task.Mappings[0], src, trgt))
+
+	for tag, digest := range map[string]string{
+		"m-1.0": v1, "m-latest": latest} {
+		d, err := registry.GetDigest(context.Background(),
+			trgt+":"+tag, nil, false)
+		th.AssertNoError(err)
+		th.AssertEqual(digest, d)
+	}
+
+	th.AssertError((&Sync{}).syncLocked(
+		task, task.Mappings[0], reg+"/acme/other", trgt),
+		"'"+reg+"/acme/other' is not in lockfile")
+
+	th.AssertError(conf.ApplyLockfile(&Lockfile{}),
+		"task 'mirror' is not in lockfile")
+}
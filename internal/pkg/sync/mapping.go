@@ -20,7 +20,13 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"text/template"
+	"time"
 
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
 	"github.com/xelalexv/dregsy/internal/pkg/tags"
 	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
@@ -28,16 +34,60 @@ import (
 //
 const RegexpPrefix = "regex:"
 
+//
+const (
+	LimitBySemver  = "semver"
+	LimitByCreated = "created"
+)
+
 //
 type Mapping struct {
-	From string   `yaml:"from"`
-	To   string   `yaml:"to"`
-	Tags []string `yaml:"tags"`
+	From            string        `yaml:"from"`
+	To              string        `yaml:"to"`
+	Tags            []string      `yaml:"tags"`
+	Digests         []*Digest     `yaml:"digests"`
+	IncludeUntagged bool          `yaml:"include-untagged"`
+	ExcludeUntagged bool          `yaml:"exclude-untagged"`
+	RequireReferrer string        `yaml:"require-referrer"`
+	Limit           int           `yaml:"limit"`
+	LimitBy         string        `yaml:"limit-by"`
+	ExcludeTags     []string      `yaml:"exclude-tags"`
+	ExcludeRepos    []string      `yaml:"exclude-repos"`
+	Platforms       []string      `yaml:"platforms"`
+	CopyReferrers   bool          `yaml:"copy-referrers"`
+	TagPrefix       string        `yaml:"tag-prefix"`
+	TagSuffix       string        `yaml:"tag-suffix"`
+	TagRewrite      *TagRewrite   `yaml:"tag-rewrite"`
+	PruneTarget     bool          `yaml:"prune-target"`
+	Retention       *Retention    `yaml:"retention"`
+	Timeout         time.Duration `yaml:"timeout"`
+	Verbose         *bool         `yaml:"verbose"`
 	//
-	fromFilter *regexp.Regexp
-	toFilter   *regexp.Regexp
-	toReplace  string
-	tagSet     *tags.TagSet
+	fromFilter   *regexp.Regexp
+	excludeRepos []*regexp.Regexp
+	excludeTags  *tags.TagSet
+	toFilter     *regexp.Regexp
+	toReplace    string
+	tagSet       *tags.TagSet
+	tagRewrite   *tags.Rewrite
+	toTemplate   *template.Template
+}
+
+// Digest is an image in the source given by its digest, which is synced to the
+// target as is, and optionally tagged there
+type Digest struct {
+	Digest string `yaml:"digest"`
+	Tag    string `yaml:"tag"`
+}
+
+// valid tag as per the OCI distribution spec
+var tagFormat = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// TagRewrite is a regular expression replacement for transforming source tags
+// into target tags; capture groups can be referenced in replace as $1, $2, ...
+type TagRewrite struct {
+	Match   string `yaml:"match"`
+	Replace string `yaml:"replace"`
 }
 
 //
@@ -51,7 +101,41 @@ func (m *Mapping) validate() error {
 		return fmt.Errorf("mapping without 'From' path")
 	}
 
-	if m.isRegexpFrom() {
+	if m.IncludeUntagged && m.ExcludeUntagged {
+		return fmt.Errorf(
+			"'include-untagged' and 'exclude-untagged' are mutually exclusive")
+	}
+
+	if m.Limit < 0 {
+		return fmt.Errorf("'limit' needs to be 0 or a positive integer")
+	}
+
+	if m.Timeout < 0 {
+		return fmt.Errorf("'timeout' must not be negative")
+	}
+
+	if err := m.Retention.validate(); err != nil {
+		return fmt.Errorf("invalid 'retention': %v", err)
+	}
+
+	switch m.LimitBy {
+	case "":
+		m.LimitBy = LimitBySemver
+	case LimitBySemver, LimitByCreated:
+	default:
+		return fmt.Errorf(
+			"invalid value for 'limit-by': '%s', must be '%s' or '%s'",
+			m.LimitBy, LimitBySemver, LimitByCreated)
+	}
+
+	if _, err := registry.ParsePlatforms(m.Platforms); err != nil {
+		return err
+	}
+
+	if isWildcard(m.From) {
+		m.fromFilter = regexp.MustCompile(
+			"^" + wildcardToRegex(strings.TrimPrefix(m.From, "/")) + "$")
+	} else if m.isRegexpFrom() {
 		regex := m.From[len(RegexpPrefix):]
 		var err error
 		if m.fromFilter, err = util.CompileRegex(regex, true); err != nil {
@@ -62,7 +146,27 @@ func (m *Mapping) validate() error {
 		m.From = normalizePath(m.From)
 	}
 
-	if m.isRegexpTo() {
+	if isTemplate(m.To) {
+		var err error
+		if m.toTemplate, err = parseToTemplate(m.To); err != nil {
+			return fmt.Errorf("'to' uses invalid template: %v", err)
+		}
+	} else if isWildcard(m.To) {
+		// the part of a source path matching the fixed prefix of 'from' is
+		// replaced with the fixed prefix of 'to'
+		if !isWildcard(m.From) {
+			return fmt.Errorf("wildcard in 'to' requires wildcard in 'from'")
+		}
+		to := normalizePath(m.To)
+		if ix := strings.Index(to, "*"); ix != len(to)-1 {
+			return fmt.Errorf(
+				"wildcard in 'to' is only supported at the end of the path")
+		}
+		from := normalizePath(m.From)
+		m.toFilter = regexp.MustCompile(
+			"^" + regexp.QuoteMeta(from[:strings.Index(from, "*")]))
+		m.toReplace = strings.TrimSuffix(to, "*")
+	} else if m.isRegexpTo() {
 		parts := strings.SplitN(m.To[len(RegexpPrefix):], ",", 2)
 		regex := parts[0]
 		if len(parts) < 2 {
@@ -79,6 +183,76 @@ func (m *Mapping) validate() error {
 		m.To = normalizePath(m.To)
 	}
 
+	if len(m.ExcludeRepos) > 0 && !m.isRegexpFrom() {
+		return fmt.Errorf("'exclude-repos' requires a regular expression or " +
+			"wildcard in 'from'")
+	}
+
+	m.excludeRepos = nil
+	for _, r := range m.ExcludeRepos {
+		var expr string
+		if isRegexp(r) {
+			expr = r[len(RegexpPrefix):]
+		} else {
+			expr = wildcardToRegex(strings.TrimPrefix(r, "/"))
+		}
+		reg, err := util.CompileRegex(expr, true)
+		if err != nil {
+			return fmt.Errorf(
+				"'exclude-repos' uses invalid expression '%s': %v", r, err)
+		}
+		m.excludeRepos = append(m.excludeRepos, reg)
+	}
+
+	if len(m.ExcludeTags) > 0 {
+		excl, err := tags.NewTagSet(m.ExcludeTags)
+		if err != nil {
+			return fmt.Errorf("'exclude-tags' uses invalid format: %v", err)
+		}
+		m.excludeTags = excl
+	}
+
+	var match, replace string
+	if m.TagRewrite != nil {
+		if m.TagRewrite.Match == "" {
+			return fmt.Errorf("'tag-rewrite' without 'match' expression")
+		}
+		match, replace = m.TagRewrite.Match, m.TagRewrite.Replace
+	}
+	rw, err := tags.NewRewrite(m.TagPrefix, m.TagSuffix, match, replace)
+	if err != nil {
+		return fmt.Errorf("invalid tag rewrite: %v", err)
+	}
+	m.tagRewrite = rw
+
+	// digests given in 'tags' are synced without tagging them in the target
+	tagList := make([]string, 0, len(m.Tags))
+	for _, t := range m.Tags {
+		if strings.HasPrefix(t, "@") {
+			m.Digests = append(m.Digests, &Digest{Digest: t[1:]})
+		} else {
+			tagList = append(tagList, t)
+		}
+	}
+	m.Tags = tagList
+
+	if len(m.Digests) > 0 && m.isRegexpFrom() {
+		return fmt.Errorf("'digests' require a single repository in 'from'")
+	}
+
+	for _, d := range m.Digests {
+		if d == nil {
+			return fmt.Errorf("'digests' contains an empty item")
+		}
+		if _, err := gocrv1.NewHash(d.Digest); err != nil {
+			return fmt.Errorf("invalid digest '%s': %v", d.Digest, err)
+		}
+		if d.Tag != "" && !tagFormat.MatchString(d.Tag) {
+			return fmt.Errorf("invalid tag '%s' for digest '%s'",
+				d.Tag, d.Digest)
+		}
+	}
+
 	if tags, err := tags.NewTagSet(m.Tags); err != nil {
 		return fmt.Errorf("'tags' uses invalid format: %v", err)
 	} else {
@@ -88,13 +262,54 @@ func (m *Mapping) validate() error {
 	return nil
 }
 
+// syncsTags returns true if tags are to be synced for this mapping, which is
+// not the case when it only lists digests
+func (m *Mapping) syncsTags() bool {
+	return len(m.Tags) > 0 || len(m.Digests) == 0
+}
+
+// targetTag returns the tag to use in the target for given source tag
+func (m *Mapping) targetTag(tag string) string {
+	return m.tagRewrite.Apply(tag)
+}
+
+// cosign signature, attestation, and SBOM tags
+var cosignTag = regexp.MustCompile(`^sha256-[0-9a-f]{64}\.(sig|att|sbom)$`)
+
+// staleTags determines which of the target tags don't have a counterpart among
+// the source tags anymore, and which ones are to be kept; cosign tags are
+// always kept, since they may have been created in the target by signing
+func (m *Mapping) staleTags(srcTags, trgtTags []string) (stale, keep []string) {
+
+	present := make(map[string]bool)
+	for _, t := range srcTags {
+		present[t] = true
+		present[m.targetTag(t)] = true
+	}
+	for _, d := range m.Digests {
+		if d.Tag != "" {
+			present[d.Tag] = true
+		}
+	}
+
+	for _, t := range trgtTags {
+		if present[t] || cosignTag.MatchString(t) {
+			keep = append(keep, t)
+		} else {
+			stale = append(stale, t)
+		}
+	}
+
+	return
+}
+
 //
 func (m *Mapping) filterRepos(repos []string) []string {
 
 	if m.isRegexpFrom() {
 		ret := make([]string, 0, len(repos))
 		for _, r := range repos {
-			if m.fromFilter.MatchString(r) {
+			if m.fromFilter.MatchString(r) && !m.isExcludedRepo(r) {
 				ret = append(ret, normalizePath(r))
 			}
 		}
@@ -104,8 +319,46 @@ func (m *Mapping) filterRepos(repos []string) []string {
 	return repos
 }
 
+// isExcludedRepo returns true if repo matches any of the 'exclude-repos'
+// expressions
+func (m *Mapping) isExcludedRepo(repo string) bool {
+	repo = strings.TrimPrefix(repo, "/")
+	for _, r := range m.excludeRepos {
+		if r.MatchString(repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterExcludedTags returns the given tags without those matching
+// 'exclude-tags'
+func (m *Mapping) filterExcludedTags(tagList []string) []string {
+	if m.excludeTags == nil {
+		return tagList
+	}
+	ret := make([]string, 0, len(tagList))
+	for _, t := range tagList {
+		if !m.excludeTags.Contains(t) {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
 //
-func (m *Mapping) mapPath(p string) string {
+func (m *Mapping) mapPath(registry, p string) string {
+	if m.toTemplate != nil {
+		ret, err := renderToTemplate(m.toTemplate, registry, p)
+		if err != nil {
+			// the template was checked during validation, so this should
+			// not happen; fall back to keeping the path
+			log.WithField("path", p).Errorf(
+				"cannot render 'to' template: %v", err)
+			return p
+		}
+		return ret
+	}
 	if m.isRegexpTo() {
 		return m.toFilter.ReplaceAllString(p, m.toReplace)
 	}
@@ -118,14 +371,15 @@ func (m *Mapping) mapPath(p string) string {
 	return p
 }
 
-//
+// isRegexpFrom returns true if 'from' matches several repositories, either via
+// regular expression or wildcard
 func (m *Mapping) isRegexpFrom() bool {
-	return isRegexp(m.From)
+	return isRegexp(m.From) || isWildcard(m.From)
 }
 
 //
 func (m *Mapping) isRegexpTo() bool {
-	return isRegexp(m.To)
+	return !isTemplate(m.To) && (isRegexp(m.To) || isWildcard(m.To))
 }
 
 //
@@ -133,6 +387,29 @@ func isRegexp(expr string) bool {
 	return strings.HasPrefix(expr, RegexpPrefix)
 }
 
+//
+func isWildcard(expr string) bool {
+	return !isRegexp(expr) && strings.Contains(expr, "*")
+}
+
+// wildcardToRegex converts a path with wildcards into a regular expression;
+// '*' matches within a single path element, '**' across elements
+func wildcardToRegex(p string) string {
+	var b strings.Builder
+	for ix, part := range strings.Split(p, "**") {
+		if ix > 0 {
+			b.WriteString(".*")
+		}
+		for jx, sub := range strings.Split(part, "*") {
+			if jx > 0 {
+				b.WriteString("[^/]*")
+			}
+			b.WriteString(regexp.QuoteMeta(sub))
+		}
+	}
+	return b.String()
+}
+
 //
 func normalizePath(p string) string {
 	if strings.HasPrefix(p, "/") {
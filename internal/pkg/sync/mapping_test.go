@@ -0,0 +1,224 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestWildcardMapping(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	repos := []string{"library/busybox", "library/nginx", "acme/app",
+		"acme/tools/lint", "library"}
+
+	tryMapping := func(from, to string, want ...string) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		m := &Mapping{From: from, To: to}
+		th.AssertNoError(m.validate())
+		th.AssertTrue(m.isRegexpFrom())
+		var got []string
+		for _, r := range m.filterRepos(repos) {
+			got = append(got, r+" -> "+m.mapPath("registry.example.com", r))
+		}
+		th.AssertEquivalentSlices(want, got)
+	}
+
+	tryMapping("library/*", "",
+		"/library/busybox -> /library/busybox",
+		"/library/nginx -> /library/nginx")
+
+	tryMapping("/library/*", "mirror",
+		"/library/busybox -> /mirror/library/busybox",
+		"/library/nginx -> /mirror/library/nginx")
+
+	tryMapping("acme/*", "mirror/*",
+		"/acme/app -> /mirror/app")
+
+	tryMapping("acme/**", "mirror/acme/*",
+		"/acme/app -> /mirror/acme/app",
+		"/acme/tools/lint -> /mirror/acme/tools/lint")
+
+	tryMapping("*/busy*", "*",
+		"/library/busybox -> /library/busybox")
+
+	th.AssertError((&Mapping{From: "acme/app", To: "mirror/*"}).validate(),
+		"wildcard in 'to' requires wildcard in 'from'")
+	th.AssertError((&Mapping{From: "acme/*", To: "mirror/*/app"}).validate(),
+		"only supported at the end")
+}
+
+//
+func TestExcludes(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{
+		From: "acme/*",
+		ExcludeRepos: []string{
+			"acme/legacy", "regex:acme/.*-test", "acme/tmp-*"},
+		ExcludeTags: []string{
+			"nightly", "regex:.*-rc[0-9]*", "regex:sha-.*", "semver:<1.0.0"},
+	}
+	th.AssertNoError(m.validate())
+
+	th.AssertEquivalentSlices([]string{"/acme/app", "/acme/db"},
+		m.filterRepos([]string{"acme/app", "acme/db", "acme/legacy",
+			"acme/app-test", "acme/tmp-1", "other/app"}))
+
+	th.AssertEquivalentSlices([]string{"1.0.0", "1.1.0", "latest"},
+		m.filterExcludedTags([]string{"0.9.0", "1.0.0", "1.1.0", "1.2.0-rc1",
+			"nightly", "sha-1a2b3c", "latest"}))
+
+	th.AssertError(
+		(&Mapping{From: "acme/app", ExcludeRepos: []string{"x"}}).validate(),
+		"'exclude-repos' requires a regular expression or wildcard")
+}
+
+//
+func TestTagRewrite(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryRewrite := func(m *Mapping, tag, want string) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		m.From = "acme/app"
+		th.AssertNoError(m.validate())
+		th.AssertEqual(want, m.targetTag(tag))
+	}
+
+	tryRewrite(&Mapping{}, "1.0", "1.0")
+	tryRewrite(&Mapping{TagPrefix: "mirror-"}, "1.0", "mirror-1.0")
+	tryRewrite(&Mapping{TagSuffix: "-stable"}, "1.0", "1.0-stable")
+	tryRewrite(&Mapping{
+		TagPrefix:  "mirror-",
+		TagRewrite: &TagRewrite{Match: "^v(.*)", Replace: "$1"},
+	}, "v1.0", "mirror-1.0")
+	tryRewrite(&Mapping{
+		TagRewrite: &TagRewrite{Match: "^v(.*)", Replace: "$1"},
+	}, "latest", "latest")
+
+	th.AssertError((&Mapping{From: "acme/app", TagPrefix: "-x"}).validate(),
+		"tag prefix must not start with '.' or '-'")
+	th.AssertError((&Mapping{From: "acme/app", TagSuffix: "/x"}).validate(),
+		"tag prefix & suffix may only contain")
+	th.AssertError((&Mapping{From: "acme/app",
+		TagRewrite: &TagRewrite{Match: "(v"}}).validate(),
+		"invalid regular expression '(v'")
+	th.AssertError((&Mapping{From: "acme/app",
+		TagRewrite: &TagRewrite{Replace: "$1"}}).validate(),
+		"'tag-rewrite' without 'match' expression")
+}
+
+//
+func TestToTemplate(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryTemplate := func(from, to, reg, path, want string) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		m := &Mapping{From: from, To: to}
+		th.AssertNoError(m.validate())
+		th.AssertEqual(want, m.mapPath(reg, path))
+	}
+
+	tryTemplate("library/*", "mirrors/{{.SourceRegistry}}/{{.Path}}",
+		"docker.io", "library/busybox", "/mirrors/docker.io/library/busybox")
+	tryTemplate("acme/app", "/{{.Dir}}-mirror/{{.Name}}",
+		"quay.io", "/acme/app", "/acme-mirror/app")
+	tryTemplate("busybox", "mirror/{{.Dir}}/{{.Name}}",
+		"docker.io", "/busybox", "/mirror/busybox")
+	tryTemplate("regex:acme/.*",
+		`{{replace .SourceRegistry ":" "-" | lower}}/{{trimPrefix .Path "acme/"}}`,
+		"Registry.local:5000", "acme/team/app", "/registry.local-5000/team/app")
+
+	th.AssertError((&Mapping{From: "acme/app", To: "{{.Nope}}"}).validate(),
+		"'to' uses invalid template")
+	th.AssertError((&Mapping{From: "acme/app", To: "{{.Path"}).validate(),
+		"'to' uses invalid template")
+	th.AssertError((&Mapping{From: "acme/app", To: "{{/* */}}"}).validate(),
+		"'to' template renders to empty path")
+}
+
+//
+func TestStaleTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "acme/app", TagPrefix: "mirror-"}
+	th.AssertNoError(m.validate())
+
+	sig := "sha256-" + strings.Repeat("a", 64) + ".sig"
+
+	stale, keep := m.staleTags(
+		[]string{"1.0", "1.1", sig},
+		[]string{"mirror-1.0", "mirror-1.1", "mirror-0.9", "1.1", "local",
+			sig})
+
+	th.AssertEquivalentSlices([]string{"mirror-0.9", "local"}, stale)
+	th.AssertEquivalentSlices(
+		[]string{"mirror-1.0", "mirror-1.1", "1.1", sig}, keep)
+}
+
+//
+func TestDigests(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	d1 := "sha256:" + strings.Repeat("a", 64)
+	d2 := "sha256:" + strings.Repeat("b", 64)
+
+	m := &Mapping{
+		From:        "acme/app",
+		Tags:        []string{"@" + d1},
+		Digests:     []*Digest{{Digest: d2, Tag: "pinned"}},
+		PruneTarget: true,
+	}
+	th.AssertNoError(m.validate())
+	th.AssertEqual(0, len(m.Tags))
+	th.AssertEqual(2, len(m.Digests))
+	th.AssertEqual(d1, m.Digests[1].Digest)
+	th.AssertEqual("", m.Digests[1].Tag)
+	th.AssertTrue(!m.syncsTags())
+
+	stale, _ := m.staleTags([]string{"1.0"}, []string{"1.0", "pinned", "old"})
+	th.AssertEquivalentSlices([]string{"old"}, stale)
+
+	m = &Mapping{From: "acme/app", Tags: []string{"1.0", "@" + d1}}
+	th.AssertNoError(m.validate())
+	th.AssertEqualSlices([]string{"1.0"}, m.Tags)
+	th.AssertTrue(m.syncsTags())
+
+	m = &Mapping{From: "acme/app", Digests: []*Digest{{Digest: "sha256:abc"}}}
+	th.AssertError(m.validate(), "invalid digest 'sha256:abc'")
+
+	m = &Mapping{From: "acme/app",
+		Digests: []*Digest{{Digest: d1, Tag: "-invalid"}}}
+	th.AssertError(m.validate(), "invalid tag '-invalid'")
+
+	m = &Mapping{From: "acme/*", Digests: []*Digest{{Digest: d1}}}
+	th.AssertError(m.validate(),
+		"'digests' require a single repository in 'from'")
+}
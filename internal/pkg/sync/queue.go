@@ -0,0 +1,176 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	gosync "sync"
+)
+
+// runQueue hands out worker slots to task runs waiting for one; runs of tasks
+// with higher priority go first, and a run only goes once none of the tasks
+// its task depends on are running or waiting to run
+type runQueue struct {
+	tasks   map[string]*Task
+	waiting []*waitingRun
+	seq     uint64
+	mutex   gosync.Mutex
+	changed *gosync.Cond
+}
+
+//
+type waitingRun struct {
+	task *Task
+	seq  uint64
+}
+
+//
+func newRunQueue() *runQueue {
+	q := &runQueue{tasks: make(map[string]*Task)}
+	q.changed = gosync.NewCond(&q.mutex)
+	return q
+}
+
+// setTasks sets the tasks by which dependencies are resolved
+func (q *runQueue) setTasks(tasks []*Task) {
+
+	if q == nil {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.tasks = make(map[string]*Task, len(tasks))
+	for _, t := range tasks {
+		q.tasks[t.Name] = t
+	}
+	q.changed.Broadcast()
+}
+
+// acquire blocks until it's the turn of a run of t, and it got one of the
+// given workers; workers need to be handed back followed by a call to notify;
+// without a queue, it just waits for a worker
+func (q *runQueue) acquire(t *Task, workers chan bool) {
+
+	if q == nil {
+		workers <- true
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	w := &waitingRun{task: t, seq: q.seq}
+	q.seq++
+	q.waiting = append(q.waiting, w)
+
+	for {
+		if q.next() == w {
+			select {
+			case workers <- true:
+				q.remove(w)
+				q.changed.Broadcast()
+				return
+			default:
+			}
+		}
+		q.changed.Wait()
+	}
+}
+
+// notify wakes up waiting runs, to be called when a task run has finished and
+// handed back its worker
+func (q *runQueue) notify() {
+
+	if q == nil {
+		return
+	}
+
+	q.mutex.Lock()
+	q.changed.Broadcast()
+	q.mutex.Unlock()
+}
+
+// next returns the waiting run whose turn it is, if any; needs to be called
+// with mutex held
+func (q *runQueue) next() *waitingRun {
+	var ret *waitingRun
+	for _, w := range q.waiting {
+		if q.blocked(w.task) {
+			continue
+		}
+		if ret == nil || w.task.Priority > ret.task.Priority ||
+			(w.task.Priority == ret.task.Priority && w.seq < ret.seq) {
+			ret = w
+		}
+	}
+	return ret
+}
+
+// blocked returns true if any of the tasks t depends on is running or waiting
+// to run; needs to be called with mutex held
+func (q *runQueue) blocked(t *Task) bool {
+	for _, d := range t.DependsOn {
+		if q.tasks[d].isRunning() {
+			return true
+		}
+	}
+	return false
+}
+
+// remove removes w from the waiting runs; needs to be called with mutex held
+func (q *runQueue) remove(w *waitingRun) {
+	for ix, other := range q.waiting {
+		if other == w {
+			q.waiting = append(q.waiting[:ix], q.waiting[ix+1:]...)
+			return
+		}
+	}
+}
+
+// inDependencyOrder returns the given tasks ordered such that each task comes
+// after the tasks it depends on, and in their original order otherwise
+func inDependencyOrder(tasks []*Task) []*Task {
+
+	byName := make(map[string]*Task, len(tasks))
+	for _, t := range tasks {
+		byName[t.Name] = t
+	}
+
+	ret := make([]*Task, 0, len(tasks))
+	added := make(map[*Task]bool, len(tasks))
+
+	var add func(t *Task)
+	add = func(t *Task) {
+		if added[t] {
+			return
+		}
+		added[t] = true // dependencies are free of cycles after validation
+		for _, d := range t.DependsOn {
+			if dep, ok := byName[d]; ok {
+				add(dep)
+			}
+		}
+		ret = append(ret, t)
+	}
+
+	for _, t := range tasks {
+		add(t)
+	}
+
+	return ret
+}
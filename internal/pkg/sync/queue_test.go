@@ -0,0 +1,105 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestRunQueue(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	low := &Task{Name: "low", Priority: -1}
+	normal := &Task{Name: "normal"}
+	high := &Task{Name: "high", Priority: 10}
+	base := &Task{Name: "base"}
+	app := &Task{Name: "app", Priority: 20, DependsOn: []string{"base"}}
+
+	q := newRunQueue()
+	q.setTasks([]*Task{low, normal, high, base, app})
+	workers := make(chan bool, 1)
+
+	// occupy the only worker, so that all runs need to queue up
+	workers <- true
+
+	var order []string
+	var mutex gosync.Mutex
+	var wg gosync.WaitGroup
+
+	run := func(task *Task) {
+		th.AssertTrue(task.tryStart())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.acquire(task, workers)
+			mutex.Lock()
+			order = append(order, task.Name)
+			mutex.Unlock()
+			<-workers
+			task.finish()
+			q.notify()
+		}()
+		time.Sleep(20 * time.Millisecond) // let run queue up
+	}
+
+	for _, task := range []*Task{low, normal, base, app, high} {
+		run(task)
+	}
+
+	<-workers
+	q.notify()
+	wg.Wait()
+
+	th.AssertEqualSlices(
+		[]string{"high", "normal", "base", "app", "low"}, order)
+}
+
+//
+func TestDependencyOrder(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tasks := []*Task{
+		{Name: "apps", DependsOn: []string{"base", "tools"}},
+		{Name: "tools", DependsOn: []string{"base"}},
+		{Name: "misc"},
+		{Name: "base"},
+	}
+
+	var order []string
+	for _, t := range inDependencyOrder(tasks) {
+		order = append(order, t.Name)
+	}
+	th.AssertEqualSlices([]string{"base", "tools", "apps", "misc"}, order)
+
+	conf := &SyncConfig{Tasks: tasks}
+	th.AssertNoError(conf.checkDependencies())
+
+	tasks[2].DependsOn = []string{"nope"}
+	th.AssertError(conf.checkDependencies(),
+		"task 'misc' depends on unknown task 'nope'")
+
+	tasks[2].DependsOn = []string{"misc"}
+	th.AssertError(conf.checkDependencies(),
+		"tasks have circular dependency: misc -> misc")
+}
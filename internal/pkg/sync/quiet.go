@@ -0,0 +1,47 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// SummaryLogField marks log entries that summarize a task run; these are still
+// logged in quiet mode
+const SummaryLogField = "summary"
+
+// quietFormatter drops all info, debug, and trace entries that aren't summaries
+type quietFormatter struct {
+	log.Formatter
+}
+
+//
+func (f *quietFormatter) Format(e *log.Entry) ([]byte, error) {
+	if e.Level > log.WarnLevel && e.Data[SummaryLogField] != true {
+		return nil, nil
+	}
+	return f.Formatter.Format(e)
+}
+
+// SetQuietLogging makes the standard logger only log summaries, warnings, and
+// errors; this needs to be called after setting the log format
+func SetQuietLogging() {
+	l := log.StandardLogger()
+	if _, ok := l.Formatter.(*quietFormatter); !ok {
+		l.SetFormatter(&quietFormatter{Formatter: l.Formatter})
+	}
+}
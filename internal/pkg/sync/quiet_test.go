@@ -0,0 +1,63 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestQuietFormatter(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var buf bytes.Buffer
+	l := log.New()
+	l.SetOutput(&buf)
+	l.SetFormatter(&quietFormatter{
+		Formatter: &log.TextFormatter{DisableTimestamp: true}})
+
+	l.Info("syncing tag")
+	l.Debug("details")
+	th.AssertEqual(0, buf.Len())
+
+	l.WithField(SummaryLogField, true).Info("task run done")
+	l.Warn("careful")
+	l.Error("failed")
+	th.AssertEqual("level=info msg=\"task run done\" summary=true\n"+
+		"level=warning msg=careful\nlevel=error msg=failed\n", buf.String())
+}
+
+//
+func TestMappingVerbose(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	off := false
+	task := &Task{Verbose: true}
+	th.AssertTrue(task.verbose(&Mapping{}))
+	th.AssertTrue(!task.verbose(&Mapping{Verbose: &off}))
+
+	on := true
+	task.Verbose = false
+	th.AssertTrue(task.verbose(&Mapping{Verbose: &on}))
+}
@@ -0,0 +1,119 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/xelalexv/dregsy/internal/pkg/relays/containerd"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/direct"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/docker"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
+)
+
+// RelayConfig holds the settings of a named relay, which tasks can select via
+// their 'relay' setting; only the settings section matching the type is used
+type RelayConfig struct {
+	Type       string                    `yaml:"type"`
+	Docker     *docker.RelayConfig       `yaml:"docker"`
+	Podman     *docker.PodmanRelayConfig `yaml:"podman"`
+	Containerd *containerd.RelayConfig   `yaml:"containerd"`
+	Skopeo     *skopeo.RelayConfig       `yaml:"skopeo"`
+	Direct     *direct.RelayConfig       `yaml:"direct"`
+}
+
+//
+func (r *RelayConfig) validate(name string) error {
+
+	if name == "" {
+		return fmt.Errorf("relays need a name")
+	}
+	if r == nil {
+		return fmt.Errorf("relay '%s' has no settings", name)
+	}
+
+	var err error
+
+	switch r.Type {
+	case docker.RelayID:
+		err = r.Docker.Validate()
+	case docker.PodmanRelayID:
+		err = r.Podman.Validate()
+	case containerd.RelayID:
+		err = r.Containerd.Validate()
+	case skopeo.RelayID:
+	case direct.RelayID:
+		err = r.Direct.Validate()
+	default:
+		return fmt.Errorf("relay '%s' has invalid type '%s', must be one of "+
+			"'%s', '%s', '%s', '%s', or '%s'", name, r.Type, docker.RelayID,
+			docker.PodmanRelayID, containerd.RelayID, skopeo.RelayID,
+			direct.RelayID)
+	}
+
+	if err != nil {
+		return fmt.Errorf("relay '%s' invalid: %v", name, err)
+	}
+	return nil
+}
+
+// unusedSections returns the names of settings sections that don't match the
+// relay's type
+func (r *RelayConfig) unusedSections() []string {
+	var ret []string
+	for id, set := range map[string]bool{
+		docker.RelayID:       r.Docker != nil,
+		docker.PodmanRelayID: r.Podman != nil,
+		containerd.RelayID:   r.Containerd != nil,
+		skopeo.RelayID:       r.Skopeo != nil,
+		direct.RelayID:       r.Direct != nil,
+	} {
+		if set && id != r.Type {
+			ret = append(ret, id)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// relayConfig returns the settings of the relay used by task t, which is either
+// one of the named relays, or the top-level relay if t is nil or doesn't select
+// a relay; nil is returned if the selected relay is not defined
+func (c *SyncConfig) relayConfig(t *Task) *RelayConfig {
+	if t != nil && t.Relay != "" {
+		return c.Relays[t.Relay]
+	}
+	return &RelayConfig{
+		Type:       c.Relay,
+		Docker:     c.Docker,
+		Podman:     c.Podman,
+		Containerd: c.Containerd,
+		Skopeo:     c.Skopeo,
+		Direct:     c.Direct,
+	}
+}
+
+// isLocalRelay tells whether the relay with given ID syncs via a local image
+// store, i.e. of Docker, Podman, or containerd
+func isLocalRelay(id string) bool {
+	switch id {
+	case docker.RelayID, docker.PodmanRelayID, containerd.RelayID:
+		return true
+	}
+	return false
+}
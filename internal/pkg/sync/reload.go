@@ -0,0 +1,192 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	gosync "sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// EnableReload makes the sync reload its config with the given loader upon
+// SIGHUP, or when Reload is called; only task changes are applied on reload
+func (s *Sync) EnableReload(load func() (*SyncConfig, error)) {
+	s.load = load
+}
+
+// Reload makes a running sync reload its config, and returns once the changes
+// have been applied; if the sync has not started waiting for task runs yet,
+// the reload waits for that; an error is returned when the sync has ended, or
+// ctx is done before the changes were applied
+func (s *Sync) Reload(ctx context.Context) error {
+
+	done := make(chan error, 1)
+	select {
+	case s.reloads <- done:
+	case <-s.halted:
+		return errors.New("sync is not running")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reloadTasks loads the config anew and applies the changes made to its tasks
+// to the currently active tasks, returning the new set of active tasks; new
+// tasks are started, removed tasks are stopped, and changed tasks are replaced
+// by their new definition, keeping their state; a changed task that is running
+// finishes its current run with its old definition, and is not started again
+// before that
+func (s *Sync) reloadTasks(conf *SyncConfig, current []*Task, c chan *Task,
+	trigger *triggerServer, running *gosync.WaitGroup) ([]*Task, error) {
+
+	if s.load == nil {
+		return current, errors.New("config reload is not enabled")
+	}
+
+	next, err := s.load()
+	if err != nil {
+		return current, err
+	}
+
+	if !sameSettings(conf, next) {
+		log.Warn("settings other than tasks have changed, these changes " +
+			"only take effect after a restart")
+	}
+
+	active := make(map[string]*Task)
+	for _, t := range current {
+		active[t.Name] = t
+	}
+
+	var tasks []*Task
+
+	for _, t := range next.Tasks {
+
+		prev, found := active[t.Name]
+		delete(active, t.Name)
+
+		if !t.isEnabled() {
+			log.WithFields(log.Fields{"task": t.Name, "reason": t.disabled}).
+				Info("task disabled, skipping")
+			if found {
+				prev.stopTicking()
+			}
+			continue
+		}
+
+		t.snapshot()
+
+		if found && prev.sameTask(t) {
+			tasks = append(tasks, prev)
+			continue
+		}
+
+		if found {
+			log.WithField("task", t.Name).Info("task changed, restarting")
+			prev.stopTicking()
+		} else {
+			log.WithField("task", t.Name).Info("new task, starting")
+		}
+
+		tasks = append(tasks, t)
+
+		// state needs to be in place before ticking starts, for resuming
+		// from the last run on record
+		if found {
+			t.adopt(prev)
+		} else {
+			t.openState()
+		}
+
+		if t.isPeriodic() {
+			t.startTicking(c)
+		} else if !found {
+			s.runTask(t, running, false)
+		}
+	}
+
+	for _, t := range active {
+		log.WithField("task", t.Name).Info("task removed, stopping")
+		t.stopTicking()
+	}
+
+	if trigger != nil {
+		trigger.setTasks(tasks)
+	}
+
+	return tasks, nil
+}
+
+// adopt takes over state file, time and outcome of last run, running state,
+// and pause state from the given task, which is replaced by this task
+func (t *Task) adopt(prev *Task) {
+
+	t.paused = atomic.LoadInt32(&prev.paused)
+	t.result = prev.lastResult()
+
+	if t.StateFile == prev.StateFile {
+		t.state = prev.state
+	} else {
+		t.openState()
+	}
+
+	if prev.isRunning() {
+		t.previous = prev
+	} else {
+		t.lastTick = prev.lastTick
+		t.lastFailed = prev.lastFailed
+	}
+}
+
+// snapshot records the task's definition, for detecting changes on reload; it
+// needs to be taken before the task starts running
+func (t *Task) snapshot() {
+	t.definition, _ = yaml.Marshal(t)
+}
+
+// sameTask returns true if the given task has the same definition as this
+// task had when its snapshot was taken
+func (t *Task) sameTask(other *Task) bool {
+	def, err := yaml.Marshal(other)
+	return err == nil && t.definition != nil && bytes.Equal(t.definition, def)
+}
+
+// sameSettings returns true if both configs have the same settings, not taking
+// into account tasks and includes
+func sameSettings(a, b *SyncConfig) bool {
+	ca, cb := *a, *b
+	ca.Tasks, cb.Tasks = nil, nil
+	ca.Include, cb.Include = nil, nil
+	ya, err := yaml.Marshal(&ca)
+	if err != nil {
+		return false
+	}
+	yb, err := yaml.Marshal(&cb)
+	return err == nil && bytes.Equal(ya, yb)
+}
@@ -0,0 +1,131 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestReload(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	task := func(name, from string) *Task {
+		m := &Mapping{From: from}
+		th.AssertNoError(m.validate())
+		return &Task{
+			Name:     name,
+			Interval: 60,
+			Source:   &Location{Registry: "source.example.com"},
+			Target:   &Location{Registry: "target.example.com"},
+			Mappings: []*Mapping{m},
+		}
+	}
+
+	relay := &mockRelay{}
+	s := &Sync{
+		relay:    relay,
+		ping:     PingOff,
+		workers:  make(chan bool, 1),
+		shutdown: make(chan bool),
+		ticks:    make(chan bool, 1),
+		reloads:  make(chan chan error),
+		halted:   make(chan bool),
+	}
+
+	waitForSyncs := func(n int) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		for start := time.Now(); time.Since(start) < 5*time.Second; {
+			relay.mutex.Lock()
+			synced := len(relay.synced)
+			relay.mutex.Unlock()
+			if synced >= n {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		relay.mutex.Lock()
+		defer relay.mutex.Unlock()
+		th.AssertEqual(n, len(relay.synced))
+	}
+
+	conf := &SyncConfig{Ping: PingOff, Tasks: []*Task{
+		task("keep", "/keep"), task("change", "/change"),
+		task("remove", "/remove")}}
+
+	done := make(chan error)
+	go func() { done <- s.SyncFromConfig(conf) }()
+	waitForSyncs(3)
+
+	// failing reload keeps current tasks
+	s.EnableReload(func() (*SyncConfig, error) {
+		return nil, errors.New("broken config")
+	})
+	th.AssertError(s.Reload(context.Background()), "broken config")
+
+	// unchanged task keeps running as is, changed task is not synced again
+	// before its interval has passed, new task is started right away
+	s.EnableReload(func() (*SyncConfig, error) {
+		return &SyncConfig{Ping: PingOff, Tasks: []*Task{
+			task("keep", "/keep"), task("change", "/changed"),
+			task("new", "/new")}}, nil
+	})
+	th.AssertNoError(s.Reload(context.Background()))
+	waitForSyncs(4)
+
+	s.Shutdown()
+	th.AssertNoError(<-done)
+
+	// reload after sync has ended returns right away
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	th.AssertError(s.Reload(ctx), "sync is not running")
+
+	th.AssertEquivalentSlices(
+		[]string{"source.example.com/keep", "source.example.com/change",
+			"source.example.com/remove", "source.example.com/new"},
+		relay.synced)
+}
+
+//
+func TestSameTask(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	a := &Task{Name: "a", Interval: 60, Mappings: []*Mapping{{From: "/x"}}}
+	b := &Task{Name: "a", Interval: 60, Mappings: []*Mapping{{From: "/x"}}}
+	th.AssertFalse(a.sameTask(b))
+
+	a.snapshot()
+	th.AssertTrue(a.sameTask(b))
+
+	b.Interval = 30
+	th.AssertFalse(a.sameTask(b))
+
+	th.AssertTrue(sameSettings(
+		&SyncConfig{Relay: "skopeo", Tasks: []*Task{a}},
+		&SyncConfig{Relay: "skopeo", Tasks: []*Task{b}}))
+	th.AssertFalse(sameSettings(
+		&SyncConfig{Relay: "skopeo"}, &SyncConfig{Relay: "docker"}))
+}
@@ -0,0 +1,136 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maximum length of a repository name in ECR
+const maxECRRepoLength = 256
+
+// maximum length of an image name including registry, as per the reference
+// grammar of the Docker distribution
+const maxImageNameLength = 255
+
+// path component of a repository name as per the OCI distribution spec
+var repoComponent = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*$`)
+
+//
+var invalidRepoChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+var repoSeparators = regexp.MustCompile(`[._-]+`)
+var validRepoSeparator = regexp.MustCompile(`^(\.|_|__|-+)$`)
+
+// maxRepoLength returns the maximum length of a repository name in this
+// location, without leading slash
+func (l *Location) maxRepoLength() int {
+	if l.IsECR() {
+		return maxECRRepoLength
+	}
+	return maxImageNameLength - len(l.Registry) -
+		len(l.Artifactory.prefix()) - 1
+}
+
+// checkRepoName checks whether p is a valid repository name for this location
+func (l *Location) checkRepoName(p string) error {
+
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return errors.New("name is empty")
+	}
+
+	for _, c := range strings.Split(p, "/") {
+		if repoComponent.MatchString(c) {
+			continue
+		}
+		if strings.ToLower(c) != c {
+			return fmt.Errorf(
+				"path component '%s' contains upper case letters", c)
+		}
+		return fmt.Errorf("path component '%s' is invalid, only lower case "+
+			"letters and digits, separated by '.', '_', '__', or '-', are "+
+			"allowed", c)
+	}
+
+	if max := l.maxRepoLength(); len(p) > max {
+		return fmt.Errorf("name is %d characters long, while the registry "+
+			"allows at most %d", len(p), max)
+	}
+
+	return nil
+}
+
+// normalizeRepoName turns p into a valid repository name for this location,
+// as far as possible: letters are lower cased, invalid characters and
+// separators are replaced with '-', empty path components are dropped, and
+// the name is truncated to the maximum length
+func (l *Location) normalizeRepoName(p string) string {
+
+	var components []string
+
+	for _, c := range strings.Split(strings.ToLower(p), "/") {
+		c = invalidRepoChars.ReplaceAllString(c, "-")
+		c = repoSeparators.ReplaceAllStringFunc(c, func(s string) string {
+			if validRepoSeparator.MatchString(s) {
+				return s
+			}
+			return "-"
+		})
+		if c = strings.Trim(c, "._-"); c != "" {
+			components = append(components, c)
+		}
+	}
+
+	ret := strings.Join(components, "/")
+	if max := l.maxRepoLength(); len(ret) > max && max > 0 {
+		ret = strings.TrimRight(ret[:max], "._-/")
+	}
+
+	return ret
+}
+
+// targetRef returns the target ref for the source repository path p, mapped
+// as per mapping m; when the task's target has 'normalize-repos' set, the
+// repository name is normalized, otherwise an invalid name is an error
+func (t *Task) targetRef(m *Mapping, p string) (string, error) {
+
+	trgt := m.mapPath(t.Source.Registry, p)
+	if t.Target.IsLayout() {
+		return t.Target.ref(trgt), nil
+	}
+
+	if t.Target.NormalizeRepos {
+		normalized := normalizePath(t.Target.normalizeRepoName(trgt))
+		if normalized != trgt {
+			log.WithFields(log.Fields{"task": t.Name, "repo": trgt}).Debugf(
+				"normalized target repository name to '%s'", normalized)
+		}
+		trgt = normalized
+	}
+
+	if err := t.Target.checkRepoName(trgt); err != nil {
+		return "", fmt.Errorf("invalid target repository '%s' for '%s': %v",
+			strings.TrimPrefix(trgt, "/"), strings.TrimPrefix(p, "/"), err)
+	}
+
+	return t.Target.ref(trgt), nil
+}
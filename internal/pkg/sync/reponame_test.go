@@ -0,0 +1,119 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestCheckRepoName(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	l := &Location{Registry: "registry.example.com"}
+	ecr := &Location{Registry: "123456789012.dkr.ecr.eu-west-1.amazonaws.com"}
+
+	th.AssertEqual(255-len("registry.example.com")-1, l.maxRepoLength())
+	th.AssertEqual(256, ecr.maxRepoLength())
+
+	for _, p := range []string{"/busybox", "mirror/library/busybox",
+		"a/b_c/d__e/f.g/h---i", strings.Repeat("a", 234)} {
+		th.AssertNoError(l.checkRepoName(p))
+	}
+	th.AssertNoError(ecr.checkRepoName(strings.Repeat("a", 256)))
+
+	tryName := func(l *Location, p, expected string) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		th.AssertError(l.checkRepoName(p), expected)
+	}
+
+	tryName(l, "/", "name is empty")
+	tryName(l, "mirror/BusyBox",
+		"path component 'BusyBox' contains upper case letters")
+	tryName(l, "mirror/nginx:latest", "path component 'nginx:latest' is "+
+		"invalid, only lower case letters and digits")
+	tryName(l, "mirror//nginx", "path component '' is invalid")
+	tryName(l, "mirror/_nginx", "path component '_nginx' is invalid")
+	tryName(l, "mirror/nginx._x", "path component 'nginx._x' is invalid")
+	tryName(l, strings.Repeat("a", 235),
+		"name is 235 characters long, while the registry allows at most 234")
+	tryName(ecr, strings.Repeat("a", 257),
+		"name is 257 characters long, while the registry allows at most 256")
+}
+
+//
+func TestNormalizeRepoName(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	l := &Location{Registry: "registry.example.com"}
+
+	tryNormalize := func(p, expected string) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		got := l.normalizeRepoName(p)
+		th.AssertEqual(expected, got)
+		th.AssertNoError(l.checkRepoName(got))
+	}
+
+	tryNormalize("/mirror/busybox", "mirror/busybox")
+	tryNormalize("/Mirror/BusyBox", "mirror/busybox")
+	tryNormalize("mirror/nginx:latest", "mirror/nginx-latest")
+	tryNormalize("mirror//my app@2", "mirror/my-app-2")
+	tryNormalize("mirror/_tools_/a._b/c__d/e---f",
+		"mirror/tools/a-b/c__d/e---f")
+	tryNormalize(strings.Repeat("ab/", 100), strings.TrimSuffix(
+		strings.Repeat("ab/", 78), "/"))
+
+	th.AssertEqual("", l.normalizeRepoName("/_/"))
+}
+
+//
+func TestTargetRef(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "Acme/App", To: "Mirror/{{ .Name }}"}
+	th.AssertNoError(m.validate())
+
+	task := &Task{
+		Name:     "test",
+		Source:   &Location{Registry: "source.example.com"},
+		Target:   &Location{Registry: "target.example.com"},
+		Mappings: []*Mapping{m},
+	}
+
+	_, err := task.targetRef(m, m.From)
+	th.AssertError(err, "invalid target repository 'Mirror/App' for "+
+		"'Acme/App': path component 'Mirror' contains upper case letters")
+
+	task.Target.NormalizeRepos = true
+	ref, err := task.targetRef(m, m.From)
+	th.AssertNoError(err)
+	th.AssertEqual("target.example.com/mirror/app", ref)
+
+	// layouts have no such restrictions
+	task.Target = &Location{Registry: "oci:/tmp/export"}
+	ref, err = task.targetRef(m, m.From)
+	th.AssertNoError(err)
+	th.AssertEqual("oci:/tmp/export/Mirror/App", ref)
+}
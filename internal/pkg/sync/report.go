@@ -0,0 +1,426 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	gosync "sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+)
+
+// report formats
+const (
+	ReportFormatJSON  = "json"
+	ReportFormatJUnit = "junit"
+)
+
+// actions taken for a tag
+const (
+	actionCopied  = "copied"
+	actionSkipped = "skipped"
+	actionFailed  = "failed"
+)
+
+// outcomes of a vulnerability scan: a tag that did not pass the scan is
+// blocked, unless the scan action is 'warn'
+const (
+	scanPassed  = "passed"
+	scanWarned  = "warned"
+	scanBlocked = "blocked"
+)
+
+// ReportConfig sets where and in which format to write a report after each
+// run of a task
+type ReportConfig struct {
+	Path   string `yaml:"path"`
+	Format string `yaml:"format"`
+}
+
+//
+func (c *ReportConfig) validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Path == "" {
+		return fmt.Errorf("'path' is required")
+	}
+
+	switch c.Format {
+	case "":
+		c.Format = ReportFormatJSON
+	case ReportFormatJSON, ReportFormatJUnit:
+	default:
+		return fmt.Errorf("invalid 'format': '%s', must be '%s' or '%s'",
+			c.Format, ReportFormatJSON, ReportFormatJUnit)
+	}
+
+	return nil
+}
+
+// taskReport lists every tag considered during a task run, grouped by mapping
+// and source ref, along with the action taken
+type taskReport struct {
+	Task     string           `json:"task"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished"`
+	Failed   bool             `json:"failed"`
+	Mappings []*mappingReport `json:"mappings"`
+	//
+	mutex gosync.Mutex
+}
+
+//
+type mappingReport struct {
+	From string       `json:"from"`
+	To   string       `json:"to"`
+	Refs []*refReport `json:"refs"`
+	//
+	mapping *Mapping
+}
+
+//
+type refReport struct {
+	Source string       `json:"source"`
+	Target string       `json:"target"`
+	Error  string       `json:"error,omitempty"`
+	Tags   []*tagReport `json:"tags"`
+	//
+	durations map[string]time.Duration
+	scans     map[string]*scanReport
+	mutex     gosync.Mutex
+}
+
+//
+type tagReport struct {
+	Tag       string      `json:"tag"`
+	TargetTag string      `json:"targetTag"`
+	Action    string      `json:"action"`
+	Digest    string      `json:"digest,omitempty"`
+	Size      int64       `json:"size,omitempty"`
+	Duration  float64     `json:"durationSeconds,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Scan      *scanReport `json:"scan,omitempty"`
+}
+
+// scanReport is the outcome of scanning a tag, with the number of findings
+// per severity, or the error if the scan itself failed
+type scanReport struct {
+	Verdict  string         `json:"verdict"`
+	Findings map[string]int `json:"findings,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+//
+func newTaskReport(task string) *taskReport {
+	return &taskReport{
+		Task:     task,
+		Started:  time.Now().UTC(),
+		Mappings: []*mappingReport{},
+	}
+}
+
+// ref adds a report for syncing src to trgt via m
+func (r *taskReport) ref(m *Mapping, src, trgt string) *refReport {
+
+	if r == nil {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var mr *mappingReport
+	for _, x := range r.Mappings {
+		if x.mapping == m {
+			mr = x
+			break
+		}
+	}
+	if mr == nil {
+		mr = &mappingReport{
+			From: m.From, To: m.To, Refs: []*refReport{}, mapping: m}
+		r.Mappings = append(r.Mappings, mr)
+	}
+
+	ret := &refReport{
+		Source:    src,
+		Target:    trgt,
+		Tags:      []*tagReport{},
+		durations: make(map[string]time.Duration),
+		scans:     make(map[string]*scanReport),
+	}
+	mr.Refs = append(mr.Refs, ret)
+	return ret
+}
+
+// tookTime records how long syncing tag took
+func (r *refReport) tookTime(tag string, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.durations[tag] = d
+}
+
+// scanned records the outcome of scanning tag
+func (r *refReport) scanned(tag string, s *scanReport) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.scans[tag] = s
+}
+
+// done records the action taken for each considered tag: tags that were
+// synced were copied, selected tags that were not synced failed in case of
+// error, all others were skipped; for copied tags, digest and size of the
+// source image are taken from images
+func (r *refReport) done(m *Mapping, considered, selected, synced []string,
+	images map[string]*imageInfo, err error) {
+
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	isSelected := make(map[string]bool)
+	for _, tag := range selected {
+		isSelected[tag] = true
+	}
+	isSynced := make(map[string]bool)
+	for _, tag := range synced {
+		isSynced[tag] = true
+	}
+
+	for _, tag := range considered {
+
+		tr := &tagReport{
+			Tag:       tag,
+			TargetTag: m.targetTag(tag),
+			Action:    actionSkipped,
+			Duration:  r.durations[tag].Seconds(),
+			Scan:      r.scans[tag],
+		}
+
+		switch {
+		case isSynced[tag]:
+			tr.Action = actionCopied
+			if img := images[tag]; img != nil {
+				tr.Digest, tr.Size = img.digest, img.size
+			}
+		case isSelected[tag] && err != nil:
+			tr.Action = actionFailed
+			tr.Error = err.Error()
+		}
+
+		r.Tags = append(r.Tags, tr)
+	}
+}
+
+// imageInfo is digest and compressed size of a synced source image
+type imageInfo struct {
+	digest string
+	size   int64
+}
+
+// lookupImages gets digest and size of the images of the given tags of source
+// ref src; tags that can't be looked up are left out
+func (t *Task) lookupImages(src string, tags []string) map[string]*imageInfo {
+	ret := make(map[string]*imageInfo)
+	for _, tag := range tags {
+		ref := fmt.Sprintf("%s:%s", src, tag)
+		digest, size, err := registry.GetDigestAndSize(
+			ref, t.Source.creds, t.Source.SkipTLSVerify)
+		if err != nil {
+			log.WithField("ref", ref).Warnf(
+				"cannot get digest and size: %v", err)
+			continue
+		}
+		ret[tag] = &imageInfo{digest: digest, size: size}
+	}
+	return ret
+}
+
+// writeReport writes the report of the task's current run, if enabled
+func (t *Task) writeReport() {
+
+	if t.report == nil {
+		return
+	}
+
+	t.report.Failed = t.failed
+	file, err := t.report.write(t.Report)
+	if err != nil {
+		log.WithField("task", t.Name).Error(err)
+	} else {
+		log.WithFields(log.Fields{"task": t.Name, "file": file}).Info(
+			"wrote report")
+	}
+
+	t.report = nil
+}
+
+// write writes the report to a file in the directory given by conf, named
+// after task and start time of the run
+func (r *taskReport) write(conf *ReportConfig) (string, error) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Finished = time.Now().UTC()
+
+	var data []byte
+	var err error
+	ext := ".json"
+
+	if conf.Format == ReportFormatJUnit {
+		ext = ".xml"
+		if data, err = xml.MarshalIndent(r.junit(), "", "  "); err == nil {
+			data = append([]byte(xml.Header), data...)
+		}
+	} else {
+		data, err = json.MarshalIndent(r, "", "  ")
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("cannot render report: %v", err)
+	}
+
+	if err := os.MkdirAll(conf.Path, 0755); err != nil {
+		return "", fmt.Errorf("cannot create report directory: %v", err)
+	}
+
+	file := filepath.Join(conf.Path, fmt.Sprintf("%s-%s%s",
+		unsafeFileChars.ReplaceAllString(r.Task, "_"),
+		r.Started.Format("20060102T150405Z"), ext))
+
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return "", fmt.Errorf("cannot write report: %v", err)
+	}
+
+	return file, nil
+}
+
+//
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// JUnit XML elements; each mapping becomes a test suite, each considered tag
+// a test case
+type junitSuites struct {
+	XMLName xml.Name      `xml:"testsuites"`
+	Name    string        `xml:"name,attr"`
+	Suites  []*junitSuite `xml:"testsuite"`
+}
+
+//
+type junitSuite struct {
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     float64      `xml:"time,attr"`
+	Cases    []*junitCase `xml:"testcase"`
+}
+
+//
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+//
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+}
+
+//
+func (r *taskReport) junit() *junitSuites {
+
+	ret := &junitSuites{Name: r.Task}
+
+	for _, m := range r.Mappings {
+
+		suite := &junitSuite{Name: fmt.Sprintf("%s -> %s", m.From, m.To)}
+
+		for _, ref := range m.Refs {
+
+			if len(ref.Tags) == 0 && ref.Error != "" {
+				suite.Cases = append(suite.Cases, &junitCase{
+					Name:      ref.Source,
+					ClassName: r.Task,
+					Failure:   &junitMessage{Message: ref.Error},
+				})
+				suite.Failures++
+				continue
+			}
+
+			for _, tag := range ref.Tags {
+				c := &junitCase{
+					Name:      fmt.Sprintf("%s:%s", ref.Source, tag.Tag),
+					ClassName: r.Task,
+					Time:      tag.Duration,
+				}
+				switch tag.Action {
+				case actionFailed:
+					c.Failure = &junitMessage{Message: tag.Error}
+					suite.Failures++
+				case actionSkipped:
+					c.Skipped = &junitMessage{}
+					if tag.Scan != nil && tag.Scan.Verdict == scanBlocked {
+						c.Skipped.Message = "blocked by vulnerability scan"
+					}
+					suite.Skipped++
+				default:
+					c.SystemOut = fmt.Sprintf("copied to %s:%s, digest %s, "+
+						"size %d", ref.Target, tag.TargetTag, tag.Digest,
+						tag.Size)
+				}
+				suite.Time += tag.Duration
+				suite.Cases = append(suite.Cases, c)
+			}
+		}
+
+		suite.Tests = len(suite.Cases)
+		ret.Suites = append(ret.Suites, suite)
+	}
+
+	return ret
+}
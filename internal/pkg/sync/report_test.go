@@ -0,0 +1,123 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestReport(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	img, err := gocrrandom.Image(1024, 1)
+	th.AssertNoError(err)
+	digest, err := img.Digest()
+	th.AssertNoError(err)
+	for _, tag := range []string{"1.0", "latest"} {
+		ref, err := gocrname.NewTag(reg + "/app:" + tag)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(ref, img))
+	}
+
+	good := &Mapping{From: "app", Tags: []string{"1.0", "latest"}}
+	th.AssertNoError(good.validate())
+	bad := &Mapping{From: "bad", Tags: []string{"1.0"}}
+	th.AssertNoError(bad.validate())
+
+	dir, err := ioutil.TempDir("", "dregsy-report-")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	task := &Task{
+		Name:     "test",
+		Source:   &Location{Registry: reg},
+		Target:   &Location{Registry: "target.example.com"},
+		Mappings: []*Mapping{good, bad},
+		Report:   &ReportConfig{Path: dir},
+	}
+	th.AssertNoError(task.Report.validate())
+
+	relay := &mockRelay{fail: map[string]bool{reg + "/bad": true}}
+	s := &Sync{relay: relay, ping: PingOff}
+
+	readReport := func(pattern string) []byte {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		th.AssertNoError(err)
+		th.AssertEqual(1, len(files))
+		data, err := ioutil.ReadFile(files[0])
+		th.AssertNoError(err)
+		return data
+	}
+
+	s.syncTask(task)
+
+	report := &taskReport{}
+	th.AssertNoError(json.Unmarshal(readReport("test-*.json"), report))
+	th.AssertEqual("test", report.Task)
+	th.AssertTrue(report.Failed)
+	th.AssertEqual(2, len(report.Mappings))
+
+	refs := report.Mappings[0].Refs
+	th.AssertEqual(1, len(refs))
+	th.AssertEqual(2, len(refs[0].Tags))
+	for _, tag := range refs[0].Tags {
+		th.AssertEqual(actionCopied, tag.Action)
+		th.AssertEqual(digest.String(), tag.Digest)
+		th.AssertTrue(tag.Size > 1024)
+	}
+
+	refs = report.Mappings[1].Refs
+	th.AssertEqual("sync failed", refs[0].Error)
+	th.AssertEqual(actionFailed, refs[0].Tags[0].Action)
+
+	task.Report.Format = ReportFormatJUnit
+	th.AssertNoError(task.Report.validate())
+	s.syncTask(task)
+
+	suites := &junitSuites{}
+	th.AssertNoError(xml.Unmarshal(readReport("test-*.xml"), suites))
+	th.AssertEqual(2, len(suites.Suites))
+	th.AssertEqual(2, suites.Suites[0].Tests)
+	th.AssertEqual(0, suites.Suites[0].Failures)
+	th.AssertEqual(1, suites.Suites[1].Failures)
+
+	th.AssertError((&ReportConfig{}).validate(), "'path' is required")
+	th.AssertError((&ReportConfig{Path: dir, Format: "html"}).validate(),
+		"invalid 'format': 'html'")
+}
@@ -0,0 +1,165 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// Retention is a policy for deleting stale tags from the target repositories
+// of a mapping after syncing; a tag is kept when it is among the newest
+// 'keep-last' tags, is younger than 'keep-days', or matches any of the
+// regular expressions in 'keep-tags'; age is taken from the creation time
+// recorded in the image config
+type Retention struct {
+	KeepLast int      `yaml:"keep-last"`
+	KeepDays int      `yaml:"keep-days"`
+	KeepTags []string `yaml:"keep-tags"`
+	//
+	keepTags []*regexp.Regexp
+}
+
+//
+func (r *Retention) validate() error {
+
+	if r == nil {
+		return nil
+	}
+
+	if r.KeepLast < 0 {
+		return errors.New("'keep-last' needs to be 0 or a positive integer")
+	}
+	if r.KeepDays < 0 {
+		return errors.New("'keep-days' needs to be 0 or a positive integer")
+	}
+	if r.KeepLast == 0 && r.KeepDays == 0 {
+		return errors.New("'keep-last' or 'keep-days' is required")
+	}
+
+	r.keepTags = nil
+	for _, expr := range r.KeepTags {
+		reg, err := util.CompileRegex(expr, true)
+		if err != nil {
+			return fmt.Errorf(
+				"'keep-tags' uses invalid expression '%s': %v", expr, err)
+		}
+		r.keepTags = append(r.keepTags, reg)
+	}
+
+	return nil
+}
+
+// staleTags determines which of the given tags to delete as of now, and which
+// ones to keep, based on their creation times; tags without known creation
+// time, and cosign tags, are always kept
+func (r *Retention) staleTags(tags []string, created map[string]time.Time,
+	now time.Time) (stale, keep []string) {
+
+	var dated []string
+	for _, t := range tags {
+		if _, ok := created[t]; ok && !cosignTag.MatchString(t) {
+			dated = append(dated, t)
+		} else {
+			keep = append(keep, t)
+		}
+	}
+
+	sort.SliceStable(dated, func(i, j int) bool {
+		return created[dated[i]].After(created[dated[j]])
+	})
+
+	cutoff := now.AddDate(0, 0, -r.KeepDays)
+
+	for ix, t := range dated {
+		if ix < r.KeepLast || (r.KeepDays > 0 && created[t].After(cutoff)) ||
+			r.isKeptTag(t) {
+			keep = append(keep, t)
+		} else {
+			stale = append(stale, t)
+		}
+	}
+
+	return
+}
+
+//
+func (r *Retention) isKeptTag(tag string) bool {
+	for _, reg := range r.keepTags {
+		if reg.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRetention deletes the tags from the target repository trgtRef that are
+// stale according to the retention policy of mapping m
+func (t *Task) applyRetention(m *Mapping, trgtRef string, dryRun bool) error {
+
+	trgtTags, err := registry.ListTags(t.context(),
+		trgtRef, t.Target.creds, t.Target.SkipTLSVerify)
+	if err != nil {
+		return fmt.Errorf(
+			"cannot list tags of target for retention: %v", err)
+	}
+
+	created := make(map[string]time.Time, len(trgtTags))
+	for _, tag := range trgtTags {
+		if cosignTag.MatchString(tag) {
+			continue
+		}
+		ref := fmt.Sprintf("%s:%s", trgtRef, tag)
+		c, err := registry.GetCreated(t.context(),
+			ref, t.Target.creds, t.Target.SkipTLSVerify)
+		if err != nil {
+			log.WithField("ref", ref).Warnf(
+				"cannot determine creation time, keeping tag: %v", err)
+			continue
+		}
+		created[tag] = c
+	}
+
+	stale, keep := m.Retention.staleTags(trgtTags, created, time.Now())
+	if len(stale) == 0 {
+		return nil
+	}
+
+	if dryRun {
+		for _, tag := range stale {
+			log.WithFields(log.Fields{"task": t.Name, "tag": tag}).Infof(
+				"dry run, would delete from '%s' as per retention", trgtRef)
+		}
+		return nil
+	}
+
+	log.WithFields(log.Fields{"ref": trgtRef, "tags": stale}).Info(
+		"deleting tags as per retention")
+
+	return t.retry(trgtRef, func() error {
+		return registry.DeleteTags(t.context(),
+			trgtRef, stale, keep, t.Target.creds, t.Target.SkipTLSVerify)
+	})
+}
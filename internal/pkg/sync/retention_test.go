@@ -0,0 +1,142 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gocrmutate "github.com/google/go-containerregistry/pkg/v1/mutate"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestRetentionValidate(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var r *Retention
+	th.AssertNoError(r.validate())
+
+	th.AssertError((&Retention{}).validate(),
+		"'keep-last' or 'keep-days' is required")
+	th.AssertError((&Retention{KeepLast: -1}).validate(),
+		"'keep-last' needs to be 0 or a positive integer")
+	th.AssertError((&Retention{KeepDays: -1}).validate(),
+		"'keep-days' needs to be 0 or a positive integer")
+	th.AssertError((&Retention{KeepLast: 1, KeepTags: []string{"v("}}).
+		validate(), "'keep-tags' uses invalid expression 'v('")
+
+	m := &Mapping{From: "acme/app", Retention: &Retention{}}
+	th.AssertError(m.validate(), "invalid 'retention': 'keep-last' or "+
+		"'keep-days' is required")
+}
+
+//
+func TestRetentionStaleTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	now := time.Date(2026, 6, 30, 12, 0, 0, 0, time.UTC)
+	daysAgo := func(d int) time.Time { return now.AddDate(0, 0, -d) }
+
+	tags := []string{"1.0", "1.1", "1.2", "1.3", "stable", "unknown",
+		"sha256-" + strings.Repeat("a", 64) + ".sig"}
+	created := map[string]time.Time{
+		"1.0":    daysAgo(90),
+		"1.1":    daysAgo(60),
+		"1.2":    daysAgo(20),
+		"1.3":    daysAgo(2),
+		"stable": daysAgo(100),
+	}
+
+	tryRetention := func(r *Retention, wantStale ...string) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		th.AssertNoError(r.validate())
+		stale, keep := r.staleTags(tags, created, now)
+		th.AssertEqualSlices(wantStale, stale)
+		th.AssertEqual(len(tags), len(stale)+len(keep))
+	}
+
+	tryRetention(&Retention{KeepLast: 2}, "1.1", "1.0", "stable")
+	tryRetention(&Retention{KeepDays: 30}, "1.1", "1.0", "stable")
+	tryRetention(&Retention{KeepDays: 70}, "1.0", "stable")
+	tryRetention(&Retention{KeepLast: 1, KeepDays: 30,
+		KeepTags: []string{"stable", `1\.0`}}, "1.1")
+	tryRetention(&Retention{KeepLast: 10})
+}
+
+//
+func TestApplyRetention(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var deleted []string
+	inner := gocrregistry.New()
+	srv := newTagListRegistry(map[string][]string{
+		"mirror/app": {"old", "new"},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deleted = append(deleted,
+				r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		inner.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+	trgt := reg + "/mirror/app"
+
+	for tag, created := range map[string]time.Time{
+		"old": time.Now().AddDate(0, 0, -40),
+		"new": time.Now().AddDate(0, 0, -1),
+	} {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		img, err = gocrmutate.CreatedAt(img, gocrv1.Time{Time: created})
+		th.AssertNoError(err)
+		r, err := gocrname.NewTag(trgt + ":" + tag)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(r, img))
+	}
+
+	m := &Mapping{From: "acme/app", To: "mirror/app",
+		Retention: &Retention{KeepDays: 30}}
+	th.AssertNoError(m.validate())
+	task := &Task{
+		Name:     "mirror",
+		Source:   &Location{Registry: reg},
+		Target:   &Location{Registry: reg},
+		Mappings: []*Mapping{m},
+	}
+
+	th.AssertNoError(task.applyRetention(m, trgt, true))
+	th.AssertEqual(0, len(deleted))
+
+	th.AssertNoError(task.applyRetention(m, trgt, false))
+	th.AssertEqualSlices([]string{"old"}, deleted)
+}
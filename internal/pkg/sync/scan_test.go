@@ -0,0 +1,151 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/scan"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// mockScanner reports the configured number of critical findings per ref,
+// plus one high finding, and fails for refs not configured
+type mockScanner struct {
+	critical map[string]int
+}
+
+//
+func (s *mockScanner) Scan(ref, creds string, skipTLSVerify bool) (
+	*scan.Result, error) {
+	if c, ok := s.critical[ref]; ok {
+		return &scan.Result{
+			Ref: ref,
+			Findings: map[string]int{
+				scan.SeverityCritical: c,
+				scan.SeverityHigh:     1,
+			},
+		}, nil
+	}
+	return nil, errors.New("scan failed")
+}
+
+//
+func TestScanTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	scanner := &mockScanner{critical: map[string]int{
+		"reg/img:clean":  0,
+		"reg/img:one":    1,
+		"reg/img:plenty": 5,
+	}}
+	tags := []string{"clean", "one", "plenty", "broken"}
+
+	tryScan := func(action, blockOn string, max int, errMsg string,
+		want ...string) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		task := &Task{
+			Name:   "test",
+			Source: &Location{Registry: "reg"},
+			Scan: &scan.Config{
+				Action: action, BlockOn: blockOn, MaxFindings: max},
+			scanner: scanner,
+		}
+		passed, err := task.scanTags("reg/img", tags, nil)
+		if errMsg == "" {
+			th.AssertNoError(err)
+		} else {
+			th.AssertError(err, errMsg)
+		}
+		th.AssertEquivalentSlices(want, passed)
+	}
+
+	crit := scan.SeverityCritical
+	tryScan(scan.ActionFail, crit, 0,
+		"3 image(s) of 'reg/img' did not pass vulnerability scan", "clean")
+	tryScan(scan.ActionFail, crit, 1,
+		"2 image(s) of 'reg/img' did not pass vulnerability scan",
+		"clean", "one")
+	tryScan(scan.ActionSkip, crit, 1, "", "clean", "one")
+	tryScan(scan.ActionWarn, crit, 0, "", "clean", "one", "plenty", "broken")
+	tryScan(scan.ActionSkip, scan.SeverityHigh, 1, "", "clean")
+	tryScan(scan.ActionSkip, scan.SeverityHigh, 2, "", "clean", "one")
+}
+
+//
+func TestScanReport(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "img"}
+	th.AssertNoError(m.validate())
+
+	scanner := &mockScanner{critical: map[string]int{
+		"reg/img:clean":  0,
+		"reg/img:plenty": 5,
+	}}
+	tags := []string{"clean", "plenty", "broken"}
+
+	tryReport := func(action string) map[string]*scanReport {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		task := &Task{
+			Name:   "test",
+			Source: &Location{Registry: "reg"},
+			Scan: &scan.Config{
+				Action: action, BlockOn: scan.SeverityCritical},
+			scanner: scanner,
+		}
+		report := newTaskReport("test").ref(m, "reg/img", "trgt/img")
+		passed, _ := task.scanTags("reg/img", tags, report)
+		report.done(m, tags, passed, passed, nil, nil)
+		ret := make(map[string]*scanReport)
+		for _, tr := range report.Tags {
+			th.AssertNotNil(tr.Scan)
+			ret[tr.Tag] = tr.Scan
+		}
+		th.AssertEqual(len(tags), len(ret))
+		return ret
+	}
+
+	res := tryReport(scan.ActionSkip)
+	th.AssertEqual(scanPassed, res["clean"].Verdict)
+	th.AssertEqual(1, res["clean"].Findings[scan.SeverityHigh])
+	th.AssertEqual(scanBlocked, res["plenty"].Verdict)
+	th.AssertEqual(5, res["plenty"].Findings[scan.SeverityCritical])
+	th.AssertEqual(1, res["plenty"].Findings[scan.SeverityHigh])
+	th.AssertEqual(scanBlocked, res["broken"].Verdict)
+	th.AssertEqual("scan failed", res["broken"].Error)
+
+	res = tryReport(scan.ActionWarn)
+	th.AssertEqual(scanPassed, res["clean"].Verdict)
+	th.AssertEqual(scanWarned, res["plenty"].Verdict)
+	th.AssertEqual(5, res["plenty"].Findings[scan.SeverityCritical])
+	th.AssertEqual(scanWarned, res["broken"].Verdict)
+
+	// blocked tags are marked as such in JUnit reports
+	report := &taskReport{Task: "test", Mappings: []*mappingReport{{
+		From: "img", To: "img", Refs: []*refReport{{
+			Source: "reg/img", Tags: []*tagReport{{
+				Tag: "plenty", Action: actionSkipped,
+				Scan: &scanReport{Verdict: scanBlocked}}}}}}}}
+	cases := report.junit().Suites[0].Cases
+	th.AssertEqual("blocked by vulnerability scan", cases[0].Skipped.Message)
+}
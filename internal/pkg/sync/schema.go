@@ -0,0 +1,115 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+//
+const schemaVersion = "http://json-schema.org/draft-07/schema#"
+
+// ConfigSchema returns the JSON schema of the config file, derived from the
+// config types, for validating config files with editors and CI tools
+func ConfigSchema() ([]byte, error) {
+	schema := typeSchema(reflect.TypeOf(SyncConfig{}))
+	schema["$schema"] = schemaVersion
+	schema["title"] = "dregsy config"
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// typeSchema returns the JSON schema for values of given type, as they are
+// parsed from YAML
+func typeSchema(t reflect.Type) map[string]interface{} {
+
+	if t == reflect.TypeOf(time.Duration(0)) {
+		// YAML parsing accepts strings like 30s, as well as plain nanoseconds
+		return map[string]interface{}{"type": []string{"string", "integer"}}
+	}
+
+	switch t.Kind() {
+
+	case reflect.Ptr:
+		// settings given as pointers may be left empty in YAML
+		s := typeSchema(t.Elem())
+		switch typ := s["type"].(type) {
+		case string:
+			s["type"] = []string{typ, "null"}
+		case []string:
+			s["type"] = append(typ, "null")
+		}
+		return s
+
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+
+	case reflect.String:
+		// the YAML lib converts any scalar into a string, e.g. 'enabled: true'
+		// or 'api-version: 1.24'
+		return map[string]interface{}{
+			"type": []string{"string", "number", "boolean"}}
+
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem()),
+		}
+
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": typeSchema(t.Elem()),
+		}
+
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for ix := 0; ix < t.NumField(); ix++ {
+			f := t.Field(ix)
+			if f.PkgPath != "" { // unexported
+				continue
+			}
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				// default key used by YAML lib
+				name = strings.ToLower(f.Name)
+			}
+			props[name] = typeSchema(f.Type)
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+	}
+
+	// any value
+	return map[string]interface{}{}
+}
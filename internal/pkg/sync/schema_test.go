@@ -0,0 +1,72 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestConfigSchema(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	data, err := ConfigSchema()
+	th.AssertNoError(err)
+
+	var schema map[string]interface{}
+	th.AssertNoError(json.Unmarshal(data, &schema))
+
+	// walks down the schema along given keys
+	get := func(keys ...string) interface{} {
+		var ret interface{} = schema
+		for _, k := range keys {
+			ret = ret.(map[string]interface{})[k]
+		}
+		return ret
+	}
+
+	// returns the types allowed at given keys
+	types := func(keys ...string) []string {
+		var ret []string
+		for _, t := range get(append(keys, "type")...).([]interface{}) {
+			ret = append(ret, t.(string))
+		}
+		return ret
+	}
+
+	th.AssertEqual(schemaVersion, get("$schema"))
+	th.AssertEqual(false, get("additionalProperties"))
+	th.AssertEquivalentSlices([]string{"string", "number", "boolean"},
+		types("properties", "relay"))
+
+	task := []string{"properties", "tasks", "items", "properties"}
+	th.AssertEqual("integer", get(append(task, "interval", "type")...))
+	th.AssertEqual("number",
+		get(append(task, "rate-limit-mbps", "type")...))
+	th.AssertEquivalentSlices([]string{"string", "integer"},
+		types(append(task, "retry-backoff")...))
+	th.AssertEquivalentSlices([]string{"object", "null"},
+		types(append(task, "source")...))
+	th.AssertEqual(false, get(append(task, "source", "additionalProperties")...))
+	th.AssertEqual("array", get(append(task, "mappings", "items",
+		"properties", "tags", "type")...))
+	th.AssertNil(get(append(task, "repoList")...))
+}
@@ -0,0 +1,115 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	gosync "sync"
+)
+
+// summary records the outcome of syncing each source ref, for reporting at
+// the end of a run
+type summary struct {
+	Synced      []*refOutcome `json:"synced"`
+	Skipped     []*refOutcome `json:"skipped"`
+	Failed      []*refOutcome `json:"failed"`
+	FailedTasks []string      `json:"failedTasks"`
+	//
+	mutex gosync.Mutex
+}
+
+//
+type refOutcome struct {
+	Task   string   `json:"task"`
+	Source string   `json:"source"`
+	Target string   `json:"target"`
+	Tags   []string `json:"tags,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// EnableSummary makes the sync record the outcome of syncing each source ref,
+// for writing a summary with WriteSummary
+func (s *Sync) EnableSummary() {
+	s.summary = &summary{
+		Synced:      []*refOutcome{},
+		Skipped:     []*refOutcome{},
+		Failed:      []*refOutcome{},
+		FailedTasks: []string{},
+	}
+}
+
+// WriteSummary writes the summary of synced, skipped, and failed refs as JSON
+// to w; does nothing if the summary is not enabled
+func (s *Sync) WriteSummary(w io.Writer) error {
+
+	if s.summary == nil {
+		return nil
+	}
+
+	s.summary.mutex.Lock()
+	defer s.summary.mutex.Unlock()
+
+	sort.Strings(s.summary.FailedTasks)
+	return json.NewEncoder(w).Encode(s.summary)
+}
+
+// add records the outcome of syncing src to trgt; the ref was synced if tags
+// were synced without error, skipped if there was nothing to sync, and failed
+// if there was an error, in which case tags lists those that were synced
+// nevertheless
+func (s *summary) add(task, src, trgt string, synced []string, err error) {
+
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	o := &refOutcome{Task: task, Source: src, Target: trgt, Tags: synced}
+
+	switch {
+	case err != nil:
+		o.Error = err.Error()
+		s.Failed = append(s.Failed, o)
+	case len(synced) > 0:
+		s.Synced = append(s.Synced, o)
+	default:
+		s.Skipped = append(s.Skipped, o)
+	}
+}
+
+// taskDone records the end of a task run; failed tasks are listed in the
+// summary, since not all task errors relate to a particular ref
+func (s *summary) taskDone(task string, failed bool) {
+
+	if s == nil || !failed {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, t := range s.FailedTasks {
+		if t == task {
+			return
+		}
+	}
+	s.FailedTasks = append(s.FailedTasks, task)
+}
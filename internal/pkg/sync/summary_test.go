@@ -0,0 +1,84 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestRunOnceSummary(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	conf := &SyncConfig{Ping: PingOff, Trigger: &TriggerConfig{Listen: ":0"}}
+	for _, from := range []string{"good", "bad"} {
+		m := &Mapping{From: from, Tags: []string{"1.0", "latest"}}
+		th.AssertNoError(m.validate())
+		conf.Tasks = append(conf.Tasks, &Task{
+			Name:     from,
+			Interval: 60,
+			Source:   &Location{Registry: "source.example.com"},
+			Target:   &Location{Registry: "target.example.com"},
+			Mappings: []*Mapping{m},
+		})
+	}
+
+	conf.RunOnce()
+	th.AssertNil(conf.Trigger)
+	for _, task := range conf.Tasks {
+		th.AssertFalse(task.isPeriodic())
+	}
+
+	relay := &mockRelay{fail: map[string]bool{"source.example.com/bad": true}}
+	s := &Sync{
+		relay:    relay,
+		ping:     PingOff,
+		workers:  make(chan bool, 1),
+		shutdown: make(chan bool),
+		ticks:    make(chan bool, 1),
+	}
+	s.EnableSummary()
+
+	// returns once all tasks have run
+	th.AssertError(s.SyncFromConfig(conf), "one or more tasks had errors")
+
+	var buf bytes.Buffer
+	th.AssertNoError(s.WriteSummary(&buf))
+
+	sum := &summary{}
+	th.AssertNoError(json.Unmarshal(buf.Bytes(), sum))
+
+	th.AssertEqual(1, len(sum.Synced))
+	th.AssertEqual("source.example.com/good", sum.Synced[0].Source)
+	th.AssertEqual("target.example.com/good", sum.Synced[0].Target)
+	th.AssertEquivalentSlices([]string{"1.0", "latest"}, sum.Synced[0].Tags)
+	th.AssertEqual(0, len(sum.Skipped))
+	th.AssertEqual(1, len(sum.Failed))
+	th.AssertEqual("source.example.com/bad", sum.Failed[0].Source)
+	th.AssertEqual("sync failed", sum.Failed[0].Error)
+	th.AssertEqualSlices([]string{"bad"}, sum.FailedTasks)
+
+	// nothing written when not enabled
+	buf.Reset()
+	th.AssertNoError((&Sync{}).WriteSummary(&buf))
+	th.AssertEqual(0, buf.Len())
+}
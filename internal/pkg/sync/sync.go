@@ -17,68 +17,216 @@
 package sync
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	gosync "sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/hooks"
+	"github.com/xelalexv/dregsy/internal/pkg/leader"
+	"github.com/xelalexv/dregsy/internal/pkg/metrics"
+	"github.com/xelalexv/dregsy/internal/pkg/notify"
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/containerd"
+	"github.com/xelalexv/dregsy/internal/pkg/relays/direct"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/docker"
 	"github.com/xelalexv/dregsy/internal/pkg/relays/skopeo"
 	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/tracing"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
+// maximum number of errors to include in a notification
+const maxNotifyErrors = 10
+
+// how long to wait for task runs to wind down after aborting them
+const abortGrace = 10 * time.Second
+
 //
 type Relay interface {
 	Prepare() error
 	Dispose() error
-	Sync(srcRef, srcAuth string, srcSkiptTLSVerify bool,
+	Sync(ctx context.Context, srcRef, srcAuth string, srcSkiptTLSVerify bool,
 		trgtRef, trgtAuth string, trgtSkiptTLSVerify bool,
-		tags *tags.TagSet, verbose bool) error
+		tags *tags.TagSet, platforms []string, throttle *util.Throttle,
+		span *tracing.Span, verbose bool) error
+}
+
+// Cleaner is implemented by relays that keep local copies of the images they
+// sync, which can be removed after syncing
+type Cleaner interface {
+	Cleanup(ctx context.Context, srcRef, trgtRef string, dangling bool) error
+}
+
+// HealthChecker is implemented by relays that depend on a service, such as the
+// Docker daemon, and can check whether it is reachable
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+// SpaceGuard is implemented by relays that store images locally, and can check
+// whether there is enough disk space left for syncing
+type SpaceGuard interface {
+	EnsureSpace() error
 }
 
 //
 type Sync struct {
 	relay    Relay
+	fallback Relay  // daemonless relay to use when daemon is not reachable
+	fbID     string // ID of the fallback relay
+	ping     string
+	dryRun   bool
+	quiet    bool // only summaries, warnings & errors are logged
+	terminal bool // whether output goes to a terminal, unless quiet
+	metrics  *metrics.Metrics
+	tracer   *tracing.Tracer
+	elector  *leader.Elector // when taking part in leader election
+	health   *health
+	board    *dashboard    // web UI, if enabled
+	summary  *summary      // outcome of syncs, if enabled
+	events   *eventStream  // lifecycle events of task runs, if enabled
+	workers  chan bool     // limits the number of tasks syncing concurrently
+	queue    *runQueue     // orders task runs waiting for a worker
+	failed   int32         // set when any task run had errors
+	stopping int32         // set when stopping, no new task runs are started
+	timeout  time.Duration // max wait for running tasks when stopping
+	maxRun   time.Duration // max duration of any task run, 0 for no limit
+	abort    chan bool     // signals a task failure with policy 'fail-run'
 	shutdown chan bool
 	ticks    chan bool
+	runs     context.Context             // parent of all task runs
+	abortAll context.CancelFunc          // aborts all task runs in progress
+	load     func() (*SyncConfig, error) // for reloading config, if enabled
+	reloads  chan chan error
+	halted   chan bool                  // closed when the sync loop has ended
+	relays   map[string]Relay           // named relays selected by tasks
+	blobs    registry.BlobCache         // for tasks without state file
+	keep     bool                       // keep running when there are no tasks
+	observer func(*notify.Notification) // called when a task run is done
 }
 
-//
-func New(conf *SyncConfig) (*Sync, error) {
-
-	sync := &Sync{}
+// newRelay creates a relay from the given relay settings
+func newRelay(conf *RelayConfig) (Relay, error) {
 
 	var relay Relay
 	var err error
 
-	switch conf.Relay {
+	switch conf.Type {
 
 	case docker.RelayID:
 		relay, err = docker.NewDockerRelay(
 			conf.Docker, log.StandardLogger().WriterLevel(log.DebugLevel))
 
+	case docker.PodmanRelayID:
+		relay, err = docker.NewPodmanRelay(
+			conf.Podman, log.StandardLogger().WriterLevel(log.DebugLevel))
+
+	case containerd.RelayID:
+		relay = containerd.NewContainerdRelay(
+			conf.Containerd, log.StandardLogger().WriterLevel(log.DebugLevel))
+
 	case skopeo.RelayID:
 		relay = skopeo.NewSkopeoRelay(
 			conf.Skopeo, log.StandardLogger().WriterLevel(log.DebugLevel))
 
+	case direct.RelayID:
+		relay = direct.NewDirectRelay(
+			conf.Direct, log.StandardLogger().WriterLevel(log.DebugLevel))
+
 	default:
-		err = fmt.Errorf("relay type '%s' not supported", conf.Relay)
+		err = fmt.Errorf("relay type '%s' not supported", conf.Type)
 	}
 
+	return relay, err
+}
+
+//
+func New(conf *SyncConfig) (*Sync, error) {
+
+	sync := &Sync{blobs: registry.NewBlobCache()}
+
+	relay, err := newRelay(conf.relayConfig(nil))
 	if err != nil {
 		return nil, fmt.Errorf("cannot create sync relay: %v", err)
 	}
 
+	// without a daemon required, sync may fall back to a daemonless relay
+	if conf.FallbackRelay != "" && !conf.RequireDaemon {
+		fb := conf.relayConfig(nil)
+		fb.Type = conf.FallbackRelay
+		if sync.fallback, err = newRelay(fb); err != nil {
+			return nil, fmt.Errorf("cannot create fallback relay: %v", err)
+		}
+		sync.fbID = conf.FallbackRelay
+	}
+
+	sync.relays = make(map[string]Relay, len(conf.Relays))
+	for name, rc := range conf.Relays {
+		if sync.relays[name], err = newRelay(rc); err != nil {
+			return nil, fmt.Errorf("cannot create relay '%s': %v", name, err)
+		}
+	}
+
+	if sync.elector, err = leader.New(conf.LeaderElection); err != nil {
+		return nil, fmt.Errorf("cannot set up leader election: %v", err)
+	}
+
 	sync.relay = relay
+	sync.ping = conf.Ping
+	sync.dryRun = conf.DryRun
+	sync.quiet = conf.Quiet
+	sync.terminal = !conf.Quiet && isTerminal()
+	sync.metrics = metrics.New(conf.Metrics)
+	sync.tracer = tracing.New(conf.Tracing)
+	sync.health = newHealth(relay, sync.isStopping)
+	sync.health.named = sync.relays
+	sync.board = newDashboard(conf.Dashboard)
+
+	parallelism := conf.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	sync.workers = make(chan bool, parallelism)
+	sync.queue = newRunQueue()
+	sync.timeout = conf.ShutdownTimeout
+	sync.maxRun = conf.MaxRunDuration
+	sync.runs, sync.abortAll = context.WithCancel(context.Background())
+	sync.abort = make(chan bool, 1)
 	sync.shutdown = make(chan bool)
 	sync.ticks = make(chan bool, 1)
+	sync.reloads = make(chan chan error)
+	sync.halted = make(chan bool)
 
 	return sync, nil
 }
 
+// KeepRunning makes the sync keep running even when there are no periodic
+// tasks, until it is stopped or shut down; this is useful when tasks are added
+// via reload
+func (s *Sync) KeepRunning() {
+	s.keep = true
+}
+
+// Halted returns a channel that is closed once the sync has stopped waiting
+// for task runs to start, and no longer accepts reloads
+func (s *Sync) Halted() <-chan bool {
+	return s.halted
+}
+
+// ObserveTasks makes the sync call observe with the outcome of each task run
+func (s *Sync) ObserveTasks(observe func(*notify.Notification)) {
+	s.observer = observe
+}
+
 //
 func (s *Sync) Shutdown() {
 	s.shutdown <- true
@@ -101,60 +249,287 @@ func (s *Sync) WaitForTick() {
 //
 func (s *Sync) Dispose() {
 	s.relay.Dispose()
+	for _, r := range s.relays {
+		r.Dispose()
+	}
+}
+
+// taskRelay returns the relay selected by task t, or nil if t selects a named
+// relay that was not defined when sync was created; named relays can only be
+// added with a restart
+func (s *Sync) taskRelay(t *Task) Relay {
+	if t.Relay == "" {
+		return s.relay
+	}
+	return s.relays[t.Relay]
+}
+
+// prepareRelays checks whether the relays used by the given tasks are ready
+func (s *Sync) prepareRelays(tasks []*Task) error {
+
+	used := make(map[string]bool)
+	for _, t := range tasks {
+		used[t.Relay] = true
+	}
+
+	if used[""] {
+		if err := s.prepareRelay(); err != nil {
+			return err
+		}
+	}
+
+	var names []string
+	for name := range s.relays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !used[name] {
+			continue
+		}
+		if err := s.relays[name].Prepare(); err != nil {
+			return fmt.Errorf("relay '%s' not ready: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// prepareRelay checks whether the relay is ready; if not, and a fallback relay
+// is set, the fallback relay is used instead from then on
+func (s *Sync) prepareRelay() error {
+
+	err := s.relay.Prepare()
+	if err == nil || s.fallback == nil {
+		return err
+	}
+
+	log.WithField("relay", s.fbID).Warnf(
+		"relay not ready, falling back to daemonless relay: %v", err)
+
+	if err := s.fallback.Prepare(); err != nil {
+		return fmt.Errorf("fallback relay not ready either: %v", err)
+	}
+
+	if err := s.relay.Dispose(); err != nil {
+		log.Warnf("error disposing relay: %v", err)
+	}
+	s.relay = s.fallback
+	if s.health != nil {
+		s.health.relay = s.fallback
+	}
+	s.fallback = nil
+
+	return nil
 }
 
 //
 func (s *Sync) SyncFromConfig(conf *SyncConfig) error {
 
-	if err := s.relay.Prepare(); err != nil {
-		return err
+	// no more reloads once sync loop has ended, or sync was not started
+	var once gosync.Once
+	halt := func() {
+		once.Do(func() {
+			if s.halted != nil {
+				close(s.halted)
+			}
+		})
 	}
+	defer halt()
 
-	// one-off tasks
+	var tasks []*Task
 	for _, t := range conf.Tasks {
-		if t.Interval == 0 {
-			s.syncTask(t)
+		if t.isEnabled() {
+			tasks = append(tasks, t)
+		} else {
+			log.WithFields(log.Fields{"task": t.Name, "reason": t.disabled}).
+				Info("task disabled, skipping")
 		}
 	}
 
-	// periodic tasks
-	c := make(chan *Task)
-	ticking := false
+	switch s.ping {
+	case PingStartup:
+		if err := s.prepareRelays(tasks); err != nil {
+			return err
+		}
+	case PingOff:
+		log.Warn("not checking whether relay is ready")
+	}
 
-	for _, t := range conf.Tasks {
-		if t.Interval > 0 {
-			t.startTicking(c)
-			ticking = true
+	s.queue.setTasks(tasks)
+	s.health.setTasks(tasks)
+	if s.health != nil {
+		s.metrics.Handle(healthPath, http.HandlerFunc(s.health.handleHealth))
+		s.metrics.Handle(readyPath, http.HandlerFunc(s.health.handleReady))
+	}
+
+	s.board.setTasks(tasks)
+	if s.board != nil {
+		s.metrics.Handle(dashboardPath, http.HandlerFunc(s.board.handlePage))
+		s.metrics.Handle(
+			dashboardTasksPath, http.HandlerFunc(s.board.handleTasks))
+	}
+
+	if err := s.metrics.Start(); err != nil {
+		return err
+	}
+	defer s.metrics.Stop()
+
+	s.tracer.Start()
+	defer s.tracer.Stop()
+
+	if s.elector != nil {
+		s.elector.Start()
+		defer s.elector.Stop()
+		if !s.awaitLeadership() {
+			return nil
 		}
 	}
 
+	var triggers chan *Task
+	var events chan *pushEvent
+	trigger := newTriggerServer(conf.Trigger, tasks)
+	if trigger != nil {
+		if err := trigger.start(); err != nil {
+			return err
+		}
+		defer trigger.stop()
+		triggers = trigger.queue
+		events = trigger.events
+	}
+
+	if s.dryRun {
+		log.Warn("dry run, nothing will be synced")
+	}
+
+	for _, t := range tasks {
+		t.openState()
+		t.snapshot()
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	if s.load != nil {
+		signal.Notify(sigs, syscall.SIGHUP)
+	}
+	defer signal.Stop(sigs)
+
+	var running gosync.WaitGroup
+
+	// one-off tasks
+	for _, t := range inDependencyOrder(tasks) {
+		if !t.isPeriodic() {
+			s.runTask(t, &running, false)
+		}
+	}
+
+	stopped := false
+	lost := false
+	oneOffsDone := waitGroupDone(&running)
+	for waiting := true; waiting; {
+		select {
+		case <-oneOffsDone:
+			waiting = false
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				log.WithField("signal", sig).Info(
+					"received signal, stopping ...")
+				s.stop()
+				stopped = true
+				waiting = false
+			}
+		}
+	}
+
+	// periodic tasks; when accepting triggers, or asked to, we keep running
+	// even if there are no periodic tasks
+	c := make(chan *Task)
+	ticking := (trigger != nil || s.keep) && !stopped
+
+	select {
+	case <-s.abort:
+		log.Error("task failed with 'on-error' set to 'fail-run', stopping ...")
+	default:
+		for _, t := range byDueTime(inDependencyOrder(tasks)) {
+			if t.isPeriodic() && !stopped {
+				t.startTicking(c)
+				ticking = true
+			}
+		}
+	}
+
+	reload := func() error {
+		var err error
+		tasks, err = s.reloadTasks(conf, tasks, c, trigger, &running)
+		s.queue.setTasks(tasks)
+		s.health.setTasks(tasks)
+		s.board.setTasks(tasks)
+		return err
+	}
 
 	for ticking {
 		log.Info("waiting for next sync task...")
 		select {
 		case t := <-c: // actual task
-			s.syncTask(t)
-			s.tick() // send a tick
-		case sig := <-sigs: // interrupt signal
+			s.runTask(t, &running, true)
+		case t := <-triggers: // triggered task
+			s.runTask(t, &running, true)
+		case e := <-events: // pushed tag
+			s.runEvent(e, &running)
+		case sig := <-sigs: // interrupt or reload signal
+			if sig == syscall.SIGHUP {
+				log.WithField("signal", sig).Info(
+					"received signal, reloading config ...")
+				if err := reload(); err != nil {
+					log.Errorf("cannot reload config, keeping current one: %v",
+						err)
+				}
+				break
+			}
 			log.WithField("signal", sig).Info("received signal, stopping ...")
+			s.stop()
+			ticking = false
+		case done := <-s.reloads: // reload requested
+			done <- reload()
+		case <-s.abort: // task failed with policy 'fail-run'
+			log.Error(
+				"task failed with 'on-error' set to 'fail-run', stopping ...")
+			ticking = false
+		case <-s.elector.Lost(): // another instance took over
+			log.Error("lost leadership, stopping ...")
+			s.stop()
 			ticking = false
+			lost = true
 		case <-s.shutdown: // shutdown flagged
 			log.Info("shutdown flagged, stopping ...")
 			ticking = false
+			running.Wait()
 			s.tick() // send a final tick to release shutdown client
 		}
 	}
 
+	halt()
+
 	log.Debug("stopping tasks")
-	errs := false
-	for _, t := range conf.Tasks {
+	for _, t := range tasks {
 		t.stopTicking()
+	}
+
+	if !s.awaitRunning(&running, sigs) {
+		return fmt.Errorf("stopped with task runs still in progress")
+	}
+
+	if lost {
+		return fmt.Errorf("stopped after losing leadership")
+	}
+
+	errs := false
+	for _, t := range tasks {
 		errs = errs || t.failed
 	}
 
-	if errs {
+	if errs || atomic.LoadInt32(&s.failed) == 1 {
 		return fmt.Errorf(
 			"one or more tasks had errors, please see log for details")
 	}
@@ -163,10 +538,190 @@ func (s *Sync) SyncFromConfig(conf *SyncConfig) error {
 	return nil
 }
 
+// awaitLeadership blocks until this instance has been elected leader, and
+// returns true then; it returns false when interrupted or shut down while
+// standing by
+func (s *Sync) awaitLeadership() bool {
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	s.health.setStandby(true)
+	log.Info("standing by until elected leader ...")
+
+	select {
+	case <-s.elector.Elected():
+		s.health.setStandby(false)
+		return true
+	case sig := <-sigs:
+		log.WithField("signal", sig).Info(
+			"received signal while standing by, stopping ...")
+	case <-s.shutdown:
+		log.Info("shutdown flagged while standing by, stopping ...")
+		s.tick() // release shutdown client
+	}
+
+	return false
+}
+
+// stop makes running task runs end after their current mapping, and prevents
+// new task runs from starting
+func (s *Sync) stop() {
+	atomic.StoreInt32(&s.stopping, 1)
+}
+
+//
+func (s *Sync) isStopping() bool {
+	return atomic.LoadInt32(&s.stopping) == 1
+}
+
+// awaitRunning waits for all task runs in progress to finish; when stopping,
+// waiting ends after the shutdown timeout, or when another interrupt signal is
+// received; returns false if waiting ended with task runs still in progress
+func (s *Sync) awaitRunning(running *gosync.WaitGroup,
+	sigs chan os.Signal) bool {
+
+	done := waitGroupDone(running)
+
+	if !s.isStopping() {
+		<-done
+		return true
+	}
+
+	timeout := s.timeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	log.WithField("timeout", timeout).Info(
+		"waiting for task runs in progress to finish")
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return true
+		case <-timer.C:
+			log.Warn("timed out waiting for task runs in progress")
+			s.abortRunning(done)
+			return false
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				log.WithField("signal", sig).Warn(
+					"received signal again, not waiting any longer")
+				s.abortRunning(done)
+				return false
+			}
+		}
+	}
+}
+
+// abortRunning cancels all task runs in progress, including their transfers,
+// and waits at most abortGrace for them to wind down
+func (s *Sync) abortRunning(done <-chan bool) {
+
+	if s.abortAll == nil {
+		return
+	}
+
+	log.Warn("aborting task runs in progress")
+	s.abortAll()
+
+	select {
+	case <-done:
+	case <-time.After(abortGrace):
+		log.Warn("task runs in progress did not stop after aborting")
+	}
+}
+
+// runContext returns the context from which the contexts of task runs are
+// derived
+func (s *Sync) runContext() context.Context {
+	if s.runs == nil {
+		return context.Background()
+	}
+	return s.runs
+}
+
+// byDueTime returns the given tasks ordered by when they're due as per their
+// last runs on record, so that overdue tasks start first; tasks without a
+// record count as due now, and keep their order otherwise
+func byDueTime(tasks []*Task) []*Task {
+	now := time.Now()
+	due := func(t *Task) time.Time {
+		if d, ok := t.resumeDue(); ok && d.Before(now) {
+			return d
+		}
+		return now
+	}
+	ret := append([]*Task{}, tasks...)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return due(ret[i]).Before(due(ret[j]))
+	})
+	return ret
+}
+
+// waitGroupDone returns a channel that is closed once the wait group is done
+func waitGroupDone(wg *gosync.WaitGroup) <-chan bool {
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// runTask syncs the given task in the background, as soon as a worker is
+// available; if the task is still syncing from a previous run, it is skipped,
+// so that a task never overlaps with itself
+func (s *Sync) runTask(t *Task, running *gosync.WaitGroup, tick bool) {
+	s.runExclusive(t, running, tick, func() { s.syncTask(t) })
+}
+
+// runEvent syncs the tag from the given push event in the background, with
+// the same restrictions as for runTask
+func (s *Sync) runEvent(e *pushEvent, running *gosync.WaitGroup) {
+	s.runExclusive(e.task, running, true, func() { s.syncEvent(e) })
+}
+
+//
+func (s *Sync) runExclusive(t *Task, running *gosync.WaitGroup, tick bool,
+	do func()) {
+
+	if t.isPaused() {
+		log.WithField("task", t.Name).Info("task paused, skipping")
+		return
+	}
+
+	if !t.tryStart() {
+		log.WithField("task", t.Name).Info("task still running, skipping")
+		return
+	}
+
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		s.queue.acquire(t, s.workers)
+		if s.isStopping() {
+			log.WithField("task", t.Name).Info("stopping, task run skipped")
+		} else {
+			do()
+		}
+		<-s.workers
+		t.finish()
+		s.queue.notify()
+		if tick {
+			s.tick() // send a tick
+		}
+	}()
+}
+
 //
 func (s *Sync) syncTask(t *Task) {
 
-	if t.tooSoon() {
+	if !t.takeForce() && t.tooSoon() {
 		log.WithField("task", t.Name).Info("task fired too soon, skipping")
 		return
 	}
@@ -175,49 +730,750 @@ func (s *Sync) syncTask(t *Task) {
 		"task":   t.Name,
 		"source": t.Source.Registry,
 		"target": t.Target.Registry}).Info("syncing task")
+	s.events.taskStart(t)
 	t.failed = false
+	t.deferred = false
+	t.runErrors, t.runImages, t.runTags, t.runBytes = nil, 0, 0, 0
+	t.runMapping, t.runResults = nil, nil
+	start := time.Now()
+
+	if t.Report != nil {
+		t.report = newTaskReport(t.Name)
+	}
+
+	t.span = s.tracer.NewSpan("sync task", tracing.Attributes{
+		"dregsy.task":     t.Name,
+		"registry.source": t.Source.Registry,
+		"registry.target": t.Target.Registry})
+	var mappingSpan *tracing.Span
+
+	limit := t.runLimit(s.maxRun)
+	ctx, cancel := withTimeout(s.runContext(), limit)
+	cancelMapping := func() {}
+	t.ctx = ctx
+	t.setCancel(cancel)
+
+	defer func() {
+		cancelMapping()
+		cancel()
+		t.setCancel(nil)
+		mappingSpan.End()
+		t.endMapping()
+		s.postSyncHooks(t, time.Since(start))
+		t.span.SetAttribute("dregsy.images", t.runImages)
+		t.span.SetAttribute("dregsy.tags", t.runTags)
+		t.span.End()
+		s.metrics.TaskDone(t.Name, time.Since(start), t.failed)
+		s.summary.taskDone(t.Name, t.failed)
+		s.health.taskDone(t.Name, t.failed)
+		fields := log.Fields{
+			"task":          t.Name,
+			"images":        t.runImages,
+			"tags":          t.runTags,
+			"duration":      time.Since(start).Round(time.Millisecond),
+			"failed":        t.failed,
+			SummaryLogField: true}
+		if s.countsBytes(t) {
+			fields["bytes"] = t.runBytes
+		}
+		log.WithFields(fields).Info("task run done")
+		t.setResult(&runResult{
+			Start:    start.UTC(),
+			Seconds:  time.Since(start).Seconds(),
+			Failed:   t.failed,
+			Images:   t.runImages,
+			Tags:     t.runTags,
+			Bytes:    t.runBytes,
+			Errors:   t.runErrors,
+			Mappings: t.runResults,
+		})
+		t.lastTick = time.Now()
+		t.writeReport()
+		s.events.taskEnd(t, time.Since(start))
+		s.notify(t, time.Since(start))
+	}()
+
+	relay := s.taskRelay(t)
+	if relay == nil {
+		s.taskError(t, fmt.Errorf("relay '%s' was added after startup, "+
+			"restart to use it, skipping task", t.Relay))
+		return
+	}
+
+	if s.ping == PingTask {
+		if err := relay.Prepare(); err != nil {
+			s.taskError(t, fmt.Errorf("relay not ready, skipping task: %v", err))
+			return
+		}
+	}
+
+	if !s.dryRun {
+		if err := t.hooks.PreSync(ctx, t.Name); err != nil {
+			s.taskError(t, fmt.Errorf("%v, skipping task", err))
+			return
+		}
+	}
+
+	paused := false
 
 	for _, m := range t.Mappings {
 
-		log.WithFields(log.Fields{"from": m.From, "to": m.To}).Info("mapping")
+		if paused || ctx.Err() != nil {
+			break
+		}
 
-		if err := t.Source.RefreshAuth(); err != nil {
-			log.Error(err)
-			t.fail(true)
-			continue
+		if s.isStopping() {
+			log.WithField("task", t.Name).Warn(
+				"stopping, skipping remaining mappings of task run")
+			break
 		}
-		if err := t.Target.RefreshAuth(); err != nil {
-			log.Error(err)
-			t.fail(true)
+
+		if t.stopOnError() {
+			log.WithField("task", t.Name).Warn(
+				"stopping task run due to error, as per 'on-error' setting")
+			break
+		}
+
+		log.WithFields(log.Fields{
+			"task": t.Name, "from": m.From, "to": m.To}).Info("mapping")
+
+		mappingSpan.End()
+		mappingSpan = t.span.Child("sync mapping", tracing.Attributes{
+			"dregsy.mapping.from": m.From, "dregsy.mapping.to": m.To})
+		s.mappingSummary(t)
+		t.startMapping(m)
+		cancelMapping()
+		t.ctx, cancelMapping = withTimeout(ctx, m.Timeout)
+
+		if err := s.refreshAuth(t); err != nil {
+			s.taskError(t, err)
 			continue
 		}
 
 		refs, err := t.mappingRefs(m)
 		if err != nil {
-			log.Error(err)
-			t.fail(true)
+			s.taskError(t, err)
 			continue
 		}
 
 		for _, ref := range refs {
 
+			if t.stopOnError() || t.ctx.Err() != nil {
+				break
+			}
+
+			if t.deferred || !s.ensureSpace(t) {
+				paused = true
+				break
+			}
+
+			// renews credentials that would expire during long mappings
+			if err := s.refreshAuth(t); err != nil {
+				s.taskError(t, err)
+				break
+			}
+
 			src := ref[0]
 			trgt := ref[1]
 
-			if err := t.ensureTargetExists(trgt); err != nil {
-				log.Error(err)
-				t.fail(true)
-				break
+			if !s.dryRun {
+				if err := t.ensureTargetExists(trgt); err != nil {
+					s.taskError(t, err)
+					break
+				}
+			}
+
+			if t.locked != nil {
+				// only what's pinned in the lockfile is synced
+				if err := s.syncLocked(t, m, src, trgt); err != nil {
+					s.taskError(t, err)
+				}
+				continue
+			}
+
+			if m.syncsTags() {
+				err := s.syncTags(t, m, mappingSpan, src, trgt)
+				if err != nil {
+					s.taskError(t, err)
+				}
+			}
+
+			if len(m.Digests) > 0 && !t.stopOnError() {
+				err := t.syncDigests(m.Digests, src, trgt, s.dryRun)
+				if err != nil {
+					s.taskError(t, err)
+				}
+			}
+
+			if m.IncludeUntagged && !t.stopOnError() {
+				if err := t.syncUntagged(src, trgt, s.dryRun); err != nil {
+					s.taskError(t, err)
+				}
+			}
+
+			if m.PruneTarget && !t.stopOnError() {
+				if err := t.pruneTarget(m, src, trgt, s.dryRun); err != nil {
+					s.taskError(t, err)
+				}
+			}
+
+			if m.Retention != nil && !t.stopOnError() {
+				err := t.applyRetention(m, trgt, s.dryRun)
+				if err != nil {
+					s.taskError(t, err)
+				}
+			}
+		}
+
+		if t.ctx.Err() != nil && ctx.Err() == nil {
+			s.taskError(t, fmt.Errorf(
+				"mapping '%s' exceeded its timeout of %v", m.From, m.Timeout))
+		}
+	}
+
+	s.mappingSummary(t)
+	t.endMapping()
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		s.taskError(t, fmt.Errorf(
+			"task run exceeded its time limit of %v, remaining syncs skipped",
+			limit))
+	case context.Canceled:
+		s.taskError(t, fmt.Errorf(
+			"task run cancelled, remaining syncs skipped"))
+	}
+
+	if !s.dryRun {
+		// a run cut short by shutdown or cancellation is not complete
+		if ctx.Err() != context.Canceled && !s.isStopping() {
+			t.recordRun(start)
+		}
+		t.saveState()
+	}
+}
+
+// syncLocked syncs the digests pinned in the task's lockfile for srcRef, as
+// well as those listed by digest in mapping m
+func (s *Sync) syncLocked(t *Task, m *Mapping, srcRef, trgtRef string) error {
+
+	var digests []*Digest
+	if m.syncsTags() {
+		var err error
+		if digests, err = t.lockedDigests(m, srcRef); err != nil {
+			return err
+		}
+	}
+
+	if m.IncludeUntagged || m.PruneTarget || m.Retention != nil {
+		log.WithField("ref", srcRef).Warn("syncing from lockfile, " +
+			"'include-untagged', 'prune-target', and 'retention' are not " +
+			"applied")
+	}
+
+	return t.syncDigests(
+		append(digests, m.Digests...), srcRef, trgtRef, s.dryRun)
+}
+
+//
+func (s *Sync) syncEvent(e *pushEvent) {
+
+	t := e.task
+	if t.locked != nil {
+		log.WithFields(log.Fields{"task": t.Name, "ref": e.src, "tag": e.tag}).
+			Warn("syncing from lockfile, ignoring pushed tag")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"task": t.Name, "ref": e.src, "tag": e.tag}).Info("syncing pushed tag")
+
+	// counters still hold the numbers of the task's last run; pushed tags
+	// are not included in reports
+	t.runErrors, t.runImages, t.runTags, t.runBytes = nil, 0, 0, 0
+	t.report = nil
+
+	t.span = s.tracer.NewSpan("sync pushed tag", tracing.Attributes{
+		"dregsy.task": t.Name, "image.source": e.src, "image.tag": e.tag})
+	defer t.span.End()
+
+	ctx, cancel := withTimeout(s.runContext(), t.runLimit(s.maxRun))
+	defer cancel()
+	ctx, cancelMapping := withTimeout(ctx, e.mapping.Timeout)
+	defer cancelMapping()
+	t.ctx = ctx
+	t.setCancel(cancel)
+	defer t.setCancel(nil)
+
+	if err := s.refreshAuth(t); err != nil {
+		s.taskError(t, err)
+		return
+	}
+
+	if !s.ensureSpace(t) {
+		return
+	}
+
+	if !s.dryRun {
+		if err := t.ensureTargetExists(e.trgt); err != nil {
+			s.taskError(t, err)
+			return
+		}
+	}
+
+	if err := s.syncTags(
+		t, e.mapping, t.span, e.src, e.trgt, e.tag); err != nil {
+		s.taskError(t, err)
+	}
+
+	if !s.dryRun {
+		t.saveState()
+	}
+}
+
+// ensureSpace returns false if the relay is low on disk space, in which case
+// the task run is paused until its next run, without counting as failed
+func (s *Sync) ensureSpace(t *Task) bool {
+	if g, ok := s.taskRelay(t).(SpaceGuard); ok && !s.dryRun {
+		if err := g.EnsureSpace(); err != nil {
+			log.WithField("task", t.Name).Warnf(
+				"pausing task until its next run: %v", err)
+			return false
+		}
+	}
+	return true
+}
+
+// notify sends a notification about the outcome of the task's run; a run
+// without errors following one with errors is a recovery
+func (s *Sync) notify(t *Task, d time.Duration) {
+
+	event := notify.EventSuccess
+	if t.failed {
+		event = notify.EventFailure
+	} else if t.lastFailed {
+		event = notify.EventRecovery
+	}
+	t.lastFailed = t.failed
+
+	n := &notify.Notification{
+		Event:    event,
+		Task:     t.Name,
+		Time:     time.Now().UTC(),
+		Duration: d,
+		Images:   t.runImages,
+		Tags:     t.runTags,
+		Errors:   t.runErrors,
+	}
+
+	t.notifier.Send(n)
+	if s.observer != nil {
+		s.observer(n)
+	}
+}
+
+// postSyncHooks runs the post-sync hooks of task t for the run that just
+// ended; failing hooks fail the run
+func (s *Sync) postSyncHooks(t *Task, d time.Duration) {
+
+	if s.dryRun {
+		return
+	}
+
+	status := hooks.OnSuccess
+	if t.failed {
+		status = hooks.OnFailure
+	}
+
+	// the run's context may already be done, so hooks get their own
+	if err := t.hooks.PostSync(context.Background(), &hooks.Result{
+		Task:    t.Name,
+		Time:    time.Now().UTC(),
+		Status:  status,
+		Seconds: d.Seconds(),
+		Images:  t.runImages,
+		Tags:    t.runTags,
+		Errors:  t.runErrors,
+	}); err != nil {
+		s.taskError(t, err)
+	}
+}
+
+// refreshAuth refreshes the credentials of source and target of task t if
+// due, and records their expiry, if known
+func (s *Sync) refreshAuth(t *Task) error {
+	for _, l := range []*Location{t.Source, t.Target} {
+		if err := l.RefreshAuth(); err != nil {
+			return err
+		}
+		if exp := l.CredentialsExpiry(); !exp.IsZero() {
+			s.metrics.CredentialsExpiry(l.Registry, exp)
+		}
+	}
+	return nil
+}
+
+// taskError records an error during a task run; depending on the task's
+// 'on-error' policy, the task run, or the whole sync run is to be stopped
+func (s *Sync) taskError(t *Task, err error) {
+
+	log.WithField("task", t.Name).Error(err)
+	t.fail(true)
+	t.span.Fail(err)
+	if len(t.runErrors) < maxNotifyErrors {
+		t.runErrors = append(t.runErrors, err.Error())
+	}
+	if mr := t.runMapping; mr != nil {
+		mr.Failed = true
+		if len(mr.Errors) < maxNotifyErrors {
+			mr.Errors = append(mr.Errors, err.Error())
+		}
+	}
+	s.metrics.SyncError(t.Name)
+	atomic.StoreInt32(&s.failed, 1)
+
+	if t.OnError == OnErrorFailRun {
+		select {
+		case s.abort <- true:
+		default:
+		}
+	}
+}
+
+// syncTags syncs the tags of the given mapping from src to trgt, traced as
+// child of parent; when only is given, just those of the mapping's tags that
+// are also contained in only are synced
+func (s *Sync) syncTags(t *Task, m *Mapping, parent *tracing.Span,
+	src, trgt string, only ...string) (ret error) {
+
+	ts := m.tagSet
+	var considered, selected, synced []string
+	var gateErr error
+
+	report := t.report.ref(m, src, trgt)
+	span := parent.Child("sync ref", tracing.Attributes{
+		"image.source": src, "image.target": trgt})
+	defer func() {
+		s.summary.add(t.Name, src, trgt, synced, ret)
+		var images map[string]*imageInfo
+		if s.countsBytes(t) {
+			images = t.lookupImages(src, synced)
+			var bytes int64
+			for _, img := range images {
+				bytes += img.size
+			}
+			t.runBytes += bytes
+			s.metrics.BytesSynced(t.Name, bytes)
+		}
+		report.done(m, considered, selected, synced, images, ret)
+		s.events.refDone(t, m, src, trgt, considered, selected, synced,
+			images, ret)
+		span.SetAttribute("dregsy.tags.selected", len(selected))
+		span.SetAttribute("dregsy.tags.synced", len(synced))
+		span.Fail(ret)
+		span.End()
+	}()
+
+	// when tags need to be filtered before syncing, synced in parallel, or
+	// counted for metrics, summary, report, or task observer, we expand the tag
+	// set here and hand only the remaining tags over to the relay
+	if t.state != nil || t.scanner != nil || t.verifier != nil ||
+		m.RequireReferrer != "" || m.Limit > 0 || t.SkipExisting ||
+		t.TagParallelism > 1 ||
+		s.metrics != nil || s.summary != nil || s.dryRun || len(only) > 0 ||
+		m.excludeTags != nil || m.CopyReferrers || t.signer != nil ||
+		t.DockerHubPacing || t.Report != nil || s.observer != nil ||
+		t.CheckDigests || t.trustCheck != nil || t.trustSign != nil ||
+		t.Target.ImmutableTags || s.terminal || s.events != nil {
+
+		var err error
+		if selected, err = t.selectTags(m, src, only); err != nil {
+			return err
+		}
+
+		considered = selected
+
+		if t.state != nil {
+			selected = t.filterChangedTags(src, trgt, selected)
+		}
+
+		if t.SkipExisting && len(selected) > 0 {
+			selected = t.filterExisting(m, src, trgt, selected)
+		}
+
+		if t.Target.ImmutableTags && len(selected) > 0 {
+			var immErr error
+			if selected, immErr = t.filterImmutable(
+				m, src, trgt, selected); gateErr == nil {
+				gateErr = immErr
+			}
+		}
+
+		if m.RequireReferrer != "" && len(selected) > 0 {
+			if selected, err = t.filterByReferrers(
+				src, selected, m.RequireReferrer); err != nil {
+				return err
+			}
+		}
+
+		if t.verifier != nil && len(selected) > 0 && !s.dryRun {
+			var verifyErr error
+			if selected, verifyErr = t.verifyTags(
+				src, selected); gateErr == nil {
+				gateErr = verifyErr
+			}
+		}
+
+		if t.trustCheck != nil && len(selected) > 0 && !s.dryRun {
+			var trustErr error
+			if selected, trustErr = t.verifyTrust(
+				src, selected); gateErr == nil {
+				gateErr = trustErr
 			}
+		}
+
+		if t.scanner != nil && len(selected) > 0 && !s.dryRun {
+			var scanErr error
+			if selected, scanErr = t.scanTags(
+				src, selected, report); gateErr == nil {
+				gateErr = scanErr
+			}
+		}
+
+		if t.DockerHubPacing && len(selected) > 0 && !s.dryRun {
+			selected = t.paceRateLimit(src, selected)
+		}
+
+		if len(selected) == 0 {
+			log.WithField("ref", src).Info("no tags left to sync, skipping")
+			return gateErr
+		}
+
+		// tag list is always non-empty here, so the resulting tag set won't
+		// be taken as 'all tags' by the relay
+		if ts, err = tags.NewTagSet(selected); err != nil {
+			return err
+		}
+	}
+
+	if s.dryRun {
+		for _, tag := range selected {
+			log.WithFields(log.Fields{"task": t.Name, "tag": tag,
+				"target-tag": m.targetTag(tag)}).Infof(
+				"dry run, would sync '%s' to '%s'", src, trgt)
+		}
+		return gateErr
+	}
+
+	synced = selected
+	var err error
 
-			if err := s.relay.Sync(src, t.Source.GetAuth(), t.Source.SkipTLSVerify,
-				trgt, t.Target.GetAuth(), t.Target.SkipTLSVerify, m.tagSet,
-				t.Verbose); err != nil {
-				log.Error(err)
-				t.fail(true)
+	// for reporting, tags are synced one by one, to know how long each took
+	if (t.TagParallelism > 1 || t.Report != nil) && len(selected) > 1 {
+		synced, err = s.syncTagsParallel(
+			t, m, src, trgt, selected, report, span)
+	} else {
+		start := time.Now()
+		if err = s.relaySync(t, m, src, trgt, ts, span); err != nil {
+			synced = nil
+		} else if len(selected) == 1 {
+			report.tookTime(selected[0], time.Since(start))
+		}
+	}
+
+	// a deferred image doesn't count as synced, except for the tags that
+	// made it before hitting the rate limit
+	deferred := false
+	if err != nil && t.DockerHubPacing && registry.IsRateLimited(err) {
+		log.WithFields(log.Fields{"task": t.Name, "ref": src}).Warnf(
+			"deferring sync to next run due to Docker Hub rate limit: %v", err)
+		t.deferred = true
+		deferred = true
+		err = nil
+	}
+
+	if (err == nil && !deferred) || len(synced) > 0 {
+		s.metrics.ImageSynced(t.Name, len(synced))
+		t.runImages++
+		t.runTags += len(synced)
+	}
+
+	if t.Cleanup && err == nil && !deferred {
+		if c, ok := s.taskRelay(t).(Cleaner); ok {
+			if cErr := c.Cleanup(
+				t.context(), src, trgt, t.CleanupDangling); cErr != nil {
+				log.WithField("task", t.Name).Warn(cErr)
 			}
 		}
 	}
 
-	t.lastTick = time.Now()
+	// tags failing the digest check are not recorded, so that they are
+	// synced again in the next run
+	checked := synced
+	if t.CheckDigests && len(synced) > 0 {
+		var dErr error
+		if checked, dErr = t.checkDigests(m, src, trgt, synced); err == nil {
+			err = dErr
+		}
+	}
+
+	if t.state != nil {
+		t.recordTags(src, trgt, checked)
+	}
+
+	if m.CopyReferrers && len(synced) > 0 {
+		if refErr := t.syncReferrers(src, trgt, synced); err == nil {
+			err = refErr
+		}
+	}
+
+	if t.signer != nil && len(synced) > 0 {
+		trgtTags := make([]string, 0, len(synced))
+		for _, tag := range synced {
+			trgtTags = append(trgtTags, m.targetTag(tag))
+		}
+		if signErr := t.signTags(trgt, trgtTags); err == nil {
+			err = signErr
+		}
+	}
+
+	if t.trustSign != nil && len(synced) > 0 {
+		trgtTags := make([]string, 0, len(synced))
+		for _, tag := range synced {
+			trgtTags = append(trgtTags, m.targetTag(tag))
+		}
+		if signErr := t.signTrust(trgt, trgtTags); err == nil {
+			err = signErr
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	return gateErr
+}
+
+// countsBytes returns whether the size of synced images is looked up for the
+// given task; relays don't report what they transferred, so this takes an
+// extra request per synced tag, and is only done when needed
+func (s *Sync) countsBytes(t *Task) bool {
+	return t.report != nil || s.terminal || s.events != nil || s.metrics != nil
+}
+
+// relaySync hands the given tag set over to the relay, retrying as per the
+// task's retry settings; the relay traces its operations as children of span;
+// the task's state file, or else the in-memory blob cache, is passed along for
+// mounting blobs
+func (s *Sync) relaySync(t *Task, m *Mapping, src, trgt string,
+	ts *tags.TagSet, span *tracing.Span) error {
+	ts.SetRewrite(m.tagRewrite)
+	ctx := t.context()
+	if t.state != nil {
+		ctx = registry.WithBlobCache(ctx, t.state)
+	} else if s.blobs != nil {
+		ctx = registry.WithBlobCache(ctx, s.blobs)
+	}
+	err := t.retry(src, func() error {
+		return s.taskRelay(t).Sync(ctx, src, t.Source.GetAuth(),
+			t.Source.insecure(), trgt, t.Target.GetAuth(),
+			t.Target.insecure(), ts, t.platforms(m), t.throttle, span,
+			t.verbose(m) && !s.quiet)
+	})
+	if err != nil {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			return fmt.Errorf("sync of '%s' timed out: %v", src, err)
+		case context.Canceled:
+			return fmt.Errorf("sync of '%s' cancelled: %v", src, err)
+		}
+	}
+	return err
+}
+
+// withTimeout derives a context from parent that is done after timeout, or
+// only when cancelled if timeout is 0
+func withTimeout(parent context.Context, timeout time.Duration) (
+	context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// syncTagsParallel hands each of the given tags over to the relay separately,
+// with up to the task's tag parallelism syncs running concurrently; returns
+// the tags that were synced successfully
+func (s *Sync) syncTagsParallel(t *Task, m *Mapping, src, trgt string,
+	tagList []string, report *refReport, span *tracing.Span) (
+	[]string, error) {
+
+	var mutex gosync.Mutex
+	var running gosync.WaitGroup
+	parallelism := t.TagParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	workers := make(chan bool, parallelism)
+
+	var synced []string
+	failed := 0
+
+	for _, tag := range tagList {
+
+		ts, err := tags.NewTagSet([]string{tag})
+		if err != nil {
+			return nil, err
+		}
+
+		running.Add(1)
+		workers <- true
+
+		go func(tag string, ts *tags.TagSet) {
+
+			defer func() {
+				<-workers
+				running.Done()
+			}()
+
+			start := time.Now()
+			tagSpan := span.Child(
+				"sync tag", tracing.Attributes{"image.tag": tag})
+			err := s.relaySync(t, m, src, trgt, ts, tagSpan)
+			report.tookTime(tag, time.Since(start))
+			tagSpan.Fail(err)
+			tagSpan.End()
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if err != nil {
+				log.WithFields(log.Fields{"ref": src, "tag": tag}).Error(err)
+				failed++
+			} else {
+				synced = append(synced, tag)
+			}
+		}(tag, ts)
+	}
+
+	running.Wait()
+	sort.Strings(synced)
+
+	if failed > 0 {
+		return synced, fmt.Errorf("%d tag(s) of '%s' failed to sync", failed, src)
+	}
+	return synced, nil
+}
+
+// intersect returns those elements of a that are also contained in b
+func intersect(a, b []string) []string {
+	set := make(map[string]bool, len(b))
+	for _, e := range b {
+		set[e] = true
+	}
+	var ret []string
+	for _, e := range a {
+		if set[e] {
+			ret = append(ret, e)
+		}
+	}
+	return ret
 }
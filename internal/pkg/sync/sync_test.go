@@ -0,0 +1,801 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/hooks"
+	"github.com/xelalexv/dregsy/internal/pkg/notify"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+	"github.com/xelalexv/dregsy/internal/pkg/tracing"
+	"github.com/xelalexv/dregsy/internal/pkg/util"
+)
+
+// mockRelay records how many syncs were running at the same time, fails syncs
+// for the refs given in fail, and blocks syncs for the refs given in hang until
+// they are cancelled
+type mockRelay struct {
+	mutex   gosync.Mutex
+	current int
+	max     int
+	synced  []string
+	fail    map[string]bool
+	hang    map[string]bool
+}
+
+//
+func (r *mockRelay) Prepare() error { return nil }
+
+//
+func (r *mockRelay) Dispose() error { return nil }
+
+//
+func (r *mockRelay) Sync(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	trgtRef, trgtAuth string, trgtSkipTLSVerify bool, ts *tags.TagSet,
+	platforms []string, throttle *util.Throttle, span *tracing.Span,
+	verbose bool) error {
+
+	r.mutex.Lock()
+	r.current++
+	if r.current > r.max {
+		r.max = r.current
+	}
+	r.synced = append(r.synced, srcRef)
+	r.mutex.Unlock()
+
+	if r.fail[srcRef] {
+		r.mutex.Lock()
+		r.current--
+		r.mutex.Unlock()
+		return errors.New("sync failed")
+	}
+
+	wait := time.After(100 * time.Millisecond)
+	if r.hang[srcRef] {
+		wait = nil
+	}
+
+	var err error
+	select {
+	case <-wait:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	r.mutex.Lock()
+	r.current--
+	r.mutex.Unlock()
+
+	return err
+}
+
+//
+func TestParallelTasks(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	trySync := func(parallelism, tasks, wantMax int) {
+
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+
+		relay := &mockRelay{}
+		conf := &SyncConfig{Ping: PingOff, Parallelism: parallelism}
+
+		for ix := 0; ix < tasks; ix++ {
+			m := &Mapping{From: fmt.Sprintf("image-%d", ix)}
+			th.AssertNoError(m.validate())
+			conf.Tasks = append(conf.Tasks, &Task{
+				Name:     fmt.Sprintf("task-%d", ix),
+				Source:   &Location{Registry: "source.example.com"},
+				Target:   &Location{Registry: "target.example.com"},
+				Mappings: []*Mapping{m},
+			})
+		}
+
+		s := &Sync{
+			relay:    relay,
+			ping:     conf.Ping,
+			workers:  make(chan bool, conf.Parallelism),
+			shutdown: make(chan bool),
+			ticks:    make(chan bool, 1),
+		}
+
+		th.AssertNoError(s.SyncFromConfig(conf))
+		th.AssertEqual(tasks, len(relay.synced))
+		th.AssertEqual(wantMax, relay.max)
+	}
+
+	trySync(1, 3, 1)
+	trySync(2, 3, 2)
+	trySync(4, 3, 3)
+}
+
+//
+func TestTagParallelism(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "image", Tags: []string{"1.0", "1.1", "1.2", "1.3"}}
+	th.AssertNoError(m.validate())
+
+	task := &Task{
+		Name:           "test",
+		Source:         &Location{Registry: "source.example.com"},
+		Target:         &Location{Registry: "target.example.com"},
+		Mappings:       []*Mapping{m},
+		TagParallelism: 3,
+	}
+
+	relay := &mockRelay{}
+	s := &Sync{relay: relay}
+
+	th.AssertNoError(s.syncTags(task, m, nil,
+		"source.example.com/image", "target.example.com/image"))
+	th.AssertEqual(4, len(relay.synced))
+	th.AssertEqual(3, relay.max)
+}
+
+//
+func TestOnError(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	newTask := func(name string, interval int, onError string,
+		from ...string) *Task {
+		task := &Task{
+			Name:     name,
+			Interval: interval,
+			Source:   &Location{Registry: "source.example.com"},
+			Target:   &Location{Registry: "target.example.com"},
+			OnError:  onError,
+		}
+		for _, f := range from {
+			m := &Mapping{From: f}
+			th.AssertNoError(m.validate())
+			task.Mappings = append(task.Mappings, m)
+		}
+		return task
+	}
+
+	trySync := func(wantSynced []string, tasks ...*Task) {
+
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+
+		relay := &mockRelay{fail: map[string]bool{
+			"source.example.com/broken": true}}
+		s := &Sync{
+			relay:    relay,
+			ping:     PingOff,
+			workers:  make(chan bool, 1),
+			abort:    make(chan bool, 1),
+			shutdown: make(chan bool),
+			ticks:    make(chan bool, 1),
+		}
+
+		th.AssertError(s.SyncFromConfig(&SyncConfig{Tasks: tasks}),
+			"one or more tasks had errors")
+		th.AssertEquivalentSlices(wantSynced, relay.synced)
+	}
+
+	trySync([]string{"source.example.com/broken", "source.example.com/fine"},
+		newTask("test", 0, OnErrorContinue, "broken", "fine"))
+
+	trySync([]string{"source.example.com/broken"},
+		newTask("test", 0, OnErrorFailTask, "broken", "fine"))
+
+	// the periodic task never starts, so the run ends right away
+	trySync([]string{"source.example.com/broken"},
+		newTask("one-off", 0, OnErrorFailRun, "broken"),
+		newTask("periodic", 60, OnErrorContinue, "fine"))
+}
+
+//
+func TestTimeouts(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	trySync := func(maxRun, taskTimeout, mappingTimeout time.Duration,
+		wantSynced []string, wantErr string) {
+
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+
+		task := &Task{
+			Name:    "test",
+			Source:  &Location{Registry: "source.example.com"},
+			Target:  &Location{Registry: "target.example.com"},
+			Timeout: taskTimeout,
+		}
+		for _, f := range []string{"hung", "fine"} {
+			m := &Mapping{From: f, Timeout: mappingTimeout}
+			th.AssertNoError(m.validate())
+			task.Mappings = append(task.Mappings, m)
+		}
+
+		relay := &mockRelay{hang: map[string]bool{
+			"source.example.com/hung": true}}
+		s := &Sync{
+			relay:    relay,
+			ping:     PingOff,
+			maxRun:   maxRun,
+			workers:  make(chan bool, 1),
+			shutdown: make(chan bool),
+			ticks:    make(chan bool, 1),
+		}
+
+		th.AssertError(s.SyncFromConfig(&SyncConfig{Tasks: []*Task{task}}),
+			"one or more tasks had errors")
+		th.AssertEquivalentSlices(wantSynced, relay.synced)
+
+		res := task.lastResult()
+		th.AssertNotNil(res)
+		th.AssertTrue(res.Failed)
+		found := false
+		for _, e := range res.Errors {
+			found = found || strings.Contains(e, wantErr)
+		}
+		th.AssertTrue(found)
+	}
+
+	// a hung mapping is given up, and the next one is synced
+	trySync(0, 0, 100*time.Millisecond,
+		[]string{"source.example.com/hung", "source.example.com/fine"},
+		"mapping '/hung' exceeded its timeout of 100ms")
+
+	// the whole task run is given up
+	trySync(0, 100*time.Millisecond, 0,
+		[]string{"source.example.com/hung"},
+		"task run exceeded its time limit of 100ms")
+	trySync(100*time.Millisecond, time.Minute, 0,
+		[]string{"source.example.com/hung"},
+		"task run exceeded its time limit of 100ms")
+
+	task := &Task{Timeout: time.Minute}
+	th.AssertEqual(time.Minute, task.runLimit(0))
+	th.AssertEqual(time.Second, task.runLimit(time.Second))
+	th.AssertEqual(time.Minute, task.runLimit(time.Hour))
+	th.AssertEqual(time.Hour, (&Task{}).runLimit(time.Hour))
+}
+
+//
+func TestDryRun(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "image", Tags: []string{"1.0", "1.1"}}
+	th.AssertNoError(m.validate())
+
+	task := &Task{
+		Name:     "test",
+		Source:   &Location{Registry: "source.example.com"},
+		Target:   &Location{Registry: "target.example.com"},
+		Mappings: []*Mapping{m},
+	}
+
+	relay := &mockRelay{}
+	s := &Sync{relay: relay, dryRun: true}
+
+	th.AssertNoError(s.syncTags(task, m, nil,
+		"source.example.com/image", "target.example.com/image"))
+	th.AssertEqual(0, len(relay.synced))
+}
+
+// cleaningRelay is a mockRelay that also records cleanups
+type cleaningRelay struct {
+	mockRelay
+	cleaned  []string
+	dangling bool
+}
+
+//
+func (r *cleaningRelay) Cleanup(ctx context.Context, srcRef, trgtRef string,
+	dangling bool) error {
+	r.cleaned = append(r.cleaned, srcRef, trgtRef)
+	r.dangling = dangling
+	return nil
+}
+
+//
+func TestCleanup(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "image"}
+	th.AssertNoError(m.validate())
+
+	task := &Task{
+		Name:     "test",
+		Source:   &Location{Registry: "source.example.com"},
+		Target:   &Location{Registry: "target.example.com"},
+		Mappings: []*Mapping{m},
+	}
+
+	relay := &cleaningRelay{}
+	s := &Sync{relay: relay}
+
+	th.AssertNoError(s.syncTags(task, m, nil,
+		"source.example.com/image", "target.example.com/image"))
+	th.AssertEqual(0, len(relay.cleaned))
+
+	task.Cleanup = true
+	task.CleanupDangling = true
+	th.AssertNoError(s.syncTags(task, m, nil,
+		"source.example.com/image", "target.example.com/image"))
+	th.AssertEqualSlices(
+		[]string{"source.example.com/image", "target.example.com/image"},
+		relay.cleaned)
+	th.AssertTrue(relay.dangling)
+
+	relay.cleaned = nil
+	relay.fail = map[string]bool{"source.example.com/image": true}
+	th.AssertError(s.syncTags(task, m, nil,
+		"source.example.com/image", "target.example.com/image"), "sync failed")
+	th.AssertEqual(0, len(relay.cleaned))
+}
+
+// rateLimitedRelay is a cleaningRelay that always hits the pull rate limit
+type rateLimitedRelay struct {
+	cleaningRelay
+}
+
+//
+func (r *rateLimitedRelay) Sync(ctx context.Context,
+	srcRef, srcAuth string, srcSkipTLSVerify bool,
+	trgtRef, trgtAuth string, trgtSkipTLSVerify bool, ts *tags.TagSet,
+	platforms []string, throttle *util.Throttle, span *tracing.Span,
+	verbose bool) error {
+	return errors.New("toomanyrequests: You have reached your pull rate limit")
+}
+
+//
+func TestDeferral(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// pacing lists the tags and checks the quota, so a source is needed
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	img, err := gocrrandom.Image(1024, 1)
+	th.AssertNoError(err)
+	ref, err := gocrname.NewTag(reg + "/image:1.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(ref, img))
+
+	m := &Mapping{From: "image", Tags: []string{"1.0"}}
+	th.AssertNoError(m.validate())
+
+	task := &Task{
+		Name:     "test",
+		Source:   &Location{Registry: reg},
+		Target:   &Location{Registry: "target.example.com"},
+		Mappings: []*Mapping{m},
+		Cleanup:  true,
+	}
+
+	relay := &rateLimitedRelay{}
+	s := &Sync{relay: relay}
+
+	// without pacing, hitting the rate limit is an error
+	th.AssertError(s.syncTags(task, m, nil,
+		reg+"/image", "target.example.com/image"), "toomanyrequests")
+	th.AssertFalse(task.deferred)
+
+	// with pacing, the image is deferred, and neither counted nor cleaned up
+	task.DockerHubPacing = true
+	th.AssertNoError(s.syncTags(task, m, nil,
+		reg+"/image", "target.example.com/image"))
+	th.AssertTrue(task.deferred)
+	th.AssertEqual(0, task.runImages)
+	th.AssertEqual(0, task.runTags)
+	th.AssertEqual(0, len(relay.cleaned))
+}
+
+// lowSpaceRelay is a mockRelay that is always low on disk space
+type lowSpaceRelay struct {
+	mockRelay
+}
+
+//
+func (r *lowSpaceRelay) EnsureSpace() error {
+	return errors.New("only 1GiB of disk space left")
+}
+
+//
+func TestLowSpace(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "image"}
+	th.AssertNoError(m.validate())
+
+	task := &Task{
+		Name:     "test",
+		Source:   &Location{Registry: "source.example.com"},
+		Target:   &Location{Registry: "target.example.com"},
+		Mappings: []*Mapping{m},
+	}
+
+	relay := &lowSpaceRelay{}
+	s := &Sync{relay: relay, ping: PingOff}
+
+	s.syncTask(task)
+	th.AssertEqual(0, len(relay.synced))
+	th.AssertTrue(!task.failed)
+}
+
+//
+func TestGracefulShutdown(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryShutdown := func(timeout time.Duration, hang, wantDone bool,
+		wantSynced int) {
+
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+
+		task := &Task{
+			Name:   "test",
+			Source: &Location{Registry: "source.example.com"},
+			Target: &Location{Registry: "target.example.com"},
+		}
+		for _, from := range []string{"one", "two", "three"} {
+			m := &Mapping{From: from}
+			th.AssertNoError(m.validate())
+			task.Mappings = append(task.Mappings, m)
+		}
+
+		relay := &mockRelay{hang: map[string]bool{
+			"source.example.com/one": hang}}
+		s := &Sync{
+			relay:   relay,
+			ping:    PingOff,
+			workers: make(chan bool, 1),
+			timeout: timeout,
+		}
+		s.runs, s.abortAll = context.WithCancel(context.Background())
+
+		var running gosync.WaitGroup
+		s.runTask(task, &running, false)
+		time.Sleep(50 * time.Millisecond)
+		s.stop()
+
+		// no new task runs once stopping
+		s.runTask(&Task{Name: "other"}, &running, false)
+
+		th.AssertEqual(wantDone, s.awaitRunning(&running, nil))
+		running.Wait()
+		th.AssertEqual(wantSynced, len(relay.synced))
+	}
+
+	// current mapping completes, remaining mappings are skipped
+	tryShutdown(time.Second, false, true, 1)
+	// waiting ends before current mapping completes, which is then aborted
+	tryShutdown(10*time.Millisecond, false, false, 1)
+	// a hung transfer is aborted once waiting ends
+	start := time.Now()
+	tryShutdown(10*time.Millisecond, true, false, 1)
+	th.AssertTrue(time.Since(start) < abortGrace)
+}
+
+//
+func TestCancelRun(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	task := &Task{
+		Name:   "test",
+		Source: &Location{Registry: "source.example.com"},
+		Target: &Location{Registry: "target.example.com"},
+	}
+	for _, from := range []string{"hung", "fine"} {
+		m := &Mapping{From: from}
+		th.AssertNoError(m.validate())
+		task.Mappings = append(task.Mappings, m)
+	}
+
+	th.AssertFalse(task.cancelRun())
+
+	relay := &mockRelay{hang: map[string]bool{
+		"source.example.com/hung": true}}
+	s := &Sync{relay: relay, ping: PingOff, workers: make(chan bool, 1)}
+
+	var running gosync.WaitGroup
+	s.runTask(task, &running, false)
+	time.Sleep(50 * time.Millisecond)
+	th.AssertTrue(task.cancelRun())
+	running.Wait()
+
+	th.AssertFalse(task.cancelRun())
+	th.AssertEqualSlices([]string{"source.example.com/hung"}, relay.synced)
+	res := task.lastResult()
+	th.AssertTrue(res.Failed)
+	th.AssertEqual(2, len(res.Errors))
+	th.AssertTrue(strings.Contains(res.Errors[0],
+		"sync of 'source.example.com/hung' cancelled"))
+	th.AssertEqual("task run cancelled, remaining syncs skipped", res.Errors[1])
+}
+
+//
+func TestNotifyEvents(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var events []string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			n := &notify.Notification{}
+			th.AssertNoError(json.NewDecoder(r.Body).Decode(n))
+			events = append(events, n.Event)
+		}))
+	defer srv.Close()
+
+	m := &Mapping{From: "image"}
+	th.AssertNoError(m.validate())
+
+	task := &Task{
+		Name:     "test",
+		Source:   &Location{Registry: "source.example.com"},
+		Target:   &Location{Registry: "target.example.com"},
+		Mappings: []*Mapping{m},
+		notifier: notify.New(&notify.Config{
+			Events: []string{notify.EventFailure, notify.EventRecovery,
+				notify.EventSuccess},
+			Webhook: &notify.WebhookConfig{URL: srv.URL},
+		}),
+	}
+
+	relay := &mockRelay{fail: map[string]bool{"source.example.com/image": true}}
+	s := &Sync{relay: relay, ping: PingOff}
+
+	s.syncTask(task)
+	delete(relay.fail, "source.example.com/image")
+	s.syncTask(task)
+	s.syncTask(task)
+
+	th.AssertEqualSlices([]string{notify.EventFailure, notify.EventRecovery,
+		notify.EventSuccess}, events)
+}
+
+// daemonRelay is a mockRelay whose daemon is not reachable
+type daemonRelay struct {
+	mockRelay
+	disposed bool
+}
+
+//
+func (r *daemonRelay) Prepare() error {
+	return errors.New("cannot reach daemon")
+}
+
+//
+func (r *daemonRelay) Dispose() error {
+	r.disposed = true
+	return nil
+}
+
+// failingRelay is a mockRelay that is never ready
+type failingRelay struct {
+	mockRelay
+}
+
+//
+func (r *failingRelay) Prepare() error {
+	return errors.New("cannot find skopeo")
+}
+
+//
+func TestRelayFallback(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	// without fallback, relay has to be ready
+	relay := &daemonRelay{}
+	s := &Sync{relay: relay, health: newHealth(relay, nil)}
+	th.AssertError(s.prepareRelay(), "cannot reach daemon")
+	th.AssertFalse(relay.disposed)
+
+	// fallback that isn't ready either
+	s.fallback = &failingRelay{}
+	th.AssertError(s.prepareRelay(),
+		"fallback relay not ready either: cannot find skopeo")
+	th.AssertTrue(s.relay == relay)
+
+	// fallback replaces relay
+	fallback := &mockRelay{}
+	s.fallback = fallback
+	th.AssertNoError(s.prepareRelay())
+	th.AssertTrue(relay.disposed)
+	th.AssertTrue(s.relay == fallback)
+	th.AssertTrue(s.health.relay == fallback)
+	th.AssertNil(s.fallback)
+
+	// fallback relay is only created when no daemon is required
+	conf, err := LoadConfig(th.GetFixture("config/docker-fallback.yaml"))
+	th.AssertNoError(err)
+	s, err = New(conf)
+	th.AssertNoError(err)
+	th.AssertNotNil(s.fallback)
+	th.AssertEqual("direct", s.fbID)
+
+	conf.RequireDaemon = true
+	s, err = New(conf)
+	th.AssertNoError(err)
+	th.AssertNil(s.fallback)
+}
+
+//
+func TestTaskRelays(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "image"}
+	th.AssertNoError(m.validate())
+
+	task := &Task{
+		Name:     "heavy",
+		Relay:    "pull-host",
+		Source:   &Location{Registry: "source.example.com"},
+		Target:   &Location{Registry: "target.example.com"},
+		Mappings: []*Mapping{m},
+	}
+
+	relay := &mockRelay{}
+	pullHost := &mockRelay{}
+	s := &Sync{relay: relay, relays: map[string]Relay{"pull-host": pullHost},
+		ping: PingOff}
+
+	s.syncTask(task)
+	th.AssertFalse(task.failed)
+	th.AssertEqual(0, len(relay.synced))
+	th.AssertEqualSlices(
+		[]string{"source.example.com/image"}, pullHost.synced)
+
+	// relay added to config after startup
+	task.Relay = "spare"
+	s.syncTask(task)
+	th.AssertTrue(task.failed)
+	th.AssertEqual(1, len(pullHost.synced))
+
+	// only relays used by tasks are checked at startup
+	s.relays["spare"] = &daemonRelay{}
+	task.Relay = "pull-host"
+	th.AssertNoError(s.prepareRelays([]*Task{task}))
+	task.Relay = "spare"
+	th.AssertError(s.prepareRelays([]*Task{task}),
+		"relay 'spare' not ready: cannot reach daemon")
+
+	// named relays are created from config
+	conf, err := LoadConfig(th.GetFixture("config/named-relays-valid.yaml"))
+	th.AssertNoError(err)
+	s, err = New(conf)
+	th.AssertNoError(err)
+	th.AssertEqual(2, len(s.relays))
+	th.AssertTrue(s.taskRelay(conf.Tasks[0]) == s.relay)
+	th.AssertNotNil(s.taskRelay(conf.Tasks[1]))
+}
+
+//
+func TestHooks(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "image"}
+	th.AssertNoError(m.validate())
+
+	out := filepath.Join(t.TempDir(), "hooks")
+	conf := &hooks.Config{
+		PreSync: []*hooks.Hook{{Command: []string{"sh", "-c", "exit 0"}}},
+		PostSync: []*hooks.Hook{{
+			Command: []string{"sh", "-c",
+				"echo $DREGSY_STATUS $DREGSY_IMAGES >> " + out},
+			On: hooks.OnAlways}},
+	}
+	th.AssertNoError(conf.Validate())
+
+	task := &Task{
+		Name:     "test",
+		Source:   &Location{Registry: "source.example.com"},
+		Target:   &Location{Registry: "target.example.com"},
+		Mappings: []*Mapping{m},
+		hooks:    hooks.New(conf),
+	}
+
+	relay := &mockRelay{}
+	s := &Sync{relay: relay, ping: PingOff}
+
+	s.syncTask(task)
+	th.AssertFalse(task.failed)
+	th.AssertEqual(1, len(relay.synced))
+
+	// failing pre-sync hook skips the task run
+	conf.PreSync[0].Command = []string{"sh", "-c", "exit 1"}
+	s.syncTask(task)
+	th.AssertTrue(task.failed)
+	th.AssertEqual(1, len(relay.synced))
+	th.AssertError(errors.New(task.runErrors[0]),
+		"'pre-sync' hook 1 failed: command 'sh': exit status 1, skipping task")
+
+	data, err := ioutil.ReadFile(out)
+	th.AssertNoError(err)
+	th.AssertEqual("success 1\nfailure 0\n", string(data))
+
+	// failing post-sync hook fails the run
+	conf.PreSync = nil
+	conf.PostSync[0].Command = []string{"sh", "-c", "exit 2"}
+	s.syncTask(task)
+	th.AssertTrue(task.failed)
+	th.AssertEqual(2, len(relay.synced))
+}
+
+//
+func TestSyncEventResetsCounters(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "image", Tags: []string{"1.0"}}
+	th.AssertNoError(m.validate())
+
+	task := &Task{
+		Name:     "test",
+		Source:   &Location{Registry: "source.example.com"},
+		Target:   &Location{Registry: "target.example.com"},
+		Mappings: []*Mapping{m},
+	}
+
+	// leftovers from the last scheduled run
+	task.runImages, task.runTags, task.runBytes = 5, 7, 1024
+	task.runErrors = []string{"stale"}
+	task.report = newTaskReport(task.Name)
+
+	relay := &mockRelay{}
+	s := &Sync{relay: relay}
+
+	s.syncEvent(&pushEvent{task: task, mapping: m,
+		src: "source.example.com/image", trgt: "target.example.com/image",
+		tag: "1.0"})
+
+	th.AssertEqual(1, len(relay.synced))
+	th.AssertEqual(1, task.runImages)
+	th.AssertEqual(1, task.runTags)
+	th.AssertEqual(int64(0), task.runBytes)
+	th.AssertEqual(0, len(task.runErrors))
+	th.AssertTrue(task.report == nil)
+}
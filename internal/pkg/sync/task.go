@@ -17,33 +17,128 @@
 package sync
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecrpublic"
+	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/xelalexv/dregsy/internal/pkg/auth"
+	"github.com/xelalexv/dregsy/internal/pkg/cosign"
+	"github.com/xelalexv/dregsy/internal/pkg/hooks"
+	"github.com/xelalexv/dregsy/internal/pkg/notary"
+	"github.com/xelalexv/dregsy/internal/pkg/notify"
 	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/scan"
+	"github.com/xelalexv/dregsy/internal/pkg/state"
+	"github.com/xelalexv/dregsy/internal/pkg/tags"
+	"github.com/xelalexv/dregsy/internal/pkg/tracing"
 	"github.com/xelalexv/dregsy/internal/pkg/util"
 )
 
+// what to do when an error occurs during a task run: 'continue' with the
+// remaining mappings, stop the task run ('fail-task'), or stop the whole sync
+// run ('fail-run')
+const (
+	OnErrorContinue = "continue"
+	OnErrorFailTask = "fail-task"
+	OnErrorFailRun  = "fail-run"
+)
+
+//
+const defaultRetryBackoff = time.Second
+const maxRetryBackoff = 5 * time.Minute
+
 //
 type Task struct {
-	Name     string     `yaml:"name"`
-	Interval int        `yaml:"interval"`
-	Source   *Location  `yaml:"source"`
-	Target   *Location  `yaml:"target"`
-	Mappings []*Mapping `yaml:"mappings"`
-	Verbose  bool       `yaml:"verbose"`
+	Name            string               `yaml:"name"`
+	Interval        int                  `yaml:"interval"`
+	Schedule        string               `yaml:"schedule"`
+	Source          *Location            `yaml:"source"`
+	Target          *Location            `yaml:"target"`
+	Mappings        []*Mapping           `yaml:"mappings"`
+	Relay           string               `yaml:"relay"`
+	Verbose         bool                 `yaml:"verbose"`
+	StateFile       string               `yaml:"state-file"`
+	Enabled         string               `yaml:"enabled"`
+	Scan            *scan.Config         `yaml:"scan"`
+	TagParallelism  int                  `yaml:"tag-parallelism"`
+	SkipExisting    bool                 `yaml:"skip-existing"`
+	CheckDigests    bool                 `yaml:"check-digests"`
+	Retries         int                  `yaml:"retries"`
+	RetryBackoff    time.Duration        `yaml:"retry-backoff"`
+	Timeout         time.Duration        `yaml:"timeout"`
+	Offset          time.Duration        `yaml:"offset"`
+	Jitter          time.Duration        `yaml:"jitter"`
+	RunOnStart      *bool                `yaml:"run-on-start"`
+	Priority        int                  `yaml:"priority"`
+	DependsOn       []string             `yaml:"depends-on"`
+	OnError         string               `yaml:"on-error"`
+	ECRRepo         *ECRRepoConfig       `yaml:"ecr-repository"`
+	Platforms       []string             `yaml:"platforms"`
+	Verify          *cosign.VerifyConfig `yaml:"verify"`
+	Sign            *cosign.SignConfig   `yaml:"sign"`
+	NotaryVerify    *notary.VerifyConfig `yaml:"notary-verify"`
+	NotarySign      *notary.SignConfig   `yaml:"notary-sign"`
+	Cleanup         bool                 `yaml:"cleanup"`
+	CleanupDangling bool                 `yaml:"cleanup-dangling"`
+	RateLimit       float64              `yaml:"rate-limit-mbps"`
+	DockerHubPacing bool                 `yaml:"dockerhub-pacing"`
+	DockerHubWait   time.Duration        `yaml:"dockerhub-max-wait"`
+	Report          *ReportConfig        `yaml:"report"`
+	Notify          *notify.Config       `yaml:"notify"`
+	Hooks           *hooks.Config        `yaml:"hooks"`
 	//
-	repoList *registry.RepoList
-	ticker   *time.Ticker
-	lastTick time.Time
-	failed   bool
+	repoList   *registry.RepoList
+	schedule   cron.Schedule
+	state      *state.Store
+	scanner    scan.Scanner
+	verifier   cosign.Verifier
+	signer     cosign.Signer
+	trustCheck notary.Verifier
+	trustSign  notary.Signer
+	throttle   *util.Throttle
+	report     *taskReport        // of the current run, if enabled
+	span       *tracing.Span      // of the current run, if tracing is enabled
+	ctx        context.Context    // of the current run or mapping, for timeouts
+	cancel     context.CancelFunc // of the current run, guarded by resultLock
+	notifier   *notify.Notifier
+	hooks      *hooks.Runner
+	disabled   string        // reason why task is disabled, empty if enabled
+	spread     time.Duration // start offset from spreading, unless 'offset' set
+	unchanged  bool          // whether the relay copies images unchanged
+	locked     LockedRefs    // when syncing from a lockfile
+	lastTick   time.Time
+	failed     bool
+	lastFailed bool           // whether the previous run had errors
+	runErrors  []string       // errors of the current run, for notifications
+	runImages  int            // images synced in the current run
+	runTags    int            // tags synced in the current run
+	runBytes   int64          // size of images synced, if known
+	runMapping *mappingResult // of the mapping currently synced
+	runResults []*mappingResult
+	tickStart  time.Time // start of ticking, guarded by resultLock
+	deferred   bool      // whether remaining syncs are deferred to the next run
+	running    int32
+	forced     int32
+	paused     int32      // set while paused via API, runs are skipped
+	result     *runResult // outcome of the last run, if any
+	resultLock gosync.Mutex
+	previous   *Task // definition replaced by a config reload, if still running
+	//
+	definition []byte // as loaded, for detecting changes on config reload
 	//
 	exit chan bool
 	done chan bool
@@ -56,6 +151,18 @@ func (t *Task) validate() error {
 		return errors.New("a task requires a name")
 	}
 
+	if t.Enabled != "" {
+		val := strings.TrimSpace(t.Enabled)
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf(
+				"task '%s' has invalid value for 'enabled': '%s'", t.Name, val)
+		}
+		if !enabled {
+			t.disable(fmt.Sprintf("'enabled' is set to '%s'", t.Enabled))
+		}
+	}
+
 	if 0 < t.Interval && t.Interval < minimumTaskInterval {
 		return fmt.Errorf(
 			"minimum task interval is %d seconds", minimumTaskInterval)
@@ -65,6 +172,147 @@ func (t *Task) validate() error {
 		return errors.New("task interval needs to be 0 or a positive integer")
 	}
 
+	if t.Schedule != "" {
+		if t.Interval > 0 {
+			return fmt.Errorf(
+				"task '%s' has both 'interval' and 'schedule' set", t.Name)
+		}
+		var err error
+		if t.schedule, err = cron.ParseStandard(t.Schedule); err != nil {
+			return fmt.Errorf(
+				"task '%s' has invalid 'schedule' '%s': %v", t.Name, t.Schedule,
+				err)
+		}
+	}
+
+	if t.Retries < 0 || t.RetryBackoff < 0 {
+		return fmt.Errorf("task '%s' has invalid retry settings, 'retries' "+
+			"and 'retry-backoff' cannot be negative", t.Name)
+	}
+	if t.Retries > 0 && t.RetryBackoff == 0 {
+		t.RetryBackoff = defaultRetryBackoff
+	}
+
+	if t.Timeout < 0 {
+		return fmt.Errorf("task '%s' has negative 'timeout'", t.Name)
+	}
+
+	if t.Offset < 0 || t.Jitter < 0 {
+		return fmt.Errorf("task '%s' has invalid start settings, 'offset' "+
+			"and 'jitter' cannot be negative", t.Name)
+	}
+	if (t.Offset > 0 || t.Jitter > 0) && !t.isPeriodic() {
+		return fmt.Errorf("task '%s' sets 'offset' or 'jitter', which "+
+			"requires an 'interval' or 'schedule'", t.Name)
+	}
+	if t.RunOnStart != nil && t.Interval == 0 {
+		return fmt.Errorf(
+			"task '%s' sets 'run-on-start', which requires an 'interval'",
+			t.Name)
+	}
+	if t.Interval > 0 && t.Jitter > time.Duration(t.Interval)*time.Second/2 {
+		return fmt.Errorf(
+			"task '%s' has 'jitter' larger than half its 'interval'", t.Name)
+	}
+
+	switch t.OnError {
+	case "":
+		t.OnError = OnErrorContinue
+	case OnErrorContinue, OnErrorFailTask, OnErrorFailRun:
+	default:
+		return fmt.Errorf(
+			"task '%s' has invalid 'on-error' policy '%s', must be one of "+
+				"'%s', '%s', or '%s'", t.Name, t.OnError, OnErrorContinue,
+			OnErrorFailTask, OnErrorFailRun)
+	}
+
+	if t.TagParallelism < 0 {
+		return fmt.Errorf("task '%s' has invalid 'tag-parallelism', "+
+			"needs to be 0 or a positive integer", t.Name)
+	}
+
+	if err := t.Scan.Validate(); err != nil {
+		return fmt.Errorf("scan settings in task '%s' invalid: %v", t.Name, err)
+	}
+	if t.Scan != nil {
+		var err error
+		if t.scanner, err = scan.NewScanner(t.Scan); err != nil {
+			return fmt.Errorf(
+				"cannot create scanner for task '%s': %v", t.Name, err)
+		}
+	}
+
+	if _, err := registry.ParsePlatforms(t.Platforms); err != nil {
+		return fmt.Errorf("task '%s' has invalid 'platforms': %v", t.Name, err)
+	}
+
+	if t.RateLimit < 0 {
+		return fmt.Errorf(
+			"task '%s' has negative 'rate-limit-mbps'", t.Name)
+	}
+	// shared among all transfers of the task, so that the limit applies to
+	// their sum
+	t.throttle = util.NewThrottle(int64(t.RateLimit * 1000 * 1000 / 8))
+
+	if t.DockerHubPacing && t.Source != nil &&
+		!registry.IsDockerHub(t.Source.Registry) {
+		return fmt.Errorf(
+			"task '%s' has 'dockerhub-pacing' set, but source is not Docker Hub",
+			t.Name)
+	}
+	if t.DockerHubWait < 0 {
+		return fmt.Errorf(
+			"task '%s' has negative 'dockerhub-max-wait'", t.Name)
+	}
+
+	if t.CleanupDangling && !t.Cleanup {
+		return fmt.Errorf(
+			"task '%s' has 'cleanup-dangling' set, but not 'cleanup'", t.Name)
+	}
+
+	if err := t.Notify.Validate(); err != nil {
+		return fmt.Errorf(
+			"notify settings in task '%s' invalid: %v", t.Name, err)
+	}
+
+	if err := t.Hooks.Validate(); err != nil {
+		return fmt.Errorf(
+			"hook settings in task '%s' invalid: %v", t.Name, err)
+	}
+	t.hooks = hooks.New(t.Hooks)
+
+	if err := t.Report.validate(); err != nil {
+		return fmt.Errorf(
+			"report settings in task '%s' invalid: %v", t.Name, err)
+	}
+
+	if err := t.Verify.Validate(); err != nil {
+		return fmt.Errorf(
+			"verify settings in task '%s' invalid: %v", t.Name, err)
+	}
+	if t.Verify != nil {
+		t.verifier = cosign.NewVerifier(t.Verify)
+	}
+
+	if err := t.Sign.Validate(); err != nil {
+		return fmt.Errorf("sign settings in task '%s' invalid: %v", t.Name, err)
+	}
+	if t.Sign != nil {
+		t.signer = cosign.NewSigner(t.Sign)
+	}
+
+	if t.NotaryVerify != nil {
+		t.trustCheck = notary.NewVerifier(t.NotaryVerify)
+	}
+
+	if err := t.NotarySign.Validate(); err != nil {
+		return fmt.Errorf(
+			"notary-sign settings in task '%s' invalid: %v", t.Name, err)
+	}
+	if t.NotarySign != nil {
+		t.trustSign = notary.NewSigner(t.NotarySign)
+	}
+
 	if err := t.Source.validate(); err != nil {
 		return fmt.Errorf(
 			"source registry in task '%s' invalid: %v", t.Name, err)
@@ -75,12 +323,50 @@ func (t *Task) validate() error {
 			"target registry in task '%s' invalid: %v", t.Name, err)
 	}
 
+	if t.Source.NormalizeRepos {
+		return fmt.Errorf(
+			"task '%s' has 'normalize-repos' set on its source, which is only "+
+				"supported for the target", t.Name)
+	}
+
+	if t.Source.ImmutableTags {
+		return fmt.Errorf(
+			"task '%s' has 'immutable-tags' set on its source, which is only "+
+				"supported for the target", t.Name)
+	}
+
+	if t.ECRRepo != nil {
+		if !t.Target.IsECR() {
+			return fmt.Errorf("task '%s' has 'ecr-repository' settings, but "+
+				"target is not an ECR registry", t.Name)
+		}
+		if err := t.ECRRepo.validate(); err != nil {
+			return fmt.Errorf(
+				"task '%s' has invalid 'ecr-repository' settings: %v",
+				t.Name, err)
+		}
+	}
+
 	hasRegexp := false
 	for _, m := range t.Mappings {
 		if err := m.validate(); err != nil {
 			return err
 		}
+		if m.Timeout > 0 && t.Timeout > 0 && m.Timeout > t.Timeout {
+			log.WithFields(log.Fields{"task": t.Name, "from": m.From}).Warn(
+				"mapping 'timeout' exceeds task 'timeout', task limit applies")
+		}
 		hasRegexp = hasRegexp || m.isRegexpFrom()
+		// targets of regular expressions are only known when syncing
+		if !m.isRegexpFrom() {
+			if _, err := t.targetRef(m, m.From); err != nil {
+				return fmt.Errorf("task '%s': %v", t.Name, err)
+			}
+		}
+	}
+
+	if err := t.validateLayouts(hasRegexp); err != nil {
+		return err
 	}
 
 	if hasRegexp {
@@ -96,9 +382,118 @@ func (t *Task) validate() error {
 	return nil
 }
 
+// validateLayouts checks that the task uses no features unavailable for OCI
+// image layouts, in case source or target are layouts; hasRegexp tells whether
+// any mapping uses a regular expression for 'from'
+func (t *Task) validateLayouts(hasRegexp bool) error {
+
+	var unsupported []string
+	seen := make(map[string]bool)
+	add := func(set bool, setting string) {
+		if set && !seen[setting] {
+			seen[setting] = true
+			unsupported = append(unsupported, setting)
+		}
+	}
+
+	if t.Source.IsLayout() {
+		add(hasRegexp, "regular expressions in 'from'")
+		add(t.Verify != nil, "verify")
+		add(t.NotaryVerify != nil, "notary-verify")
+		add(t.Scan != nil, "scan")
+	}
+
+	if t.Target.IsLayout() {
+		add(t.Sign != nil, "sign")
+		add(t.NotarySign != nil, "notary-sign")
+		for _, m := range t.Mappings {
+			for _, d := range m.Digests {
+				add(d.Tag == "", "digests without 'tag'")
+			}
+		}
+	}
+
+	if t.Source.IsLayout() || t.Target.IsLayout() {
+		for _, m := range t.Mappings {
+			add(m.IncludeUntagged, "include-untagged")
+			add(m.RequireReferrer != "", "require-referrer")
+			add(m.CopyReferrers, "copy-referrers")
+			add(m.PruneTarget, "prune-target")
+			add(m.Retention != nil, "retention")
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return fmt.Errorf("task '%s' uses an OCI image layout, which does not "+
+			"support %s", t.Name, strings.Join(unsupported, ", "))
+	}
+
+	return nil
+}
+
+//
+func (t *Task) disable(reason string) {
+	if t.disabled == "" {
+		t.disabled = reason
+	}
+}
+
+//
+func (t *Task) isEnabled() bool {
+	return t.disabled == ""
+}
+
+//
+func (t *Task) isPeriodic() bool {
+	return t.Interval > 0 || t.schedule != nil
+}
+
+// expectedInterval returns the time expected between runs of the task; for a
+// cron schedule, this is the time between its next two runs; returns 0 for
+// one-off tasks
+func (t *Task) expectedInterval() time.Duration {
+	if t.schedule != nil {
+		next := t.schedule.Next(time.Now())
+		return t.schedule.Next(next).Sub(next)
+	}
+	return time.Duration(t.Interval) * time.Second
+}
+
+// nextRun returns when the task is run next as per its interval or schedule,
+// or nil for one-off tasks; jitter is not taken into account
+func (t *Task) nextRun() *time.Time {
+	now := time.Now()
+	var next time.Time
+	switch {
+	case t.schedule != nil:
+		next = t.nextScheduled(now)
+	case t.Interval > 0:
+		t.resultLock.Lock()
+		start := t.tickStart
+		t.resultLock.Unlock()
+		if start.IsZero() {
+			return nil
+		}
+		if now.Before(start) {
+			next = start
+			break
+		}
+		i := time.Duration(t.Interval) * time.Second
+		next = start.Add((now.Sub(start)/i + 1) * i)
+	default:
+		return nil
+	}
+	return &next
+}
+
 //
 func (t *Task) startTicking(c chan *Task) {
 
+	if t.schedule != nil {
+		t.startScheduling(c)
+		return
+	}
+
 	logger := log.WithField("task", t.Name)
 	logger.Debug("task starts ticking")
 
@@ -107,23 +502,87 @@ func (t *Task) startTicking(c chan *Task) {
 		i = 3
 	}
 
-	t.ticker = time.NewTicker(time.Second * i)
-	t.lastTick = time.Now().Add(time.Second * i * (-2))
+	// without run on start, the first sync happens one interval later; when
+	// the last run is on record, the first sync happens once it's due
+	offset := t.startOffset()
+	if !t.runsOnStart() {
+		offset += time.Second * i
+	}
+	start := time.Now()
+	if due, ok := t.resumeDue(); ok {
+		offset = 0
+		if due.After(start) {
+			offset = due.Sub(start)
+		}
+	}
+	if t.lastTick.IsZero() {
+		t.lastTick = start.Add(time.Second * i * (-2))
+	}
+	t.resultLock.Lock()
+	t.tickStart = start.Add(offset)
+	t.resultLock.Unlock()
 
 	t.exit = make(chan bool, 1)
 	t.done = make(chan bool, 1)
 
 	go func() {
 
+		if offset > 0 {
+			logger.WithField("offset", offset).Info("delaying first sync")
+			if !t.wait(offset) {
+				return
+			}
+		}
+
+		ticker := time.NewTicker(time.Second * i)
+		defer ticker.Stop()
+
 		logger.Debug("sending initial fire")
-		c <- t
+		if !t.wait(t.jitter()) || !t.fire(c) {
+			return
+		}
+
+		for {
+			select {
+			case <-ticker.C:
+				logger.Debug("task firing")
+				if !t.wait(t.jitter()) || !t.fire(c) {
+					return
+				}
+			case <-t.exit:
+				logger.Debug("task exiting")
+				close(t.done)
+				return
+			}
+		}
+	}()
+}
+
+// startScheduling fires the task at the times given by its cron schedule;
+// different from tasks with an interval, there is no initial fire at start-up
+func (t *Task) startScheduling(c chan *Task) {
+
+	logger := log.WithField("task", t.Name)
+	logger.Debug("task starts scheduling")
+
+	t.exit = make(chan bool, 1)
+	t.done = make(chan bool, 1)
+
+	go func() {
 
 		for {
+			next := t.nextScheduled(time.Now())
+			logger.WithField("next", next).Info("next scheduled sync")
+			timer := time.NewTimer(time.Until(next) + t.jitter())
+
 			select {
-			case <-t.ticker.C:
+			case <-timer.C:
 				logger.Debug("task firing")
-				c <- t
+				if !t.fire(c) {
+					return
+				}
 			case <-t.exit:
+				timer.Stop()
 				logger.Debug("task exiting")
 				close(t.done)
 				return
@@ -132,8 +591,229 @@ func (t *Task) startTicking(c chan *Task) {
 	}()
 }
 
+// nextScheduled returns the next time after now at which the task is due as
+// per its schedule, shifted by its start offset
+func (t *Task) nextScheduled(now time.Time) time.Time {
+	offset := t.startOffset()
+	return t.schedule.Next(now.Add(-offset)).Add(offset)
+}
+
+// startOffset returns by how much the runs of the task are shifted against
+// its interval or schedule
+func (t *Task) startOffset() time.Duration {
+	if t.Offset > 0 {
+		return t.Offset
+	}
+	return t.spread
+}
+
+// resumeDue returns when the next run of an interval task is due as per the
+// start of its last run recorded in the state store; ok is false when there
+// is no such record
+func (t *Task) resumeDue() (due time.Time, ok bool) {
+	if t.state == nil || t.Interval == 0 {
+		return time.Time{}, false
+	}
+	last := t.state.LastRun(t.Name)
+	if last.IsZero() {
+		return time.Time{}, false
+	}
+	return last.Add(time.Duration(t.Interval) * time.Second), true
+}
+
+// recordRun records the start of a completed run in the state store, if any
+func (t *Task) recordRun(start time.Time) {
+	if t.state != nil {
+		t.state.RecordRun(t.Name, start)
+	}
+}
+
+// runsOnStart returns whether an interval task syncs right when it starts
+// ticking, i.e. at start-up or after a config reload, rather than only after
+// its first interval has passed; start offset still applies
+func (t *Task) runsOnStart() bool {
+	return t.RunOnStart == nil || *t.RunOnStart
+}
+
+// jitter returns a random delay of up to the task's jitter
+func (t *Task) jitter() time.Duration {
+	if t.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(t.Jitter) + 1))
+}
+
+// wait waits for the given duration, unless the task is told to exit
+// meanwhile, in which case false is returned
+func (t *Task) wait(d time.Duration) bool {
+
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	select {
+	case <-timer.C:
+		return true
+	case <-t.exit:
+		timer.Stop()
+		log.WithField("task", t.Name).Debug("task exiting")
+		close(t.done)
+		return false
+	}
+}
+
+// fire hands the task over to the sync loop via c, unless the task is told to
+// exit while waiting for the loop to pick it up, in which case false is returned
+func (t *Task) fire(c chan *Task) bool {
+	select {
+	case c <- t:
+		return true
+	case <-t.exit:
+		log.WithField("task", t.Name).Debug("task exiting")
+		close(t.done)
+		return false
+	}
+}
+
+// runLimit returns the time limit for a run of the task, as given by the
+// task's timeout and maxRun, whichever is shorter; 0 means no limit
+func (t *Task) runLimit(maxRun time.Duration) time.Duration {
+	if t.Timeout > 0 && (maxRun == 0 || t.Timeout < maxRun) {
+		return t.Timeout
+	}
+	return maxRun
+}
+
+// context returns the context of the current run or mapping of the task,
+// which is done once its time limit is exceeded
+func (t *Task) context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+// retry runs op, and retries it as per the task's retry settings if it fails;
+// the wait time between attempts doubles with each retry, and is randomized
+// to avoid retries of concurrent tasks hitting a registry at the same time; no
+// more retries are made once the current run or mapping has timed out
+func (t *Task) retry(ref string, op func() error) error {
+
+	err := op()
+	backoff := t.RetryBackoff
+
+	ctx := t.context()
+
+	for attempt := 1; err != nil && attempt <= t.Retries; attempt++ {
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.WithFields(log.Fields{"task": t.Name, "ref": ref,
+			"attempt": attempt, "wait": wait}).Warnf("retrying: %v", err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+
+		err = op()
+
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+
+	return err
+}
+
+// tryStart marks the task as running, and returns true if it wasn't running
+// already; a task replaced by a config reload is considered running as long
+// as its previous definition still is
+func (t *Task) tryStart() bool {
+	if t.previous.isRunning() {
+		return false
+	}
+	return atomic.CompareAndSwapInt32(&t.running, 0, 1)
+}
+
+//
+func (t *Task) finish() {
+	atomic.StoreInt32(&t.running, 0)
+}
+
+//
+func (t *Task) isRunning() bool {
+	if t == nil {
+		return false
+	}
+	return atomic.LoadInt32(&t.running) == 1 || t.previous.isRunning()
+}
+
+// force makes the next run of the task happen even if it would otherwise be
+// considered too soon
+func (t *Task) force() {
+	atomic.StoreInt32(&t.forced, 1)
+}
+
+// setCancel sets the function for cancelling the current run of the task
+func (t *Task) setCancel(cancel context.CancelFunc) {
+	t.resultLock.Lock()
+	defer t.resultLock.Unlock()
+	t.cancel = cancel
+}
+
+// cancelRun cancels the current run of the task, including its transfers in
+// progress; returns false if the task is not running
+func (t *Task) cancelRun() bool {
+	t.resultLock.Lock()
+	defer t.resultLock.Unlock()
+	if t.cancel == nil {
+		return false
+	}
+	t.cancel()
+	return true
+}
+
+//
+func (t *Task) pause() {
+	atomic.StoreInt32(&t.paused, 1)
+}
+
+//
+func (t *Task) resume() {
+	atomic.StoreInt32(&t.paused, 0)
+}
+
+//
+func (t *Task) isPaused() bool {
+	return atomic.LoadInt32(&t.paused) == 1
+}
+
+//
+func (t *Task) setResult(r *runResult) {
+	t.resultLock.Lock()
+	defer t.resultLock.Unlock()
+	t.result = r
+}
+
+// lastResult returns the outcome of the task's last run, nil if there was none
+func (t *Task) lastResult() *runResult {
+	t.resultLock.Lock()
+	defer t.resultLock.Unlock()
+	return t.result
+}
+
+//
+func (t *Task) takeForce() bool {
+	return atomic.CompareAndSwapInt32(&t.forced, 1, 0)
+}
+
 //
 func (t *Task) tooSoon() bool {
+	if t.schedule != nil {
+		return false
+	}
 	i := time.Duration(t.Interval)
 	if i == 0 {
 		return false
@@ -143,8 +823,7 @@ func (t *Task) tooSoon() bool {
 
 //
 func (t *Task) stopTicking() {
-	if t.ticker != nil {
-		t.ticker.Stop()
+	if t.exit != nil {
 		close(t.exit)
 		<-t.done
 	}
@@ -156,6 +835,12 @@ func (t *Task) fail(f bool) {
 	t.failed = t.failed || f
 }
 
+// stopOnError returns true if the current run of the task had an error, and
+// the task's error policy says to not continue
+func (t *Task) stopOnError() bool {
+	return t.failed && t.OnError != "" && t.OnError != OnErrorContinue
+}
+
 //
 func (t *Task) mappingRefs(m *Mapping) ([][2]string, error) {
 
@@ -171,26 +856,840 @@ func (t *Task) mappingRefs(m *Mapping) ([][2]string, error) {
 			}
 
 			for _, r := range m.filterRepos(repos) {
-				ret = append(ret, [2]string{
-					t.Source.Registry + r,
-					t.Target.Registry + m.mapPath(r),
-				})
+				trgt, err := t.targetRef(m, r)
+				if err != nil {
+					return nil, err
+				}
+				ret = append(ret, [2]string{t.Source.ref(r), trgt})
 			}
 
 		} else {
-			ret = append(ret, [2]string{
-				t.Source.Registry + m.From,
-				t.Target.Registry + m.mapPath(m.From),
-			})
-		}
-	}
+			trgt, err := t.targetRef(m, m.From)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, [2]string{t.Source.ref(m.From), trgt})
+		}
+	}
 
 	return ret, nil
 }
 
+// platforms returns the platforms to sync for mapping m, which are the
+// mapping's own if set, otherwise those of the task
+func (t *Task) platforms(m *Mapping) []string {
+	if len(m.Platforms) > 0 {
+		return m.Platforms
+	}
+	return t.Platforms
+}
+
+// verbose returns whether to show relay output for the given mapping, which can
+// override the task's setting
+func (t *Task) verbose(m *Mapping) bool {
+	if m.Verbose != nil {
+		return *m.Verbose
+	}
+	return t.Verbose
+}
+
+// hasPlatforms checks whether the task or any of its mappings restricts the
+// platforms to sync
+func (t *Task) hasPlatforms() bool {
+	for _, m := range t.Mappings {
+		if len(t.platforms(m)) > 0 {
+			return true
+		}
+	}
+	return len(t.Platforms) > 0
+}
+
+//
+func (t *Task) openState() {
+	if t.StateFile != "" {
+		log.WithFields(log.Fields{"task": t.Name, "state": t.StateFile}).Info(
+			"only syncing new or changed tags according to state file")
+		t.state = state.Open(t.StateFile)
+	}
+}
+
+//
+func (t *Task) expandTags(srcRef string, ts *tags.TagSet) ([]string, error) {
+	ret, err := ts.Expand(func() ([]string, error) {
+		return registry.ListTags(t.context(),
+			srcRef, t.Source.creds, t.Source.SkipTLSVerify)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error expanding tags: %v", err)
+	}
+	return ret, nil
+}
+
+// selectTags returns the tags of src selected by the tag filters of the given
+// mapping, i.e. 'tags', 'exclude-tags', and 'limit'; when only is given, just
+// those selected tags that are also contained in only
+func (t *Task) selectTags(m *Mapping, src string, only []string) (
+	[]string, error) {
+
+	selected, err := t.expandTags(src, m.tagSet)
+	if err != nil {
+		return nil, err
+	}
+
+	selected = m.filterExcludedTags(selected)
+
+	if m.Limit > 0 {
+		selected = t.limitTags(src, selected, m.Limit, m.LimitBy)
+	}
+
+	if len(only) > 0 {
+		selected = intersect(selected, only)
+	}
+
+	return selected, nil
+}
+
+// limitTags returns the newest tags among the given candidates, at most limit
+// many; tags are ordered either by semantic version, in which case non-semver
+// tags are dropped, or by the creation time recorded in the image config
+func (t *Task) limitTags(srcRef string, candidates []string, limit int,
+	by string) []string {
+
+	var sorted []string
+
+	if by == LimitByCreated {
+		created := make(map[string]time.Time, len(candidates))
+		for _, tag := range candidates {
+			ref := fmt.Sprintf("%s:%s", srcRef, tag)
+			c, err := registry.GetCreated(t.context(),
+				ref, t.Source.creds, t.Source.SkipTLSVerify)
+			if err != nil {
+				log.WithField("ref", ref).Warnf(
+					"cannot determine creation time, taking as oldest: %v", err)
+			}
+			created[tag] = c
+		}
+		sorted = append(sorted, candidates...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return created[sorted[i]].After(created[sorted[j]])
+		})
+
+	} else {
+		sorted = tags.SortSemver(candidates)
+	}
+
+	if len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+
+	log.WithField("ref", srcRef).Debugf("newest %d tags: %v", limit, sorted)
+	return sorted
+}
+
+// filterChangedTags returns those of the given tags that have not yet been
+// synced according to the task's state, or whose digest in the source has
+// changed since they were last synced
+func (t *Task) filterChangedTags(srcRef, trgtRef string,
+	tags []string) []string {
+
+	synced := t.state.SyncedTags(state.MappingKey(srcRef, trgtRef))
+	var ret []string
+
+	for _, tag := range tags {
+
+		last, ok := synced[tag]
+		if !ok || last == "" {
+			ret = append(ret, tag)
+			continue
+		}
+
+		ref := fmt.Sprintf("%s:%s", srcRef, tag)
+		digest, err := registry.GetDigest(t.context(),
+			ref, t.Source.creds, t.Source.SkipTLSVerify)
+		if err != nil {
+			log.WithField("ref", ref).Warnf(
+				"cannot get digest, syncing anyway: %v", err)
+			ret = append(ret, tag)
+			continue
+		}
+
+		if digest != last {
+			log.WithFields(log.Fields{"ref": ref, "digest": digest}).Info(
+				"digest changed since last sync")
+			ret = append(ret, tag)
+		}
+	}
+
+	log.WithField("ref", srcRef).Debugf("new or changed tags: %v", ret)
+	return ret
+}
+
+// filterExisting returns those of the given tags that are either not present
+// in the target, or point to a different digest than in the source
+func (t *Task) filterExisting(m *Mapping, srcRef, trgtRef string,
+	tags []string) []string {
+
+	var ret []string
+
+	for _, tag := range tags {
+
+		src := fmt.Sprintf("%s:%s", srcRef, tag)
+		srcDigest, err := registry.GetDigest(t.context(),
+			src, t.Source.creds, t.Source.SkipTLSVerify)
+		if err != nil {
+			log.WithField("ref", src).Warnf(
+				"cannot get digest, syncing anyway: %v", err)
+			ret = append(ret, tag)
+			continue
+		}
+
+		trgt := fmt.Sprintf("%s:%s", trgtRef, m.targetTag(tag))
+		trgtDigest, err := registry.GetDigest(t.context(),
+			trgt, t.Target.creds, t.Target.SkipTLSVerify)
+		if err != nil || trgtDigest != srcDigest {
+			ret = append(ret, tag)
+			continue
+		}
+
+		log.WithFields(log.Fields{"ref": trgt, "digest": trgtDigest}).Info(
+			"tag already present in target, skipping")
+	}
+
+	return ret
+}
+
+// filterImmutable drops the given tags that already exist in the target, for
+// a target with 'immutable-tags' set; a tag whose digest in the target differs
+// from the one in the source is a conflict, which with 'on-tag-conflict: fail'
+// is returned as error; when the relay doesn't copy images unchanged, or
+// platforms are filtered out, digests can't be compared, so existing tags are
+// dropped without conflict; returns the tags to sync
+func (t *Task) filterImmutable(m *Mapping, srcRef, trgtRef string,
+	tags []string) ([]string, error) {
+
+	strict := t.unchanged && len(t.platforms(m)) == 0
+	var ret, conflicts []string
+	failed := 0
+
+	for _, tag := range tags {
+
+		trgt := fmt.Sprintf("%s:%s", trgtRef, m.targetTag(tag))
+		logger := log.WithFields(log.Fields{"task": t.Name, "ref": trgt})
+
+		// a tag we can't check must not be overwritten either
+		trgtDigest, err := registry.GetDigestIfExists(t.context(),
+			trgt, t.Target.creds, t.Target.SkipTLSVerify)
+		if err != nil {
+			logger.Errorf("cannot check immutable target, not syncing: %v", err)
+			failed++
+			continue
+		}
+		if trgtDigest == "" {
+			ret = append(ret, tag)
+			continue
+		}
+
+		if !strict {
+			logger.Info("tag already present in immutable target, skipping")
+			continue
+		}
+
+		src := fmt.Sprintf("%s:%s", srcRef, tag)
+		srcDigest, err := registry.GetDigest(t.context(),
+			src, t.Source.creds, t.Source.SkipTLSVerify)
+		if err != nil {
+			logger.Errorf("cannot get digest of '%s', not syncing: %v",
+				src, err)
+			failed++
+			continue
+		}
+
+		if srcDigest == trgtDigest {
+			logger.Info("tag already present in immutable target, skipping")
+			continue
+		}
+
+		logger.WithFields(log.Fields{"source": srcDigest,
+			"target": trgtDigest}).Warn("tag exists in immutable target " +
+			"with different digest, not overwriting")
+		conflicts = append(conflicts, tag)
+	}
+
+	if len(conflicts) > 0 && t.Target.OnTagConflict == OnTagConflictFail {
+		return ret, fmt.Errorf("%d tag(s) of '%s' exist in immutable target "+
+			"'%s' with a different digest: %s", len(conflicts), srcRef,
+			trgtRef, strings.Join(conflicts, ", "))
+	}
+
+	if failed > 0 {
+		return ret, fmt.Errorf(
+			"%d tag(s) of '%s' could not be checked in immutable target '%s'",
+			failed, srcRef, trgtRef)
+	}
+
+	return ret, nil
+}
+
+// checkDigests compares the digests of the given tags in source and target
+// after syncing; when the relay copies images unchanged and no platforms are
+// filtered out, they need to match, otherwise both digests are only logged;
+// returns the tags that passed
+func (t *Task) checkDigests(m *Mapping, srcRef, trgtRef string,
+	tags []string) ([]string, error) {
+
+	strict := t.unchanged && len(t.platforms(m)) == 0
+	var passed []string
+
+	for _, tag := range tags {
+
+		src := fmt.Sprintf("%s:%s", srcRef, tag)
+		trgt := fmt.Sprintf("%s:%s", trgtRef, m.targetTag(tag))
+		logger := log.WithFields(
+			log.Fields{"task": t.Name, "source": src, "target": trgt})
+
+		srcDigest, err := registry.GetDigest(t.context(),
+			src, t.Source.creds, t.Source.SkipTLSVerify)
+		if err == nil {
+			var trgtDigest string
+			if trgtDigest, err = registry.GetDigest(t.context(),
+				trgt, t.Target.creds, t.Target.SkipTLSVerify); err == nil {
+				logger = logger.WithFields(log.Fields{
+					"source-digest": srcDigest, "target-digest": trgtDigest})
+				switch {
+				case srcDigest == trgtDigest:
+					logger.Info("digests match")
+					passed = append(passed, tag)
+				case strict:
+					logger.Error("digest mismatch")
+				default:
+					logger.Info("digests differ, as expected for this relay " +
+						"or platform selection")
+					passed = append(passed, tag)
+				}
+				continue
+			}
+		}
+
+		if strict {
+			logger.Errorf("cannot check digests: %v", err)
+		} else {
+			logger.Warnf("cannot check digests: %v", err)
+			passed = append(passed, tag)
+		}
+	}
+
+	if failed := len(tags) - len(passed); failed > 0 {
+		return passed, fmt.Errorf("digests of %d tag(s) of '%s' could not be "+
+			"verified in target '%s'", failed, srcRef, trgtRef)
+	}
+
+	return passed, nil
+}
+
+// filterByReferrers returns those of the given tags whose manifest has at least
+// one referrer of the given artifact type; if the source registry does not
+// support the referrers API, all tags are returned
+func (t *Task) filterByReferrers(srcRef string, tags []string,
+	artifactType string) ([]string, error) {
+
+	var ret []string
+
+	for _, tag := range tags {
+
+		ref := fmt.Sprintf("%s:%s", srcRef, tag)
+		refs, err := registry.ListReferrers(t.context(),
+			ref, t.Source.creds, t.Source.SkipTLSVerify, artifactType)
+
+		if err == registry.ErrReferrersNotSupported {
+			log.WithField("ref", srcRef).Warnf(
+				"%v, not filtering by referrers", err)
+			return tags, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(refs) > 0 {
+			ret = append(ret, tag)
+		} else {
+			log.WithFields(log.Fields{"ref": ref, "type": artifactType}).Info(
+				"no referrers of required type, skipping")
+		}
+	}
+
+	return ret, nil
+}
+
+// verifyTags verifies the cosign signatures of the images for the given tags,
+// and returns those tags that passed; an error is returned if any of the
+// signatures did not verify
+func (t *Task) verifyTags(srcRef string, tags []string) ([]string, error) {
+
+	var passed []string
+	failed := 0
+
+	for _, tag := range tags {
+		ref := fmt.Sprintf("%s:%s", srcRef, tag)
+		if err := t.verifier.Verify(
+			ref, t.Source.basicCreds(), t.Source.insecure()); err != nil {
+			log.WithFields(log.Fields{"task": t.Name, "ref": ref}).Errorf(
+				"%v, not syncing", err)
+			failed++
+			continue
+		}
+		passed = append(passed, tag)
+	}
+
+	if failed > 0 {
+		return passed, fmt.Errorf(
+			"%d image(s) of '%s' failed signature verification", failed, srcRef)
+	}
+
+	return passed, nil
+}
+
+// verifyTrust verifies the Notary signatures of the given tags, and returns
+// those tags that passed; a signature only passes if it is for the manifest
+// currently in the source; an error is returned if any of the signatures did
+// not verify
+func (t *Task) verifyTrust(srcRef string, tags []string) ([]string, error) {
+
+	var passed []string
+	failed := 0
+
+	for _, tag := range tags {
+		ref := fmt.Sprintf("%s:%s", srcRef, tag)
+		logger := log.WithFields(log.Fields{"task": t.Name, "ref": ref})
+		digest, err := registry.GetDigest(t.context(),
+			ref, t.Source.creds, t.Source.SkipTLSVerify)
+		if err == nil {
+			err = t.trustCheck.Verify(ref, digest, t.Source.basicCreds())
+		}
+		if err != nil {
+			logger.Errorf("%v, not syncing", err)
+			failed++
+			continue
+		}
+		passed = append(passed, tag)
+	}
+
+	if failed > 0 {
+		return passed, fmt.Errorf(
+			"%d image(s) of '%s' failed Notary signature verification",
+			failed, srcRef)
+	}
+
+	return passed, nil
+}
+
+// scanTags scans the images for the given tags, and returns those tags that
+// may be synced according to the task's scan settings; an error is returned
+// if with action 'fail', any of the images did not pass the scan; the outcome
+// for each tag is recorded in report
+func (t *Task) scanTags(srcRef string, tags []string, report *refReport) (
+	[]string, error) {
+
+	var passed []string
+	failed := 0
+
+	for _, tag := range tags {
+
+		ref := fmt.Sprintf("%s:%s", srcRef, tag)
+		logger := log.WithFields(log.Fields{"task": t.Name, "ref": ref})
+
+		res, err := t.scanner.Scan(
+			ref, t.Source.basicCreds(), t.Source.insecure())
+		if err != nil {
+			sr := &scanReport{Verdict: scanBlocked, Error: err.Error()}
+			switch t.Scan.Action {
+			case scan.ActionWarn:
+				logger.Warnf("scan failed, syncing anyway: %v", err)
+				passed = append(passed, tag)
+				sr.Verdict = scanWarned
+			case scan.ActionSkip:
+				logger.Warnf("scan failed, skipping: %v", err)
+			default:
+				logger.Errorf("scan failed, not syncing: %v", err)
+				failed++
+			}
+			report.scanned(tag, sr)
+			continue
+		}
+
+		blocking := res.CountAtLeast(t.Scan.BlockOn)
+		logger.WithField("findings", res.Findings).Info("scan result")
+
+		if blocking <= t.Scan.MaxFindings {
+			passed = append(passed, tag)
+			report.scanned(tag, &scanReport{
+				Verdict: scanPassed, Findings: res.Findings})
+			continue
+		}
+
+		msg := fmt.Sprintf(
+			"%d findings of severity %s or higher exceed maximum of %d",
+			blocking, t.Scan.BlockOn, t.Scan.MaxFindings)
+		sr := &scanReport{Verdict: scanBlocked, Findings: res.Findings}
+
+		switch t.Scan.Action {
+		case scan.ActionWarn:
+			logger.Warnf("%s, syncing anyway", msg)
+			passed = append(passed, tag)
+			sr.Verdict = scanWarned
+		case scan.ActionSkip:
+			logger.Warnf("%s, skipping", msg)
+		default:
+			logger.Errorf("%s, not syncing", msg)
+			failed++
+		}
+		report.scanned(tag, sr)
+	}
+
+	if failed > 0 {
+		return passed, fmt.Errorf(
+			"%d image(s) of '%s' did not pass vulnerability scan", failed, srcRef)
+	}
+
+	return passed, nil
+}
+
+//
+func (t *Task) recordTags(srcRef, trgtRef string, tags []string) {
+
+	key := state.MappingKey(srcRef, trgtRef)
+
+	for _, tag := range tags {
+		ref := fmt.Sprintf("%s:%s", srcRef, tag)
+		digest, err := registry.GetDigest(t.context(),
+			ref, t.Source.creds, t.Source.SkipTLSVerify)
+		if err != nil {
+			log.WithField("ref", ref).Warnf(
+				"recording tag without digest: %v", err)
+		}
+		t.state.RecordTag(key, tag, digest)
+	}
+}
+
+// syncUntagged copies all manifests in the source repo that are not referenced
+// by any tag directly to the target, by digest; this bypasses the relay, since
+// neither Docker nor Skopeo can push a manifest without a tag; with dryRun set,
+// the manifests are only listed
+func (t *Task) syncUntagged(srcRef, trgtRef string, dryRun bool) error {
+
+	digests, err := registry.ListUntagged(
+		srcRef, t.Source.creds, t.Source.SkipTLSVerify)
+	if err != nil {
+		return err
+	}
+
+	errs := false
+	for _, d := range digests {
+		if dryRun {
+			log.WithFields(log.Fields{"ref": srcRef, "digest": d}).Infof(
+				"dry run, would sync untagged manifest to '%s'", trgtRef)
+			continue
+		}
+		log.WithFields(log.Fields{"ref": srcRef, "digest": d}).Info(
+			"syncing untagged manifest")
+		src := fmt.Sprintf("%s@%s", srcRef, d)
+		if err := t.retry(src, func() error {
+			return registry.Copy(t.context(), src, t.Source.creds,
+				t.Source.SkipTLSVerify,
+				fmt.Sprintf("%s@%s", trgtRef, d), t.Target.creds,
+				t.Target.SkipTLSVerify, nil, t.throttle, "")
+		}); err != nil {
+			log.Error(err)
+			errs = true
+		}
+	}
+
+	if errs {
+		return fmt.Errorf("errors during sync of untagged manifests")
+	}
+
+	return nil
+}
+
+// syncDigests copies the images with given digests from srcRef to trgtRef, and
+// tags them there if a tag is given; images are copied as is, i.e. without
+// platform filtering, so they keep their digest; images already in the target
+// are skipped
+func (t *Task) syncDigests(digests []*Digest, srcRef, trgtRef string,
+	dryRun bool) error {
+
+	errs := false
+	for _, d := range digests {
+
+		src := fmt.Sprintf("%s@%s", srcRef, d.Digest)
+		trgt := fmt.Sprintf("%s@%s", trgtRef, d.Digest)
+		if d.Tag != "" {
+			trgt = fmt.Sprintf("%s:%s", trgtRef, d.Tag)
+		}
+		logger := log.WithFields(log.Fields{"ref": srcRef, "digest": d.Digest})
+
+		digest, err := registry.GetDigestIfExists(t.context(),
+			trgt, t.Target.creds, t.Target.SkipTLSVerify)
+		if err == nil && digest == d.Digest {
+			logger.Debugf("already in '%s', skipping", trgt)
+			continue
+		}
+
+		if t.Target.ImmutableTags && d.Tag != "" {
+			if err != nil {
+				logger.Errorf("cannot check immutable target '%s', not "+
+					"syncing: %v", trgt, err)
+				errs = true
+				continue
+			}
+			if digest != "" {
+				logger.WithField("target", digest).Warnf("'%s' exists in "+
+					"immutable target with different digest, not "+
+					"overwriting", trgt)
+				errs = errs || t.Target.OnTagConflict == OnTagConflictFail
+				continue
+			}
+		}
+
+		if dryRun {
+			logger.Infof("dry run, would sync digest to '%s'", trgt)
+			continue
+		}
+
+		logger.Infof("syncing digest to '%s'", trgt)
+		if err := t.retry(src, func() error {
+			return registry.Copy(t.context(), src, t.Source.creds,
+				t.Source.SkipTLSVerify, trgt, t.Target.creds,
+				t.Target.SkipTLSVerify, nil, t.throttle, "")
+		}); err != nil {
+			log.Error(err)
+			errs = true
+		}
+	}
+
+	if errs {
+		return fmt.Errorf("errors during sync of digests")
+	}
+
+	return nil
+}
+
+// paceRateLimit checks the remaining Docker Hub pull quota before syncing the
+// given tags of srcRef; if it doesn't suffice, it waits for the quota to
+// recover, but at most for 'dockerhub-max-wait'; tags that still can't be
+// pulled after that are deferred to the next run of the task; returns the tags
+// to sync now
+func (t *Task) paceRateLimit(srcRef string, tags []string) []string {
+
+	ref := fmt.Sprintf("%s:%s", srcRef, tags[0])
+	rl, err := registry.GetRateLimit(
+		ref, t.Source.creds, t.Source.SkipTLSVerify)
+	if err != nil {
+		log.WithField("ref", srcRef).Warnf("cannot check rate limit: %v", err)
+		return tags
+	}
+	if rl == nil || rl.Remaining >= len(tags) {
+		return tags
+	}
+
+	if wait := rl.WaitFor(len(tags)); wait > 0 && t.DockerHubWait > 0 {
+		if wait > t.DockerHubWait {
+			wait = t.DockerHubWait
+		}
+		log.WithFields(log.Fields{"task": t.Name, "ref": srcRef,
+			"remaining": rl.Remaining, "wait": wait}).Warn(
+			"Docker Hub pull quota too low, waiting for it to recover")
+		time.Sleep(wait)
+		if rl, err = registry.GetRateLimit(
+			ref, t.Source.creds, t.Source.SkipTLSVerify); err != nil {
+			log.WithField("ref", srcRef).Warnf(
+				"cannot check rate limit: %v", err)
+			return tags
+		}
+		if rl == nil || rl.Remaining >= len(tags) {
+			return tags
+		}
+	}
+
+	n := rl.Remaining
+	if n < 0 {
+		n = 0
+	}
+	log.WithFields(log.Fields{"task": t.Name, "ref": srcRef}).Warnf(
+		"Docker Hub pull quota exhausted, deferring %d tag(s) to next run",
+		len(tags)-n)
+	t.deferred = true
+
+	return tags[:n]
+}
+
+// syncReferrers copies the artifacts attached to each of the given tags in the
+// source repo, such as signatures and SBOMs, directly to the target; like
+// syncUntagged, this bypasses the relay
+func (t *Task) syncReferrers(srcRef, trgtRef string, tags []string) error {
+
+	errs := false
+	for _, tag := range tags {
+		src := fmt.Sprintf("%s:%s", srcRef, tag)
+		if err := t.retry(src, func() error {
+			n, err := registry.CopyReferrers(t.context(), src, t.Source.creds,
+				t.Source.SkipTLSVerify, trgtRef, t.Target.creds,
+				t.Target.SkipTLSVerify, t.throttle)
+			if n > 0 {
+				log.WithFields(log.Fields{"ref": src, "count": n}).Info(
+					"synced referrers")
+			}
+			return err
+		}); err != nil {
+			log.Error(err)
+			errs = true
+		}
+	}
+
+	if errs {
+		return fmt.Errorf("errors during sync of referrers")
+	}
+
+	return nil
+}
+
+// pruneTarget deletes those tags from the target repo that no longer exist in
+// the source; with dryRun set, the tags are only listed
+func (t *Task) pruneTarget(m *Mapping, srcRef, trgtRef string,
+	dryRun bool) error {
+
+	srcTags, err := registry.ListTags(t.context(),
+		srcRef, t.Source.creds, t.Source.SkipTLSVerify)
+	if err != nil {
+		return fmt.Errorf("cannot list tags of source for pruning: %v", err)
+	}
+
+	// an empty source is more likely the result of an error somewhere than
+	// an intentional wipe, so we don't want to delete everything then
+	if len(srcTags) == 0 {
+		log.WithField("ref", srcRef).Warn(
+			"source has no tags, not pruning target")
+		return nil
+	}
+
+	trgtTags, err := registry.ListTags(t.context(),
+		trgtRef, t.Target.creds, t.Target.SkipTLSVerify)
+	if err != nil {
+		return fmt.Errorf("cannot list tags of target for pruning: %v", err)
+	}
+
+	stale, keep := m.staleTags(srcTags, trgtTags)
+	if len(stale) == 0 {
+		return nil
+	}
+
+	if dryRun {
+		for _, tag := range stale {
+			log.WithFields(log.Fields{"task": t.Name, "tag": tag}).Infof(
+				"dry run, would delete from '%s'", trgtRef)
+		}
+		return nil
+	}
+
+	log.WithFields(log.Fields{"ref": trgtRef, "tags": stale}).Info(
+		"pruning tags no longer in source")
+
+	return t.retry(trgtRef, func() error {
+		return registry.DeleteTags(t.context(),
+			trgtRef, stale, keep, t.Target.creds, t.Target.SkipTLSVerify)
+	})
+}
+
+// signTags signs the images for the given tags in the target; images are
+// signed by digest, so that a concurrent push to a tag can't cause the wrong
+// image to get signed
+func (t *Task) signTags(trgtRef string, tags []string) error {
+
+	errs := false
+	for _, tag := range tags {
+		ref := fmt.Sprintf("%s:%s", trgtRef, tag)
+		if err := t.retry(ref, func() error {
+			digest, err := registry.GetDigest(t.context(),
+				ref, t.Target.creds, t.Target.SkipTLSVerify)
+			if err != nil {
+				return err
+			}
+			return t.signer.Sign(fmt.Sprintf("%s@%s", trgtRef, digest),
+				t.Target.basicCreds(), t.Target.insecure())
+		}); err != nil {
+			log.Error(err)
+			errs = true
+		}
+	}
+
+	if errs {
+		return fmt.Errorf("errors during signing of images")
+	}
+
+	return nil
+}
+
+// signTrust signs the given tags in the target with Notary; the signature is
+// for the manifest found in the target right after syncing
+func (t *Task) signTrust(trgtRef string, tags []string) error {
+
+	errs := false
+	for _, tag := range tags {
+		ref := fmt.Sprintf("%s:%s", trgtRef, tag)
+		if err := t.retry(ref, func() error {
+			digest, size, err := registry.GetManifestDigestAndSize(
+				ref, t.Target.creds, t.Target.SkipTLSVerify)
+			if err != nil {
+				return err
+			}
+			return t.trustSign.Sign(ref, digest, size, t.Target.basicCreds())
+		}); err != nil {
+			log.Error(err)
+			errs = true
+		}
+	}
+
+	if errs {
+		return fmt.Errorf("errors during Notary signing of images")
+	}
+
+	return nil
+}
+
+//
+func (t *Task) saveState() {
+	if t.state != nil {
+		if err := t.state.Save(); err != nil {
+			log.WithField("task", t.Name).Errorf(
+				"error saving state: %v", err)
+		}
+	}
+}
+
 //
 func (t *Task) ensureTargetExists(ref string) error {
 
+	if t.Target.Harbor != nil {
+		return t.Target.Harbor.ensureProject(t.Target, ref)
+	}
+
+	if t.Target.Artifactory != nil {
+		return t.Target.Artifactory.ensureRepo(t.Target)
+	}
+
+	if t.Target.GitLab != nil {
+		return t.Target.GitLab.checkProject(t.Target, ref)
+	}
+
+	if t.Target.IsQuay() && t.Target.APIToken != "" {
+		_, path, _ := util.SplitRef(ref)
+		return registry.EnsureQuayRepo(t.Target.Registry, path,
+			t.Target.RepoVisibility, t.Target.APIToken, t.Target.SkipTLSVerify)
+	}
+
+	if t.Target.IsECRPublic() {
+		return t.ensureECRPublicTargetExists(ref)
+	}
+
 	isEcr, region, account := t.Target.GetECR()
 
 	if isEcr {
@@ -200,7 +1699,7 @@ func (t *Task) ensureTargetExists(ref string) error {
 			return nil
 		}
 
-		sess, err := session.NewSession()
+		sess, err := auth.NewAWSSession(t.Target.creds)
 		if err != nil {
 			return err
 		}
@@ -214,9 +1713,20 @@ func (t *Task) ensureTargetExists(ref string) error {
 			RepositoryNames: []*string{aws.String(path)},
 		}
 
+		inpPol, err := t.ECRRepo.lifecyclePolicyInput(
+			newLifecyclePolicyData(account, region, t.Name, path))
+		if err != nil {
+			return fmt.Errorf("invalid lifecycle policy for '%s': %v", ref, err)
+		}
+
 		out, err := svc.DescribeRepositories(inpDescr)
 		if err == nil && len(out.Repositories) > 0 {
 			log.WithField("ref", ref).Info("target already exists")
+			if inpPol != nil && t.ECRRepo.EnforceLifecyclePolicy {
+				if err := enforceLifecyclePolicy(svc, inpPol); err != nil {
+					return fmt.Errorf("'%s': %v", ref, err)
+				}
+			}
 			return nil
 		}
 
@@ -231,14 +1741,62 @@ func (t *Task) ensureTargetExists(ref string) error {
 		}
 
 		log.WithField("ref", ref).Info("creating target")
-		inpCrea := &ecr.CreateRepositoryInput{
-			RepositoryName: aws.String(path),
+		if _, err := svc.CreateRepository(t.ECRRepo.createInput(path)); err != nil {
+			return err
 		}
 
-		if _, err := svc.CreateRepository(inpCrea); err != nil {
-			return err
+		if inpPol != nil {
+			log.WithField("ref", ref).Info("attaching lifecycle policy")
+			if _, err := svc.PutLifecyclePolicy(inpPol); err != nil {
+				return fmt.Errorf(
+					"error attaching lifecycle policy to '%s': %v", ref, err)
+			}
 		}
 	}
 
 	return nil
 }
+
+// ensureECRPublicTargetExists creates the repository for ref in ECR Public if
+// it doesn't exist yet; the first path element of ref is the registry alias,
+// which is not part of the repository name
+func (t *Task) ensureECRPublicTargetExists(ref string) error {
+
+	_, path, _ := util.SplitRef(ref)
+	ix := strings.Index(path, "/")
+	if ix == -1 || ix == len(path)-1 {
+		return fmt.Errorf(
+			"ECR Public ref '%s' needs to contain registry alias and repo", ref)
+	}
+	repo := path[ix+1:]
+
+	sess, err := auth.NewAWSSession(t.Target.creds)
+	if err != nil {
+		return err
+	}
+
+	svc := ecrpublic.New(sess, &aws.Config{
+		Region: aws.String(auth.ECRPublicRegion),
+	})
+
+	out, err := svc.DescribeRepositories(&ecrpublic.DescribeRepositoriesInput{
+		RepositoryNames: []*string{aws.String(repo)},
+	})
+	if err == nil && len(out.Repositories) > 0 {
+		log.WithField("ref", ref).Info("target already exists")
+		return nil
+	}
+
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != ecrpublic.ErrCodeRepositoryNotFoundException {
+			return err
+		}
+	}
+
+	log.WithField("ref", ref).Info("creating target")
+	_, err = svc.CreateRepository(&ecrpublic.CreateRepositoryInput{
+		RepositoryName: aws.String(repo),
+	})
+	return err
+}
@@ -0,0 +1,879 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	gocrname "github.com/google/go-containerregistry/pkg/name"
+	gocrregistry "github.com/google/go-containerregistry/pkg/registry"
+	gocrv1 "github.com/google/go-containerregistry/pkg/v1"
+	gocrmutate "github.com/google/go-containerregistry/pkg/v1/mutate"
+	gocrrandom "github.com/google/go-containerregistry/pkg/v1/random"
+	gocrremote "github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/xelalexv/dregsy/internal/pkg/registry"
+	"github.com/xelalexv/dregsy/internal/pkg/state"
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestFilterExisting(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	push := func(ref string, img gocrv1.Image) {
+		r, err := gocrname.NewTag(ref)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(r, img))
+	}
+
+	random := func() gocrv1.Image {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		return img
+	}
+
+	same := random()
+	push(reg+"/source/image:same", same)
+	push(reg+"/target/image:same", same)
+	push(reg+"/source/image:changed", random())
+	push(reg+"/target/image:changed", random())
+	push(reg+"/source/image:new", random())
+
+	task := &Task{
+		Name:   "test",
+		Source: &Location{Registry: reg},
+		Target: &Location{Registry: reg},
+	}
+
+	th.AssertEquivalentSlices([]string{"changed", "new"},
+		task.filterExisting(&Mapping{}, reg+"/source/image",
+			reg+"/target/image", []string{"same", "changed", "new"}))
+}
+
+//
+func TestCheckDigests(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	push := func(ref string, img gocrv1.Image) {
+		r, err := gocrname.NewTag(ref)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(r, img))
+	}
+
+	random := func() gocrv1.Image {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		return img
+	}
+
+	same := random()
+	push(reg+"/source/image:same", same)
+	push(reg+"/target/image:same", same)
+	push(reg+"/source/image:changed", random())
+	push(reg+"/target/image:changed", random())
+	push(reg+"/source/image:missing", random())
+
+	task := &Task{
+		Name:      "test",
+		Source:    &Location{Registry: reg},
+		Target:    &Location{Registry: reg},
+		unchanged: true,
+	}
+	tags := []string{"same", "changed", "missing"}
+
+	passed, err := task.checkDigests(&Mapping{}, reg+"/source/image",
+		reg+"/target/image", tags)
+	th.AssertError(err, "digests of 2 tag(s)")
+	th.AssertEqualSlices([]string{"same"}, passed)
+
+	// with platforms filtered out, digests are only logged
+	passed, err = task.checkDigests(
+		&Mapping{Platforms: []string{"linux/amd64"}},
+		reg+"/source/image", reg+"/target/image", tags)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(tags, passed)
+
+	task.unchanged = false
+	passed, err = task.checkDigests(&Mapping{}, reg+"/source/image",
+		reg+"/target/image", tags)
+	th.AssertNoError(err)
+	th.AssertEqualSlices(tags, passed)
+}
+
+//
+func TestSyncDigests(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	img, err := gocrrandom.Image(256, 1)
+	th.AssertNoError(err)
+	r, err := gocrname.NewTag(reg + "/source/image:1.0")
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(r, img))
+	// the tag in the source moves on, but the pinned digest stays
+	newer, err := gocrrandom.Image(256, 1)
+	th.AssertNoError(err)
+	th.AssertNoError(gocrremote.Write(r, newer))
+
+	d, err := img.Digest()
+	th.AssertNoError(err)
+
+	task := &Task{
+		Name:   "test",
+		Source: &Location{Registry: reg},
+		Target: &Location{Registry: reg},
+	}
+	m := &Mapping{Digests: []*Digest{
+		{Digest: d.String()},
+		{Digest: d.String(), Tag: "pinned"},
+	}}
+
+	th.AssertNoError(task.syncDigests(
+		m.Digests, reg+"/source/image", reg+"/target/image", false))
+
+	for _, ref := range []string{"@" + d.String(), ":pinned"} {
+		digest, err := registry.GetDigest(context.Background(),
+			reg+"/target/image"+ref, nil, false)
+		th.AssertNoError(err)
+		th.AssertEqual(d.String(), digest)
+	}
+
+	m = &Mapping{Digests: []*Digest{
+		{Digest: "sha256:" + strings.Repeat("0", 64)}}}
+	th.AssertError(task.syncDigests(
+		m.Digests, reg+"/source/image", reg+"/target/image", false),
+		"errors during sync of digests")
+
+	// an immutable target keeps its tag when the pinned digest differs
+	nd, err := newer.Digest()
+	th.AssertNoError(err)
+	task.Target.ImmutableTags = true
+	m = &Mapping{Digests: []*Digest{{Digest: nd.String(), Tag: "pinned"}}}
+	th.AssertNoError(task.syncDigests(
+		m.Digests, reg+"/source/image", reg+"/target/image", false))
+	digest, err := registry.GetDigest(context.Background(),
+		reg+"/target/image:pinned", nil, false)
+	th.AssertNoError(err)
+	th.AssertEqual(d.String(), digest)
+
+	task.Target.OnTagConflict = OnTagConflictFail
+	th.AssertError(task.syncDigests(
+		m.Digests, reg+"/source/image", reg+"/target/image", false),
+		"errors during sync of digests")
+}
+
+//
+func TestFilterImmutable(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	push := func(ref string, img gocrv1.Image) {
+		r, err := gocrname.NewTag(ref)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(r, img))
+	}
+
+	random := func() gocrv1.Image {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		return img
+	}
+
+	same := random()
+	push(reg+"/source/image:same", same)
+	push(reg+"/target/image:same", same)
+	push(reg+"/source/image:moved", random())
+	push(reg+"/target/image:moved", random())
+	push(reg+"/source/image:new", random())
+
+	task := &Task{
+		Name:      "test",
+		Source:    &Location{Registry: reg},
+		Target:    &Location{Registry: reg, ImmutableTags: true},
+		unchanged: true,
+	}
+	tags := []string{"same", "moved", "new"}
+
+	filtered, err := task.filterImmutable(
+		&Mapping{}, reg+"/source/image", reg+"/target/image", tags)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"new"}, filtered)
+
+	task.Target.OnTagConflict = OnTagConflictFail
+	filtered, err = task.filterImmutable(
+		&Mapping{}, reg+"/source/image", reg+"/target/image", tags)
+	th.AssertError(err, "1 tag(s) of '"+reg+"/source/image' exist in "+
+		"immutable target")
+	th.AssertEqualSlices([]string{"new"}, filtered)
+
+	// digests can't be compared, so existing tags are never a conflict
+	task.unchanged = false
+	filtered, err = task.filterImmutable(
+		&Mapping{}, reg+"/source/image", reg+"/target/image", tags)
+	th.AssertNoError(err)
+	th.AssertEqualSlices([]string{"new"}, filtered)
+}
+
+//
+func TestFilterChangedTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	dir, err := ioutil.TempDir("", "dregsy-state")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	src := reg + "/source/image"
+	trgt := reg + "/target/image"
+
+	for _, tag := range []string{"same", "changed", "unknown", "new"} {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		r, err := gocrname.NewTag(src + ":" + tag)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(r, img))
+	}
+
+	task := &Task{
+		Name:      "test",
+		Source:    &Location{Registry: reg},
+		Target:    &Location{Registry: reg},
+		StateFile: filepath.Join(dir, "state.json"),
+	}
+	task.openState()
+
+	digest, err := registry.GetDigest(context.Background(),
+		src+":same", nil, false)
+	th.AssertNoError(err)
+
+	key := state.MappingKey(src, trgt)
+	task.state.RecordTag(key, "same", digest)
+	task.state.RecordTag(key, "changed", "sha256:outdated")
+	task.state.RecordTag(key, "unknown", "")
+
+	th.AssertEquivalentSlices([]string{"changed", "unknown", "new"},
+		task.filterChangedTags(src, trgt,
+			[]string{"same", "changed", "unknown", "new"}))
+}
+
+//
+func TestLimitTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+	src := reg + "/source/image"
+
+	for tag, days := range map[string]int{"old": 10, "mid": 5, "new": 1} {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		img, err = gocrmutate.CreatedAt(img,
+			gocrv1.Time{Time: time.Now().AddDate(0, 0, -days)})
+		th.AssertNoError(err)
+		r, err := gocrname.NewTag(src + ":" + tag)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(r, img))
+	}
+
+	task := &Task{
+		Name:   "test",
+		Source: &Location{Registry: reg},
+		Target: &Location{Registry: reg},
+	}
+
+	for _, tc := range []struct {
+		candidates []string
+		limit      int
+		by         string
+		want       []string
+	}{
+		// newest versions first
+		{[]string{"1.2.0", "1.10.0", "1.9.3", "v2.0.0"}, 2, LimitBySemver,
+			[]string{"v2.0.0", "1.10.0"}},
+		// non-semver tags are dropped
+		{[]string{"latest", "1.0.0", "edge", "0.9"}, 2, LimitBySemver,
+			[]string{"1.0.0", "0.9"}},
+		{[]string{"latest", "edge"}, 1, LimitBySemver, nil},
+		// limit greater than number of candidates
+		{[]string{"1.0.0", "1.1.0"}, 5, LimitBySemver,
+			[]string{"1.1.0", "1.0.0"}},
+		// newest images first, regardless of tag name
+		{[]string{"old", "new", "mid"}, 2, LimitByCreated,
+			[]string{"new", "mid"}},
+		// tags whose creation time can't be determined count as oldest
+		{[]string{"missing", "old", "new", "mid"}, 10, LimitByCreated,
+			[]string{"new", "mid", "old", "missing"}},
+		{[]string{"missing", "old"}, 1, LimitByCreated, []string{"old"}},
+	} {
+		th.AssertEqualSlices(tc.want,
+			task.limitTags(src, tc.candidates, tc.limit, tc.by))
+	}
+}
+
+//
+func TestRetry(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	tryRetry := func(retries, failures, wantCalls int, wantErr bool) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		task := &Task{
+			Name:         "test",
+			Retries:      retries,
+			RetryBackoff: time.Millisecond,
+		}
+		calls := 0
+		err := task.retry("reg/img", func() error {
+			calls++
+			if calls <= failures {
+				return errors.New("transient failure")
+			}
+			return nil
+		})
+		if wantErr {
+			th.AssertError(err, "transient failure")
+		} else {
+			th.AssertNoError(err)
+		}
+		th.AssertEqual(wantCalls, calls)
+	}
+
+	tryRetry(0, 0, 1, false)
+	tryRetry(0, 1, 1, true)
+	tryRetry(3, 2, 3, false)
+	tryRetry(3, 5, 4, true)
+}
+
+//
+func TestStartOffsets(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	newTask := func(name string, interval int, schedule string,
+		offset time.Duration) *Task {
+		m := &Mapping{From: "image"}
+		th.AssertNoError(m.validate())
+		task := &Task{
+			Name:     name,
+			Interval: interval,
+			Schedule: schedule,
+			Offset:   offset,
+			Source:   &Location{Registry: "source.example.com"},
+			Target:   &Location{Registry: "target.example.com"},
+			Mappings: []*Mapping{m},
+		}
+		th.AssertNoError(task.validate())
+		return task
+	}
+
+	// spreading
+	a := newTask("a", 3600, "", 0)
+	b := newTask("b", 3600, "", 5*time.Minute)
+	c := newTask("c", 3600, "", 0)
+	d := newTask("d", 0, "0 * * * *", 0)
+	e := newTask("e", 120, "", 0)
+	conf := &SyncConfig{Spread: 10 * time.Minute,
+		Tasks: []*Task{a, b, c, d, e}}
+	conf.spreadTasks()
+	th.AssertEqual(time.Duration(0), a.startOffset())
+	th.AssertEqual(5*time.Minute, b.startOffset())
+	th.AssertEqual(200*time.Second, c.startOffset())
+	th.AssertEqual(time.Duration(0), d.startOffset())
+	th.AssertEqual(40*time.Second, e.startOffset()) // 400s within 120s
+
+	// offset on schedule
+	hourly := newTask("hourly", 0, "0 * * * *", 10*time.Minute)
+	at := func(h, m int) time.Time {
+		return time.Date(2024, 3, 1, h, m, 0, 0, time.Local)
+	}
+	th.AssertEqual(at(10, 10), hourly.nextScheduled(at(10, 5)))
+	th.AssertEqual(at(11, 10), hourly.nextScheduled(at(10, 10)))
+	th.AssertEqual(at(11, 10), hourly.nextScheduled(at(10, 30)))
+
+	// jitter
+	jittery := &Task{Jitter: time.Second}
+	for ix := 0; ix < 100; ix++ {
+		j := jittery.jitter()
+		th.AssertTrue(j >= 0 && j <= time.Second)
+	}
+	th.AssertEqual(time.Duration(0), (&Task{}).jitter())
+
+	// first run of an interval task is delayed by its offset
+	delayed := newTask("delayed", 60, "", 200*time.Millisecond)
+	fired := make(chan *Task, 1)
+	start := time.Now()
+	delayed.startTicking(fired)
+	th.AssertTrue(delayed.nextRun().After(start.Add(150 * time.Millisecond)))
+	select {
+	case <-fired:
+		th.AssertTrue(time.Since(start) >= 200*time.Millisecond)
+	case <-time.After(2 * time.Second):
+		th.AssertTrue(false)
+	}
+	next := delayed.nextRun()
+	th.AssertTrue(next.After(start.Add(time.Minute)))
+	delayed.stopTicking()
+
+	// a task told to exit while waiting for its offset stops right away
+	waiting := newTask("waiting", 60, "", time.Hour)
+	waiting.startTicking(fired)
+	waiting.stopTicking()
+
+	th.AssertError((&Task{Name: "x", Jitter: -time.Second}).validate(),
+		"'offset' and 'jitter' cannot be negative")
+	th.AssertError((&Task{Name: "x", Offset: time.Second}).validate(),
+		"requires an 'interval' or 'schedule'")
+	th.AssertError((&Task{Name: "x", Interval: 60,
+		Jitter: time.Minute}).validate(),
+		"'jitter' larger than half its 'interval'")
+}
+
+//
+func TestFirstFire(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	m := &Mapping{From: "image"}
+	th.AssertNoError(m.validate())
+
+	// checks that the task reports due as its next run, and when that's soon
+	// enough, that the task actually fires then
+	tryFirstFire := func(interval int, schedule string, offset time.Duration,
+		runOnStart bool, want func(now time.Time) time.Time) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		var ros *bool // only valid with an interval
+		if !runOnStart {
+			ros = &runOnStart
+		}
+		task := &Task{
+			Name:       "test",
+			Interval:   interval,
+			Schedule:   schedule,
+			Offset:     offset,
+			RunOnStart: ros,
+			Source:     &Location{Registry: "source.example.com"},
+			Target:     &Location{Registry: "target.example.com"},
+			Mappings:   []*Mapping{m},
+		}
+		th.AssertNoError(task.validate())
+		fired := make(chan *Task, 1)
+		now := time.Now()
+		due := want(now)
+		task.startTicking(fired)
+		defer task.stopTicking()
+		// once the initial fire is through, the next run is already the one
+		// after that
+		if due.After(now) {
+			next := task.nextRun()
+			th.AssertTrue(!next.Before(due.Add(-10 * time.Millisecond)))
+			th.AssertTrue(next.Before(due.Add(10 * time.Millisecond)))
+		}
+		if time.Until(due) > 2*time.Second {
+			return
+		}
+		select {
+		case <-fired:
+			at := time.Now()
+			th.AssertTrue(!at.Before(due.Add(-10 * time.Millisecond)))
+			th.AssertTrue(at.Before(due.Add(250 * time.Millisecond)))
+		case <-time.After(3 * time.Second):
+			th.AssertTrue(false)
+		}
+	}
+
+	// interval: right away, or one interval later without run on start, and
+	// delayed by the offset
+	tryFirstFire(60, "", 0, true,
+		func(now time.Time) time.Time { return now })
+	tryFirstFire(60, "", 0, false,
+		func(now time.Time) time.Time { return now.Add(time.Minute) })
+	tryFirstFire(60, "", 300*time.Millisecond, true,
+		func(now time.Time) time.Time {
+			return now.Add(300 * time.Millisecond)
+		})
+	tryFirstFire(60, "", time.Second, false,
+		func(now time.Time) time.Time {
+			return now.Add(time.Minute + time.Second)
+		})
+
+	// schedule: no initial fire, but at the next scheduled time, which is
+	// shifted by the offset
+	tryFirstFire(0, "@every 1s", 0, true,
+		func(now time.Time) time.Time {
+			return now.Truncate(time.Second).Add(time.Second)
+		})
+	tryFirstFire(0, "@every 1s", 400*time.Millisecond, true,
+		func(now time.Time) time.Time {
+			return now.Add(-400 * time.Millisecond).Truncate(time.Second).Add(
+				time.Second + 400*time.Millisecond)
+		})
+	tryFirstFire(0, "0 * * * *", 10*time.Minute, true,
+		func(now time.Time) time.Time {
+			next := time.Date(now.Year(), now.Month(), now.Day(),
+				now.Hour(), 10, 0, 0, now.Location())
+			if !next.After(now) {
+				next = next.Add(time.Hour)
+			}
+			return next
+		})
+}
+
+//
+func TestRunOnStart(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	off := false
+	m := &Mapping{From: "image"}
+	th.AssertNoError(m.validate())
+	task := &Task{
+		Name:       "daily",
+		Interval:   86400,
+		RunOnStart: &off,
+		Source:     &Location{Registry: "source.example.com"},
+		Target:     &Location{Registry: "target.example.com"},
+		Mappings:   []*Mapping{m},
+	}
+	th.AssertNoError(task.validate())
+	th.AssertFalse(task.runsOnStart())
+	th.AssertTrue((&Task{}).runsOnStart())
+
+	fired := make(chan *Task, 1)
+	start := time.Now()
+	task.startTicking(fired)
+	select {
+	case <-fired:
+		th.AssertTrue(false)
+	case <-time.After(200 * time.Millisecond):
+	}
+	next := task.nextRun()
+	th.AssertNotNil(next)
+	th.AssertTrue(!next.Before(start.Add(24 * time.Hour)))
+	task.stopTicking()
+
+	th.AssertError((&Task{Name: "x", RunOnStart: &off}).validate(),
+		"'run-on-start', which requires an 'interval'")
+	th.AssertError((&Task{Name: "x", Schedule: "@daily",
+		RunOnStart: &off}).validate(),
+		"'run-on-start', which requires an 'interval'")
+}
+
+//
+func TestResumeFromState(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	dir, err := ioutil.TempDir("", "dregsy-state")
+	th.AssertNoError(err)
+	defer os.RemoveAll(dir)
+
+	newTask := func(name string) *Task {
+		m := &Mapping{From: "image"}
+		th.AssertNoError(m.validate())
+		task := &Task{
+			Name:      name,
+			Interval:  3600,
+			StateFile: filepath.Join(dir, "state.json"),
+			Source:    &Location{Registry: "source.example.com"},
+			Target:    &Location{Registry: "target.example.com"},
+			Mappings:  []*Mapping{m},
+		}
+		th.AssertNoError(task.validate())
+		task.openState()
+		return task
+	}
+
+	near := func(a, b time.Time) bool {
+		d := a.Sub(b)
+		return -time.Second < d && d < time.Second
+	}
+
+	now := time.Now()
+	recent := newTask("recent")
+	recent.recordRun(now.Add(-10 * time.Minute))
+	overdue := newTask("overdue")
+	overdue.recordRun(now.Add(-2 * time.Hour))
+	longOverdue := newTask("long-overdue")
+	longOverdue.recordRun(now.Add(-3 * time.Hour))
+	fresh := newTask("fresh")
+
+	due, ok := recent.resumeDue()
+	th.AssertTrue(ok)
+	th.AssertTrue(near(due, now.Add(50*time.Minute)))
+	_, ok = fresh.resumeDue()
+	th.AssertFalse(ok)
+
+	var order []string
+	for _, task := range byDueTime(
+		[]*Task{recent, fresh, overdue, longOverdue}) {
+		order = append(order, task.Name)
+	}
+	th.AssertEqualSlices(
+		[]string{"long-overdue", "overdue", "recent", "fresh"}, order)
+
+	// a task whose interval hasn't elapsed waits until it's due
+	fired := make(chan *Task, 1)
+	recent.startTicking(fired)
+	select {
+	case <-fired:
+		th.AssertTrue(false)
+	case <-time.After(200 * time.Millisecond):
+	}
+	th.AssertTrue(near(*recent.nextRun(), due))
+	recent.stopTicking()
+
+	// an overdue task runs right away, even without run on start
+	off := false
+	overdue.RunOnStart = &off
+	overdue.startTicking(fired)
+	select {
+	case <-fired:
+	case <-time.After(2 * time.Second):
+		th.AssertTrue(false)
+	}
+	overdue.stopTicking()
+}
+
+//
+func TestECRRepoCreateInput(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var none *ECRRepoConfig
+	inp := none.createInput("dregsy/test")
+	th.AssertEqual("dregsy/test", *inp.RepositoryName)
+	th.AssertTrue(inp.ImageTagMutability == nil)
+	data := newLifecyclePolicyData("123", "eu-west-1", "test", "dregsy/test")
+	pol, err := none.lifecyclePolicyInput(data)
+	th.AssertNoError(err)
+	th.AssertTrue(pol == nil)
+
+	conf := &ECRRepoConfig{
+		Tags:            map[string]string{"team": "platform", "env": "prod"},
+		ImmutableTags:   true,
+		ScanOnPush:      true,
+		Encryption:      "KMS",
+		KMSKey:          "alias/dregsy",
+		LifecyclePolicy: `{"rules": []}`,
+	}
+	th.AssertNoError(conf.validate())
+
+	inp = conf.createInput("dregsy/test")
+	th.AssertEqual("IMMUTABLE", *inp.ImageTagMutability)
+	th.AssertTrue(*inp.ImageScanningConfiguration.ScanOnPush)
+	th.AssertEqual("KMS", *inp.EncryptionConfiguration.EncryptionType)
+	th.AssertEqual("alias/dregsy", *inp.EncryptionConfiguration.KmsKey)
+	th.AssertEqual(2, len(inp.Tags))
+	th.AssertEqual("env", *inp.Tags[0].Key)
+
+	pol, err = conf.lifecyclePolicyInput(data)
+	th.AssertNoError(err)
+	th.AssertEqual(`{"rules": []}`, *pol.LifecyclePolicyText)
+	th.AssertEqual("123", *pol.RegistryId)
+	th.AssertEqual("dregsy/test", *pol.RepositoryName)
+
+	th.AssertError((&ECRRepoConfig{KMSKey: "alias/dregsy"}).validate(),
+		"'kms-key' requires 'encryption' to be 'KMS'")
+	th.AssertError((&ECRRepoConfig{LifecyclePolicy: "{"}).validate(),
+		"not valid JSON")
+	th.AssertError((&ECRRepoConfig{EnforceLifecyclePolicy: true}).validate(),
+		"'enforce-lifecycle-policy' requires a lifecycle policy")
+	th.AssertError((&ECRRepoConfig{LifecyclePolicy: `{"x": "{{.Repo"}`}).
+		validate(), "lifecycle policy is not a valid template")
+	th.AssertError((&ECRRepoConfig{LifecyclePolicy: `{"x": "{{.Project}}"}`}).
+		validate(), "cannot render lifecycle policy")
+}
+
+//
+func TestECRLifecyclePolicyTemplate(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	conf := &ECRRepoConfig{LifecyclePolicy: `{"rules": [{
+		"rulePriority": 1,
+		"description": "{{.Task}}: expire {{.Name}} in {{.Dir}} ({{.Region}})",
+		"selection": {"tagStatus": "any", "countType": "imageCountMoreThan",
+			"countNumber": {{if eq .Dir "mirror/dev"}}5{{else}}50{{end}}},
+		"action": {"type": "expire"}}]}`}
+	th.AssertNoError(conf.validate())
+
+	tryRender := func(repo, wantDesc string, wantCount float64) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		pol, err := conf.lifecyclePolicyInput(newLifecyclePolicyData(
+			"123", "eu-west-1", "mirror", repo))
+		th.AssertNoError(err)
+		var p struct {
+			Rules []struct {
+				Description string
+				Selection   struct{ CountNumber float64 }
+			}
+		}
+		th.AssertNoError(json.Unmarshal([]byte(*pol.LifecyclePolicyText), &p))
+		th.AssertEqual(wantDesc, p.Rules[0].Description)
+		th.AssertEqual(wantCount, p.Rules[0].Selection.CountNumber)
+	}
+
+	tryRender("mirror/dev/app",
+		"mirror: expire app in mirror/dev (eu-west-1)", 5)
+	tryRender("mirror/prod/app",
+		"mirror: expire app in mirror/prod (eu-west-1)", 50)
+	tryRender("app", "mirror: expire app in  (eu-west-1)", 50)
+}
+
+// mockECR records lifecycle policies put, and returns the given policy, or an
+// error when there is none
+type mockECR struct {
+	ecriface.ECRAPI
+	policy string
+	put    []string
+}
+
+//
+func (m *mockECR) GetLifecyclePolicy(in *ecr.GetLifecyclePolicyInput) (
+	*ecr.GetLifecyclePolicyOutput, error) {
+	if m.policy == "" {
+		return nil, awserr.New(ecr.ErrCodeLifecyclePolicyNotFoundException,
+			"no policy", nil)
+	}
+	return &ecr.GetLifecyclePolicyOutput{
+		LifecyclePolicyText: aws.String(m.policy)}, nil
+}
+
+//
+func (m *mockECR) PutLifecyclePolicy(in *ecr.PutLifecyclePolicyInput) (
+	*ecr.PutLifecyclePolicyOutput, error) {
+	m.put = append(m.put, *in.LifecyclePolicyText)
+	m.policy = *in.LifecyclePolicyText
+	return &ecr.PutLifecyclePolicyOutput{}, nil
+}
+
+//
+func TestEnforceLifecyclePolicy(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	inp := &ecr.PutLifecyclePolicyInput{
+		RegistryId:          aws.String("123"),
+		RepositoryName:      aws.String("mirror/app"),
+		LifecyclePolicyText: aws.String(`{"rules": [{"rulePriority": 1}]}`),
+	}
+
+	// no policy yet
+	svc := &mockECR{}
+	th.AssertNoError(enforceLifecyclePolicy(svc, inp))
+	th.AssertEqual(1, len(svc.put))
+
+	// same policy, formatted differently
+	svc.policy = `{"rules":[{"rulePriority":1}]}`
+	th.AssertNoError(enforceLifecyclePolicy(svc, inp))
+	th.AssertEqual(1, len(svc.put))
+
+	// drifted policy
+	svc.policy = `{"rules":[{"rulePriority":2}]}`
+	th.AssertNoError(enforceLifecyclePolicy(svc, inp))
+	th.AssertEqual(2, len(svc.put))
+	th.AssertEqual(*inp.LifecyclePolicyText, svc.policy)
+}
+
+// mockSigner records the refs it was asked to sign
+type mockSigner struct {
+	signed []string
+}
+
+//
+func (s *mockSigner) Sign(ref, creds string, skipTLSVerify bool) error {
+	s.signed = append(s.signed, ref)
+	return nil
+}
+
+//
+func TestSignTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	srv := httptest.NewServer(gocrregistry.New())
+	defer srv.Close()
+	reg := strings.TrimPrefix(srv.URL, "http://")
+
+	trgt := reg + "/target/image"
+	var want []string
+
+	for _, tag := range []string{"1.0", "1.1"} {
+		img, err := gocrrandom.Image(256, 1)
+		th.AssertNoError(err)
+		r, err := gocrname.NewTag(trgt + ":" + tag)
+		th.AssertNoError(err)
+		th.AssertNoError(gocrremote.Write(r, img))
+		d, err := img.Digest()
+		th.AssertNoError(err)
+		want = append(want, trgt+"@"+d.String())
+	}
+
+	signer := &mockSigner{}
+	task := &Task{
+		Name:   "test",
+		Target: &Location{Registry: reg},
+		signer: signer,
+	}
+
+	th.AssertNoError(task.signTags(trgt, []string{"1.0", "1.1"}))
+	th.AssertEquivalentSlices(want, signer.signed)
+
+	th.AssertError(task.signTags(trgt, []string{"missing"}),
+		"errors during signing of images")
+}
@@ -0,0 +1,95 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// ToTemplateData holds the values that can be used in a 'to' template
+type ToTemplateData struct {
+	// registry of the source location, as configured, e.g. 'docker.io'
+	SourceRegistry string
+	// path of the source repo without leading slash, e.g. 'library/busybox'
+	Path string
+	// last element of Path, e.g. 'busybox'
+	Name string
+	// Path without its last element, e.g. 'library'
+	Dir string
+}
+
+//
+var toTemplateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"replace": func(s, old, new string) string {
+		return strings.ReplaceAll(s, old, new)
+	},
+	"trimPrefix": strings.TrimPrefix,
+}
+
+//
+func isTemplate(expr string) bool {
+	return strings.Contains(expr, "{{")
+}
+
+// parseToTemplate parses a 'to' template, and checks that it can be rendered
+func parseToTemplate(to string) (*template.Template, error) {
+
+	tmpl, err := template.New("to").Funcs(toTemplateFuncs).Option(
+		"missingkey=error").Parse(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := renderToTemplate(tmpl, "registry.example.com:5000",
+		"/acme/app"); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// renderToTemplate renders the target path for given source registry & path
+func renderToTemplate(tmpl *template.Template, registry, p string) (
+	string, error) {
+
+	p = strings.Trim(p, "/")
+	dir := path.Dir(p)
+	if dir == "." {
+		dir = ""
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &ToTemplateData{
+		SourceRegistry: registry,
+		Path:           p,
+		Name:           path.Base(p),
+		Dir:            dir,
+	}); err != nil {
+		return "", err
+	}
+
+	ret := path.Clean(normalizePath(strings.TrimSpace(buf.String())))
+	if ret == "/" {
+		return "", fmt.Errorf("'to' template renders to empty path")
+	}
+	return ret, nil
+}
@@ -0,0 +1,54 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"os"
+	"time"
+
+	units "github.com/docker/go-units"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// isTerminal checks whether stdout is a terminal
+func isTerminal() bool {
+	return terminal.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// mappingSummary logs the images, tags, and bytes synced for the mapping t is
+// currently syncing, along with the throughput; only in terminal mode
+func (s *Sync) mappingSummary(t *Task) {
+
+	mr := t.runMapping
+	if !s.terminal || mr == nil {
+		return
+	}
+
+	elapsed := time.Since(mr.start)
+	bytes := t.runBytes - mr.bytes
+	throughput := "--"
+	if secs := elapsed.Seconds(); secs > 0 && bytes > 0 {
+		throughput = units.HumanSize(float64(bytes)/secs) + "/s"
+	}
+
+	log.WithFields(log.Fields{"task": t.Name, "from": mr.From,
+		"to": mr.To}).Infof("mapping done: %d image(s), %d tag(s), %s in "+
+		"%v, %s", t.runImages-mr.images, t.runTags-mr.tags,
+		units.HumanSize(float64(bytes)), elapsed.Round(time.Second),
+		throughput)
+}
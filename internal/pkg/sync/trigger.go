@@ -0,0 +1,210 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	gosync "sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const triggerPath = "/trigger/"
+const triggerTimeout = 10 * time.Second
+
+//
+type TriggerConfig struct {
+	Listen string `yaml:"listen"`
+	Secret string `yaml:"secret"`
+	API    bool   `yaml:"api"`
+}
+
+//
+func (c *TriggerConfig) validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Listen == "" {
+		return errors.New("'listen' address is required")
+	}
+
+	if c.API && c.Secret == "" {
+		return errors.New("'api' requires a 'secret'")
+	}
+
+	return nil
+}
+
+// triggerServer accepts requests for immediately syncing tasks, and hands
+// the requested tasks over to the sync loop
+type triggerServer struct {
+	conf   *TriggerConfig
+	tasks  map[string]*Task
+	queue  chan *Task
+	events chan *pushEvent
+	server *http.Server
+	mutex  gosync.RWMutex // guards tasks, which change on config reload
+}
+
+//
+func newTriggerServer(conf *TriggerConfig, tasks []*Task) *triggerServer {
+
+	if conf == nil {
+		return nil
+	}
+
+	ts := &triggerServer{
+		conf:   conf,
+		queue:  make(chan *Task),
+		events: make(chan *pushEvent),
+	}
+
+	ts.setTasks(tasks)
+	return ts
+}
+
+// setTasks replaces the tasks that can be triggered
+func (ts *triggerServer) setTasks(tasks []*Task) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.tasks = make(map[string]*Task)
+	for _, t := range tasks {
+		ts.tasks[t.Name] = t
+	}
+}
+
+//
+func (ts *triggerServer) start() error {
+
+	l, err := net.Listen("tcp", ts.conf.Listen)
+	if err != nil {
+		return fmt.Errorf(
+			"cannot listen for triggers on '%s': %v", ts.conf.Listen, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(triggerPath, ts.handleTrigger)
+	mux.HandleFunc(webhookDockerHubPath, ts.handleDockerHub)
+	mux.HandleFunc(webhookRegistryPath, ts.handleRegistry)
+	if ts.conf.API {
+		mux.HandleFunc(apiTasksPath, ts.handleAPI)
+		mux.HandleFunc(apiTasksPath+"/", ts.handleAPI)
+	}
+	ts.server = &http.Server{Handler: mux}
+
+	log.WithField("listen", l.Addr().String()).Info("accepting sync triggers")
+
+	go func() {
+		if err := ts.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("trigger listener failed: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+//
+func (ts *triggerServer) stop() {
+	if ts == nil || ts.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.server.Shutdown(ctx); err != nil {
+		log.Warnf("error stopping trigger listener: %v", err)
+	}
+	ts.server = nil
+}
+
+// authorized checks the secret given in the request, either as bearer token,
+// or as query parameter 'secret' for webhook senders that can't set headers
+func (ts *triggerServer) authorized(r *http.Request) bool {
+	if ts.conf.Secret == "" {
+		return true
+	}
+	token := r.URL.Query().Get("secret")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare(
+		[]byte(token), []byte(ts.conf.Secret)) == 1
+}
+
+//
+func (ts *triggerServer) handleTrigger(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !ts.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, triggerPath)
+	ts.mutex.RLock()
+	t, ok := ts.tasks[name]
+	ts.mutex.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no task with name '%s'", name),
+			http.StatusNotFound)
+		return
+	}
+
+	log.WithFields(log.Fields{"task": t.Name, "remote": r.RemoteAddr}).Info(
+		"sync triggered")
+	ts.enqueue(w, t)
+}
+
+// enqueue hands the task over to the sync loop, and responds accordingly
+func (ts *triggerServer) enqueue(w http.ResponseWriter, t *Task) {
+
+	if t.isPaused() {
+		http.Error(w, fmt.Sprintf("task '%s' is paused", t.Name),
+			http.StatusConflict)
+		return
+	}
+
+	if t.isRunning() {
+		http.Error(w, fmt.Sprintf("task '%s' is already running", t.Name),
+			http.StatusConflict)
+		return
+	}
+
+	t.force()
+
+	select {
+	case ts.queue <- t:
+		w.WriteHeader(http.StatusAccepted)
+	case <-time.After(triggerTimeout):
+		http.Error(w, "timeout while enqueuing task",
+			http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestTrigger(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	task := &Task{Name: "mirror"}
+	ts := newTriggerServer(
+		&TriggerConfig{Listen: ":0", Secret: "s3cr3t"}, []*Task{task})
+
+	received := make(chan *Task, 1)
+	go func() {
+		received <- <-ts.queue
+	}()
+
+	tryTrigger := func(method, path, secret string, want int) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		req := httptest.NewRequest(method, path, nil)
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		rec := httptest.NewRecorder()
+		ts.handleTrigger(rec, req)
+		th.AssertEqual(want, rec.Code)
+	}
+
+	tryTrigger(http.MethodGet, "/trigger/mirror", "s3cr3t",
+		http.StatusMethodNotAllowed)
+	tryTrigger(http.MethodPost, "/trigger/mirror", "", http.StatusUnauthorized)
+	tryTrigger(http.MethodPost, "/trigger/mirror", "wrong",
+		http.StatusUnauthorized)
+	tryTrigger(http.MethodPost, "/trigger/other", "s3cr3t",
+		http.StatusNotFound)
+	tryTrigger(http.MethodPost, "/trigger/mirror", "s3cr3t",
+		http.StatusAccepted)
+
+	th.AssertEqual(task, <-received)
+	th.AssertTrue(task.takeForce())
+
+	task.tryStart()
+	tryTrigger(http.MethodPost, "/trigger/mirror", "s3cr3t",
+		http.StatusConflict)
+}
@@ -0,0 +1,61 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+// mockVerifier only accepts the signatures of refs listed in signed
+type mockVerifier struct {
+	signed map[string]bool
+}
+
+//
+func (v *mockVerifier) Verify(ref, creds string, skipTLSVerify bool) error {
+	if v.signed[ref] {
+		return nil
+	}
+	return errors.New("no matching signatures")
+}
+
+//
+func TestVerifyTags(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	task := &Task{
+		Name:   "test",
+		Source: &Location{Registry: "reg"},
+		verifier: &mockVerifier{signed: map[string]bool{
+			"reg/img:1.0": true,
+			"reg/img:1.2": true,
+		}},
+	}
+
+	passed, err := task.verifyTags("reg/img", []string{"1.0", "1.1", "1.2"})
+	th.AssertError(err,
+		"1 image(s) of 'reg/img' failed signature verification")
+	th.AssertEquivalentSlices([]string{"1.0", "1.2"}, passed)
+
+	passed, err = task.verifyTags("reg/img", []string{"1.0"})
+	th.AssertNoError(err)
+	th.AssertEquivalentSlices([]string{"1.0"}, passed)
+}
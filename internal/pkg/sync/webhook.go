@@ -0,0 +1,268 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const (
+	webhookDockerHubPath = "/webhook/dockerhub"
+	webhookRegistryPath  = "/webhook/registry"
+	maxWebhookPayload    = 1 << 20
+)
+
+// host names under which Docker Hub is known
+var dockerHubHosts = map[string]bool{
+	"docker.io":               true,
+	"index.docker.io":         true,
+	"registry.hub.docker.com": true,
+	"registry-1.docker.io":    true,
+}
+
+// pushEvent describes a tag pushed to a source registry, and the task mapping
+// through which it is to be synced
+type pushEvent struct {
+	task    *Task
+	mapping *Mapping
+	src     string
+	trgt    string
+	tag     string
+}
+
+// pushedTag is a tag pushed to a registry, as reported by a webhook
+type pushedTag struct {
+	registry string // empty if unknown
+	repo     string
+	tag      string
+}
+
+// dockerHubPayload is the part of a Docker Hub webhook payload we're
+// interested in
+type dockerHubPayload struct {
+	PushData struct {
+		Tag string `json:"tag"`
+	} `json:"push_data"`
+	Repository struct {
+		RepoName string `json:"repo_name"`
+	} `json:"repository"`
+}
+
+// registryPayload is the part of an OCI distribution notification we're
+// interested in
+type registryPayload struct {
+	Events []struct {
+		Action string `json:"action"`
+		Target struct {
+			Repository string `json:"repository"`
+			Tag        string `json:"tag"`
+		} `json:"target"`
+		Request struct {
+			Host string `json:"host"`
+		} `json:"request"`
+	} `json:"events"`
+}
+
+//
+func parseDockerHubPayload(r io.Reader) ([]*pushedTag, error) {
+
+	var p dockerHubPayload
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid Docker Hub payload: %v", err)
+	}
+
+	repo := p.Repository.RepoName
+	if repo == "" || p.PushData.Tag == "" {
+		return nil, errors.New("payload from Docker Hub lacks repository or tag")
+	}
+	if !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+
+	return []*pushedTag{
+		{registry: "docker.io", repo: repo, tag: p.PushData.Tag}}, nil
+}
+
+// parseRegistryPayload parses an OCI distribution notification envelope, and
+// returns the tags that were pushed; events for other actions, and pushes of
+// blobs or untagged manifests are ignored
+func parseRegistryPayload(r io.Reader) ([]*pushedTag, error) {
+
+	var p registryPayload
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid registry notification: %v", err)
+	}
+
+	var ret []*pushedTag
+	for _, e := range p.Events {
+		if e.Action != "push" || e.Target.Tag == "" {
+			continue
+		}
+		ret = append(ret, &pushedTag{
+			registry: e.Request.Host,
+			repo:     e.Target.Repository,
+			tag:      e.Target.Tag,
+		})
+	}
+
+	return ret, nil
+}
+
+//
+func sameRegistry(a, b string) bool {
+	return a == b || (dockerHubHosts[a] && dockerHubHosts[b])
+}
+
+// match returns a push event for each task mapping through which the given
+// pushed tag is synced
+func (ts *triggerServer) match(p *pushedTag) []*pushEvent {
+
+	var ret []*pushEvent
+
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	for _, t := range ts.tasks {
+
+		if p.registry != "" && !sameRegistry(t.Source.Registry, p.registry) {
+			continue
+		}
+
+		repo, ok := t.Source.repoPath(p.repo)
+		if !ok {
+			continue
+		}
+		repo = strings.TrimPrefix(repo, "/")
+		path := normalizePath(repo)
+
+		for _, m := range t.Mappings {
+
+			if m.isRegexpFrom() {
+				if !m.fromFilter.MatchString(repo) || m.isExcludedRepo(repo) {
+					continue
+				}
+			} else if m.From != path {
+				continue
+			}
+
+			trgt, err := t.targetRef(m, path)
+			if err != nil {
+				log.WithField("task", t.Name).Errorf(
+					"ignoring pushed tag: %v", err)
+				continue
+			}
+
+			ret = append(ret, &pushEvent{
+				task:    t,
+				mapping: m,
+				src:     t.Source.ref(path),
+				trgt:    trgt,
+				tag:     p.tag,
+			})
+		}
+	}
+
+	return ret
+}
+
+//
+func (ts *triggerServer) handleDockerHub(w http.ResponseWriter,
+	r *http.Request) {
+	ts.handleWebhook(w, r, parseDockerHubPayload)
+}
+
+//
+func (ts *triggerServer) handleRegistry(w http.ResponseWriter,
+	r *http.Request) {
+	ts.handleWebhook(w, r, parseRegistryPayload)
+}
+
+//
+func (ts *triggerServer) handleWebhook(w http.ResponseWriter, r *http.Request,
+	parse func(io.Reader) ([]*pushedTag, error)) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !ts.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	pushed, err := parse(io.LimitReader(r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var events []*pushEvent
+	for _, p := range pushed {
+		matched := ts.match(p)
+		log.WithFields(log.Fields{
+			"registry": p.registry, "repo": p.repo, "tag": p.tag,
+			"matches": len(matched)}).Info("push notification received")
+		events = append(events, matched...)
+	}
+
+	if len(events) == 0 {
+		fmt.Fprintln(w, "no matching task mapping")
+		return
+	}
+
+	// the notification is refused as a whole before anything is enqueued, so
+	// that when the registry delivers it again, no tag gets synced twice
+	for _, e := range events {
+		if e.task.isRunning() {
+			http.Error(w, fmt.Sprintf("task '%s' is already running",
+				e.task.Name), http.StatusConflict)
+			return
+		}
+	}
+
+	enqueued := 0
+	for _, e := range events {
+		select {
+		case ts.events <- e:
+			enqueued++
+		case <-time.After(triggerTimeout):
+			if enqueued == 0 {
+				http.Error(w, "timeout while enqueuing sync",
+					http.StatusServiceUnavailable)
+				return
+			}
+			// part of the notification is already being synced, so it
+			// mustn't be refused anymore
+			log.WithFields(log.Fields{"task": e.task.Name, "ref": e.src,
+				"tag": e.tag}).Error(
+				"timeout while enqueuing sync, dropping pushed tag")
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,212 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+const dockerHubEvent = `{
+  "push_data": {"pushed_at": 1417566161, "pusher": "someone", "tag": "1.2.3"},
+  "repository": {"name": "app", "namespace": "someone",
+    "repo_name": "someone/app", "status": "Active"}
+}`
+
+//
+const registryEvent = `{
+  "events": [
+    {"action": "push",
+     "target": {"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+       "repository": "team/service", "digest": "sha256:aaaa"},
+     "request": {"host": "registry.example.com"}},
+    {"action": "push",
+     "target": {"mediaType": "application/vnd.oci.image.manifest.v1+json",
+       "repository": "team/service", "digest": "sha256:bbbb", "tag": "v1"},
+     "request": {"host": "registry.example.com"}},
+    {"action": "pull",
+     "target": {"repository": "team/service", "tag": "v0"},
+     "request": {"host": "registry.example.com"}}
+  ]
+}`
+
+//
+func newWebhookTestServer(th *test.TestHelper) *triggerServer {
+
+	newTask := func(name, src string, mappings ...*Mapping) *Task {
+		for _, m := range mappings {
+			th.AssertNoError(m.validate())
+		}
+		return &Task{
+			Name:     name,
+			Source:   &Location{Registry: src},
+			Target:   &Location{Registry: "mirror.example.com"},
+			Mappings: mappings,
+		}
+	}
+
+	return newTriggerServer(&TriggerConfig{Listen: ":0", Secret: "s3cr3t"},
+		[]*Task{
+			newTask("hub", "registry.hub.docker.com",
+				&Mapping{From: "someone/app", To: "hub/app"},
+				&Mapping{From: "someone/other"}),
+			newTask("internal", "registry.example.com",
+				&Mapping{From: "regex:team/.*", To: "regex:team/(.*),teams/$1"}),
+		})
+}
+
+//
+func TestParseWebhookPayloads(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	pushed, err := parseDockerHubPayload(strings.NewReader(dockerHubEvent))
+	th.AssertNoError(err)
+	th.AssertEqual(1, len(pushed))
+	th.AssertEqual(pushedTag{
+		registry: "docker.io", repo: "someone/app", tag: "1.2.3"}, *pushed[0])
+
+	_, err = parseDockerHubPayload(strings.NewReader(`{}`))
+	th.AssertError(err, "lacks repository or tag")
+
+	pushed, err = parseRegistryPayload(strings.NewReader(registryEvent))
+	th.AssertNoError(err)
+	th.AssertEqual(1, len(pushed))
+	th.AssertEqual(pushedTag{registry: "registry.example.com",
+		repo: "team/service", tag: "v1"}, *pushed[0])
+}
+
+//
+func TestMatchPushedTag(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ts := newWebhookTestServer(th)
+
+	events := ts.match(&pushedTag{
+		registry: "docker.io", repo: "someone/app", tag: "1.2.3"})
+	th.AssertEqual(1, len(events))
+	th.AssertEqual("hub", events[0].task.Name)
+	th.AssertEqual("registry.hub.docker.com/someone/app", events[0].src)
+	th.AssertEqual("mirror.example.com/hub/app", events[0].trgt)
+	th.AssertEqual("1.2.3", events[0].tag)
+
+	events = ts.match(&pushedTag{
+		registry: "registry.example.com", repo: "team/service", tag: "v1"})
+	th.AssertEqual(1, len(events))
+	th.AssertEqual("mirror.example.com/teams/service", events[0].trgt)
+
+	th.AssertEqual(0, len(ts.match(&pushedTag{
+		registry: "registry.example.com", repo: "someone/app", tag: "v1"})))
+	th.AssertEqual(1, len(ts.match(&pushedTag{repo: "team/service", tag: "v1"})))
+}
+
+//
+func TestWebhookHandler(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+	ts := newWebhookTestServer(th)
+
+	received := make(chan *pushEvent, 1)
+	go func() {
+		received <- <-ts.events
+	}()
+
+	tryWebhook := func(path, payload string, want int) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		req := httptest.NewRequest(
+			http.MethodPost, path, strings.NewReader(payload))
+		rec := httptest.NewRecorder()
+		ts.handleDockerHub(rec, req)
+		th.AssertEqual(want, rec.Code)
+	}
+
+	tryWebhook("/webhook/dockerhub", dockerHubEvent, http.StatusUnauthorized)
+	tryWebhook("/webhook/dockerhub?secret=s3cr3t", "{", http.StatusBadRequest)
+	tryWebhook("/webhook/dockerhub?secret=s3cr3t",
+		strings.Replace(dockerHubEvent, "someone/app", "someone/unknown", 1),
+		http.StatusOK)
+	tryWebhook("/webhook/dockerhub?secret=s3cr3t", dockerHubEvent,
+		http.StatusAccepted)
+
+	e := <-received
+	th.AssertEqual("hub", e.task.Name)
+	th.AssertEqual("1.2.3", e.tag)
+}
+
+//
+func TestWebhookMultipleMatches(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var tasks []*Task
+	for _, name := range []string{"mirror", "backup"} {
+		m := &Mapping{From: "someone/app", To: name + "/app"}
+		th.AssertNoError(m.validate())
+		tasks = append(tasks, &Task{
+			Name:     name,
+			Source:   &Location{Registry: "registry.hub.docker.com"},
+			Target:   &Location{Registry: "mirror.example.com"},
+			Mappings: []*Mapping{m},
+		})
+	}
+	ts := newTriggerServer(
+		&TriggerConfig{Listen: ":0", Secret: "s3cr3t"}, tasks)
+
+	received := make(chan *pushEvent, 2)
+	go func() {
+		for e := range ts.events {
+			received <- e
+		}
+	}()
+	defer close(ts.events)
+
+	tryWebhook := func(want int) {
+		test.StackTraceDepth = 2
+		defer func() { test.StackTraceDepth = 1 }()
+		req := httptest.NewRequest(http.MethodPost,
+			"/webhook/dockerhub?secret=s3cr3t",
+			strings.NewReader(dockerHubEvent))
+		rec := httptest.NewRecorder()
+		ts.handleDockerHub(rec, req)
+		th.AssertEqual(want, rec.Code)
+	}
+
+	// with one of the tasks running, nothing is enqueued
+	atomic.StoreInt32(&tasks[1].running, 1)
+	tryWebhook(http.StatusConflict)
+	select {
+	case e := <-received:
+		th.AssertEqual("", e.task.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	atomic.StoreInt32(&tasks[1].running, 0)
+	tryWebhook(http.StatusAccepted)
+	var names []string
+	for i := 0; i < 2; i++ {
+		names = append(names, (<-received).task.Name)
+	}
+	th.AssertEquivalentSlices([]string{"mirror", "backup"}, names)
+}
@@ -0,0 +1,78 @@
+/*
+	Copyright 2021 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tags
+
+import (
+	"fmt"
+	"regexp"
+)
+
+//
+var validTagChars = regexp.MustCompile(`^[A-Za-z0-9_.-]*$`)
+
+// Rewrite describes how source tags are transformed into target tags: a
+// regular expression replacement is applied first, and then prefix and suffix
+// are added
+type Rewrite struct {
+	Prefix  string
+	Suffix  string
+	Match   *regexp.Regexp
+	Replace string
+}
+
+//
+func NewRewrite(prefix, suffix, match, replace string) (*Rewrite, error) {
+
+	if prefix == "" && suffix == "" && match == "" {
+		return nil, nil
+	}
+
+	if !validTagChars.MatchString(prefix) ||
+		!validTagChars.MatchString(suffix) {
+		return nil, fmt.Errorf(
+			"tag prefix & suffix may only contain letters, digits, '_', '.', " +
+				"and '-'")
+	}
+	if prefix != "" && (prefix[0] == '.' || prefix[0] == '-') {
+		return nil, fmt.Errorf("tag prefix must not start with '.' or '-'")
+	}
+
+	ret := &Rewrite{Prefix: prefix, Suffix: suffix, Replace: replace}
+
+	if match != "" {
+		var err error
+		if ret.Match, err = regexp.Compile(match); err != nil {
+			return nil, fmt.Errorf(
+				"invalid regular expression '%s': %v", match, err)
+		}
+	} else if replace != "" {
+		return nil, fmt.Errorf("tag rewrite has 'replace', but no 'match'")
+	}
+
+	return ret, nil
+}
+
+// Apply returns the target tag for given source tag
+func (r *Rewrite) Apply(tag string) string {
+	if r == nil {
+		return tag
+	}
+	if r.Match != nil {
+		tag = r.Match.ReplaceAllString(tag, r.Replace)
+	}
+	return r.Prefix + tag + r.Suffix
+}
@@ -46,6 +46,7 @@ type TagSet struct {
 	verbatim []string
 	semver   []semver.Range
 	regex    []*regex
+	rewrite  *Rewrite
 }
 
 //
@@ -94,6 +95,19 @@ func (ts *TagSet) addRegex(r string) error {
 	return nil
 }
 
+// SetRewrite sets the rewrite to apply when tagging for the target
+func (ts *TagSet) SetRewrite(r *Rewrite) {
+	ts.rewrite = r
+}
+
+// TargetTag returns the tag to use in the target for given source tag
+func (ts *TagSet) TargetTag(tag string) string {
+	if ts == nil {
+		return tag
+	}
+	return ts.rewrite.Apply(tag)
+}
+
 //
 func (ts *TagSet) IsEmpty() bool {
 	return !ts.HasVerbatim() && !ts.HasSemver() && !ts.HasRegex()
@@ -205,6 +219,65 @@ func (ts *TagSet) expandRegex(tags []string) []string {
 	return ret
 }
 
+// Contains returns true if tag is one of the verbatim tags of this set, or
+// matches any of its semver ranges or regular expressions
+func (ts *TagSet) Contains(tag string) bool {
+
+	for _, v := range ts.verbatim {
+		if v == tag {
+			return true
+		}
+	}
+
+	if ts.HasSemver() {
+		if v, err := semver.ParseTolerant(tag); err == nil {
+			for _, r := range ts.semver {
+				if r(v) {
+					return true
+				}
+			}
+		}
+	}
+
+	for _, r := range ts.regex {
+		if r.matches(tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SortSemver returns the given tags sorted by semantic version in descending
+// order, i.e. newest version first; tags that are not a valid semver are
+// dropped
+func SortSemver(tags []string) []string {
+
+	type version struct {
+		tag string
+		ver semver.Version
+	}
+
+	var vers []version
+	for _, t := range tags {
+		if v, err := semver.ParseTolerant(t); err != nil {
+			log.Debugf("skipping tag '%s', not a valid semver: %v", t, err)
+		} else {
+			vers = append(vers, version{tag: t, ver: v})
+		}
+	}
+
+	sort.SliceStable(vers, func(i, j int) bool {
+		return vers[i].ver.GT(vers[j].ver)
+	})
+
+	ret := make([]string, 0, len(vers))
+	for _, v := range vers {
+		ret = append(ret, v.tag)
+	}
+	return ret
+}
+
 //
 func addToSet(s map[string]string, tags []string) {
 	for _, t := range tags {
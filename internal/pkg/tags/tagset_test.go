@@ -0,0 +1,63 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tags
+
+import (
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestSortSemver(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	for _, tc := range []struct {
+		tags []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"latest", "edge"}, nil},
+		{
+			[]string{"1.2.0", "1.10.0", "1.9.3", "2.0.0"},
+			[]string{"2.0.0", "1.10.0", "1.9.3", "1.2.0"},
+		},
+		// tolerant parsing of prefix and short versions
+		{
+			[]string{"v1.1", "1.0.1", "v2"},
+			[]string{"v2", "v1.1", "1.0.1"},
+		},
+		// pre-releases come before the release
+		{
+			[]string{"1.0.0-rc.1", "1.0.0", "1.0.0-beta"},
+			[]string{"1.0.0", "1.0.0-rc.1", "1.0.0-beta"},
+		},
+		// non-semver tags are dropped
+		{
+			[]string{"latest", "1.0.0", "stable-slim", "0.9"},
+			[]string{"1.0.0", "0.9"},
+		},
+		// equal versions keep their order
+		{
+			[]string{"1.0", "v1.0.0", "1.0.0"},
+			[]string{"1.0", "v1.0.0", "1.0.0"},
+		},
+	} {
+		th.AssertEqualSlices(tc.want, SortSemver(tc.tags))
+	}
+}
@@ -0,0 +1,210 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// OTLP status codes
+const (
+	statusOK    = 1
+	statusError = 2
+)
+
+// span kind internal
+const kindInternal = 1
+
+// the following types model the JSON encoding of an OTLP trace export request,
+// as far as needed here
+
+//
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+//
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+//
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+//
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []spanJSON `json:"spans"`
+}
+
+//
+type scope struct {
+	Name string `json:"name"`
+}
+
+//
+type spanJSON struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []keyValue `json:"attributes,omitempty"`
+	Status       status     `json:"status"`
+}
+
+//
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+//
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+//
+type anyValue struct {
+	String *string     `json:"stringValue,omitempty"`
+	Bool   *bool       `json:"boolValue,omitempty"`
+	Int    *string     `json:"intValue,omitempty"`
+	Double *float64    `json:"doubleValue,omitempty"`
+	Array  *arrayValue `json:"arrayValue,omitempty"`
+}
+
+//
+type arrayValue struct {
+	Values []anyValue `json:"values"`
+}
+
+// send exports the given spans to the collector
+func (t *Tracer) send(spans []*Span) error {
+
+	encoded := make([]spanJSON, 0, len(spans))
+	for _, s := range spans {
+		encoded = append(encoded, s.encode())
+	}
+
+	body, err := json.Marshal(&exportRequest{
+		ResourceSpans: []resourceSpans{{
+			Resource: resource{Attributes: []keyValue{
+				{Key: "service.name", Value: toAnyValue(t.service)}}},
+			ScopeSpans: []scopeSpans{{
+				Scope: scope{Name: defaultServiceName},
+				Spans: encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with status %s", resp.Status)
+	}
+	return nil
+}
+
+//
+func (s *Span) encode() spanJSON {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ret := spanJSON{
+		TraceID: hex.EncodeToString(s.traceID[:]),
+		SpanID:  hex.EncodeToString(s.spanID[:]),
+		Name:    s.name,
+		Kind:    kindInternal,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:  status{Code: statusOK},
+	}
+
+	if s.parentID != [8]byte{} {
+		ret.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+
+	if s.failed {
+		ret.Status = status{Code: statusError, Message: s.errMsg}
+	}
+
+	for k, v := range s.attrs {
+		ret.Attributes = append(ret.Attributes,
+			keyValue{Key: k, Value: toAnyValue(v)})
+	}
+
+	return ret
+}
+
+// toAnyValue converts v into an OTLP attribute value; types not supported by
+// OTLP are recorded as their string representation
+func toAnyValue(v interface{}) anyValue {
+	switch val := v.(type) {
+	case string:
+		return anyValue{String: &val}
+	case bool:
+		return anyValue{Bool: &val}
+	case int:
+		i := strconv.Itoa(val)
+		return anyValue{Int: &i}
+	case int64:
+		i := strconv.FormatInt(val, 10)
+		return anyValue{Int: &i}
+	case float64:
+		return anyValue{Double: &val}
+	case []string:
+		arr := &arrayValue{Values: make([]anyValue, 0, len(val))}
+		for _, e := range val {
+			arr.Values = append(arr.Values, toAnyValue(e))
+		}
+		return anyValue{Array: arr}
+	default:
+		s := fmt.Sprint(val)
+		return anyValue{String: &s}
+	}
+}
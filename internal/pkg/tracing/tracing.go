@@ -0,0 +1,315 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	gosync "sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//
+const (
+	defaultServiceName = "dregsy"
+	tracesPath         = "/v1/traces"
+	exportInterval     = 5 * time.Second
+	exportTimeout      = 10 * time.Second
+	maxBatch           = 512
+	maxQueue           = 4096
+)
+
+// Config sets where to export spans to, via OTLP over HTTP; endpoint is the
+// base URL of the collector, to which '/v1/traces' is appended unless already
+// present; endpoint and header values may reference environment variables
+type Config struct {
+	Endpoint    string            `yaml:"endpoint"`
+	Headers     map[string]string `yaml:"headers"`
+	ServiceName string            `yaml:"service-name"`
+}
+
+//
+func (c *Config) Validate() error {
+
+	if c == nil {
+		return nil
+	}
+
+	if c.Endpoint == "" {
+		return errors.New("'endpoint' is required")
+	}
+
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid 'endpoint': %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf(
+			"invalid 'endpoint' '%s', must be an http or https URL",
+			c.Endpoint)
+	}
+
+	if c.ServiceName == "" {
+		c.ServiceName = defaultServiceName
+	}
+
+	return nil
+}
+
+// Tracer records spans, and exports them in batches; all methods are safe to
+// call on a nil *Tracer, in which case they do nothing
+type Tracer struct {
+	url     string
+	headers map[string]string
+	service string
+	client  *http.Client
+	//
+	mutex   gosync.Mutex
+	queue   []*Span // ended spans not yet exported
+	dropped int
+	flush   chan bool
+	stop    chan bool
+	done    chan bool
+}
+
+// New creates a tracer for given config; returns nil if config is nil
+func New(conf *Config) *Tracer {
+
+	if conf == nil {
+		return nil
+	}
+
+	t := &Tracer{
+		url:     conf.Endpoint,
+		headers: make(map[string]string),
+		service: conf.ServiceName,
+		client:  &http.Client{Timeout: exportTimeout},
+		flush:   make(chan bool, 1),
+	}
+
+	if !strings.HasSuffix(t.url, tracesPath) {
+		t.url = strings.TrimSuffix(t.url, "/") + tracesPath
+	}
+	if t.service == "" {
+		t.service = defaultServiceName
+	}
+	for k, v := range conf.Headers {
+		t.headers[k] = v
+	}
+
+	return t
+}
+
+// Start starts exporting ended spans in the background
+func (t *Tracer) Start() {
+
+	if t == nil || t.stop != nil {
+		return
+	}
+
+	t.stop = make(chan bool)
+	t.done = make(chan bool)
+
+	log.WithField("url", t.url).Info("exporting traces")
+
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(exportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-t.flush:
+			case <-t.stop:
+				t.export()
+				return
+			}
+			t.export()
+		}
+	}()
+}
+
+// Stop exports all remaining spans, and stops exporting
+func (t *Tracer) Stop() {
+	if t == nil || t.stop == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	t.stop = nil
+}
+
+// NewSpan starts a new trace with a root span of given name
+func (t *Tracer) NewSpan(name string, attrs Attributes) *Span {
+	if t == nil {
+		return nil
+	}
+	s := newSpan(t, name, attrs)
+	rand.Read(s.traceID[:])
+	return s
+}
+
+//
+func (t *Tracer) enqueue(s *Span) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.queue) >= maxQueue {
+		t.dropped++
+		return
+	}
+
+	t.queue = append(t.queue, s)
+	if len(t.queue) >= maxBatch {
+		select {
+		case t.flush <- true:
+		default:
+		}
+	}
+}
+
+// export sends all queued spans to the collector, in batches; errors are
+// logged, and the affected spans are dropped
+func (t *Tracer) export() {
+
+	t.mutex.Lock()
+	queue := t.queue
+	dropped := t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mutex.Unlock()
+
+	if dropped > 0 {
+		log.Warnf("span queue full, dropped %d span(s)", dropped)
+	}
+
+	for len(queue) > 0 {
+		n := len(queue)
+		if n > maxBatch {
+			n = maxBatch
+		}
+		if err := t.send(queue[:n]); err != nil {
+			log.Warnf("cannot export %d span(s): %v", n, err)
+		}
+		queue = queue[n:]
+	}
+}
+
+// Span is a timed operation within a trace; all methods are safe to call on a
+// nil *Span, in which case they do nothing
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	//
+	mutex  gosync.Mutex
+	attrs  Attributes
+	errMsg string
+	failed bool
+	ended  bool
+}
+
+// Attributes are the key/value pairs recorded with a span
+type Attributes map[string]interface{}
+
+//
+func newSpan(t *Tracer, name string, attrs Attributes) *Span {
+	s := &Span{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+		attrs:  make(Attributes, len(attrs)),
+	}
+	for k, v := range attrs {
+		s.attrs[k] = v
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// Child starts a span of given name as child of this span
+func (s *Span) Child(name string, attrs Attributes) *Span {
+	if s == nil {
+		return nil
+	}
+	c := newSpan(s.tracer, name, attrs)
+	c.traceID = s.traceID
+	c.parentID = s.spanID
+	return c
+}
+
+//
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attrs[key] = value
+}
+
+// Fail sets the status of this span to error, with err as message; the first
+// error is kept, nil errors and errors after the span has ended are ignored
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.failed && !s.ended {
+		s.failed = true
+		s.errMsg = err.Error()
+	}
+}
+
+// End ends this span, and hands it over for export; only the first call has
+// an effect
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mutex.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// TraceParent returns the W3C trace context header value identifying this
+// span, for propagating it to registries; empty for a nil span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01",
+		hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
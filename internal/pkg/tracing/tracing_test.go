@@ -0,0 +1,129 @@
+/*
+	Copyright 2020 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xelalexv/dregsy/internal/pkg/test"
+)
+
+//
+func TestExport(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var paths, auth []string
+	var requests []exportRequest
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			data, _ := ioutil.ReadAll(req.Body)
+			var r exportRequest
+			json.Unmarshal(data, &r)
+			requests = append(requests, r)
+			paths = append(paths, req.URL.Path)
+			auth = append(auth, req.Header.Get("Authorization"))
+		}))
+	defer srv.Close()
+
+	conf := &Config{Endpoint: srv.URL + "/",
+		Headers: map[string]string{"Authorization": "Bearer token"}}
+	th.AssertNoError(conf.Validate())
+
+	tracer := New(conf)
+	tracer.Start()
+
+	root := tracer.NewSpan("sync task", Attributes{"dregsy.task": "mirror"})
+	child := root.Child("sync ref", Attributes{"image.source": "busybox"})
+	child.SetAttribute("dregsy.tags.synced", 2)
+	child.Fail(errors.New("push failed"))
+	child.Fail(errors.New("ignored"))
+	child.End()
+	root.End()
+	root.End()
+	root.Fail(errors.New("ignored after end"))
+
+	tracer.Stop()
+
+	th.AssertEqual(1, len(requests))
+	th.AssertEqualSlices([]string{"/v1/traces"}, paths)
+	th.AssertEqualSlices([]string{"Bearer token"}, auth)
+
+	rs := requests[0].ResourceSpans[0]
+	th.AssertEqual("service.name", rs.Resource.Attributes[0].Key)
+	th.AssertEqual("dregsy", *rs.Resource.Attributes[0].Value.String)
+
+	spans := rs.ScopeSpans[0].Spans
+	th.AssertEqual(2, len(spans))
+	c, r := spans[0], spans[1]
+
+	th.AssertEqual("sync ref", c.Name)
+	th.AssertEqual(r.TraceID, c.TraceID)
+	th.AssertEqual(r.SpanID, c.ParentSpanID)
+	th.AssertEqual(statusError, c.Status.Code)
+	th.AssertEqual("push failed", c.Status.Message)
+	th.AssertEqual(2, len(c.Attributes))
+
+	th.AssertEqual("sync task", r.Name)
+	th.AssertEqual("", r.ParentSpanID)
+	th.AssertEqual(statusOK, r.Status.Code)
+	th.AssertEqual(32, len(r.TraceID))
+	th.AssertEqual(16, len(r.SpanID))
+
+	th.AssertEqual("00-"+r.TraceID+"-"+r.SpanID+"-01", root.TraceParent())
+}
+
+//
+func TestNilTracer(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	var tracer *Tracer
+	tracer.Start()
+	span := tracer.NewSpan("nothing", nil)
+	th.AssertNil(span)
+	span.Child("child", nil).End()
+	span.SetAttribute("key", "value")
+	span.Fail(errors.New("failed"))
+	span.End()
+	th.AssertEqual("", span.TraceParent())
+	tracer.Stop()
+
+	th.AssertNil(New(nil))
+}
+
+//
+func TestConfig(t *testing.T) {
+
+	th := test.NewTestHelper(t)
+
+	th.AssertNoError((*Config)(nil).Validate())
+	th.AssertError((&Config{}).Validate(), "'endpoint' is required")
+	th.AssertError((&Config{Endpoint: "collector:4318"}).Validate(),
+		"must be an http or https URL")
+
+	conf := &Config{Endpoint: "https://collector:4318/v1/traces"}
+	th.AssertNoError(conf.Validate())
+	th.AssertEqual("dregsy", conf.ServiceName)
+	th.AssertEqual("https://collector:4318/v1/traces", New(conf).url)
+}
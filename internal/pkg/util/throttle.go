@@ -0,0 +1,116 @@
+/*
+	Copyright 2021 Alexander Vollschwitz <xelalex@gmx.net>
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	  http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Throttle limits the combined throughput of all readers wrapped with it to a
+// maximum number of bytes per second
+type Throttle struct {
+	rate  int64
+	chunk int
+	next  time.Time
+	mutex sync.Mutex
+}
+
+// NewThrottle creates a throttle for the given rate in bytes per second; for a
+// rate of 0 or less, nil is returned, which does not throttle at all
+func NewThrottle(rate int64) *Throttle {
+	if rate <= 0 {
+		return nil
+	}
+	// limit the size of single reads, so that throughput stays smooth
+	chunk := int(rate / 10)
+	if chunk < 1024 {
+		chunk = 1024
+	}
+	return &Throttle{rate: rate, chunk: chunk}
+}
+
+// Rate returns the throttle's rate in bytes per second, 0 if not throttled
+func (t *Throttle) Rate() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.rate
+}
+
+// Reader wraps the given reader so that reads from it are throttled
+func (t *Throttle) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &throttledReader{reader: r, throttle: t}
+}
+
+// ReadCloser wraps the given read closer so that reads from it are throttled
+func (t *Throttle) ReadCloser(rc io.ReadCloser) io.ReadCloser {
+	if t == nil || rc == nil {
+		return rc
+	}
+	return &throttledReadCloser{
+		Reader: t.Reader(rc),
+		Closer: rc,
+	}
+}
+
+// wait blocks for as long as it takes to transfer n bytes at the throttle's
+// rate, counting from the end of the previous transfer, if that is still
+// pending
+func (t *Throttle) wait(n int) {
+
+	if n <= 0 {
+		return
+	}
+
+	t.mutex.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(n) * time.Second / time.Duration(t.rate))
+	delay := t.next.Sub(now)
+	t.mutex.Unlock()
+
+	time.Sleep(delay)
+}
+
+//
+type throttledReader struct {
+	reader   io.Reader
+	throttle *Throttle
+}
+
+//
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > r.throttle.chunk {
+		p = p[:r.throttle.chunk]
+	}
+	n, err := r.reader.Read(p)
+	r.throttle.wait(n)
+	return n, err
+}
+
+//
+type throttledReadCloser struct {
+	io.Reader
+	io.Closer
+}
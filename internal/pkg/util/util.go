@@ -20,6 +20,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"os"
 	"regexp"
 	"strings"
 
@@ -89,3 +90,26 @@ func DecodeJSONAuth(authBase64 string) string {
 
 	return fmt.Sprintf("%s:%s", ret.Username, ret.Password)
 }
+
+// envRef matches ${VAR} and ${VAR:-default}, as well as $${, which escapes a
+// literal ${
+var envRef = regexp.MustCompile(
+	`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ExpandEnvRefs replaces ${VAR} and ${VAR:-default} in the given string with
+// the value of the according environment variable, or default when VAR is
+// unset or empty; $VAR is left alone, so that this can safely be applied to
+// text in which $ may also have other meanings, such as in regular expressions;
+// $${ yields a literal ${
+func ExpandEnvRefs(s string) string {
+	return envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := envRef.FindStringSubmatch(ref)
+		if val := os.Getenv(m[1]); val != "" || m[2] == "" {
+			return val
+		}
+		return m[3]
+	})
+}